@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Diagnostics is the typed content of the MESSAGE and WARNING files written
+// by a HYSPLIT run.
+type Diagnostics struct {
+	Version        string            `json:"version,omitempty"`
+	SimulationDate string            `json:"simulationDate,omitempty"` // CCYYMMDD
+	SimulationTime string            `json:"simulationTime,omitempty"` // HHMMSS.S
+	Setup          map[string]string `json:"setup,omitempty"`          // echoed &SETUP namelist
+	MetGrids       []MetGridInfo     `json:"metGrids,omitempty"`
+	MetReads       []MetRead         `json:"metReads,omitempty"`
+	Hours          []HourCount       `json:"hours,omitempty"`
+	Warnings       []Diagnostic      `json:"warnings,omitempty"`
+	Errors         []Diagnostic      `json:"errors,omitempty"`
+	Completed      bool              `json:"completed"`
+}
+
+// MetGridInfo is one row of the "KG KT DATA SIZE NX NY" table.
+type MetGridInfo struct {
+	Grid   int     `json:"grid"`
+	File   int     `json:"file"`
+	Model  string  `json:"model"`
+	SizeMB float64 `json:"sizeMB"`
+	NX     int     `json:"nx"`
+	NY     int     `json:"ny"`
+}
+
+// MetRead is a met data time loaded by the model (metinp notices).
+type MetRead struct {
+	Model  string    `json:"model"`
+	Grid   int       `json:"grid"`
+	Record int       `json:"record"`
+	Time   time.Time `json:"time"`
+}
+
+// HourCount is the state of the run at one reported simulation hour. Particle
+// and mass counts are only reported by concentration runs.
+type HourCount struct {
+	Hour      float64 `json:"hour"`
+	Particles int     `json:"particles,omitempty"`
+	Mass      float64 `json:"mass,omitempty"`
+}
+
+// Diagnostic is a warning or error line together with its classification.
+type Diagnostic struct {
+	Severity string `json:"severity"` // "notice", "warning" or "error"
+	Routine  string `json:"routine,omitempty"`
+	Code     string `json:"code"`
+	Reason   string `json:"reason"`
+	Message  string `json:"message"`
+}
+
+// missingFile matches the ways HYSPLIT reports a file it cannot open.
+const missingFile = `(file not found|unable to open|cannot open|no such file)`
+
+// diagnosticCodes maps known HYSPLIT messages to a stable code and a reason
+// that can be shown to users. The first matching entry wins.
+var diagnosticCodes = []struct {
+	code    string
+	reason  string
+	pattern *regexp.Regexp
+}{
+	// Only errors about the CONTROL file, not notices that echo its path.
+	{"CONTROL_INVALID", "invalid CONTROL file",
+		regexp.MustCompile(`(\*ERROR\*|FATAL).*\bCONTROL\b`)},
+	{"MET_TIME_RANGE", "met data ends before run end",
+		regexp.MustCompile(`(?i)(time|date).*(not within|outside|beyond|exceed|past)|end of (met|meteo|data)|no more (met|data)`)},
+	{"SOURCE_OUTSIDE_GRID", "source outside grid",
+		regexp.MustCompile(`(?i)(source|start|release|point).*(not within|outside|off).*(grid|domain)`)},
+	// A missing file is only a met file when a met routine reports it or
+	// the path looks like met data; SETUP.CFG, EMITIMES and PARINIT are not.
+	{"MET_FILE_MISSING", "met file not found",
+		regexp.MustCompile(`(?i)\bmet\w*:.*` + missingFile + `|` + missingFile + `.*(\bmet|\.arl\b|\.bin\b)`)},
+	{"FILE_MISSING", "input file not found",
+		regexp.MustCompile(`(?i)` + missingFile)},
+	{"PARTICLE_LIMIT", "particle limit reached",
+		regexp.MustCompile(`(?i)maxpar|(particle|puff).*(limit|exceed|maximum)`)},
+	{"MET_MODEL_ID", "met model id not recognized, using default vertical interpolation",
+		regexp.MustCompile(`(?i)model_id|default vertical interpolation`)},
+}
+
+var (
+	routinePattern = regexp.MustCompile(`(?:NOTICE|WARNING|\*ERROR\*|FATAL)\s+(\w+):`)
+	// NOTICE metinp: GFSQ 1 2444   24   24 1070  510 66226860 25 12  1 21
+	metInpPattern = regexp.MustCompile(`metinp:\s+(\S+)\s+(\d+)\s+(\d+)\s+\d+\s+\d+\s+\d+\s+\d+\s+\d+\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)`)
+)
+
+// classifyDiagnostic builds a Diagnostic for a MESSAGE or WARNING line.
+func classifyDiagnostic(line string) Diagnostic {
+	d := Diagnostic{Severity: "warning", Code: "UNKNOWN", Message: strings.TrimSpace(line)}
+	switch {
+	case strings.Contains(line, "*ERROR*") || strings.Contains(line, "FATAL"):
+		d.Severity = "error"
+	case strings.HasPrefix(d.Message, "NOTICE"):
+		d.Severity = "notice"
+	}
+	if m := routinePattern.FindStringSubmatch(line); m != nil {
+		d.Routine = m[1]
+	}
+	for _, c := range diagnosticCodes {
+		if c.pattern.MatchString(line) {
+			d.Code = c.code
+			d.Reason = c.reason
+			break
+		}
+	}
+	if d.Reason == "" {
+		d.Reason = d.Message
+	}
+	return d
+}
+
+// ParseMessage reads a MESSAGE file into Diagnostics.
+func ParseMessage(r io.Reader) (*Diagnostics, error) {
+	diag := &Diagnostics{Setup: make(map[string]string)}
+	stream := newMessageStream(0)
+
+	inSetup := false
+	lastKey := ""
+	inMetTable := false
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if inSetup {
+			if trimmed == "/" {
+				inSetup = false
+				continue
+			}
+			if key, value, ok := strings.Cut(trimmed, "="); ok {
+				lastKey = strings.ToUpper(strings.TrimSpace(key))
+				diag.Setup[lastKey] = namelistValue(value)
+			} else if lastKey != "" {
+				diag.Setup[lastKey] += "," + namelistValue(trimmed)
+			}
+			continue
+		}
+
+		switch {
+		case strings.EqualFold(trimmed, "&SETUP"):
+			inSetup = true
+			continue
+		case strings.HasPrefix(trimmed, "HYSPLIT version:"):
+			diag.Version = strings.TrimSpace(strings.TrimPrefix(trimmed, "HYSPLIT version:"))
+			continue
+		case strings.HasPrefix(trimmed, "Simulation Date (CCYYMMDD):"):
+			diag.SimulationDate = strings.TrimSpace(strings.TrimPrefix(trimmed, "Simulation Date (CCYYMMDD):"))
+			continue
+		case strings.HasPrefix(trimmed, "Simulation Time (HHMMSS.S):"):
+			diag.SimulationTime = strings.TrimSpace(strings.TrimPrefix(trimmed, "Simulation Time (HHMMSS.S):"))
+			continue
+		case strings.HasPrefix(trimmed, "KG") && strings.Contains(trimmed, "KT"):
+			inMetTable = true
+			continue
+		}
+
+		if inMetTable {
+			if m := metTablePattern.FindStringSubmatch(line); m != nil {
+				f := strings.Fields(trimmed)
+				info := MetGridInfo{Model: f[2]}
+				info.Grid, _ = strconv.Atoi(f[0])
+				info.File, _ = strconv.Atoi(f[1])
+				info.SizeMB, _ = strconv.ParseFloat(f[3], 64)
+				info.NX, _ = strconv.Atoi(f[4])
+				info.NY, _ = strconv.Atoi(f[5])
+				diag.MetGrids = append(diag.MetGrids, info)
+				continue
+			}
+			inMetTable = false
+		}
+
+		if m := metInpPattern.FindStringSubmatch(trimmed); m != nil {
+			read := MetRead{Model: m[1]}
+			read.Grid, _ = strconv.Atoi(m[2])
+			read.Record, _ = strconv.Atoi(m[3])
+			read.Time = hysplitDate(m[4], m[5], m[6], m[7])
+			diag.MetReads = append(diag.MetReads, read)
+			continue
+		}
+
+		for _, ev := range stream.parseLine(line) {
+			switch ev.Type {
+			case "progress":
+				diag.Hours = append(diag.Hours, HourCount{Hour: ev.Hour, Particles: ev.Particles, Mass: ev.Mass})
+			case "warning":
+				diag.Warnings = append(diag.Warnings, classifyDiagnostic(line))
+			case "failed":
+				diag.Errors = append(diag.Errors, classifyDiagnostic(line))
+			case "completed":
+				diag.Completed = true
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return diag, nil
+}
+
+// ParseWarning reads a WARNING file. Every non-empty line is reported; lines
+// without a severity prefix are treated as warnings.
+func ParseWarning(r io.Reader) ([]Diagnostic, error) {
+	var diags []Diagnostic
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		diags = append(diags, classifyDiagnostic(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return diags, nil
+}
+
+// readDiagnostics parses the MESSAGE and WARNING files of a job directory.
+// Missing files are not an error; the job may not have started yet.
+func readDiagnostics(dir string) (*Diagnostics, error) {
+	diag := &Diagnostics{}
+	if f, err := os.Open(filepath.Join(dir, "MESSAGE")); err == nil {
+		diag, err = ParseMessage(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if f, err := os.Open(filepath.Join(dir, "WARNING")); err == nil {
+		warnings, err := ParseWarning(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range warnings {
+			if w.Severity == "error" {
+				diag.Errors = appendUnique(diag.Errors, w)
+			} else {
+				diag.Warnings = appendUnique(diag.Warnings, w)
+			}
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return diag, nil
+}
+
+// FailureReason returns the most specific reason explaining a failed run, or
+// an empty string if the diagnostics contain no error.
+func (d *Diagnostics) FailureReason() string {
+	for _, e := range d.Errors {
+		if e.Code != "UNKNOWN" {
+			return e.Reason
+		}
+	}
+	if len(d.Errors) > 0 {
+		return d.Errors[0].Reason
+	}
+	return ""
+}
+
+func appendUnique(diags []Diagnostic, d Diagnostic) []Diagnostic {
+	for _, existing := range diags {
+		if existing.Message == d.Message {
+			return diags
+		}
+	}
+	return append(diags, d)
+}
+
+// namelistValue cleans up a value echoed by the Fortran namelist writer,
+// e.g. `  100.000000    ,` or `"MESSAGE      ",`.
+func namelistValue(s string) string {
+	s = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), ","))
+	if len(s) >= 2 && strings.HasPrefix(s, `"`) && strings.HasSuffix(s, `"`) && strings.Count(s, `"`) == 2 {
+		s = strings.TrimSpace(s[1 : len(s)-1])
+	}
+	return s
+}
+
+// hysplitDate converts the two digit year and month, day, hour fields used
+// in HYSPLIT output into a UTC time.
+func hysplitDate(yy, mm, dd, hh string) time.Time {
+	y, _ := strconv.Atoi(yy)
+	m, _ := strconv.Atoi(mm)
+	d, _ := strconv.Atoi(dd)
+	h, _ := strconv.Atoi(hh)
+	if y < 100 {
+		if y < 40 {
+			y += 2000
+		} else {
+			y += 1900
+		}
+	}
+	return time.Date(y, time.Month(m), d, h, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseMessage(t *testing.T) {
+	f, err := os.Open(testMessageFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	diag, err := ParseMessage(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diag.Version != "hysplit.v5.4.2" || diag.SimulationDate != "20251215" {
+		t.Errorf("version %q, date %q", diag.Version, diag.SimulationDate)
+	}
+	if diag.Setup["TRATIO"] != "0.750000000" || diag.Setup["KHMAX"] != "9999" {
+		t.Errorf("setup TRATIO=%q KHMAX=%q", diag.Setup["TRATIO"], diag.Setup["KHMAX"])
+	}
+	want := MetGridInfo{Grid: 1, File: 1, Model: "GFSQ", SizeMB: 27.8, NX: 1440, NY: 721}
+	if len(diag.MetGrids) != 1 || diag.MetGrids[0] != want {
+		t.Errorf("met grids = %+v, want %+v", diag.MetGrids, want)
+	}
+	if n := len(diag.MetReads); n != 8 {
+		t.Errorf("got %d met reads, want 8", n)
+	} else if first := diag.MetReads[0]; first.Model != "GFSQ" || first.Record != 2444 ||
+		!first.Time.Equal(time.Date(2025, 12, 1, 21, 0, 0, 0, time.UTC)) {
+		t.Errorf("first met read = %+v", first)
+	}
+	if n := len(diag.Hours); n == 0 || diag.Hours[n-1].Hour != 20 {
+		t.Errorf("hours = %+v, want up to hour 20", diag.Hours)
+	}
+	// Routine notices, including those of metpos, are neither warnings nor
+	// errors.
+	if len(diag.Warnings) != 0 || len(diag.Errors) != 0 || diag.FailureReason() != "" {
+		t.Errorf("warnings %+v, errors %+v", diag.Warnings, diag.Errors)
+	}
+	if diag.Completed {
+		t.Error("the run did not write its completion line")
+	}
+}
+
+func TestParseWarning(t *testing.T) {
+	f, err := os.Open("../programfiles/test/WARNING")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	diags, err := ParseWarning(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diags) != 2 {
+		t.Fatalf("got %d diagnostics, want 2", len(diags))
+	}
+	if d := diags[0]; d.Severity != "notice" || d.Routine != "metini" || d.Code != "MET_MODEL_ID" {
+		t.Errorf("first = %+v", d)
+	}
+	if d := diags[1]; d.Severity != "warning" || d.Code != "MET_MODEL_ID" {
+		t.Errorf("second = %+v", d)
+	}
+}
+
+func TestClassifyDiagnostic(t *testing.T) {
+	for _, tc := range []struct {
+		line, severity, code string
+	}{
+		{"  NOTICE metpos: (mtime,ftime) -     66226500    66226860", "notice", "UNKNOWN"},
+		{" WARNING main: reading /jobs/a/CONTROL", "warning", "UNKNOWN"},
+		{" NOTICE   main: met file /data/metfiles/gdas1.dec25.w1", "notice", "UNKNOWN"},
+		{" *ERROR* main: CONTROL file not found", "error", "CONTROL_INVALID"},
+		{" *ERROR* metini: unable to open gdas1.dec25.w1", "error", "MET_FILE_MISSING"},
+		{" *ERROR* main: cannot open /data/metfiles/gdas1.dec25.w1", "error", "MET_FILE_MISSING"},
+		{" *ERROR* main: unable to open hrrr.20251201.arl", "error", "MET_FILE_MISSING"},
+		{" *ERROR* main: unable to open SETUP.CFG", "error", "FILE_MISSING"},
+		{" *ERROR* emspec: EMITIMES file not found", "error", "FILE_MISSING"},
+		{" *ERROR* parinp: cannot open PARINIT", "error", "FILE_MISSING"},
+		{" *ERROR* runset: invalid CONTROL starting time", "error", "CONTROL_INVALID"},
+		{" *ERROR* metpos: start time not within data file", "error", "MET_TIME_RANGE"},
+	} {
+		d := classifyDiagnostic(tc.line)
+		if d.Severity != tc.severity || d.Code != tc.code {
+			t.Errorf("%q: got %s %s, want %s %s", tc.line, d.Severity, d.Code, tc.severity, tc.code)
+		}
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	dir := t.TempDir()
+	message, err := os.ReadFile(testMessageFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message = append(message, " *ERROR* metpos: start time not within data file\n"...)
+	os.WriteFile(filepath.Join(dir, "MESSAGE"), message, 0644)
+	warning, _ := os.ReadFile("../programfiles/test/WARNING")
+	os.WriteFile(filepath.Join(dir, "WARNING"), warning, 0644)
+
+	diag, err := readDiagnostics(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := diag.FailureReason(); got != "met data ends before run end" {
+		t.Errorf("FailureReason() = %q", got)
+	}
+	if len(diag.Warnings) != 2 {
+		t.Errorf("got %d warnings from WARNING, want 2", len(diag.Warnings))
+	}
+
+	unknown := &Diagnostics{Errors: []Diagnostic{classifyDiagnostic(" *ERROR* main: something else")}}
+	if got := unknown.FailureReason(); got != "*ERROR* main: something else" {
+		t.Errorf("FailureReason() of an unknown error = %q", got)
+	}
+}
@@ -14,6 +14,8 @@ func helloHandler(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 	http.HandleFunc("/", helloHandler)
+	http.HandleFunc("GET /jobs/{id}", jobStatusHandler)
+	http.HandleFunc("GET /jobs/{id}/events", jobEventsHandler)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	messagePollInterval = 500 * time.Millisecond
+	heartbeatInterval   = 15 * time.Second
+)
+
+// jobEventsHandler streams the progress of a job as Server-Sent Events by
+// tailing the MESSAGE file in its working directory. The stream ends with a
+// "completed" or "failed" event.
+func jobEventsHandler(w http.ResponseWriter, r *http.Request) {
+	dir, err := jobDir(r.PathValue("id"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(ev ProgressEvent) error {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	totalHours, _ := readControlRunHours(dir)
+	stream := newMessageStream(totalHours)
+	tail := &fileTail{path: filepath.Join(dir, "MESSAGE")}
+
+	poll := time.NewTicker(messagePollInterval)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		// Check for exit before reading so no output written just before the
+		// process ended is missed.
+		code, exited := readExitCode(dir)
+		lines, err := tail.readLines()
+		if err != nil {
+			send(ProgressEvent{Type: "failed", Message: err.Error()})
+			return
+		}
+		if exited {
+			// The process is gone, so whatever is left in MESSAGE is final.
+			lines = append(lines, tail.flush()...)
+		}
+
+		for _, line := range lines {
+			for _, ev := range stream.parseLine(line) {
+				if err := send(ev); err != nil {
+					return
+				}
+			}
+			if stream.done {
+				return
+			}
+		}
+
+		if exited {
+			final := ProgressEvent{Type: "completed", Hour: stream.totalHours, TotalHours: stream.totalHours, ExitCode: &code}
+			if code != 0 {
+				final = ProgressEvent{Type: "failed", Hour: stream.lastHour, TotalHours: stream.totalHours, ExitCode: &code,
+					Message: fmt.Sprintf("model exited with code %d", code)}
+				if diag, err := readDiagnostics(dir); err == nil {
+					final.Reason = diag.FailureReason()
+				}
+			}
+			send(final)
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-poll.C:
+		}
+	}
+}
+
+// fileTail reads complete lines appended to a file since the last call. The
+// file does not need to exist yet.
+type fileTail struct {
+	path    string
+	offset  int64
+	partial []byte
+}
+
+func (t *fileTail) readLines() ([]string, error) {
+	f, err := os.Open(t.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < t.offset {
+		// The file was truncated or replaced, start over.
+		t.offset = 0
+		t.partial = nil
+	}
+	if _, err := f.Seek(t.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	t.offset += int64(len(data))
+
+	buf := append(t.partial, data...)
+	var lines []string
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		lines = append(lines, string(bytes.TrimRight(buf[:i], "\r")))
+		buf = buf[i+1:]
+	}
+	t.partial = append([]byte(nil), buf...)
+	return lines, nil
+}
+
+// flush returns any trailing line that was not terminated by a newline.
+func (t *fileTail) flush() []string {
+	if len(t.partial) == 0 {
+		return nil
+	}
+	line := string(t.partial)
+	t.partial = nil
+	return []string{line}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bhagirath-bhp/hysplit-test/internal/jobdir"
+)
+
+// newTestJob makes a job directory holding the recorded CONTROL and MESSAGE
+// of a trajectory run and the given exit code.
+func newTestJob(t *testing.T, exitCode string) {
+	t.Helper()
+	root := t.TempDir()
+	t.Setenv("HYSPLIT_JOBS_DIR", root)
+	dir := filepath.Join(root, "job1")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"CONTROL", "MESSAGE"} {
+		data, err := os.ReadFile(filepath.Join("../programfiles/test", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, jobdir.ExitCodeFile), []byte(exitCode+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// streamEvents requests the event stream of a job and decodes its events.
+func streamEvents(t *testing.T, id string) (int, []ProgressEvent) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /jobs/{id}/events", jobEventsHandler)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/jobs/"+id+"/events", nil))
+
+	var events []ProgressEvent
+	name := ""
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if v, ok := strings.CutPrefix(line, "event: "); ok {
+			name = v
+		}
+		if v, ok := strings.CutPrefix(line, "data: "); ok {
+			var ev ProgressEvent
+			if err := json.Unmarshal([]byte(v), &ev); err != nil {
+				t.Fatal(err)
+			}
+			if ev.Type != name {
+				t.Errorf("event %q carries type %q", name, ev.Type)
+			}
+			events = append(events, ev)
+		}
+	}
+	return rec.Code, events
+}
+
+func TestJobEventsCompleted(t *testing.T) {
+	newTestJob(t, "0")
+	code, events := streamEvents(t, "job1")
+	if code != http.StatusOK || len(events) < 2 {
+		t.Fatalf("got status %d with %d events", code, len(events))
+	}
+	if events[0].Type != "met" {
+		t.Errorf("first event is %q, want met", events[0].Type)
+	}
+	for _, ev := range events[1 : len(events)-1] {
+		if ev.Type != "progress" {
+			t.Errorf("unexpected %q event before the end", ev.Type)
+		}
+	}
+	last := events[len(events)-1]
+	if last.Type != "completed" || last.ExitCode == nil || *last.ExitCode != 0 || last.Hour != 20 {
+		t.Errorf("terminal event = %+v, want completed at hour 20 with exit code 0", last)
+	}
+}
+
+func TestJobEventsFailed(t *testing.T) {
+	newTestJob(t, "3")
+	_, events := streamEvents(t, "job1")
+	if len(events) == 0 {
+		t.Fatal("no events")
+	}
+	last := events[len(events)-1]
+	if last.Type != "failed" || last.ExitCode == nil || *last.ExitCode != 3 || last.Hour != 20 {
+		t.Errorf("terminal event = %+v, want failed at hour 20 with exit code 3", last)
+	}
+
+	if code, _ := streamEvents(t, "missing"); code != http.StatusNotFound {
+		t.Errorf("unknown job: status %d, want 404", code)
+	}
+	if code, _ := streamEvents(t, "job%201"); code != http.StatusBadRequest {
+		t.Errorf("job id with a space: status %d, want 400", code)
+	}
+}
+
+func TestFileTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "MESSAGE")
+	tail := &fileTail{path: path}
+	if lines, err := tail.readLines(); err != nil || lines != nil {
+		t.Fatalf("missing file: got %q, %v", lines, err)
+	}
+
+	os.WriteFile(path, []byte("one\r\ntw"), 0644)
+	if lines, _ := tail.readLines(); len(lines) != 1 || lines[0] != "one" {
+		t.Errorf("got %q, want the complete line only", lines)
+	}
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("o\nthree")
+	f.Close()
+	if lines, _ := tail.readLines(); len(lines) != 1 || lines[0] != "two" {
+		t.Errorf("got %q, want the line completed by the append", lines)
+	}
+	if lines := tail.flush(); len(lines) != 1 || lines[0] != "three" {
+		t.Errorf("flush got %q, want the unterminated line", lines)
+	}
+
+	// A replaced, shorter file is read from the start.
+	os.WriteFile(path, []byte("new\n"), 0644)
+	if lines, _ := tail.readLines(); len(lines) != 1 || lines[0] != "new" {
+		t.Errorf("after truncation got %q", lines)
+	}
+}
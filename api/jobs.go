@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"bhagirath-bhp/hysplit-test/internal/jobdir"
+)
+
+// jobsRoot returns the directory holding one working directory per job.
+func jobsRoot() string {
+	if dir := os.Getenv("HYSPLIT_JOBS_DIR"); dir != "" {
+		return dir
+	}
+	return "jobs"
+}
+
+// jobDir resolves the working directory of a job, rejecting ids that could
+// escape the jobs root.
+func jobDir(id string) (string, error) {
+	if !jobdir.ValidId(id) {
+		return "", fmt.Errorf("invalid job id %q", id)
+	}
+	dir := filepath.Join(jobsRoot(), id)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("job %q is not a directory", id)
+	}
+	return dir, nil
+}
+
+// readExitCode returns the exit code recorded for a job, and false if the
+// model has not finished yet.
+func readExitCode(dir string) (int, bool) {
+	data, err := os.ReadFile(filepath.Join(dir, jobdir.ExitCodeFile))
+	if err != nil {
+		return 0, false
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, false
+	}
+	return code, true
+}
+
+// readControlRunHours reads the total run time (hours) from the CONTROL file
+// of a job. The value is returned unsigned; backward runs count down.
+func readControlRunHours(dir string) (float64, error) {
+	f, err := os.Open(filepath.Join(dir, "CONTROL"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSpace(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	// Line 1 is the start time, line 2 the number of sources, followed by one
+	// line per source and then the run time.
+	if len(lines) < 2 {
+		return 0, fmt.Errorf("CONTROL file is truncated")
+	}
+	numSources, err := strconv.Atoi(strings.Fields(lines[1] + " 0")[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid source count in CONTROL: %v", err)
+	}
+	idx := 2 + numSources
+	if idx >= len(lines) {
+		return 0, fmt.Errorf("CONTROL file is truncated")
+	}
+	hours, err := strconv.ParseFloat(strings.Fields(lines[idx] + " 0")[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid run time in CONTROL: %v", err)
+	}
+	if hours < 0 {
+		hours = -hours
+	}
+	return hours, nil
+}
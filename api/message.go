@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProgressEvent is a single structured update derived from the HYSPLIT
+// MESSAGE file of a running job.
+type ProgressEvent struct {
+	Type       string  `json:"type"` // "progress", "met", "warning", "completed" or "failed"
+	Hour       float64 `json:"hour"`
+	TotalHours float64 `json:"totalHours,omitempty"`
+	Particles  int     `json:"particles,omitempty"`
+	Mass       float64 `json:"mass,omitempty"`
+	MetGrid    int     `json:"metGrid,omitempty"`
+	MetFile    int     `json:"metFile,omitempty"` // files opened on the grid so far, 1 for the first
+	MetModel   string  `json:"metModel,omitempty"`
+	Message    string  `json:"message,omitempty"`
+	Reason     string  `json:"reason,omitempty"`
+	ExitCode   *int    `json:"exitCode,omitempty"`
+}
+
+var (
+	// NOTICE   main:     66226845           1           1         -15   1081.00183       520.942200      0.997877419
+	trajStepPattern = regexp.MustCompile(`main:\s+(\d+)\s+(\d+)\s+(\d+)\s+(-?\d+)\s+[-\d.]+\s+[-\d.]+\s+[-\d.]+\s*$`)
+	// Concentration runs report the particles and mass released each hour:
+	// NOTICE   main:     1 hour emissions      2500 particles   0.1000E+01 mass
+	emissionsPattern = regexp.MustCompile(`main:\s+(\d+)\s+hour emissions\s+(\d+)\s+particles(?:\s+([-+.\dEe]+)\s+mass)?\s*$`)
+	//     1    1 GFSQ  27.8 1440  721
+	metTablePattern = regexp.MustCompile(`^\s*(\d+)\s+(\d+)\s+(\S+)\s+[\d.]+\s+\d+\s+\d+\s*$`)
+)
+
+// metPosition is the last met record the model read on a grid.
+type metPosition struct {
+	model  string
+	record int
+	time   time.Time
+}
+
+// messageStream turns MESSAGE lines into progress events. It keeps enough
+// state to only report forward progress and actual met file switches.
+type messageStream struct {
+	totalHours float64
+	lastHour   float64
+	metRead    map[int]metPosition // met grid -> last record read
+	metFiles   map[int]int         // met grid -> files opened
+	done       bool
+}
+
+func newMessageStream(totalHours float64) *messageStream {
+	return &messageStream{
+		totalHours: totalHours,
+		lastHour:   -1,
+		metRead:    make(map[int]metPosition),
+		metFiles:   make(map[int]int),
+	}
+}
+
+// parseLine returns the events produced by one MESSAGE line, if any.
+func (s *messageStream) parseLine(line string) []ProgressEvent {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" {
+		return nil
+	}
+
+	switch {
+	case strings.Contains(trimmed, "*ERROR*") || strings.Contains(trimmed, "FATAL"):
+		s.done = true
+		return []ProgressEvent{{Type: "failed", Message: trimmed, Reason: classifyDiagnostic(trimmed).Reason}}
+	case strings.Contains(trimmed, "Complete Hysplit"):
+		s.done = true
+		return []ProgressEvent{{Type: "completed", Hour: s.totalHours, TotalHours: s.totalHours, Message: trimmed}}
+	case strings.Contains(trimmed, "WARNING"):
+		return []ProgressEvent{{Type: "warning", Message: trimmed, Reason: classifyDiagnostic(trimmed).Reason}}
+	}
+
+	if m := trajStepPattern.FindStringSubmatch(trimmed); m != nil {
+		minutes, _ := strconv.Atoi(m[4])
+		return s.progress(math.Abs(float64(minutes))/60.0, 0, 0)
+	}
+
+	if m := emissionsPattern.FindStringSubmatch(trimmed); m != nil {
+		hour, _ := strconv.ParseFloat(m[1], 64)
+		particles, _ := strconv.Atoi(m[2])
+		mass, _ := strconv.ParseFloat(m[3], 64)
+		return s.progress(hour, particles, mass)
+	}
+
+	if m := metInpPattern.FindStringSubmatch(trimmed); m != nil {
+		grid, _ := strconv.Atoi(m[2])
+		record, _ := strconv.Atoi(m[3])
+		return s.metInput(grid, metPosition{model: m[1], record: record, time: hysplitDate(m[4], m[5], m[6], m[7])}, trimmed)
+	}
+
+	return nil
+}
+
+// metInput reports a met file switch when a metinp read is not the next
+// record of the file last read on its grid. Within one file the records
+// follow the data times, so a record that does not move the same way as
+// the time, or a new model id, means another file was opened.
+func (s *messageStream) metInput(grid int, pos metPosition, line string) []ProgressEvent {
+	prev, ok := s.metRead[grid]
+	s.metRead[grid] = pos
+	if ok && pos.model == prev.model {
+		dr, dt := pos.record-prev.record, pos.time.Compare(prev.time)
+		if (dr > 0 && dt > 0) || (dr < 0 && dt < 0) || (dr == 0 && dt == 0) {
+			return nil
+		}
+	}
+	s.metFiles[grid]++
+	return []ProgressEvent{{
+		Type:     "met",
+		Hour:     math.Max(s.lastHour, 0),
+		MetGrid:  grid,
+		MetFile:  s.metFiles[grid],
+		MetModel: pos.model,
+		Message:  line,
+	}}
+}
+
+// progress reports a simulation hour unless it does not move the run forward.
+// Particle updates are always reported since they carry new counts.
+func (s *messageStream) progress(hour float64, particles int, mass float64) []ProgressEvent {
+	if particles == 0 && hour <= s.lastHour {
+		return nil
+	}
+	if hour > s.lastHour {
+		s.lastHour = hour
+	}
+	return []ProgressEvent{{
+		Type:       "progress",
+		Hour:       hour,
+		TotalHours: s.totalHours,
+		Particles:  particles,
+		Mass:       mass,
+	}}
+}
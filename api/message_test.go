@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testMessageFile = "../programfiles/test/MESSAGE"
+
+// TestMessageStreamRecorded feeds the MESSAGE of a 20 hour backward
+// trajectory run through the stream.
+func TestMessageStreamRecorded(t *testing.T) {
+	f, err := os.Open(testMessageFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	stream := newMessageStream(20)
+	var events []ProgressEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		events = append(events, stream.parseLine(scanner.Text())...)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var met, progress int
+	last := -1.0
+	for _, ev := range events {
+		switch ev.Type {
+		case "met":
+			met++
+			if ev.MetGrid != 1 || ev.MetFile != 1 {
+				t.Errorf("met event for grid %d file %d, want 1 1", ev.MetGrid, ev.MetFile)
+			}
+		case "progress":
+			progress++
+			if ev.Hour <= last {
+				t.Errorf("progress went from hour %g to %g", last, ev.Hour)
+			}
+			if ev.TotalHours != 20 || ev.Particles != 0 {
+				t.Errorf("progress event %+v", ev)
+			}
+			last = ev.Hour
+		default:
+			t.Errorf("unexpected %s event: %s", ev.Type, ev.Message)
+		}
+	}
+	// All eight met times are read from the one file.
+	if met != 1 {
+		t.Errorf("got %d met events, want 1", met)
+	}
+	// Steps of 15 minutes for the first hour, then hourly to 20 hours.
+	if progress != 23 || last != 20 {
+		t.Errorf("got %d progress events up to hour %g, want 23 up to 20", progress, last)
+	}
+	if stream.done {
+		t.Error("a MESSAGE without the completion line should not end the stream")
+	}
+}
+
+func TestMessageStreamLines(t *testing.T) {
+	stream := newMessageStream(24)
+	for _, tc := range []struct {
+		line string
+		want []ProgressEvent
+	}{
+		{"  NOTICE   main: Initial time step (min)           10", nil},
+		{"  NOTICE   main:     1 hour emissions      2500 particles   0.1000E+01 mass",
+			[]ProgressEvent{{Type: "progress", Hour: 1, TotalHours: 24, Particles: 2500, Mass: 1}}},
+		{"  NOTICE   main:     2 hour emissions      5000 particles",
+			[]ProgressEvent{{Type: "progress", Hour: 2, TotalHours: 24, Particles: 5000}}},
+		{"  NOTICE   main:     66226845           1           1         -15   1081.00183       520.942200      0.997877419", nil},
+		{"  NOTICE   main:     66226845           1           1        -180   1081.00183       520.942200      0.997877419",
+			[]ProgressEvent{{Type: "progress", Hour: 3, TotalHours: 24}}},
+		{"  NOTICE   main: reading particles from PARINIT", nil},
+		{" Complete Hysplit",
+			[]ProgressEvent{{Type: "completed", Hour: 24, TotalHours: 24, Message: "Complete Hysplit"}}},
+	} {
+		got := stream.parseLine(tc.line)
+		if len(got) != len(tc.want) {
+			t.Errorf("%q: got %+v, want %+v", tc.line, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%q: got %+v, want %+v", tc.line, got[i], tc.want[i])
+			}
+		}
+	}
+	if !stream.done {
+		t.Error("the completion line should end the stream")
+	}
+}
+
+// TestMessageStreamMetSwitches follows the metinp reads of a forward run on
+// two grids whose model ids HYSPLIT knows, so there is no MODEL_ID notice.
+// The first grid moves on to its second file at 06 UTC.
+func TestMessageStreamMetSwitches(t *testing.T) {
+	message := `  NOTICE metinp: GDAS 1    1   24   24  100  100 66226320 25 12  1  0
+  NOTICE metinp: GDAS 1  350   24   24  100  100 66226500 25 12  1  3
+  NOTICE metinp: NAMS 2    1   24   24  300  200 66226320 25 12  1  0
+  NOTICE   main:     1 hour emissions      2500 particles   0.1000E+01 mass
+  NOTICE   main:     2 hour emissions      5000 particles   0.2000E+01 mass
+  NOTICE   main:     3 hour emissions      7500 particles   0.3000E+01 mass
+  NOTICE metinp: GDAS 1    1   24   24  100  100 66226680 25 12  1  6
+  NOTICE metinp: GDAS 1  350   24   24  100  100 66226860 25 12  1  9
+  NOTICE metinp: NAMS 2  175   24   24  300  200 66226500 25 12  1  3`
+	stream := newMessageStream(12)
+	var met []ProgressEvent
+	for _, line := range strings.Split(message, "\n") {
+		for _, ev := range stream.parseLine(line) {
+			if ev.Type == "met" {
+				met = append(met, ev)
+			}
+		}
+	}
+
+	want := []struct {
+		grid, file int
+		model      string
+		hour       float64
+	}{
+		{1, 1, "GDAS", 0},
+		{2, 1, "NAMS", 0},
+		{1, 2, "GDAS", 3},
+	}
+	if len(met) != len(want) {
+		t.Fatalf("got %d met events, want %d: %+v", len(met), len(want), met)
+	}
+	for i, w := range want {
+		if ev := met[i]; ev.MetGrid != w.grid || ev.MetFile != w.file || ev.MetModel != w.model || ev.Hour != w.hour {
+			t.Errorf("met event %d = %+v, want grid %d file %d %s at hour %g", i, ev, w.grid, w.file, w.model, w.hour)
+		}
+	}
+
+	data, err := json.Marshal(met[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"hour":0`) {
+		t.Errorf("the first met event %s should carry hour 0", data)
+	}
+}
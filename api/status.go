@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// JobStatus is the state of a job as reported by GET /jobs/{id}.
+type JobStatus struct {
+	JobId       string       `json:"jobId"`
+	State       string       `json:"state"` // "pending", "running", "completed" or "failed"
+	ExitCode    *int         `json:"exitCode,omitempty"`
+	Hour        float64      `json:"hour"`
+	TotalHours  float64      `json:"totalHours,omitempty"`
+	Reason      string       `json:"reason,omitempty"`
+	Diagnostics *Diagnostics `json:"diagnostics,omitempty"`
+}
+
+// jobStatus derives the status of a job from the files in its directory.
+func jobStatus(id, dir string) (*JobStatus, error) {
+	diag, err := readDiagnostics(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &JobStatus{JobId: id, State: "pending", Diagnostics: diag}
+	status.TotalHours, _ = readControlRunHours(dir)
+	if n := len(diag.Hours); n > 0 {
+		status.Hour = diag.Hours[n-1].Hour
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "MESSAGE")); err == nil {
+		status.State = "running"
+	}
+
+	code, exited := readExitCode(dir)
+	switch {
+	case len(diag.Errors) > 0:
+		status.State = "failed"
+		status.Reason = diag.FailureReason()
+	case exited && code != 0:
+		status.State = "failed"
+		status.Reason = fmt.Sprintf("model exited with code %d", code)
+	case exited || diag.Completed:
+		status.State = "completed"
+		status.Hour = status.TotalHours
+	}
+	if exited {
+		status.ExitCode = &code
+	}
+	return status, nil
+}
+
+func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	dir, err := jobDir(id)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status, err := jobStatus(id, dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
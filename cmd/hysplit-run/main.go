@@ -0,0 +1,14 @@
+// Command hysplit-run generates the input files of HYSPLIT jobs, runs the
+// model and post-processes its output. See the handlers package for the
+// subcommands.
+package main
+
+import (
+	"os"
+
+	"bhagirath-bhp/hysplit-test/handlers"
+)
+
+func main() {
+	os.Exit(handlers.Main(os.Args[1:]))
+}
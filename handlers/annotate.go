@@ -0,0 +1,425 @@
+package handlers
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fogleman/gg"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// Unit is a display unit of the payload's "units" map. Model values are
+// converted with ConversionStrategy and classified by CustomZones.
+type Unit struct {
+	UnitId             string          `json:"unitId"`
+	Label              string          `json:"label"`
+	Description        string          `json:"description,omitempty"`
+	ConversionStrategy *UnitConversion `json:"conversion_strategy,omitempty"`
+	CustomZones        *UnitZones      `json:"custom_zones,omitempty"`
+}
+
+// UnitConversion turns model values into the unit. Type "mx" multiplies by M.
+type UnitConversion struct {
+	M    float64 `json:"m"`
+	Type string  `json:"type"`
+}
+
+// UnitZones are consecutive value bands from Lower, each up to its Upper.
+type UnitZones struct {
+	Lower float64    `json:"lower"`
+	Next  []UnitZone `json:"next"`
+}
+
+type UnitZone struct {
+	Color         string  `json:"color"` // "#rrggbb"
+	Upper         float64 `json:"upper"`
+	InvertedColor string  `json:"inverted_color,omitempty"`
+}
+
+// Convert returns a model value in the unit.
+func (u Unit) Convert(v float64) (float64, error) {
+	c := u.ConversionStrategy
+	if c == nil || c.Type == "" {
+		return v, nil
+	}
+	if c.Type != "mx" {
+		return 0, fmt.Errorf("unit %s: unknown conversion type %q (want mx)", u.UnitId, c.Type)
+	}
+	return c.M * v, nil
+}
+
+// parseHexColor parses "#rrggbb" or "#rrggbbaa".
+func parseHexColor(s string) (color.NRGBA, error) {
+	h := strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(h) != 6 && len(h) != 8 {
+		return color.NRGBA{}, fmt.Errorf("bad color %q (want #rrggbb)", s)
+	}
+	v, err := strconv.ParseUint(h, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("bad color %q (want #rrggbb)", s)
+	}
+	if len(h) == 6 {
+		return color.NRGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 200}, nil
+	}
+	return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+}
+
+// zoneScale returns the zones of a unit as a color scale in the unit, from
+// the lowest zone up. The last zone is open ended.
+func zoneScale(u Unit) ([]ContourLevel, error) {
+	z := u.CustomZones
+	if z == nil || len(z.Next) == 0 {
+		return nil, fmt.Errorf("unit %s has no zones", u.UnitId)
+	}
+	var scale []ContourLevel
+	lower := z.Lower
+	for _, zone := range z.Next {
+		c, err := parseHexColor(zone.Color)
+		if err != nil {
+			return nil, fmt.Errorf("unit %s: %v", u.UnitId, err)
+		}
+		if zone.Upper <= lower {
+			return nil, fmt.Errorf("unit %s: zone upper %g is not above %g", u.UnitId, zone.Upper, lower)
+		}
+		scale = append(scale, ContourLevel{Threshold: lower, Color: c, Units: u.Label})
+		lower = zone.Upper
+	}
+	return scale, nil
+}
+
+// legendEntry is one line of a legend.
+type legendEntry struct {
+	Color color.NRGBA
+	Label string
+}
+
+// scaleLegend lists contour levels the way concplot labels them, the
+// highest first.
+func scaleLegend(scale []ContourLevel) []legendEntry {
+	var entries []legendEntry
+	for i := len(scale) - 1; i >= 0; i-- {
+		entries = append(entries, legendEntry{scale[i].Color, fmt.Sprintf("> %.1E", scale[i].Threshold)})
+	}
+	return entries
+}
+
+// zoneLegend lists the zones of a unit, the highest first.
+func zoneLegend(u Unit, scale []ContourLevel) []legendEntry {
+	var entries []legendEntry
+	for i := len(scale) - 1; i >= 0; i-- {
+		upper := u.CustomZones.Next[i].Upper
+		entries = append(entries, legendEntry{scale[i].Color, fmt.Sprintf("%g – %g", scale[i].Threshold, upper)})
+	}
+	return entries
+}
+
+// annotationFont is Go Regular, embedded so rendering needs no font files.
+var annotationFont = sync.OnceValue(func() *truetype.Font {
+	f, err := truetype.Parse(goregular.TTF)
+	if err != nil {
+		panic(err)
+	}
+	return f
+})
+
+// annotationFace returns the annotation font at a size in points.
+func annotationFace(points float64) font.Face {
+	return truetype.NewFace(annotationFont(), &truetype.Options{Size: points})
+}
+
+// drawLegend draws a legend box with its top left corner at (x, y) and
+// returns its height.
+func drawLegend(dc *gg.Context, x, y float64, title string, entries []legendEntry, boxed bool) float64 {
+	const row, swatch, pad = 22.0, 24.0, 8.0
+	width := legendWidth(dc, title, entries)
+	height := 2*pad + 18 + row*float64(max(len(entries), 1))
+	if boxed {
+		dc.SetRGBA(1, 1, 1, 0.85)
+		dc.DrawRectangle(x, y, width, height)
+		dc.Fill()
+		dc.SetRGB(0.3, 0.3, 0.3)
+		dc.SetLineWidth(1)
+		dc.DrawRectangle(x, y, width, height)
+		dc.Stroke()
+	}
+	dc.SetRGB(0, 0, 0)
+	dc.DrawStringAnchored(title, x+pad, y+pad, 0, 0.8)
+	ty := y + pad + 18
+	if len(entries) == 0 {
+		dc.DrawStringAnchored("no concentrations", x+pad, ty+8, 0, 0.4)
+	}
+	for _, e := range entries {
+		dc.SetColor(e.Color)
+		dc.DrawRectangle(x+pad, ty, swatch, 16)
+		dc.Fill()
+		dc.SetRGB(0, 0, 0)
+		dc.SetLineWidth(1)
+		dc.DrawRectangle(x+pad, ty, swatch, 16)
+		dc.Stroke()
+		dc.DrawStringAnchored(e.Label, x+pad+swatch+8, ty+8, 0, 0.4)
+		ty += row
+	}
+	return height
+}
+
+// AnnotateOptions controls RenderAnnotatedKml.
+type AnnotateOptions struct {
+	Pollutant string  // pollutant name for the title
+	Level     string  // level for the title when the KML does not give it
+	Points    []Point // source (receptor for backward runs) markers
+	Backward  bool
+	// Unit, when it has zones, recolors the contours by zone and replaces
+	// the KML legend. Contour levels are converted to the unit first.
+	Unit *Unit
+}
+
+var averagedLevel = regexp.MustCompile(`Averaged from\s+(\d+)\s+to\s+(\d+)\s*m`)
+
+// RenderAnnotatedKml renders the concentration frames of a concplot KML
+// file like ProcessKml, on the same canvas and bbox, and adds a legend, the
+// pollutant, level and valid time, markers for the points and a scale bar.
+func RenderAnnotatedKml(filePath string, opts AnnotateOptions) ([]KmlResult, error) {
+	root, err := readKml(filePath)
+	if err != nil {
+		return nil, err
+	}
+	styles := kmlFillColors(root)
+	var zones []ContourLevel
+	if opts.Unit != nil && opts.Unit.CustomZones != nil {
+		if zones, err = zoneScale(*opts.Unit); err != nil {
+			return nil, err
+		}
+	}
+
+	var results []KmlResult
+	for _, folder := range root.Document.Folders {
+		if !strings.Contains(folder.Name, "Concentration") {
+			continue
+		}
+		minLon, minLat, maxLon, maxLat := 180.0, 90.0, -180.0, -90.0
+		n := 0
+		for _, pm := range folder.Placemarks {
+			for _, poly := range pm.MultiGeometry.Polygons {
+				for _, p := range parseCoordinates(poly.OuterBoundary) {
+					minLon, maxLon = min(minLon, p[0]), max(maxLon, p[0])
+					minLat, maxLat = min(minLat, p[1]), max(maxLat, p[1])
+					n++
+				}
+			}
+		}
+		if n == 0 {
+			continue
+		}
+		minX, maxX := lonToX(minLon), lonToX(maxLon)
+		minY, maxY := latToY(maxLat), latToY(minLat)
+		const imgSize = 1024
+		project := func(lon, lat float64) (float64, float64) {
+			return (lonToX(lon) - minX) / (maxX - minX) * imgSize,
+				(latToY(lat) - minY) / (maxY - minY) * imgSize
+		}
+
+		dc := gg.NewContext(imgSize, imgSize)
+		var scale []ContourLevel
+		units := "mass/m3"
+		for _, pm := range folder.Placemarks {
+			c, ok := styles[pm.StyleUrl]
+			if !ok {
+				c = color.NRGBA{255, 0, 0, 128}
+			}
+			if m := contourLevelName.FindStringSubmatch(pm.Name); m != nil {
+				if v, err := strconv.ParseFloat(m[1], 64); err == nil {
+					if u := strings.TrimSpace(m[2]); u != "" {
+						units = u
+					}
+					scale = append(scale, ContourLevel{Threshold: v, Color: c, Units: units})
+					if zones != nil {
+						cv, err := opts.Unit.Convert(v)
+						if err != nil {
+							return nil, err
+						}
+						if c, ok = contourColor(zones, cv); !ok {
+							continue // below the lowest zone
+						}
+					}
+				}
+			}
+			dc.SetColor(c)
+			for _, poly := range pm.MultiGeometry.Polygons {
+				for i, p := range parseCoordinates(poly.OuterBoundary) {
+					x, y := project(p[0], p[1])
+					if i == 0 {
+						dc.MoveTo(x, y)
+					} else {
+						dc.LineTo(x, y)
+					}
+				}
+				dc.Fill()
+			}
+		}
+		sort.Slice(scale, func(i, j int) bool { return scale[i].Threshold < scale[j].Threshold })
+
+		t := extractTimestamp(folder)
+		for _, p := range startLocations(opts.Points) {
+			x, y := project(p.Longitude, p.Latitude)
+			if x >= 0 && y >= 0 && x <= imgSize && y <= imgSize {
+				drawStar(dc, x, y, 9)
+			}
+		}
+
+		dc.SetFontFace(annotationFace(14))
+		level := opts.Level
+		if m := averagedLevel.FindStringSubmatch(folder.Description); m != nil {
+			bottom, _ := strconv.Atoi(m[1])
+			top, _ := strconv.Atoi(m[2])
+			level = fmt.Sprintf("%d–%d m AGL", bottom, top)
+		}
+		title := strings.TrimSpace(strings.Join([]string{opts.Pollutant, level}, "  "))
+		drawCaption(dc, 12, 12, []string{title, "Valid " + time.Unix(t, 0).UTC().Format("2006-01-02 15:04 UTC")})
+
+		entries, legendTitle := scaleLegend(scale), units
+		if zones != nil {
+			entries, legendTitle = zoneLegend(*opts.Unit, zones), opts.Unit.Label
+		}
+		legendW := legendWidth(dc, legendTitle, entries)
+		h := drawLegend(dc, imgSize-12-legendW, 12, legendTitle, entries, true)
+		if len(opts.Points) > 0 {
+			label := "Source"
+			if opts.Backward {
+				label = "Receptor"
+			}
+			drawMarkerKey(dc, imgSize-12-legendW, 12+h+8, label)
+		}
+		drawScaleBar(dc, 16, imgSize-24, minLon, maxLon, minY, maxY, imgSize)
+
+		frame, err := encodeFrame(dc, t, minLon, minLat, maxLon, maxLat)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, frame)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].T < results[j].T })
+	return results, nil
+}
+
+// legendWidth returns the width drawLegend gives a legend.
+func legendWidth(dc *gg.Context, title string, entries []legendEntry) float64 {
+	const swatch, pad = 24.0, 8.0
+	tw, _ := dc.MeasureString(title)
+	width := max(swatch+2*pad, tw+2*pad)
+	for _, e := range entries {
+		w, _ := dc.MeasureString(e.Label)
+		width = max(width, swatch+8+w+2*pad)
+	}
+	return width
+}
+
+// drawCaption draws lines of text in a box with its top left corner at
+// (x, y).
+func drawCaption(dc *gg.Context, x, y float64, lines []string) {
+	const row, pad = 20.0, 8.0
+	width := 0.0
+	for _, l := range lines {
+		w, _ := dc.MeasureString(l)
+		width = max(width, w)
+	}
+	dc.SetRGBA(1, 1, 1, 0.85)
+	dc.DrawRectangle(x, y, width+2*pad, row*float64(len(lines))+2*pad-4)
+	dc.Fill()
+	dc.SetRGB(0, 0, 0)
+	for i, l := range lines {
+		dc.DrawStringAnchored(l, x+pad, y+pad+row*float64(i), 0, 0.8)
+	}
+}
+
+// drawStar draws a release point marker, a red star with a black outline.
+func drawStar(dc *gg.Context, x, y, r float64) {
+	dc.NewSubPath()
+	for i := 0; i < 10; i++ {
+		a := float64(i)*math.Pi/5 - math.Pi/2
+		rr := r
+		if i%2 == 1 {
+			rr = r * 0.45
+		}
+		dc.LineTo(x+rr*math.Cos(a), y+rr*math.Sin(a))
+	}
+	dc.ClosePath()
+	dc.SetRGB(0.9, 0, 0)
+	dc.FillPreserve()
+	dc.SetRGB(0, 0, 0)
+	dc.SetLineWidth(1)
+	dc.Stroke()
+}
+
+// drawMarkerKey explains the point marker below the legend.
+func drawMarkerKey(dc *gg.Context, x, y float64, label string) {
+	w, _ := dc.MeasureString(label)
+	dc.SetRGBA(1, 1, 1, 0.85)
+	dc.DrawRectangle(x, y, w+48, 28)
+	dc.Fill()
+	drawStar(dc, x+20, y+14, 9)
+	dc.SetRGB(0, 0, 0)
+	dc.DrawStringAnchored(label, x+40, y+14, 0, 0.4)
+}
+
+// drawScaleBar draws a bar of a round distance with its left end at (x, y).
+// The length holds at the latitude of the bar, as Mercator scale varies
+// with latitude.
+func drawScaleBar(dc *gg.Context, x, y, west, east, minY, maxY float64, size int) {
+	my := minY + y/float64(size)*(maxY-minY)
+	lat := 2*math.Atan(math.Exp(math.Pi-my*math.Pi/128)) - math.Pi/2
+	kmPerPx := (east - west) / float64(size) * math.Pi / 180 * earthRadiusKm * math.Cos(lat)
+	if kmPerPx <= 0 {
+		return
+	}
+	// The longest 1, 2 or 5 times a power of ten that fits in 200 pixels.
+	raw := 200 * kmPerPx
+	mag := math.Pow(10, math.Floor(math.Log10(raw)))
+	km := mag
+	for _, f := range []float64{5, 2} {
+		if f*mag <= raw {
+			km = f * mag
+			break
+		}
+	}
+	px := km / kmPerPx
+	label := strconv.FormatFloat(km, 'f', -1, 64) + " km"
+
+	dc.SetRGBA(1, 1, 1, 0.85)
+	dc.DrawRectangle(x-6, y-26, px+12, 36)
+	dc.Fill()
+	dc.SetRGB(0, 0, 0)
+	dc.SetLineWidth(2)
+	dc.DrawLine(x, y, x+px, y)
+	dc.DrawLine(x, y-6, x, y+4)
+	dc.DrawLine(x+px, y-6, x+px, y+4)
+	dc.Stroke()
+	dc.DrawStringAnchored(label, x+px/2, y-10, 0.5, 0)
+}
+
+// annotateOptions takes the title, markers and unit of the annotated frames
+// from a payload.
+func annotateOptions(payload Payload) AnnotateOptions {
+	opts := AnnotateOptions{
+		Pollutant: payloadPollutants(payload)[0],
+		Points:    payload.Points,
+		Backward:  payload.SimulationMeta.Direction == "BACKWARD",
+	}
+	if grids := payload.ConcentrationGrids; len(grids) > 0 && len(grids[0].OutputLevelsMAgl) > 0 {
+		opts.Level = fmt.Sprintf("%g m AGL", grids[0].OutputLevelsMAgl[0])
+	}
+	if id := payload.PollutantMatrixConfig.SOX.UnitId; id != "" {
+		if u, ok := payload.Units[id]; ok {
+			opts.Unit = &u
+		}
+	}
+	return opts
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestZoneScale(t *testing.T) {
+	u := Unit{
+		UnitId:             "u1",
+		Label:              "ug/m3",
+		ConversionStrategy: &UnitConversion{M: 1e6, Type: "mx"},
+		CustomZones: &UnitZones{Lower: 1, Next: []UnitZone{
+			{Color: "#6ecc58", Upper: 10},
+			{Color: "#bbcf4c", Upper: 100},
+		}},
+	}
+	scale, err := zoneScale(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		model float64
+		want  color.NRGBA
+		ok    bool
+	}{
+		{5e-7, color.NRGBA{}, false},
+		{2e-6, color.NRGBA{0x6e, 0xcc, 0x58, 200}, true},
+		{5e-5, color.NRGBA{0xbb, 0xcf, 0x4c, 200}, true},
+		{1e-3, color.NRGBA{0xbb, 0xcf, 0x4c, 200}, true}, // the last zone is open ended
+	} {
+		v, err := u.Convert(tc.model)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := contourColor(scale, v)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("%g g/m3: got %v %v, want %v %v", tc.model, got, ok, tc.want, tc.ok)
+		}
+	}
+	if legend := zoneLegend(u, scale); legend[0].Label != "10 – 100" || legend[1].Label != "1 – 10" {
+		t.Errorf("zone legend = %+v", legend)
+	}
+
+	u.CustomZones.Next[1].Upper = 5
+	if _, err := zoneScale(u); err == nil {
+		t.Error("expected an error for zones out of order")
+	}
+	u.ConversionStrategy.Type = "log"
+	if _, err := u.Convert(1); err == nil {
+		t.Error("expected an error for an unknown conversion")
+	}
+}
+
+func TestRenderAnnotatedKml(t *testing.T) {
+	const kml = "../programfiles/test/HYSPLIT_ps.kml"
+	scales, err := KmlColorScales(kml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames, err := RenderAnnotatedKml(kml, AnnotateOptions{
+		Pollutant: "SOX",
+		Points:    []Point{{PointId: 1, Latitude: 39.027718, Longitude: -105.117188}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != len(scales) {
+		t.Fatalf("got %d frames, want one per concentration folder (%d)", len(frames), len(scales))
+	}
+	for i, f := range frames {
+		if _, ok := scales[f.T]; !ok {
+			t.Errorf("frame %d at %d has no matching folder", i, f.T)
+		}
+		if i > 0 && f.T < frames[i-1].T {
+			t.Errorf("frames out of time order at %d", i)
+		}
+		if f.Bbox["west"] >= f.Bbox["east"] || f.Bbox["south"] >= f.Bbox["north"] {
+			t.Errorf("frame %d has an empty bbox %v", i, f.Bbox)
+		}
+	}
+}
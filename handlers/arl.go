@@ -0,0 +1,563 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ARL packed meteorology files are a sequence of fixed length records: a
+// 50 byte ASCII label followed by NX*NY bytes of packed data. Every time
+// period starts with an index record (variable INDX) whose data part holds
+// the grid definition and the variables present at each level.
+const (
+	arlLabelLength  = 50
+	arlHeaderLength = 108
+)
+
+// earthRadiusKm is the earth radius of the HYSPLIT map projections.
+const earthRadiusKm = 6371.2
+
+// ARLGrid is the grid definition of an ARL index record. Conformal grids
+// (Size > 0) are polar stereographic, Lambert conformal or Mercator,
+// depending on the tangent latitude. Lat-lon grids (Size == 0) store the
+// upper right corner in PoleLat/PoleLon, the spacing in RefLat/RefLon and
+// the lower left corner in SyncLat/SyncLon.
+type ARLGrid struct {
+	PoleLat  float64 `json:"poleLat"`
+	PoleLon  float64 `json:"poleLon"`
+	RefLat   float64 `json:"refLat"` // latitude at which Size applies
+	RefLon   float64 `json:"refLon"` // meridian parallel to the y axis
+	Size     float64 `json:"size"`   // grid spacing in km, 0 for lat-lon grids
+	Orient   float64 `json:"orient"`
+	TangLat  float64 `json:"tangLat"` // 90 polar stereographic, 0 Mercator
+	SyncX    float64 `json:"syncX"`
+	SyncY    float64 `json:"syncY"`
+	SyncLat  float64 `json:"syncLat"`
+	SyncLon  float64 `json:"syncLon"`
+	NX       int     `json:"nx"`
+	NY       int     `json:"ny"`
+	NZ       int     `json:"nz"`
+	VertFlag int     `json:"vertFlag"` // 1 sigma, 2 pressure, 3 terrain following, 4 hybrid
+}
+
+// ARLLevel lists the variables of one level.
+type ARLLevel struct {
+	Height    float64  `json:"height"`
+	Variables []string `json:"variables"`
+	checksums []int
+}
+
+// ARLFile describes an ARL met file from its index records.
+type ARLFile struct {
+	Path           string      `json:"path"`
+	Source         string      `json:"source"` // data source of the index record, e.g. "GFSQ"
+	Grid           ARLGrid     `json:"grid"`
+	Levels         []ARLLevel  `json:"levels"`
+	Times          []time.Time `json:"times"`
+	RecordLength   int         `json:"-"`
+	RecordsPerTime int         `json:"-"`
+	indexRecords   int
+	checksums      [][]int // per time period and data record
+}
+
+// arlLabel is the 50 byte label of a record.
+type arlLabel struct {
+	Time      time.Time
+	Forecast  int
+	Level     int
+	Grid      string // grid number, or the thousands of NX and NY on large grids
+	Variable  string
+	Exponent  int
+	Precision float64
+	Value     float64 // unpacked value at grid point (1,1)
+}
+
+func parseARLLabel(b []byte) (arlLabel, error) {
+	var l arlLabel
+	if len(b) < arlLabelLength {
+		return l, fmt.Errorf("short ARL label")
+	}
+	s := string(b[:arlLabelLength])
+	ints := make([]int, 6)
+	for i := range ints {
+		v, err := strconv.Atoi(strings.TrimSpace(s[2*i : 2*i+2]))
+		if err != nil {
+			return l, fmt.Errorf("bad ARL label %q", s)
+		}
+		ints[i] = v
+	}
+	year := ints[0] + 1900
+	if ints[0] < 40 {
+		year += 100
+	}
+	l.Time = time.Date(year, time.Month(ints[1]), ints[2], ints[3], 0, 0, 0, time.UTC)
+	l.Forecast, l.Level = ints[4], ints[5]
+	l.Grid = s[12:14]
+	l.Variable = s[14:18]
+	var err error
+	if l.Exponent, err = strconv.Atoi(strings.TrimSpace(s[18:22])); err != nil {
+		return l, fmt.Errorf("bad ARL label %q", s)
+	}
+	if l.Precision, err = strconv.ParseFloat(strings.TrimSpace(s[22:36]), 64); err != nil {
+		return l, fmt.Errorf("bad ARL label %q", s)
+	}
+	if l.Value, err = strconv.ParseFloat(strings.TrimSpace(s[36:50]), 64); err != nil {
+		return l, fmt.Errorf("bad ARL label %q", s)
+	}
+	return l, nil
+}
+
+// fixedFields splits s into fields of the given widths, trimmed.
+func fixedFields(s string, widths ...int) ([]string, error) {
+	var out []string
+	for _, w := range widths {
+		if len(s) < w {
+			return nil, fmt.Errorf("short ARL header")
+		}
+		out = append(out, strings.TrimSpace(s[:w]))
+		s = s[w:]
+	}
+	return out, nil
+}
+
+// parseARLHeader reads the grid definition at the start of an index
+// record. It returns the source, the minutes past the label hour, the grid
+// and the length of the index data.
+func parseARLHeader(data []byte, gridField string) (string, int, ARLGrid, int, error) {
+	var g ARLGrid
+	if len(data) < arlHeaderLength {
+		return "", 0, g, 0, fmt.Errorf("short ARL index record")
+	}
+	widths := []int{4, 3, 2}
+	for i := 0; i < 12; i++ {
+		widths = append(widths, 7)
+	}
+	widths = append(widths, 3, 3, 3, 2, 4)
+	f, err := fixedFields(string(data[:arlHeaderLength]), widths...)
+	if err != nil {
+		return "", 0, g, 0, err
+	}
+	num := make([]float64, len(f))
+	for i := 1; i < len(f); i++ {
+		if num[i], err = strconv.ParseFloat(f[i], 64); err != nil {
+			return "", 0, g, 0, fmt.Errorf("bad ARL index header field %q", f[i])
+		}
+	}
+	g = ARLGrid{
+		PoleLat: num[3], PoleLon: num[4], RefLat: num[5], RefLon: num[6],
+		Size: num[7], Orient: num[8], TangLat: num[9],
+		SyncX: num[10], SyncY: num[11], SyncLat: num[12], SyncLon: num[13],
+		NX: int(num[15]), NY: int(num[16]), NZ: int(num[17]), VertFlag: int(num[18]),
+	}
+	// Grids of 1000 points or more keep the thousands of NX and NY in the
+	// grid number of the label, as characters counted from '@'.
+	if len(gridField) == 2 && gridField[0] >= '@' && gridField[1] >= '@' {
+		g.NX += int(gridField[0]-'@') * 1000
+		g.NY += int(gridField[1]-'@') * 1000
+	}
+	return f[0], int(num[2]), g, int(num[19]), nil
+}
+
+// parseARLLevels reads the level table that follows the index header.
+func parseARLLevels(data []byte, nz int) ([]ARLLevel, error) {
+	s := string(data)
+	levels := make([]ARLLevel, nz)
+	for k := range levels {
+		f, err := fixedFields(s, 6, 2)
+		if err != nil {
+			return nil, err
+		}
+		s = s[8:]
+		if levels[k].Height, err = strconv.ParseFloat(f[0], 64); err != nil {
+			return nil, fmt.Errorf("bad ARL level height %q", f[0])
+		}
+		nv, err := strconv.Atoi(f[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad ARL variable count %q", f[1])
+		}
+		for v := 0; v < nv; v++ {
+			if len(s) < 8 {
+				return nil, fmt.Errorf("short ARL level table")
+			}
+			sum, err := strconv.Atoi(strings.TrimSpace(s[4:7]))
+			if err != nil {
+				return nil, fmt.Errorf("bad ARL checksum %q", s[4:7])
+			}
+			levels[k].Variables = append(levels[k].Variables, s[:4])
+			levels[k].checksums = append(levels[k].checksums, sum)
+			s = s[8:]
+		}
+	}
+	return levels, nil
+}
+
+// arlIndex is the decoded index of one time period.
+type arlIndex struct {
+	time      time.Time
+	source    string
+	grid      ARLGrid
+	levels    []ARLLevel
+	checksums []int // per data record, in file order
+	records   int   // number of index records
+}
+
+// readARLIndex reads the index record, or records, at off.
+func readARLIndex(f *os.File, off int64) (*arlIndex, error) {
+	first := make([]byte, arlLabelLength+arlHeaderLength)
+	if _, err := f.ReadAt(first, off); err != nil {
+		return nil, fmt.Errorf("no index record at byte %d", off)
+	}
+	label, err := parseARLLabel(first)
+	if err != nil || label.Variable != "INDX" {
+		return nil, fmt.Errorf("no index record at byte %d", off)
+	}
+	source, minutes, grid, indexLength, err := parseARLHeader(first[arlLabelLength:], label.Grid)
+	if err != nil {
+		return nil, err
+	}
+	nxy := grid.NX * grid.NY
+	if nxy <= 0 || grid.NZ <= 0 {
+		return nil, fmt.Errorf("bad ARL grid %dx%dx%d", grid.NX, grid.NY, grid.NZ)
+	}
+
+	// The index data may span several records.
+	idx := &arlIndex{
+		time:    label.Time.Add(time.Duration(minutes) * time.Minute),
+		source:  source,
+		grid:    grid,
+		records: (indexLength + nxy - 1) / nxy,
+	}
+	data := make([]byte, 0, idx.records*nxy)
+	record := make([]byte, arlLabelLength+nxy)
+	for r := 0; r < idx.records; r++ {
+		if _, err := f.ReadAt(record, off+int64(r*len(record))); err != nil {
+			return nil, fmt.Errorf("reading index record: %v", err)
+		}
+		data = append(data, record[arlLabelLength:]...)
+	}
+	if idx.levels, err = parseARLLevels(data[arlHeaderLength:], grid.NZ); err != nil {
+		return nil, err
+	}
+	for _, l := range idx.levels {
+		idx.checksums = append(idx.checksums, l.checksums...)
+	}
+	return idx, nil
+}
+
+// ReadARLFile reads the index records of an ARL file: the grid and levels
+// of the first time period and the valid time of every period. A file
+// without one complete period, such as a partial download, is an error.
+func ReadARLFile(path string) (*ARLFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	idx, err := readARLIndex(f, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: not an ARL file: %v", path, err)
+	}
+	a := &ARLFile{
+		Path:           path,
+		Source:         idx.source,
+		Grid:           idx.grid,
+		Levels:         idx.levels,
+		RecordLength:   arlLabelLength + idx.grid.NX*idx.grid.NY,
+		RecordsPerTime: idx.records + len(idx.checksums),
+		indexRecords:   idx.records,
+	}
+	period := int64(a.RecordLength * a.RecordsPerTime)
+	for off := int64(0); off+period <= info.Size(); off += period {
+		if off > 0 {
+			if idx, err = readARLIndex(f, off); err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			if len(idx.checksums) != len(a.checksums[0]) {
+				return nil, fmt.Errorf("%s: variables change at %s", path, idx.time.Format("2006-01-02 15:04"))
+			}
+		}
+		a.Times = append(a.Times, idx.time)
+		a.checksums = append(a.checksums, idx.checksums)
+	}
+	if len(a.Times) == 0 {
+		return nil, fmt.Errorf("%s: shorter than one time period (%d of %d bytes)", path, info.Size(), period)
+	}
+	return a, nil
+}
+
+// ARLField is one unpacked variable on the grid, row by row from the
+// lower left corner.
+type ARLField struct {
+	NX, NY int
+	Data   []float64
+}
+
+// unpackARL decodes the 8 bit differences of a record. Each value is the
+// previous one plus (byte-127)/2^(7-exponent); rows start from the first
+// value of the row below, and the first value of all is in the label.
+// It also returns the checksum of the packed bytes.
+func unpackARL(packed []byte, nx, ny, exponent int, first float64) ([]float64, int) {
+	scale := math.Pow(2, float64(7-exponent))
+	data := make([]float64, nx*ny)
+	sum := 0
+	rowStart := first
+	for j := 0; j < ny; j++ {
+		v := rowStart
+		for i := 0; i < nx; i++ {
+			b := packed[j*nx+i]
+			v += (float64(b) - 127) / scale
+			data[j*nx+i] = v
+			if sum += int(b); sum >= 256 {
+				sum -= 255
+			}
+		}
+		rowStart = data[j*nx]
+	}
+	return data, sum
+}
+
+// ReadField reads variable v of level k (0 is the surface) at time
+// period t, and verifies its checksum against the index record.
+func (a *ARLFile) ReadField(t, k int, v string) (*ARLField, error) {
+	if t < 0 || t >= len(a.Times) {
+		return nil, fmt.Errorf("%s: no time period %d", a.Path, t)
+	}
+	if k < 0 || k >= len(a.Levels) {
+		return nil, fmt.Errorf("%s: no level %d", a.Path, k)
+	}
+	record := a.indexRecords
+	for l := 0; l < k; l++ {
+		record += len(a.Levels[l].Variables)
+	}
+	index := -1
+	for i, name := range a.Levels[k].Variables {
+		if name == v {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("%s: no %s at level %d", a.Path, v, k)
+	}
+	record += index
+
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, a.RecordLength)
+	off := int64(t*a.RecordsPerTime+record) * int64(a.RecordLength)
+	if _, err := f.ReadAt(buf, off); err != nil {
+		return nil, fmt.Errorf("%s: reading %s: %v", a.Path, v, err)
+	}
+	label, err := parseARLLabel(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", a.Path, err)
+	}
+	if label.Variable != v || label.Level != k {
+		return nil, fmt.Errorf("%s: expected %s at level %d, found %s at level %d", a.Path, v, k, label.Variable, label.Level)
+	}
+	nx, ny := a.Grid.NX, a.Grid.NY
+	data, sum := unpackARL(buf[arlLabelLength:], nx, ny, label.Exponent, label.Value)
+	if want := a.checksums[t][record-a.indexRecords]; sum != want {
+		return nil, fmt.Errorf("%s: checksum of %s at level %d is %d, index says %d", a.Path, v, k, sum, want)
+	}
+	return &ARLField{NX: nx, NY: ny, Data: data}, nil
+}
+
+// At interpolates the field bilinearly at a grid position, with (1,1) the
+// lower left point. Positions outside the grid are clamped to its edge,
+// except across the date line of a global grid, where x wraps.
+func (f *ARLField) At(x, y float64, wrap bool) float64 {
+	x, y = x-1, y-1
+	if wrap {
+		x = math.Mod(x, float64(f.NX))
+		if x < 0 {
+			x += float64(f.NX)
+		}
+	} else {
+		x = min(max(x, 0), float64(f.NX-1))
+	}
+	y = min(max(y, 0), float64(f.NY-1))
+	i0, j0 := int(math.Floor(x)), int(math.Floor(y))
+	i1, j1 := i0+1, min(j0+1, f.NY-1)
+	if i1 >= f.NX {
+		i1 = 0
+		if !wrap {
+			i1 = f.NX - 1
+		}
+	}
+	i0 = min(i0, f.NX-1)
+	fx, fy := x-math.Floor(x), y-float64(j0)
+	at := func(i, j int) float64 { return f.Data[j*f.NX+i] }
+	return (1-fy)*((1-fx)*at(i0, j0)+fx*at(i1, j0)) + fy*((1-fx)*at(i0, j1)+fx*at(i1, j1))
+}
+
+// IsLatLon reports whether the grid is a regular lat-lon grid.
+func (g ARLGrid) IsLatLon() bool { return g.Size == 0 }
+
+// Global reports whether a lat-lon grid wraps around the earth.
+func (g ARLGrid) Global() bool {
+	return g.IsLatLon() && float64(g.NX)*g.RefLon >= 359.99
+}
+
+// conformal returns the cone constant, the hemisphere sign and the
+// projection constant of a conformal grid, so that the distance from the
+// pole in grid units is scale*t(lat)^n.
+func (g ARLGrid) conformal() (n, hemi, scale float64) {
+	hemi = 1
+	if g.TangLat < 0 {
+		hemi = -1
+	}
+	n = math.Sin(math.Abs(g.TangLat) * math.Pi / 180)
+	ref := hemi * g.RefLat * math.Pi / 180
+	// cos(lat)/t(lat)^n written as (1 + sin(lat)) for the stereographic
+	// case, where both go to zero at the pole.
+	var k float64
+	if n > 0.9999 {
+		k = 1 + math.Sin(ref)
+	} else {
+		k = math.Cos(ref) / math.Pow(math.Tan(math.Pi/4-ref/2), n)
+	}
+	scale = earthRadiusKm * k / (n * g.Size)
+	return n, hemi, scale
+}
+
+// polar returns the distance from the pole in grid units and the polar angle
+// of a point on a conic grid.
+func (g ARLGrid) polar(lat, lon float64) (float64, float64) {
+	n, hemi, scale := g.conformal()
+	phi := hemi * lat * math.Pi / 180
+	r := scale * math.Pow(math.Tan(math.Pi/4-phi/2), n)
+	theta := n * normalizeLon(lon-g.RefLon) * math.Pi / 180
+	return r, theta
+}
+
+// pole returns the grid position of the pole of a conic grid.
+func (g ARLGrid) pole() (float64, float64) {
+	_, hemi, _ := g.conformal()
+	r, theta := g.polar(g.SyncLat, g.SyncLon)
+	return g.SyncX - r*math.Sin(theta), g.SyncY + hemi*r*math.Cos(theta)
+}
+
+// mercator returns the grid units per radian of a Mercator grid.
+func (g ARLGrid) mercator() float64 {
+	return earthRadiusKm * math.Cos(g.RefLat*math.Pi/180) / g.Size
+}
+
+// XY returns the grid position of a point, with (1,1) at the lower left
+// grid point as in HYSPLIT. The grid orientation is assumed to be zero.
+func (g ARLGrid) XY(lat, lon float64) (float64, float64) {
+	switch {
+	case g.IsLatLon():
+		return g.SyncX + normalizeLon360(lon-g.SyncLon)/g.RefLon, g.SyncY + (lat-g.SyncLat)/g.RefLat
+	case math.Abs(g.TangLat) < 1e-4:
+		c := g.mercator()
+		y := func(lat float64) float64 { return math.Log(math.Tan(math.Pi/4 + lat*math.Pi/360)) }
+		return g.SyncX + c*normalizeLon(lon-g.SyncLon)*math.Pi/180, g.SyncY + c*(y(lat)-y(g.SyncLat))
+	}
+	_, hemi, _ := g.conformal()
+	xp, yp := g.pole()
+	r, theta := g.polar(lat, lon)
+	return xp + r*math.Sin(theta), yp - hemi*r*math.Cos(theta)
+}
+
+// LatLonAt returns the latitude and longitude of a grid position.
+func (g ARLGrid) LatLonAt(x, y float64) (float64, float64) {
+	switch {
+	case g.IsLatLon():
+		return g.SyncLat + (y-g.SyncY)*g.RefLat, normalizeLon(g.SyncLon + (x-g.SyncX)*g.RefLon)
+	case math.Abs(g.TangLat) < 1e-4:
+		c := g.mercator()
+		y0 := math.Log(math.Tan(math.Pi/4 + g.SyncLat*math.Pi/360))
+		lat := (2*math.Atan(math.Exp(y0+(y-g.SyncY)/c)) - math.Pi/2) * 180 / math.Pi
+		return lat, normalizeLon(g.SyncLon + (x-g.SyncX)/c*180/math.Pi)
+	}
+	n, hemi, scale := g.conformal()
+	xp, yp := g.pole()
+	dx, dy := x-xp, hemi*(yp-y)
+	r := math.Hypot(dx, dy)
+	theta := math.Atan2(dx, dy)
+	lat := hemi * (math.Pi/2 - 2*math.Atan(math.Pow(r/scale, 1/n))) * 180 / math.Pi
+	return lat, normalizeLon(g.RefLon + theta/n*180/math.Pi)
+}
+
+// Rotation returns the angle in radians by which true north is turned
+// counterclockwise from the grid y axis at a point. Grid relative winds
+// (u, v) are u*cos+v*sin towards the east and v*cos-u*sin towards the
+// north, with the sign of the angle already applied for the hemisphere.
+func (g ARLGrid) Rotation(lat, lon float64) float64 {
+	if g.IsLatLon() || math.Abs(g.TangLat) < 1e-4 {
+		return 0
+	}
+	n, hemi, _ := g.conformal()
+	return hemi * n * normalizeLon(lon-g.RefLon) * math.Pi / 180
+}
+
+// Contains reports whether a point lies inside the grid.
+func (g ARLGrid) Contains(lat, lon float64) bool {
+	x, y := g.XY(lat, lon)
+	if g.Global() {
+		return y >= 1 && y <= float64(g.NY)
+	}
+	return x >= 1 && x <= float64(g.NX) && y >= 1 && y <= float64(g.NY)
+}
+
+// Bounds returns the latitude and longitude range of the grid, from the
+// points along its edges.
+func (g ARLGrid) Bounds() (south, north, west, east float64) {
+	if g.IsLatLon() {
+		south, north = g.SyncLat, g.SyncLat+float64(g.NY-1)*g.RefLat
+		west, east = g.SyncLon, g.SyncLon+float64(g.NX-1)*g.RefLon
+		if g.Global() {
+			west, east = -180, 180
+		}
+		return south, north, normalizeLon(west), normalizeLon(east)
+	}
+	south, north, west, east = 90, -90, 180, -180
+	edge := func(x, y float64) {
+		lat, lon := g.LatLonAt(x, y)
+		south, north = math.Min(south, lat), math.Max(north, lat)
+		west, east = math.Min(west, lon), math.Max(east, lon)
+	}
+	for i := 1; i <= g.NX; i++ {
+		edge(float64(i), 1)
+		edge(float64(i), float64(g.NY))
+	}
+	for j := 1; j <= g.NY; j++ {
+		edge(1, float64(j))
+		edge(float64(g.NX), float64(j))
+	}
+	return south, north, west, east
+}
+
+// Resolution returns the grid spacing and its units, "deg" or "km".
+func (g ARLGrid) Resolution() (float64, string) {
+	if g.IsLatLon() {
+		return g.RefLat, "deg"
+	}
+	return g.Size, "km"
+}
+
+// normalizeLon maps a longitude into [-180, 180).
+func normalizeLon(lon float64) float64 {
+	return normalizeLon360(lon+180) - 180
+}
+
+// normalizeLon360 maps a longitude into [0, 360).
+func normalizeLon360(lon float64) float64 {
+	lon = math.Mod(lon, 360)
+	if lon < 0 {
+		lon += 360
+	}
+	return lon
+}
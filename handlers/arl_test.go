@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testARLFile = "../programfiles/test/oct1618.BIN"
+
+func TestReadARLFile(t *testing.T) {
+	a, err := ReadARLFile(testARLFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := a.Grid
+	if a.Source != "NGM" || g.NX != 33 || g.NY != 28 || g.NZ != 11 || len(a.Levels) != 11 {
+		t.Fatalf("got source %q, grid %dx%dx%d with %d levels", a.Source, g.NX, g.NY, g.NZ, len(a.Levels))
+	}
+	first := time.Date(1995, 10, 16, 0, 0, 0, 0, time.UTC)
+	if len(a.Times) != 36 || !a.Times[0].Equal(first) || !a.Times[35].Equal(first.Add(70*time.Hour)) {
+		t.Fatalf("got %d times from %v to %v", len(a.Times), a.Times[0], a.Times[len(a.Times)-1])
+	}
+
+	// The sync point of the grid is the north pole.
+	if lat, _ := g.LatLonAt(g.SyncX, g.SyncY); math.Abs(lat-90) > 1e-9 {
+		t.Errorf("sync point at latitude %g, want 90", lat)
+	}
+	x, y := g.XY(40, -90)
+	if lat, lon := g.LatLonAt(x, y); math.Abs(lat-40) > 1e-9 || math.Abs(lon+90) > 1e-9 {
+		t.Errorf("40,-90 maps back to %g,%g", lat, lon)
+	}
+
+	// Every record of the last period unpacks with a matching checksum.
+	for k, l := range a.Levels {
+		for _, v := range l.Variables {
+			if _, err := a.ReadField(35, k, v); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+func TestReadARLFileTruncated(t *testing.T) {
+	a, err := ReadARLFile(testARLFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(testARLFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first index record is intact, but the period is cut short.
+	dir := t.TempDir()
+	path := filepath.Join(dir, "partial.BIN")
+	if err := os.WriteFile(path, data[:a.RecordLength*a.RecordsPerTime-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadARLFile(path); err == nil {
+		t.Error("expected an error for a file shorter than one period")
+	}
+	cat, err := ScanMetCatalog([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cat.Entries) != 0 {
+		t.Errorf("got %d catalog entries, want the partial file skipped", len(cat.Entries))
+	}
+}
+
+func TestARLProfile(t *testing.T) {
+	a, err := ReadARLFile(testARLFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := a.Profile(40, -90, time.Date(1995, 10, 16, 1, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if psfc := p.Surface["PRSS"]; psfc < 950 || psfc > 1050 {
+		t.Errorf("surface pressure %g hPa", psfc)
+	}
+	for k, l := range p.Levels {
+		if k > 0 && l.HeightMAgl <= p.Levels[k-1].HeightMAgl {
+			t.Errorf("level %d at %g m is not above level %d", k, l.HeightMAgl, k-1)
+		}
+		if temp := l.Values["TEMP"]; temp < 200 || temp > 320 {
+			t.Errorf("level %d temperature %g K", k, temp)
+		}
+	}
+	if _, err := a.Profile(40, -90, time.Date(1995, 10, 20, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("expected an error for a time after the file")
+	}
+	if _, err := a.Profile(-40, 90, time.Date(1995, 10, 16, 1, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("expected an error for a point outside the grid")
+	}
+}
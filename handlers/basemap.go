@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fogleman/gg"
+)
+
+// Basemap draws geographic context under rendered frames from local data
+// only: a cache of XYZ map tiles or an MBTiles file, shapefiles of
+// coastlines and boundaries, or both.
+type Basemap struct {
+	// Tiles is a tile path template with {z}, {x} and {y}, or {-y} for
+	// TMS row order. Empty means no tiles.
+	Tiles      string
+	MBTiles    *MBTiles // tiles from an MBTiles file instead of Tiles
+	Shapefiles []*Shapefile
+}
+
+// maxTileZoom is the deepest zoom level looked for in a tile cache.
+const maxTileZoom = 19
+
+// tileTemplate turns the configured tile location into a path template. A
+// directory holds {z}/{x}/{y}.png tiles, or .jpg when there are no PNGs.
+func tileTemplate(location string) (string, error) {
+	if location == "" || strings.Contains(location, "{z}") {
+		return location, nil
+	}
+	info, err := os.Stat(location)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a tile directory", location)
+	}
+	for _, ext := range []string{"png", "jpg", "jpeg"} {
+		if matches, _ := filepath.Glob(filepath.Join(location, "*", "*", "*."+ext)); len(matches) > 0 {
+			return filepath.Join(location, "{z}", "{x}", "{y}."+ext), nil
+		}
+	}
+	return "", fmt.Errorf("%s holds no {z}/{x}/{y} PNG or JPEG tiles", location)
+}
+
+// LoadBasemap reads the basemap sources of the config.
+func LoadBasemap(cfg Config) (*Basemap, error) {
+	if cfg.BasemapTiles == "" && len(cfg.BasemapShapefiles) == 0 {
+		return nil, fmt.Errorf("no basemap configured (-basemap-tiles or -basemap-shp)")
+	}
+	b := &Basemap{}
+	var err error
+	if strings.HasSuffix(strings.ToLower(cfg.BasemapTiles), ".mbtiles") {
+		b.MBTiles, err = OpenMBTiles(cfg.BasemapTiles)
+	} else {
+		b.Tiles, err = tileTemplate(cfg.BasemapTiles)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range cfg.BasemapShapefiles {
+		sf, err := ReadShapefile(path)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.Shapefiles = append(b.Shapefiles, sf)
+	}
+	return b, nil
+}
+
+// Close closes the MBTiles file, if the basemap has one.
+func (b *Basemap) Close() error {
+	if b.MBTiles == nil {
+		return nil
+	}
+	return b.MBTiles.Close()
+}
+
+// tilePath returns the file of one tile.
+func (b *Basemap) tilePath(z, x, y int) string {
+	r := strings.NewReplacer(
+		"{z}", strconv.Itoa(z),
+		"{x}", strconv.Itoa(x),
+		"{y}", strconv.Itoa(y),
+		"{-y}", strconv.Itoa(1<<z-1-y),
+	)
+	return r.Replace(b.Tiles)
+}
+
+// drawTiles draws the tiles covering a Web Mercator window, given in the
+// 256 unit world coordinates of lonToX and latToY. It uses the first zoom
+// level, from the one matching the canvas resolution down, that has any
+// tile in the window, and reports whether it found one.
+func (b *Basemap) drawTiles(dc *gg.Context, minX, minY, maxX, maxY float64) (bool, error) {
+	w, h := float64(dc.Width()), float64(dc.Height())
+	want := int(math.Ceil(math.Log2(w / (maxX - minX))))
+	for z := min(max(want, 0), maxTileZoom); z >= 0; z-- {
+		n := 1 << z
+		tile := 256.0 / float64(n) // tile size in world units
+		// Frames stretch the bbox over the canvas, so x and y scale apart.
+		sx, sy := w/(maxX-minX)*tile, h/(maxY-minY)*tile
+		found := false
+		for ty := int(math.Floor(minY / tile)); ty <= int(math.Floor(maxY/tile)); ty++ {
+			for tx := int(math.Floor(minX / tile)); tx <= int(math.Floor(maxX/tile)); tx++ {
+				if ty < 0 || ty >= n {
+					continue
+				}
+				img, err := b.loadTile(z, (tx%n+n)%n, ty)
+				if err != nil {
+					return false, err
+				}
+				if img == nil {
+					continue
+				}
+				found = true
+				dc.Push()
+				dc.Translate((float64(tx)*tile-minX)/(maxX-minX)*w, (float64(ty)*tile-minY)/(maxY-minY)*h)
+				dc.Scale(sx/float64(img.Bounds().Dx()), sy/float64(img.Bounds().Dy()))
+				dc.DrawImage(img, 0, 0)
+				dc.Pop()
+			}
+		}
+		if found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// loadTile decodes a tile, or returns nil when the cache does not have it.
+func (b *Basemap) loadTile(z, x, y int) (image.Image, error) {
+	if b.MBTiles != nil {
+		data, err := b.MBTiles.Tile(z, x, y)
+		if data == nil || err != nil {
+			return nil, err
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: tile %d/%d/%d: %v", b.MBTiles.Path, z, x, y, err)
+		}
+		return img, nil
+	}
+	path := b.tilePath(z, x, y)
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("tile %s: %v", path, err)
+	}
+	return img, nil
+}
+
+// Colors of the shapefile layers. Polygons are only filled without tiles,
+// over a water background.
+var (
+	basemapWater = [3]float64{0.84, 0.90, 0.95}
+	basemapLand  = [3]float64{0.95, 0.94, 0.91}
+	basemapLine  = [3]float64{0.45, 0.45, 0.45}
+)
+
+// Draw draws the basemap of a bbox onto dc, with the Web Mercator canvas
+// layout of ProcessKml.
+func (b *Basemap) Draw(dc *gg.Context, west, south, east, north float64) error {
+	// Web Mercator does not reach the poles.
+	clampLat := func(lat float64) float64 { return min(max(lat, -85.05), 85.05) }
+	minX, maxX := lonToX(west), lonToX(east)
+	minY, maxY := latToY(clampLat(north)), latToY(clampLat(south))
+	if maxX <= minX || maxY <= minY {
+		return fmt.Errorf("empty bbox %g,%g,%g,%g", west, south, east, north)
+	}
+	w, h := float64(dc.Width()), float64(dc.Height())
+	project := func(lon, lat float64) (float64, float64) {
+		return (lonToX(lon) - minX) / (maxX - minX) * w,
+			(latToY(clampLat(lat)) - minY) / (maxY - minY) * h
+	}
+
+	tiled := false
+	if b.Tiles != "" || b.MBTiles != nil {
+		var err error
+		if tiled, err = b.drawTiles(dc, minX, minY, maxX, maxY); err != nil {
+			return err
+		}
+	}
+	fill := !tiled
+	if fill {
+		hasPolygons := false
+		for _, sf := range b.Shapefiles {
+			for _, s := range sf.Shapes {
+				hasPolygons = hasPolygons || s.Polygon
+			}
+		}
+		if hasPolygons {
+			dc.SetRGB(basemapWater[0], basemapWater[1], basemapWater[2])
+			dc.Clear()
+		}
+	}
+
+	dc.SetLineWidth(1)
+	for _, sf := range b.Shapefiles {
+		for _, s := range sf.Shapes {
+			if !s.Intersects(west, south, east, north) {
+				continue
+			}
+			for _, part := range s.Parts {
+				dc.NewSubPath()
+				for _, p := range part {
+					dc.LineTo(project(p[0], p[1]))
+				}
+			}
+			if s.Polygon && fill {
+				dc.SetFillRuleEvenOdd()
+				dc.SetRGB(basemapLand[0], basemapLand[1], basemapLand[2])
+				dc.FillPreserve()
+			}
+			dc.SetRGB(basemapLine[0], basemapLine[1], basemapLine[2])
+			dc.Stroke()
+		}
+	}
+	return nil
+}
+
+// Compose draws a rendered frame over the basemap of its bbox. Frames
+// without a map bbox, such as cross-sections, are an error.
+func (b *Basemap) Compose(frame KmlResult) (KmlResult, error) {
+	bbox := frame.Bbox
+	for _, k := range []string{"west", "south", "east", "north"} {
+		if _, ok := bbox[k]; !ok {
+			return frame, fmt.Errorf("frame %d has no map bbox", frame.T)
+		}
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(frame.Base64, "data:image/png;base64,"))
+	if err != nil {
+		return frame, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return frame, fmt.Errorf("frame %d: %v", frame.T, err)
+	}
+	dc := gg.NewContext(img.Bounds().Dx(), img.Bounds().Dy())
+	if err := b.Draw(dc, bbox["west"], bbox["south"], bbox["east"], bbox["north"]); err != nil {
+		return frame, err
+	}
+	dc.DrawImage(img, 0, 0)
+	out, err := encodeFrame(dc, frame.T, bbox["west"], bbox["south"], bbox["east"], bbox["north"])
+	if err != nil {
+		return frame, err
+	}
+	out.Bbox = bbox
+	return out, nil
+}
+
+// ComposeFrames composes every frame over the basemap.
+func (b *Basemap) ComposeFrames(frames []KmlResult) ([]KmlResult, error) {
+	out := make([]KmlResult, len(frames))
+	for i, f := range frames {
+		var err error
+		if out[i], err = b.Compose(f); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func basemapCmd(args []string) error {
+	fs := flag.NewFlagSet("basemap", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: hysplit-run basemap [flags] <frames.json>")
+		fmt.Fprintln(fs.Output(), "Draws the frames of a frames file over the basemap of -basemap-tiles and -basemap-shp.")
+		fs.PrintDefaults()
+	}
+	output := fs.String("o", ".", "output directory")
+	name := fs.String("name", "map", "base name of the PNG and frames files")
+	resolve := configFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected one frames file")
+	}
+	cfg, err := resolve()
+	if err != nil {
+		return err
+	}
+	b, err := LoadBasemap(cfg)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var frames []KmlResult
+	if err := json.Unmarshal(data, &frames); err != nil {
+		return fmt.Errorf("parsing %s: %v", fs.Arg(0), err)
+	}
+	if frames, err = b.ComposeFrames(frames); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*output, 0755); err != nil {
+		return err
+	}
+	written, err := writeFrames(frames, *output, *name)
+	for _, path := range written {
+		fmt.Println(path)
+	}
+	return err
+}
@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fogleman/gg"
+)
+
+// writeShapefile writes a .shp file of polygons, each a single ring.
+func writeShapefile(t *testing.T, path string, rings ...[][2]float64) {
+	t.Helper()
+	le := binary.LittleEndian
+	var records bytes.Buffer
+	for i, ring := range rings {
+		west, south, east, north := 180.0, 90.0, -180.0, -90.0
+		for _, p := range ring {
+			west, east = min(west, p[0]), max(east, p[0])
+			south, north = min(south, p[1]), max(north, p[1])
+		}
+		rec := make([]byte, 48+16*len(ring))
+		le.PutUint32(rec, 5)
+		for j, v := range []float64{west, south, east, north} {
+			le.PutUint64(rec[4+8*j:], math.Float64bits(v))
+		}
+		le.PutUint32(rec[36:], 1)
+		le.PutUint32(rec[40:], uint32(len(ring)))
+		for j, p := range ring {
+			le.PutUint64(rec[48+16*j:], math.Float64bits(p[0]))
+			le.PutUint64(rec[56+16*j:], math.Float64bits(p[1]))
+		}
+		binary.Write(&records, binary.BigEndian, [2]uint32{uint32(i + 1), uint32(len(rec) / 2)})
+		records.Write(rec)
+	}
+	header := make([]byte, 100)
+	binary.BigEndian.PutUint32(header, 9994)
+	binary.BigEndian.PutUint32(header[24:], uint32((100+records.Len())/2))
+	le.PutUint32(header[28:], 1000)
+	le.PutUint32(header[32:], 5)
+	if err := os.WriteFile(path, append(header, records.Bytes()...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadShapefile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "land.shp")
+	square := [][2]float64{{-106, 38}, {-104, 38}, {-104, 40}, {-106, 40}, {-106, 38}}
+	writeShapefile(t, path, square)
+
+	sf, err := ReadShapefile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sf.Shapes) != 1 || !sf.Shapes[0].Polygon || len(sf.Shapes[0].Parts) != 1 {
+		t.Fatalf("got shapes %+v, want one polygon of one ring", sf.Shapes)
+	}
+	if got := sf.Shapes[0].Parts[0]; len(got) != len(square) || got[2] != square[2] {
+		t.Errorf("ring = %v, want %v", got, square)
+	}
+	if !sf.Shapes[0].Intersects(-105, 39, -100, 45) || sf.Shapes[0].Intersects(-100, 39, -90, 45) {
+		t.Error("wrong bbox test")
+	}
+
+	os.WriteFile(filepath.Join(dir, "land.prj"), []byte(`PROJCS["WGS_1984_Web_Mercator"]`), 0644)
+	if _, err := ReadShapefile(path); err == nil {
+		t.Error("expected an error for projected coordinates")
+	}
+}
+
+func TestBasemapCompose(t *testing.T) {
+	dir := t.TempDir()
+	shp := filepath.Join(dir, "land.shp")
+	writeShapefile(t, shp, [][2]float64{{-110, 30}, {-100, 30}, {-100, 45}, {-110, 45}, {-110, 30}})
+
+	// A frame covering the east edge of the polygon, with one opaque
+	// pixel in the middle.
+	dc := gg.NewContext(64, 64)
+	dc.SetRGB(1, 0, 0)
+	dc.SetPixel(32, 32)
+	frame, err := encodeFrame(dc, 100, -105, 35, -95, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := LoadBasemap(Config{BasemapShapefiles: []string{shp}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := b.Compose(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.T != frame.T || out.Bbox["west"] != -105 {
+		t.Errorf("composed frame = %d %v, want the frame's time and bbox", out.T, out.Bbox)
+	}
+	img := decodeFrame(t, out)
+	at := func(x, y int) color.NRGBA { return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA) }
+	if got := at(32, 32); got != (color.NRGBA{255, 0, 0, 255}) {
+		t.Errorf("frame pixel = %v, want it drawn over the basemap", got)
+	}
+	if land, water := at(8, 16), at(56, 16); land == water || land.A != 255 || water.A != 255 {
+		t.Errorf("land %v and water %v should be opaque and differ", land, water)
+	}
+
+	if _, err := b.Compose(KmlResult{T: 1, Bbox: map[string]float64{"distanceKm": 10}}); err == nil {
+		t.Error("expected an error for a frame without a map bbox")
+	}
+	if _, err := LoadBasemap(Config{}); err == nil {
+		t.Error("expected an error without a basemap")
+	}
+	if _, err := LoadBasemap(Config{BasemapTiles: filepath.Join(dir, "world.mbtiles")}); err == nil {
+		t.Error("expected an error for a missing MBTiles file")
+	}
+}
+
+func TestBasemapTiles(t *testing.T) {
+	// The whole world as a single zoom 0 tile, green in the north and blue
+	// in the south.
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "0", "0"), 0755)
+	tile := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			c := color.NRGBA{0, 0, 255, 255}
+			if y < 128 {
+				c = color.NRGBA{0, 255, 0, 255}
+			}
+			tile.SetNRGBA(x, y, c)
+		}
+	}
+	f, err := os.Create(filepath.Join(dir, "0", "0", "0.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, tile)
+	f.Close()
+
+	b, err := LoadBasemap(Config{BasemapTiles: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(b.Tiles, filepath.Join("{z}", "{x}", "{y}.png")) {
+		t.Errorf("tile template = %q", b.Tiles)
+	}
+	// A window straddling the equator falls back to the zoom 0 tile.
+	out, err := b.Compose(KmlResult{T: 1, Bbox: map[string]float64{"west": 10, "south": -10, "east": 20, "north": 10},
+		Base64: mustEncodeEmpty(t, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := decodeFrame(t, out)
+	north := color.NRGBAModel.Convert(img.At(16, 4)).(color.NRGBA)
+	south := color.NRGBAModel.Convert(img.At(16, 28)).(color.NRGBA)
+	if north.G < 200 || south.B < 200 {
+		t.Errorf("north %v should be green and south %v blue", north, south)
+	}
+}
+
+// testMBTiles was written by sqlite3. Zoom 0 has the world of
+// TestBasemapTiles, zoom 1 only a red north-west tile and zoom 3 all 64
+// tiles. view.mbtiles has the map and images tables of mb-util, with the
+// red tile shared by the two northern tiles of zoom 1.
+const testMBTiles = "testdata/basemap/tiles.mbtiles"
+
+func TestMBTiles(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	check := func(m *MBTiles, z, x, y int, want color.NRGBA) {
+		t.Helper()
+		data, err := m.Tile(z, x, y)
+		if err != nil || data == nil {
+			t.Fatalf("%s: tile %d/%d/%d: %v", m.Path, z, x, y, err)
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := color.NRGBAModel.Convert(img.At(0, 0)); got != want {
+			t.Errorf("%s: tile %d/%d/%d = %v, want %v", m.Path, z, x, y, got, want)
+		}
+	}
+
+	m, err := OpenMBTiles(testMBTiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if m.Format != "png" {
+		t.Errorf("format %q", m.Format)
+	}
+	check(m, 1, 0, 0, red)
+	check(m, 3, 2, 7, color.NRGBA{64, 0, 128, 255}) // row 0 from the south
+	check(m, 3, 7, 0, color.NRGBA{224, 224, 128, 255})
+	if data, err := m.Tile(1, 0, 1); data != nil || err != nil {
+		t.Errorf("missing tile: %d bytes, %v", len(data), err)
+	}
+
+	v, err := OpenMBTiles("testdata/basemap/view.mbtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	check(v, 1, 0, 0, red)
+	check(v, 1, 1, 0, red)
+	if data, err := v.Tile(1, 1, 1); data != nil || err != nil {
+		t.Errorf("missing tile in the view: %d bytes, %v", len(data), err)
+	}
+
+	if _, err := OpenMBTiles(testARLFile); err == nil {
+		t.Error("expected an error for a file that is not SQLite")
+	}
+}
+
+// TestMBTilesWAL reads a tile that is still in the write-ahead log of a
+// database another connection is writing.
+func TestMBTilesWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.mbtiles")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	tile := []byte("a tile")
+	for _, stmt := range []string{
+		`PRAGMA journal_mode = WAL`,
+		`PRAGMA wal_autocheckpoint = 0`,
+		`CREATE TABLE metadata (name text, value text)`,
+		`CREATE TABLE tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	if _, err := db.Exec(`INSERT INTO tiles VALUES (0, 0, 0, ?)`, tile); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || bytes.Contains(data, tile) {
+		t.Fatalf("the tile should only be in the log: %v", err)
+	}
+
+	m, err := OpenMBTiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if data, err := m.Tile(0, 0, 0); err != nil || !bytes.Equal(data, tile) {
+		t.Errorf("tile from the WAL: %d bytes, %v", len(data), err)
+	}
+}
+
+func TestBasemapMBTiles(t *testing.T) {
+	b, err := LoadBasemap(Config{BasemapTiles: testMBTiles})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	// At zoom 3 the window spans the tiles of column 4 in rows 3 and 4 from
+	// the north, stored as rows 4 and 3 from the south.
+	frame := KmlResult{T: 1, Bbox: map[string]float64{"west": 10, "south": -10, "east": 20, "north": 10},
+		Base64: mustEncodeEmpty(t, 32)}
+	out, err := b.Compose(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := decodeFrame(t, out)
+	north := color.NRGBAModel.Convert(img.At(16, 4)).(color.NRGBA)
+	south := color.NRGBAModel.Convert(img.At(16, 28)).(color.NRGBA)
+	if north != (color.NRGBA{128, 128, 128, 255}) || south != (color.NRGBA{128, 96, 128, 255}) {
+		t.Errorf("north %v and south %v, want the zoom 3 tiles of rows 4 and 3", north, south)
+	}
+
+	// A smaller canvas needs zoom 1, where the file only has the north-west
+	// tile, so the world tile of zoom 0 is drawn.
+	frame.Base64 = mustEncodeEmpty(t, 8)
+	if out, err = b.Compose(frame); err != nil {
+		t.Fatal(err)
+	}
+	img = decodeFrame(t, out)
+	north = color.NRGBAModel.Convert(img.At(4, 0)).(color.NRGBA)
+	south = color.NRGBAModel.Convert(img.At(4, 7)).(color.NRGBA)
+	if north.G < 200 || south.B < 200 {
+		t.Errorf("north %v should be green and south %v blue", north, south)
+	}
+}
+
+func mustEncodeEmpty(t *testing.T, size int) string {
+	t.Helper()
+	f, err := encodeFrame(gg.NewContext(size, size), 0, 0, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Base64
+}
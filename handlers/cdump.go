@@ -0,0 +1,500 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- Types for cdump (binary concentration) files ---
+
+// Cdump is a concentration file written by hycs_std. It is stored as
+// big-endian Fortran unformatted records.
+type Cdump struct {
+	MetModel     string
+	MetTime      time.Time
+	ForecastHour int
+	Starts       []CdumpStart
+	NumLat       int
+	NumLon       int
+	DLat         float64
+	DLon         float64
+	Lat1         float64 // lower left corner
+	Lon1         float64
+	Levels       []int // heights (m agl)
+	Pollutants   []string
+	Packed       bool
+	Periods      []CdumpPeriod
+}
+
+type CdumpStart struct {
+	Time       time.Time
+	Latitude   float64
+	Longitude  float64
+	HeightMAgl float64
+}
+
+// CdumpPeriod is one sampling period. Conc is indexed
+// [pollutant][level][j*NumLon+i] where i is the longitude index and j the
+// latitude index, both from the lower left corner.
+type CdumpPeriod struct {
+	Start             time.Time
+	Stop              time.Time
+	StartForecastHour int
+	StopForecastHour  int
+	Conc              [][][]float32
+}
+
+// Lat returns the latitude of grid row j.
+func (c *Cdump) Lat(j int) float64 { return c.Lat1 + float64(j)*c.DLat }
+
+// Lon returns the longitude of grid column i.
+func (c *Cdump) Lon(i int) float64 { return c.Lon1 + float64(i)*c.DLon }
+
+// PollutantIndex returns the index of a pollutant id, or -1.
+func (c *Cdump) PollutantIndex(id string) int {
+	for i, p := range c.Pollutants {
+		if strings.EqualFold(strings.TrimSpace(p), strings.TrimSpace(id)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// LevelIndex returns the index of a level height, or -1.
+func (c *Cdump) LevelIndex(height int) int {
+	for i, l := range c.Levels {
+		if l == height {
+			return i
+		}
+	}
+	return -1
+}
+
+// SameGrid reports whether two files share grid, levels and pollutants, so
+// their fields can be combined cell by cell.
+func (c *Cdump) SameGrid(o *Cdump) bool {
+	if c.NumLat != o.NumLat || c.NumLon != o.NumLon ||
+		math.Abs(c.DLat-o.DLat) > 1e-6 || math.Abs(c.DLon-o.DLon) > 1e-6 ||
+		math.Abs(c.Lat1-o.Lat1) > 1e-6 || math.Abs(c.Lon1-o.Lon1) > 1e-6 ||
+		len(c.Levels) != len(o.Levels) || len(c.Pollutants) != len(o.Pollutants) {
+		return false
+	}
+	for i := range c.Levels {
+		if c.Levels[i] != o.Levels[i] {
+			return false
+		}
+	}
+	for i := range c.Pollutants {
+		if c.Pollutants[i] != o.Pollutants[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// NewPeriodLike returns an empty period with the same times as p, sized for
+// the grid of c.
+func (c *Cdump) NewPeriodLike(p CdumpPeriod) CdumpPeriod {
+	out := p
+	out.Conc = make([][][]float32, len(c.Pollutants))
+	for k := range out.Conc {
+		out.Conc[k] = make([][]float32, len(c.Levels))
+		for l := range out.Conc[k] {
+			out.Conc[k][l] = make([]float32, c.NumLat*c.NumLon)
+		}
+	}
+	return out
+}
+
+// CloneHeader returns a copy of c without any sampling periods.
+func (c *Cdump) CloneHeader() *Cdump {
+	out := *c
+	out.Starts = append([]CdumpStart(nil), c.Starts...)
+	out.Levels = append([]int(nil), c.Levels...)
+	out.Pollutants = append([]string(nil), c.Pollutants...)
+	out.Periods = nil
+	return &out
+}
+
+// ReadCdumpFile reads a binary concentration file.
+func ReadCdumpFile(path string) (*Cdump, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := ReadCdump(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// readRecord reads one Fortran unformatted sequential record.
+func readRecord(r io.Reader) ([]byte, error) {
+	var n int32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if n < 0 || n > 1<<30 {
+		return nil, fmt.Errorf("invalid record length %d", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var trailer int32
+	if err := binary.Read(r, binary.BigEndian, &trailer); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if trailer != n {
+		return nil, fmt.Errorf("record length mismatch (%d != %d)", n, trailer)
+	}
+	return buf, nil
+}
+
+// recordReader decodes big-endian values from a record.
+type recordReader struct {
+	buf []byte
+	err error
+}
+
+func (rr *recordReader) int32() int {
+	if rr.err != nil || len(rr.buf) < 4 {
+		rr.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := int32(binary.BigEndian.Uint32(rr.buf))
+	rr.buf = rr.buf[4:]
+	return int(v)
+}
+
+func (rr *recordReader) int16() int {
+	if rr.err != nil || len(rr.buf) < 2 {
+		rr.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := int16(binary.BigEndian.Uint16(rr.buf))
+	rr.buf = rr.buf[2:]
+	return int(v)
+}
+
+func (rr *recordReader) float32() float32 {
+	if rr.err != nil || len(rr.buf) < 4 {
+		rr.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := math.Float32frombits(binary.BigEndian.Uint32(rr.buf))
+	rr.buf = rr.buf[4:]
+	return v
+}
+
+func (rr *recordReader) chars(n int) string {
+	if rr.err != nil || len(rr.buf) < n {
+		rr.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	s := string(rr.buf[:n])
+	rr.buf = rr.buf[n:]
+	return s
+}
+
+// cdumpTime converts the year, month, day, hour, minute fields of a cdump.
+func cdumpTime(yy, mm, dd, hh, mi int) time.Time {
+	return tdumpTime(float64(yy), float64(mm), float64(dd), float64(hh), float64(mi))
+}
+
+// ReadCdump decodes a binary concentration file.
+func ReadCdump(r io.Reader) (*Cdump, error) {
+	c := &Cdump{}
+
+	// 1. Met model, met start time and number of starting locations.
+	rec, err := readRecord(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+	rr := &recordReader{buf: rec}
+	c.MetModel = strings.TrimSpace(rr.chars(4))
+	yy, mm, dd, hh := rr.int32(), rr.int32(), rr.int32(), rr.int32()
+	c.MetTime = cdumpTime(yy, mm, dd, hh, 0)
+	c.ForecastHour = rr.int32()
+	numStarts := rr.int32()
+	if len(rr.buf) >= 4 {
+		c.Packed = rr.int32() == 1
+	}
+	if rr.err != nil {
+		return nil, fmt.Errorf("reading header: %v", rr.err)
+	}
+
+	// 2. Starting locations.
+	for i := 0; i < numStarts; i++ {
+		if rec, err = readRecord(r); err != nil {
+			return nil, fmt.Errorf("reading starting location %d: %v", i+1, err)
+		}
+		rr = &recordReader{buf: rec}
+		yy, mm, dd, hh := rr.int32(), rr.int32(), rr.int32(), rr.int32()
+		s := CdumpStart{
+			Latitude:   float64(rr.float32()),
+			Longitude:  float64(rr.float32()),
+			HeightMAgl: float64(rr.float32()),
+		}
+		mi := 0
+		if len(rr.buf) >= 4 {
+			mi = rr.int32()
+		}
+		s.Time = cdumpTime(yy, mm, dd, hh, mi)
+		if rr.err != nil {
+			return nil, fmt.Errorf("reading starting location %d: %v", i+1, rr.err)
+		}
+		c.Starts = append(c.Starts, s)
+	}
+
+	// 3. Grid definition.
+	if rec, err = readRecord(r); err != nil {
+		return nil, fmt.Errorf("reading grid: %v", err)
+	}
+	rr = &recordReader{buf: rec}
+	c.NumLat, c.NumLon = rr.int32(), rr.int32()
+	c.DLat, c.DLon = float64(rr.float32()), float64(rr.float32())
+	c.Lat1, c.Lon1 = float64(rr.float32()), float64(rr.float32())
+	if rr.err != nil || c.NumLat <= 0 || c.NumLon <= 0 {
+		return nil, fmt.Errorf("invalid grid definition")
+	}
+
+	// 4. Vertical levels.
+	if rec, err = readRecord(r); err != nil {
+		return nil, fmt.Errorf("reading levels: %v", err)
+	}
+	rr = &recordReader{buf: rec}
+	numLevels := rr.int32()
+	for i := 0; i < numLevels; i++ {
+		c.Levels = append(c.Levels, rr.int32())
+	}
+	if rr.err != nil {
+		return nil, fmt.Errorf("reading levels: %v", rr.err)
+	}
+
+	// 5. Pollutant ids.
+	if rec, err = readRecord(r); err != nil {
+		return nil, fmt.Errorf("reading pollutants: %v", err)
+	}
+	rr = &recordReader{buf: rec}
+	numPollutants := rr.int32()
+	for i := 0; i < numPollutants; i++ {
+		c.Pollutants = append(c.Pollutants, rr.chars(4))
+	}
+	if rr.err != nil {
+		return nil, fmt.Errorf("reading pollutants: %v", rr.err)
+	}
+
+	// 6. Sampling periods until the end of the file.
+	cells := c.NumLat * c.NumLon
+	for {
+		rec, err = readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading period %d: %v", len(c.Periods)+1, err)
+		}
+		var p CdumpPeriod
+		rr = &recordReader{buf: rec}
+		yy, mm, dd, hh, mi := rr.int32(), rr.int32(), rr.int32(), rr.int32(), rr.int32()
+		p.Start, p.StartForecastHour = cdumpTime(yy, mm, dd, hh, mi), rr.int32()
+
+		if rec, err = readRecord(r); err != nil {
+			return nil, fmt.Errorf("reading period %d: %v", len(c.Periods)+1, err)
+		}
+		rr = &recordReader{buf: rec}
+		yy, mm, dd, hh, mi = rr.int32(), rr.int32(), rr.int32(), rr.int32(), rr.int32()
+		p.Stop, p.StopForecastHour = cdumpTime(yy, mm, dd, hh, mi), rr.int32()
+
+		p.Conc = make([][][]float32, numPollutants)
+		for k := 0; k < numPollutants; k++ {
+			p.Conc[k] = make([][]float32, numLevels)
+			for l := 0; l < numLevels; l++ {
+				if rec, err = readRecord(r); err != nil {
+					return nil, fmt.Errorf("reading period %d field: %v", len(c.Periods)+1, err)
+				}
+				rr = &recordReader{buf: rec}
+				rr.chars(4)
+				rr.int32()
+				field := make([]float32, cells)
+				if c.Packed {
+					n := rr.int32()
+					for e := 0; e < n; e++ {
+						i, j := rr.int16()-1, rr.int16()-1
+						v := rr.float32()
+						if i >= 0 && i < c.NumLon && j >= 0 && j < c.NumLat {
+							field[j*c.NumLon+i] = v
+						}
+					}
+				} else {
+					for e := 0; e < cells; e++ {
+						field[e] = rr.float32()
+					}
+				}
+				if rr.err != nil {
+					return nil, fmt.Errorf("reading period %d field: %v", len(c.Periods)+1, rr.err)
+				}
+				p.Conc[k][l] = field
+			}
+		}
+		c.Periods = append(c.Periods, p)
+	}
+
+	return c, nil
+}
+
+// recordWriter encodes big-endian values into a record.
+type recordWriter struct{ bytes.Buffer }
+
+func (rw *recordWriter) int32(v int)       { binary.Write(&rw.Buffer, binary.BigEndian, int32(v)) }
+func (rw *recordWriter) int16(v int)       { binary.Write(&rw.Buffer, binary.BigEndian, int16(v)) }
+func (rw *recordWriter) float32(v float32) { binary.Write(&rw.Buffer, binary.BigEndian, v) }
+func (rw *recordWriter) chars(s string, n int) {
+	rw.WriteString(fmt.Sprintf("%-*.*s", n, n, s))
+}
+
+func (rw *recordWriter) flush(w io.Writer) error {
+	n := int32(rw.Len())
+	if err := binary.Write(w, binary.BigEndian, n); err != nil {
+		return err
+	}
+	if _, err := w.Write(rw.Bytes()); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, n); err != nil {
+		return err
+	}
+	rw.Reset()
+	return nil
+}
+
+// WriteCdumpFile writes c as a binary concentration file readable by concplot
+// and the other HYSPLIT utilities.
+func WriteCdumpFile(path string, c *Cdump) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := WriteCdump(w, c); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WriteCdump encodes c in the cdump format. Fields are always written packed,
+// keeping only the non-zero cells.
+func WriteCdump(w io.Writer, c *Cdump) error {
+	rw := &recordWriter{}
+	yy := func(t time.Time) int { return t.Year() % 100 }
+
+	rw.chars(c.MetModel, 4)
+	rw.int32(yy(c.MetTime))
+	rw.int32(int(c.MetTime.Month()))
+	rw.int32(c.MetTime.Day())
+	rw.int32(c.MetTime.Hour())
+	rw.int32(c.ForecastHour)
+	rw.int32(len(c.Starts))
+	rw.int32(1)
+	if err := rw.flush(w); err != nil {
+		return err
+	}
+
+	for _, s := range c.Starts {
+		rw.int32(yy(s.Time))
+		rw.int32(int(s.Time.Month()))
+		rw.int32(s.Time.Day())
+		rw.int32(s.Time.Hour())
+		rw.float32(float32(s.Latitude))
+		rw.float32(float32(s.Longitude))
+		rw.float32(float32(s.HeightMAgl))
+		rw.int32(s.Time.Minute())
+		if err := rw.flush(w); err != nil {
+			return err
+		}
+	}
+
+	rw.int32(c.NumLat)
+	rw.int32(c.NumLon)
+	rw.float32(float32(c.DLat))
+	rw.float32(float32(c.DLon))
+	rw.float32(float32(c.Lat1))
+	rw.float32(float32(c.Lon1))
+	if err := rw.flush(w); err != nil {
+		return err
+	}
+
+	rw.int32(len(c.Levels))
+	for _, l := range c.Levels {
+		rw.int32(l)
+	}
+	if err := rw.flush(w); err != nil {
+		return err
+	}
+
+	rw.int32(len(c.Pollutants))
+	for _, p := range c.Pollutants {
+		rw.chars(p, 4)
+	}
+	if err := rw.flush(w); err != nil {
+		return err
+	}
+
+	for _, p := range c.Periods {
+		for _, t := range []struct {
+			time time.Time
+			fh   int
+		}{{p.Start, p.StartForecastHour}, {p.Stop, p.StopForecastHour}} {
+			rw.int32(yy(t.time))
+			rw.int32(int(t.time.Month()))
+			rw.int32(t.time.Day())
+			rw.int32(t.time.Hour())
+			rw.int32(t.time.Minute())
+			rw.int32(t.fh)
+			if err := rw.flush(w); err != nil {
+				return err
+			}
+		}
+
+		for k, pol := range c.Pollutants {
+			for l, level := range c.Levels {
+				field := p.Conc[k][l]
+				rw.chars(pol, 4)
+				rw.int32(level)
+				n := 0
+				for _, v := range field {
+					if v != 0 {
+						n++
+					}
+				}
+				rw.int32(n)
+				for e, v := range field {
+					if v != 0 {
+						rw.int16(e%c.NumLon + 1)
+						rw.int16(e/c.NumLon + 1)
+						rw.float32(v)
+					}
+				}
+				if err := rw.flush(w); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
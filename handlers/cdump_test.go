@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testCdump returns a 3x4 grid with two pollutants, two levels and two
+// sampling periods, with a few non-zero cells in each field.
+func testCdump() *Cdump {
+	start := time.Date(2025, 12, 1, 0, 30, 0, 0, time.UTC)
+	c := &Cdump{
+		MetModel:     "GFSQ",
+		MetTime:      time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC),
+		ForecastHour: 6,
+		Starts:       []CdumpStart{{Time: start, Latitude: 40.5, Longitude: -89.5, HeightMAgl: 100}},
+		NumLat:       3, NumLon: 4, DLat: 0.5, DLon: 0.25, Lat1: 40, Lon1: -90,
+		Levels:     []int{100, 500},
+		Pollutants: []string{"SOX ", "NOX "},
+		Packed:     true,
+	}
+	for h := 0; h < 2; h++ {
+		p := c.NewPeriodLike(CdumpPeriod{
+			Start:             start.Add(time.Duration(h) * 3 * time.Hour),
+			Stop:              start.Add(time.Duration(h+1) * 3 * time.Hour),
+			StartForecastHour: 3 * h,
+			StopForecastHour:  3 * (h + 1),
+		})
+		for k := range c.Pollutants {
+			for l := range c.Levels {
+				// The first and last cells mark the corners of the packed
+				// index, the middle one differs per field.
+				p.Conc[k][l][0] = float32(1 + h)
+				p.Conc[k][l][5+k+2*l] = float32(10*(k+1) + l)
+				p.Conc[k][l][c.NumLat*c.NumLon-1] = 1.5e-12
+			}
+		}
+		c.Periods = append(c.Periods, p)
+	}
+	return c
+}
+
+func TestCdumpRoundTrip(t *testing.T) {
+	c := testCdump()
+	var buf bytes.Buffer
+	if err := WriteCdump(&buf, c); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	got, err := ReadCdump(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, c) {
+		t.Errorf("round trip changed the file:\ngot  %+v\nwant %+v", got, c)
+	}
+
+	// Each packed field holds three cells of 8 bytes, not the twelve of the
+	// grid. Every record adds 8 bytes of length markers.
+	header := (32 + 8) + (32 + 8) + (24 + 8) + (12 + 8) + (12 + 8)
+	periods := len(c.Periods) * 2 * (24 + 8)
+	fields := len(c.Periods) * len(c.Pollutants) * len(c.Levels) * (12 + 3*8 + 8)
+	if want := header + periods + fields; len(data) != want {
+		t.Errorf("file is %d bytes, want %d", len(data), want)
+	}
+
+	if _, err := ReadCdump(bytes.NewReader(data[:len(data)-10])); err == nil {
+		t.Error("expected an error for a truncated file")
+	}
+}
+
+func TestReadCdumpUnpacked(t *testing.T) {
+	// A single field written the way hycs_std does without packing: every
+	// cell, row by row from the lower left corner.
+	var buf bytes.Buffer
+	rw := &recordWriter{}
+	rw.chars("NAM", 4)
+	for _, v := range []int{25, 12, 1, 0, 0, 0, 0} {
+		rw.int32(v)
+	}
+	rw.flush(&buf)
+	rw.int32(2)
+	rw.int32(3)
+	for _, v := range []float32{1, 1, 40, -90} {
+		rw.float32(v)
+	}
+	rw.flush(&buf)
+	rw.int32(1)
+	rw.int32(0)
+	rw.flush(&buf)
+	rw.int32(1)
+	rw.chars("TEST", 4)
+	rw.flush(&buf)
+	for _, h := range []int{0, 1} {
+		for _, v := range []int{25, 12, 1, h, 0, h} {
+			rw.int32(v)
+		}
+		rw.flush(&buf)
+	}
+	rw.chars("TEST", 4)
+	rw.int32(0)
+	for e := 0; e < 6; e++ {
+		rw.float32(float32(e))
+	}
+	rw.flush(&buf)
+
+	c, err := ReadCdump(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Packed || c.MetModel != "NAM" || len(c.Periods) != 1 || c.Levels[0] != 0 {
+		t.Fatalf("header = %+v", c)
+	}
+	want := []float32{0, 1, 2, 3, 4, 5}
+	if got := c.Periods[0].Conc[0][0]; !reflect.DeepEqual(got, want) {
+		t.Errorf("field = %v, want %v", got, want)
+	}
+	if p := c.Periods[0]; !p.Stop.Equal(time.Date(2025, 12, 1, 1, 0, 0, 0, time.UTC)) || p.StopForecastHour != 1 {
+		t.Errorf("period %s-%s", p.Start, p.Stop)
+	}
+}
@@ -0,0 +1,158 @@
+// Package handlers builds HYSPLIT model inputs from JSON payloads, runs the
+// model in per-job working directories and post-processes its output. Main
+// is the hysplit-run command line; each group of subcommands lives in a
+// *_cmd.go file next to the feature it drives.
+package handlers
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const usage = `Usage: hysplit-run <command> [flags] <json_payload_file>
+
+Commands:
+  generate  write CONTROL, SETUP.CFG and EMITIMES for a payload
+  run       run the model in the job's isolated working directory
+  plot      convert the model output to KML, PNG or GeoJSON
+  all       generate, run and plot in one go
+  ensemble  expand an ensemble payload into member jobs and optionally run them
+  ensemble-stats
+            mean, max, percentiles and exceedance probability over ensemble members
+  transfer  write unit-release runs per source and period for a transfer coefficient matrix
+  transfer-apply
+            evaluate the payload's emission scenarios from a transfer coefficient matrix
+  timeseries
+            concentration time series at receptor points from a cdump
+  matrix    per-source contributions at receptors from a matrix run cdump
+  evaluate  score a cdump against measured concentrations
+  source-estimate
+            locate a source and its emission rate from backward footprints
+  cluster   cluster trajectories from tdump files into typical airflow patterns
+  trajfreq  grid the frequency (or residence time) of trajectories from tdump files
+  metcatalog
+            list the ARL met files of the met catalog, or those picked for a payload
+  metprofile
+            vertical profile and surface meteorology at a point from ARL files
+  wind      render wind barbs or streamlines from ARL files as overlay PNG frames
+  particles render particle positions from a PARDUMP file as plan view and cross-section frames
+  parinit   write a PARINIT file from one time of a PARDUMP file
+  section   render concentration against height along a polyline or a trajectory
+  basemap   draw rendered frames over an offline basemap of tiles or shapefiles
+
+Run "hysplit-run <command> -h" for the flags of a command.
+A payload file given without a command prints its CONTROL file.
+`
+
+// Main runs the hysplit-run command line with the arguments after the
+// program name and returns the exit status.
+func Main(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, usage)
+		return 1
+	}
+
+	var err error
+	switch cmd, cmdArgs := args[0], args[1:]; cmd {
+	case "generate":
+		err = generateCmd(cmdArgs)
+	case "run":
+		err = runCmd(cmdArgs)
+	case "plot":
+		err = plotCmd(cmdArgs)
+	case "all":
+		err = allCmd(cmdArgs)
+	case "ensemble":
+		err = ensembleCmd(cmdArgs)
+	case "ensemble-stats":
+		err = ensembleStatsCmd(cmdArgs)
+	case "transfer":
+		err = transferCmd(cmdArgs)
+	case "transfer-apply":
+		err = transferApplyCmd(cmdArgs)
+	case "timeseries":
+		err = timeSeriesCmd(cmdArgs)
+	case "matrix":
+		err = matrixCmd(cmdArgs)
+	case "evaluate":
+		err = evaluateCmd(cmdArgs)
+	case "source-estimate":
+		err = sourceEstimateCmd(cmdArgs)
+	case "cluster":
+		err = clusterCmd(cmdArgs)
+	case "trajfreq":
+		err = trajFreqCmd(cmdArgs)
+	case "metcatalog":
+		err = metCatalogCmd(cmdArgs)
+	case "metprofile":
+		err = metProfileCmd(cmdArgs)
+	case "wind":
+		err = windCmd(cmdArgs)
+	case "particles":
+		err = particlesCmd(cmdArgs)
+	case "parinit":
+		err = parinitCmd(cmdArgs)
+	case "section":
+		err = sectionCmd(cmdArgs)
+	case "basemap":
+		err = basemapCmd(cmdArgs)
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		// Backwards compatible form: hysplit-run <json_payload_file>
+		err = generateCmd(args)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func loadPayload(filePath string) (Payload, error) {
+	var payload Payload
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return payload, fmt.Errorf("reading file: %v", err)
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return payload, fmt.Errorf("parsing JSON: %v", err)
+	}
+	return payload, nil
+}
+
+// parseCommand parses the flags of a subcommand and loads its payload.
+func parseCommand(fs *flag.FlagSet, args []string, resolve func() (Config, error)) (Config, Payload, error) {
+	if err := fs.Parse(args); err != nil {
+		return Config{}, Payload{}, err
+	}
+	if fs.NArg() != 1 {
+		return Config{}, Payload{}, fmt.Errorf("%s: expected exactly one payload file", fs.Name())
+	}
+	cfg, err := resolve()
+	if err != nil {
+		return cfg, Payload{}, err
+	}
+	payload, err := loadPayload(fs.Arg(0))
+	return cfg, payload, err
+}
+
+// parseFloatList parses a comma separated list of numbers.
+func parseFloatList(s string) ([]float64, error) {
+	var values []float64
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
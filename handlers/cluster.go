@@ -0,0 +1,534 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ClusterOptions controls trajectory clustering.
+type ClusterOptions struct {
+	// Method is "tsv" (HYSPLIT style agglomeration that always merges the
+	// pair adding the least total spatial variance) or "kmeans".
+	Method string
+	// Clusters is the number of clusters to report.
+	Clusters int
+	// Hours is the common length trajectories are resampled to. Shorter
+	// trajectories are skipped. 0 uses the shortest trajectory.
+	Hours int
+	// MaxClusters is the largest cluster count on the change curve
+	// (default 10).
+	MaxClusters int
+}
+
+// ClusterMember is one clustered trajectory.
+type ClusterMember struct {
+	Source     string    `json:"source"`     // tdump file the trajectory came from
+	Trajectory int       `json:"trajectory"` // trajectory index within the file
+	Start      time.Time `json:"start"`
+	Cluster    int       `json:"cluster"`
+}
+
+// TrajectoryCluster is one cluster with its mean trajectory. SPV is the
+// spatial variance of its members around the mean, in km².
+type TrajectoryCluster struct {
+	Id      int               `json:"id"`
+	Size    int               `json:"size"`
+	Percent float64           `json:"percent"`
+	SPV     float64           `json:"spv"`
+	Mean    []TrajectoryPoint `json:"mean"`
+}
+
+// TSVStep is one point of the change curve: the total spatial variance with
+// the given number of clusters, and its percent increase over one cluster
+// more. A large jump means two distinct clusters were just merged.
+type TSVStep struct {
+	Clusters      int     `json:"clusters"`
+	TSV           float64 `json:"tsv"`
+	PercentChange float64 `json:"percentChange"`
+}
+
+type ClusterResult struct {
+	Method      string              `json:"method"`
+	Hours       int                 `json:"hours"`
+	Direction   string              `json:"direction"`
+	TSV         float64             `json:"tsv"`
+	Skipped     int                 `json:"skipped"` // trajectories shorter than Hours
+	Clusters    []TrajectoryCluster `json:"clusters"`
+	Members     []ClusterMember     `json:"members"`
+	ChangeCurve []TSVStep           `json:"changeCurve"`
+}
+
+// resampledTrajectory holds the hourly positions of a trajectory, in
+// degrees and as a km vector on a common local projection.
+type resampledTrajectory struct {
+	member ClusterMember
+	points []TrajectoryPoint
+	vec    []float64
+}
+
+// resampleTrajectory interpolates a trajectory to one point per hour of
+// age, from 0 to hours. It returns false if the trajectory is too short.
+func resampleTrajectory(traj Trajectory, hours int) ([]TrajectoryPoint, bool) {
+	pts := append([]TrajectoryPoint(nil), traj.Points...)
+	sort.Slice(pts, func(a, b int) bool { return math.Abs(pts[a].Age) < math.Abs(pts[b].Age) })
+	if len(pts) == 0 || math.Abs(pts[len(pts)-1].Age) < float64(hours) {
+		return nil, false
+	}
+	sign := 1.0
+	if pts[len(pts)-1].Age < 0 {
+		sign = -1
+	}
+	out := make([]TrajectoryPoint, 0, hours+1)
+	k := 0
+	for h := 0; h <= hours; h++ {
+		age := float64(h)
+		for k < len(pts)-2 && math.Abs(pts[k+1].Age) < age {
+			k++
+		}
+		a, b := pts[k], pts[min(k+1, len(pts)-1)]
+		f := 0.0
+		if da := math.Abs(b.Age) - math.Abs(a.Age); da > 0 {
+			f = (age - math.Abs(a.Age)) / da
+		}
+		out = append(out, TrajectoryPoint{
+			Time:      traj.Start.Time.Add(time.Duration(sign*age) * time.Hour),
+			Age:       sign * age,
+			Latitude:  a.Latitude + (b.Latitude-a.Latitude)*f,
+			Longitude: a.Longitude + (b.Longitude-a.Longitude)*f,
+			Height:    a.Height + (b.Height-a.Height)*f,
+		})
+	}
+	return out, true
+}
+
+// ClusterTrajectories groups the trajectories of several tdump files into
+// typical airflow patterns. sources names each tdump in the membership
+// report. Distances are horizontal, between endpoints of the same age, on
+// an equirectangular projection centred on the mean start latitude.
+func ClusterTrajectories(sources []string, tdumps []*Tdump, opts ClusterOptions) (*ClusterResult, error) {
+	method := strings.ToLower(opts.Method)
+	if method == "" {
+		method = "tsv"
+	}
+	if method != "tsv" && method != "kmeans" {
+		return nil, fmt.Errorf("unknown clustering method %q (want tsv or kmeans)", opts.Method)
+	}
+	maxK := opts.MaxClusters
+	if maxK <= 0 {
+		maxK = 10
+	}
+
+	hours := opts.Hours
+	if hours <= 0 {
+		hours = math.MaxInt
+		for _, td := range tdumps {
+			for _, traj := range td.Trajectories {
+				longest := 0.0
+				for _, p := range traj.Points {
+					longest = max(longest, math.Abs(p.Age))
+				}
+				hours = min(hours, int(longest))
+			}
+		}
+		if hours == math.MaxInt || hours == 0 {
+			return nil, fmt.Errorf("trajectories have no duration")
+		}
+	}
+
+	result := &ClusterResult{Method: method, Hours: hours}
+	var trajs []resampledTrajectory
+	latSum := 0.0
+	for i, td := range tdumps {
+		if result.Direction == "" {
+			result.Direction = td.Direction
+		}
+		for _, traj := range td.Trajectories {
+			pts, ok := resampleTrajectory(traj, hours)
+			if !ok {
+				result.Skipped++
+				continue
+			}
+			trajs = append(trajs, resampledTrajectory{
+				member: ClusterMember{Source: sources[i], Trajectory: traj.Index, Start: traj.Start.Time},
+				points: pts,
+			})
+			latSum += pts[0].Latitude
+		}
+	}
+	n := len(trajs)
+	if n == 0 {
+		return nil, fmt.Errorf("no trajectories of at least %d hours", hours)
+	}
+	k := opts.Clusters
+	if k <= 0 || k > n {
+		return nil, fmt.Errorf("cluster count must be between 1 and %d", n)
+	}
+	maxK = min(max(maxK, k), n)
+
+	const earthRadiusKm = 6371.0
+	cosLat := math.Cos(latSum / float64(n) * math.Pi / 180)
+	for t := range trajs {
+		vec := make([]float64, 0, 2*len(trajs[t].points))
+		for _, p := range trajs[t].points {
+			vec = append(vec,
+				earthRadiusKm*p.Longitude*math.Pi/180*cosLat,
+				earthRadiusKm*p.Latitude*math.Pi/180)
+		}
+		trajs[t].vec = vec
+	}
+	vecs := make([][]float64, n)
+	for t := range trajs {
+		vecs[t] = trajs[t].vec
+	}
+
+	var labels []int
+	tsv := make(map[int]float64)
+	if method == "tsv" {
+		labels = agglomerate(vecs, k, tsv)
+	} else {
+		for c := 1; c <= maxK; c++ {
+			l := kmeans(vecs, c)
+			tsv[c] = totalSpatialVariance(vecs, l, c)
+			if c == k {
+				labels = l
+			}
+		}
+		if maxK < n {
+			// One more count for the percent change of the last step.
+			tsv[maxK+1] = totalSpatialVariance(vecs, kmeans(vecs, maxK+1), maxK+1)
+		}
+	}
+	for c := maxK; c >= 1; c-- {
+		step := TSVStep{Clusters: c, TSV: tsv[c]}
+		if prev, ok := tsv[c+1]; ok && prev > 0 {
+			step.PercentChange = (tsv[c] - prev) / prev * 100
+		}
+		result.ChangeCurve = append(result.ChangeCurve, step)
+	}
+
+	// Number clusters by size, largest first.
+	sizes := make([]int, k)
+	for _, l := range labels {
+		sizes[l]++
+	}
+	order := make([]int, k)
+	for c := range order {
+		order[c] = c
+	}
+	sort.SliceStable(order, func(a, b int) bool { return sizes[order[a]] > sizes[order[b]] })
+	id := make([]int, k)
+	for rank, c := range order {
+		id[c] = rank + 1
+	}
+
+	result.Clusters = make([]TrajectoryCluster, k)
+	for rank, c := range order {
+		cl := TrajectoryCluster{
+			Id:      rank + 1,
+			Size:    sizes[c],
+			Percent: 100 * float64(sizes[c]) / float64(n),
+			Mean:    make([]TrajectoryPoint, hours+1),
+		}
+		var first time.Time
+		for t := range trajs {
+			if labels[t] != c {
+				continue
+			}
+			if first.IsZero() || trajs[t].member.Start.Before(first) {
+				first = trajs[t].member.Start
+			}
+			for h, p := range trajs[t].points {
+				m := &cl.Mean[h]
+				m.Age = p.Age
+				m.Latitude += p.Latitude / float64(sizes[c])
+				m.Longitude += p.Longitude / float64(sizes[c])
+				m.Height += p.Height / float64(sizes[c])
+			}
+		}
+		// Mean trajectories are timed from their earliest member.
+		for h := range cl.Mean {
+			cl.Mean[h].Time = first.Add(time.Duration(cl.Mean[h].Age) * time.Hour)
+		}
+		result.Clusters[rank] = cl
+	}
+
+	centroids := clusterCentroids(vecs, labels, k)
+	for t := range trajs {
+		c := labels[t]
+		trajs[t].member.Cluster = id[c]
+		spv := squaredDistance(vecs[t], centroids[c])
+		result.Clusters[id[c]-1].SPV += spv
+		result.TSV += spv
+		result.Members = append(result.Members, trajs[t].member)
+	}
+	return result, nil
+}
+
+// MeanTrajectories returns the cluster means as a tdump so they can be
+// converted and rendered like model output.
+func (r *ClusterResult) MeanTrajectories() *Tdump {
+	td := &Tdump{Direction: r.Direction}
+	for _, c := range r.Clusters {
+		if len(c.Mean) == 0 {
+			continue
+		}
+		start := c.Mean[0]
+		td.Trajectories = append(td.Trajectories, Trajectory{
+			Index: c.Id,
+			Start: TrajectoryStart{
+				Time:       start.Time,
+				Latitude:   start.Latitude,
+				Longitude:  start.Longitude,
+				HeightMAgl: start.Height,
+			},
+			Points: c.Mean,
+		})
+	}
+	return td
+}
+
+func squaredDistance(a, b []float64) float64 {
+	d := 0.0
+	for i := range a {
+		d += (a[i] - b[i]) * (a[i] - b[i])
+	}
+	return d
+}
+
+func clusterCentroids(vecs [][]float64, labels []int, k int) [][]float64 {
+	centroids := make([][]float64, k)
+	counts := make([]int, k)
+	for c := range centroids {
+		centroids[c] = make([]float64, len(vecs[0]))
+	}
+	for t, v := range vecs {
+		counts[labels[t]]++
+		for i, x := range v {
+			centroids[labels[t]][i] += x
+		}
+	}
+	for c := range centroids {
+		for i := range centroids[c] {
+			if counts[c] > 0 {
+				centroids[c][i] /= float64(counts[c])
+			}
+		}
+	}
+	return centroids
+}
+
+func totalSpatialVariance(vecs [][]float64, labels []int, k int) float64 {
+	centroids := clusterCentroids(vecs, labels, k)
+	tsv := 0.0
+	for t, v := range vecs {
+		tsv += squaredDistance(v, centroids[labels[t]])
+	}
+	return tsv
+}
+
+// agglomerate starts with every trajectory in its own cluster and keeps
+// merging the pair whose merge adds the least total spatial variance
+// (Ward's criterion), until one cluster is left. It records the TSV for
+// every cluster count in tsv and returns the labels at k clusters.
+func agglomerate(vecs [][]float64, k int, tsv map[int]float64) []int {
+	n := len(vecs)
+	size := make([]int, n)
+	active := make([]bool, n)
+	parent := make([]int, n)
+	// cost[i][j] is the TSV increase of merging clusters i and j.
+	cost := make([][]float64, n)
+	for i := range vecs {
+		size[i], active[i], parent[i] = 1, true, i
+		cost[i] = make([]float64, n)
+		for j := 0; j < i; j++ {
+			cost[i][j] = squaredDistance(vecs[i], vecs[j]) / 2
+			cost[j][i] = cost[i][j]
+		}
+	}
+
+	labelsAt := func() []int {
+		ids := make(map[int]int)
+		labels := make([]int, n)
+		for t := range labels {
+			r := t
+			for parent[r] != r {
+				r = parent[r]
+			}
+			if _, ok := ids[r]; !ok {
+				ids[r] = len(ids)
+			}
+			labels[t] = ids[r]
+		}
+		return labels
+	}
+
+	var labels []int
+	total := 0.0
+	tsv[n] = 0
+	if k == n {
+		labels = labelsAt()
+	}
+	for clusters := n; clusters > 1; clusters-- {
+		bi, bj := -1, -1
+		for i := 0; i < n; i++ {
+			if !active[i] {
+				continue
+			}
+			for j := i + 1; j < n; j++ {
+				if active[j] && (bi < 0 || cost[i][j] < cost[bi][bj]) {
+					bi, bj = i, j
+				}
+			}
+		}
+		total += cost[bi][bj]
+		// Lance-Williams update of the Ward cost for the merged cluster.
+		for m := 0; m < n; m++ {
+			if !active[m] || m == bi || m == bj {
+				continue
+			}
+			nm, ni, nj := float64(size[m]), float64(size[bi]), float64(size[bj])
+			c := ((nm+ni)*cost[m][bi] + (nm+nj)*cost[m][bj] - nm*cost[bi][bj]) / (nm + ni + nj)
+			cost[m][bi], cost[bi][m] = c, c
+		}
+		size[bi] += size[bj]
+		active[bj] = false
+		parent[bj] = bi
+		tsv[clusters-1] = total
+		if clusters-1 == k {
+			labels = labelsAt()
+		}
+	}
+	return labels
+}
+
+// kmeans runs Lloyd's algorithm from a deterministic farthest-point start,
+// so repeated runs give the same clusters.
+func kmeans(vecs [][]float64, k int) []int {
+	n := len(vecs)
+	centers := [][]float64{append([]float64(nil), vecs[0]...)}
+	nearest := make([]float64, n)
+	for t := range nearest {
+		nearest[t] = squaredDistance(vecs[t], centers[0])
+	}
+	for len(centers) < k {
+		far := 0
+		for t := range nearest {
+			if nearest[t] > nearest[far] {
+				far = t
+			}
+		}
+		centers = append(centers, append([]float64(nil), vecs[far]...))
+		for t := range nearest {
+			nearest[t] = min(nearest[t], squaredDistance(vecs[t], vecs[far]))
+		}
+	}
+
+	labels := make([]int, n)
+	for iter := 0; iter < 100; iter++ {
+		changed := iter == 0
+		for t, v := range vecs {
+			best := 0
+			for c := 1; c < k; c++ {
+				if squaredDistance(v, centers[c]) < squaredDistance(v, centers[best]) {
+					best = c
+				}
+			}
+			if labels[t] != best {
+				labels[t] = best
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+		updated := clusterCentroids(vecs, labels, k)
+		for c := range centers {
+			// Keep the old center of a cluster that lost all members.
+			for _, l := range labels {
+				if l == c {
+					centers[c] = updated[c]
+					break
+				}
+			}
+		}
+	}
+	return labels
+}
+
+// writeClusterResult writes the clustering report into dir: clusters.json
+// with everything, CLUSLIST.tsv with the membership, TSVchange.tsv with the
+// change curve and the cluster means in the requested formats.
+func writeClusterResult(r *ClusterResult, dir string, formats []string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var written []string
+	write := func(name string, data []byte) error {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+		written = append(written, path)
+		return nil
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return written, err
+	}
+	if err := write("clusters.json", data); err != nil {
+		return written, err
+	}
+
+	var sb strings.Builder
+	sb.WriteString("cluster\tsource\ttrajectory\tstart\n")
+	for _, m := range r.Members {
+		sb.WriteString(fmt.Sprintf("%d\t%s\t%d\t%s\n", m.Cluster, m.Source, m.Trajectory, m.Start.Format(time.RFC3339)))
+	}
+	if err := write("CLUSLIST.tsv", []byte(sb.String())); err != nil {
+		return written, err
+	}
+
+	sb.Reset()
+	sb.WriteString("clusters\ttsv\tpercent_change\n")
+	for _, s := range r.ChangeCurve {
+		sb.WriteString(fmt.Sprintf("%d\t%.1f\t%.2f\n", s.Clusters, s.TSV, s.PercentChange))
+	}
+	if err := write("TSVchange.tsv", []byte(sb.String())); err != nil {
+		return written, err
+	}
+
+	means := r.MeanTrajectories()
+	for _, format := range formats {
+		switch strings.ToLower(strings.TrimSpace(format)) {
+		case "":
+		case "geojson":
+			data, err := json.MarshalIndent(TdumpToGeoJSON(means), "", "  ")
+			if err != nil {
+				return written, err
+			}
+			if err := write("cluster_means.geojson", data); err != nil {
+				return written, err
+			}
+		case "png":
+			frame, err := RenderTrajectories(means)
+			if err != nil {
+				return written, err
+			}
+			files, err := writeFrames([]KmlResult{frame}, dir, "cluster_means")
+			written = append(written, files...)
+			if err != nil {
+				return written, err
+			}
+		default:
+			return written, fmt.Errorf("unknown format %q (want geojson or png)", format)
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func clusterCmd(args []string) error {
+	fs := flag.NewFlagSet("cluster", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: hysplit-run cluster [flags] <tdump>...")
+		fs.PrintDefaults()
+	}
+	method := fs.String("method", "tsv", "tsv (total spatial variance) or kmeans")
+	clusters := fs.Int("k", 4, "number of clusters")
+	hours := fs.Int("hours", 0, "common trajectory length in hours (default: shortest trajectory)")
+	maxClusters := fs.Int("max-k", 10, "largest cluster count on the TSV change curve")
+	output := fs.String("o", "cluster", "output directory")
+	formats := fs.String("format", "geojson", "render the cluster means: geojson, png")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no tdump files given")
+	}
+
+	var tdumps []*Tdump
+	for _, path := range fs.Args() {
+		td, err := ReadTdumpFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		tdumps = append(tdumps, td)
+	}
+	result, err := ClusterTrajectories(fs.Args(), tdumps, ClusterOptions{
+		Method:      *method,
+		Clusters:    *clusters,
+		Hours:       *hours,
+		MaxClusters: *maxClusters,
+	})
+	if err != nil {
+		return err
+	}
+	if result.Skipped > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped %d trajectories shorter than %d hours\n", result.Skipped, result.Hours)
+	}
+
+	written, err := writeClusterResult(result, *output, strings.Split(*formats, ","))
+	for _, path := range written {
+		fmt.Println(path)
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestClusterTrajectories(t *testing.T) {
+	// Three trajectories heading east and two heading north from 40 N 90 W,
+	// each a little apart, and one too short to cluster.
+	start := time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC)
+	td := &Tdump{MetModels: []string{"GFSQ"}, Direction: "FORWARD"}
+	add := func(dLat, dLon, spread float64, hours int) {
+		traj := Trajectory{Index: len(td.Trajectories) + 1, Start: TrajectoryStart{Time: start, Latitude: 40, Longitude: -90}}
+		for h := 0; h <= hours; h++ {
+			traj.Points = append(traj.Points, TrajectoryPoint{
+				Time: start.Add(time.Duration(h) * time.Hour), Age: float64(h),
+				Latitude:  40 + (dLat+spread)*float64(h),
+				Longitude: -90 + (dLon+spread)*float64(h),
+				Height:    500,
+			})
+		}
+		td.Trajectories = append(td.Trajectories, traj)
+	}
+	add(0, 1, 0, 4)
+	add(0, 1, 0.05, 4)
+	add(0, 1, -0.05, 4)
+	add(1, 0, 0, 4)
+	add(1, 0, 0.05, 4)
+	add(1, 0, 0, 1)
+
+	for _, method := range []string{"tsv", "kmeans"} {
+		r, err := ClusterTrajectories([]string{"tdump"}, []*Tdump{td}, ClusterOptions{Method: method, Clusters: 2, Hours: 4, MaxClusters: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Skipped != 1 || len(r.Members) != 5 || len(r.Clusters) != 2 {
+			t.Fatalf("%s: %d skipped, %d members, %d clusters", method, r.Skipped, len(r.Members), len(r.Clusters))
+		}
+		// The larger, eastward cluster is numbered first.
+		for _, m := range r.Members {
+			if want := 1 + m.Trajectory/4; m.Cluster != want {
+				t.Errorf("%s: trajectory %d in cluster %d, want %d", method, m.Trajectory, m.Cluster, want)
+			}
+		}
+		east, north := r.Clusters[0], r.Clusters[1]
+		if east.Size != 3 || east.Percent != 60 || north.Size != 2 {
+			t.Errorf("%s: cluster sizes %d and %d", method, east.Size, north.Size)
+		}
+		if end := east.Mean[4]; math.Abs(end.Longitude+86) > 1e-9 || math.Abs(end.Latitude-40) > 1e-9 {
+			t.Errorf("%s: east mean ends at %g,%g, want 40,-86", method, end.Latitude, end.Longitude)
+		}
+		if end := north.Mean[4]; math.Abs(end.Latitude-44.1) > 1e-9 || !end.Time.Equal(start.Add(4*time.Hour)) {
+			t.Errorf("%s: north mean ends at %g at %s", method, end.Latitude, end.Time)
+		}
+		if math.Abs(r.TSV-east.SPV-north.SPV) > 1e-6*r.TSV {
+			t.Errorf("%s: TSV %g is not the sum of the cluster SPVs", method, r.TSV)
+		}
+		// Merging the two directions into one cluster multiplies the TSV.
+		curve := r.ChangeCurve
+		if len(curve) != 3 || curve[2].Clusters != 1 || curve[2].PercentChange < 1000 || curve[1].TSV != r.TSV {
+			t.Errorf("%s: change curve %+v", method, curve)
+		}
+	}
+
+	if _, err := ClusterTrajectories([]string{"tdump"}, []*Tdump{td}, ClusterOptions{Clusters: 6, Hours: 4}); err == nil {
+		t.Error("expected an error for more clusters than trajectories")
+	}
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Config holds the locations hysplit-run needs outside of the payload.
+// Values are resolved from, in increasing priority: defaults, a JSON config
+// file, environment variables and command line flags.
+type Config struct {
+	ExecDir   string `json:"execDir"`   // hycs_std, hyts_std, concplot, trajplot
+	BdyDir    string `json:"bdyDir"`    // ASCDATA.CFG and land use files
+	WorkRoot  string `json:"workRoot"`  // one isolated working directory per job
+	MetDir    string `json:"metDir"`    // used for met files without a directory
+	OutputDir string `json:"outputDir"` // used when the payload has no output directory
+
+	MetCatalogDirs []string `json:"metCatalogDirs"` // scanned for payloads with "met"; defaults to MetDir
+
+	BasemapTiles      string   `json:"basemapTiles"`      // XYZ tile directory or {z}/{x}/{y} path template
+	BasemapShapefiles []string `json:"basemapShapefiles"` // coastline and boundary shapefiles
+}
+
+func defaultConfig() Config {
+	return Config{
+		ExecDir:  filepath.Join("programfiles", "hysplit", "exec"),
+		BdyDir:   filepath.Join("programfiles", "hysplit", "bdyfiles"),
+		WorkRoot: "jobs",
+	}
+}
+
+// configFlags registers the shared configuration flags on fs. The returned
+// function resolves the final Config once fs has been parsed.
+func configFlags(fs *flag.FlagSet) func() (Config, error) {
+	configPath := fs.String("config", os.Getenv("HYSPLIT_RUN_CONFIG"), "JSON config file (env HYSPLIT_RUN_CONFIG)")
+	execDir := fs.String("exec-dir", "", "HYSPLIT executables directory (env HYSPLIT_EXEC_DIR)")
+	bdyDir := fs.String("bdy-dir", "", "HYSPLIT bdyfiles directory (env HYSPLIT_BDY_DIR)")
+	workRoot := fs.String("work-root", "", "root of per-job working directories (env HYSPLIT_JOBS_DIR)")
+	metDir := fs.String("met-dir", "", "default met file directory (env HYSPLIT_MET_DIR)")
+	outputDir := fs.String("output-dir", "", "default output directory (env HYSPLIT_OUTPUT_DIR)")
+	metCatalog := fs.String("met-catalog", "", "met catalog directories, separated by "+string(os.PathListSeparator)+" (env HYSPLIT_MET_CATALOG)")
+	basemapTiles := fs.String("basemap-tiles", "", "offline basemap XYZ tile directory, {z}/{x}/{y} template or MBTiles file (env HYSPLIT_BASEMAP_TILES)")
+	basemapShp := fs.String("basemap-shp", "", "offline basemap shapefiles, separated by "+string(os.PathListSeparator)+" (env HYSPLIT_BASEMAP_SHP)")
+
+	return func() (Config, error) {
+		cfg := defaultConfig()
+
+		if *configPath != "" {
+			data, err := os.ReadFile(*configPath)
+			if err != nil {
+				return cfg, fmt.Errorf("reading config: %v", err)
+			}
+			if err := json.Unmarshal(data, &cfg); err != nil {
+				return cfg, fmt.Errorf("parsing config %s: %v", *configPath, err)
+			}
+		}
+
+		override := func(dst *string, env, flagValue string) {
+			if v := os.Getenv(env); v != "" {
+				*dst = v
+			}
+			if flagValue != "" {
+				*dst = flagValue
+			}
+		}
+		override(&cfg.ExecDir, "HYSPLIT_EXEC_DIR", *execDir)
+		override(&cfg.BdyDir, "HYSPLIT_BDY_DIR", *bdyDir)
+		override(&cfg.WorkRoot, "HYSPLIT_JOBS_DIR", *workRoot)
+		override(&cfg.MetDir, "HYSPLIT_MET_DIR", *metDir)
+		override(&cfg.OutputDir, "HYSPLIT_OUTPUT_DIR", *outputDir)
+
+		catalog := ""
+		override(&catalog, "HYSPLIT_MET_CATALOG", *metCatalog)
+		if catalog != "" {
+			cfg.MetCatalogDirs = filepath.SplitList(catalog)
+		}
+
+		override(&cfg.BasemapTiles, "HYSPLIT_BASEMAP_TILES", *basemapTiles)
+		shapefiles := ""
+		override(&shapefiles, "HYSPLIT_BASEMAP_SHP", *basemapShp)
+		if shapefiles != "" {
+			cfg.BasemapShapefiles = filepath.SplitList(shapefiles)
+		}
+
+		return cfg, nil
+	}
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// parinitFile is the particle file a continued run starts from.
+const parinitFile = "PARINIT"
+
+// priorPardump returns the particle dump written by an earlier job. The
+// job's payload.json tells where poutf pointed; without it the default
+// PARDUMP in the job directory is used.
+func priorPardump(cfg Config, jobId string) (string, error) {
+	dir, err := jobWorkDir(cfg, jobId)
+	if err != nil {
+		return "", err
+	}
+	prior := Payload{}
+	data, err := os.ReadFile(filepath.Join(dir, "payload.json"))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &prior); err != nil {
+			return "", fmt.Errorf("job %s: payload.json: %v", jobId, err)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return "", err
+	}
+	return pardumpPath(prior, dir), nil
+}
+
+// continueFromJob starts a concentration run from the particles of the job
+// named by continueFromJobId. The last dump at or before the requested
+// start, or the last dump when no start is given, is written to PARINIT
+// in dir, and the start moves back to the time of that dump. The end of
+// the run stays as requested.
+func continueFromJob(cfg Config, payload Payload, dir string) (Payload, error) {
+	id := payload.ContinueFromJobId
+	if id == "" {
+		return payload, nil
+	}
+	meta := payload.SimulationMeta
+	if meta.ModelType != "CONCENTRATION" || meta.Direction != "FORWARD" {
+		return payload, fmt.Errorf("continueFromJobId needs a forward concentration run")
+	}
+	if id == payload.JobId {
+		return payload, fmt.Errorf("job %s cannot continue from itself", id)
+	}
+	path, err := priorPardump(cfg, id)
+	if err != nil {
+		return payload, err
+	}
+	dumps, err := ReadPardumpFile(path)
+	if err != nil {
+		return payload, fmt.Errorf("continuing from job %s (set ndump in its setupOverrides): %v", id, err)
+	}
+	if len(dumps) == 0 {
+		return payload, fmt.Errorf("continuing from job %s: %s holds no particle dumps", id, path)
+	}
+
+	dump := dumps[len(dumps)-1]
+	if meta.StartEpochUTC != 0 {
+		start := time.Unix(meta.StartEpochUTC, 0).UTC()
+		found := false
+		for _, d := range dumps {
+			if !d.Time.After(start) {
+				dump, found = d, true
+			}
+		}
+		if !found {
+			return payload, fmt.Errorf("continuing from job %s: no particle dump at or before %s (first is %s)",
+				id, start.Format("2006-01-02 15:04"), dumps[0].Time.Format("2006-01-02 15:04"))
+		}
+	}
+	payload.SimulationMeta.StartEpochUTC = dump.Time.Unix()
+	if payload.SimulationMeta.EndEpochUTC <= payload.SimulationMeta.StartEpochUTC {
+		return payload, fmt.Errorf("continuing from job %s: run ends before the particle dump at %s",
+			id, dump.Time.Format("2006-01-02 15:04"))
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return payload, err
+	}
+	if err := WritePardumpFile(filepath.Join(dir, parinitFile), []ParticleDump{dump}); err != nil {
+		return payload, err
+	}
+	return payload, nil
+}
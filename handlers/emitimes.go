@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// payloadPollutants returns the pollutant ids written to CONTROL, in order.
+func payloadPollutants(payload Payload) []string {
+	return []string{strings.ToUpper(payload.PollutantMatrixConfig.SOX.PollutantId)}
+}
+
+// GenerateEmitimesFile builds an EMITIMES file from the emission scenarios.
+// Each distinct release window becomes one emission cycle, and every cycle
+// carries a record for every point and pollutant (zero rate when inactive),
+// as HYSPLIT requires. HYSPLIT reads the cycles one after the other, so
+// windows that overlap, or that share the hour a cycle starts on, are
+// rejected.
+func GenerateEmitimesFile(payload Payload) (string, error) {
+	pollutants := payloadPollutants(payload)
+	pollutantIdx := make(map[string]int, len(pollutants))
+	for i, id := range pollutants {
+		pollutantIdx[id] = i
+	}
+	pointIdx := make(map[int]int, len(payload.Points))
+	for i, p := range payload.Points {
+		pointIdx[p.PointId] = i
+	}
+
+	type window struct{ start, end int64 }
+	rates := make(map[window][][]float64)
+	areas := make(map[window][][]float64)
+	var windows []window
+
+	for _, sc := range payload.EmissionScenarios {
+		pi, ok := pointIdx[sc.PointId]
+		if !ok {
+			return "", fmt.Errorf("emission scenario references unknown pointId %d", sc.PointId)
+		}
+		ci, ok := pollutantIdx[strings.ToUpper(sc.PollutantId)]
+		if !ok {
+			return "", fmt.Errorf("emission scenario references unknown pollutantId %q", sc.PollutantId)
+		}
+		if sc.ReleaseEndEpochUTC <= sc.ReleaseStartEpochUTC {
+			return "", fmt.Errorf("emission scenario for point %d ends before it starts", sc.PointId)
+		}
+
+		w := window{sc.ReleaseStartEpochUTC, sc.ReleaseEndEpochUTC}
+		if _, seen := rates[w]; !seen {
+			rates[w] = newMatrix(len(payload.Points), len(pollutants))
+			areas[w] = newMatrix(len(payload.Points), len(pollutants))
+			windows = append(windows, w)
+		}
+		rates[w][pi][ci] += sc.Rate.Value
+		areas[w][pi][ci] = sc.Area.Value
+	}
+
+	sort.Slice(windows, func(i, j int) bool {
+		if windows[i].start != windows[j].start {
+			return windows[i].start < windows[j].start
+		}
+		return windows[i].end < windows[j].end
+	})
+
+	var sb strings.Builder
+	sb.WriteString("YYYY MM DD HH    DURATION(hhhh) #RECORDS\n")
+	sb.WriteString("YYYY MM DD HH MM DURATION(hhmm) LAT LON HGT(m) RATE(/h) AREA(m2) HEAT(w)\n")
+
+	var prev window
+	var prevCycleEnd int64
+	for i, w := range windows {
+		start := time.Unix(w.start, 0).UTC()
+		minutes := (w.end - w.start + 59) / 60
+		// Cycles start on the hour, so a release starting at minute 45 needs
+		// one more cycle hour to reach its end.
+		cycleStart := start.Truncate(time.Hour)
+		cycleHours := (w.end - cycleStart.Unix() + 3599) / 3600
+
+		if i > 0 && w.start < prev.end {
+			return "", fmt.Errorf("release windows %s to %s and %s to %s overlap",
+				time.Unix(prev.start, 0).UTC().Format(time.RFC3339), time.Unix(prev.end, 0).UTC().Format(time.RFC3339),
+				start.Format(time.RFC3339), time.Unix(w.end, 0).UTC().Format(time.RFC3339))
+		}
+		if i > 0 && cycleStart.Unix() < prevCycleEnd {
+			return "", fmt.Errorf("release window starting %s begins in the hour the previous window ends in; emission cycles start on the hour",
+				start.Format(time.RFC3339))
+		}
+		prev, prevCycleEnd = w, cycleStart.Unix()+cycleHours*3600
+
+		sb.WriteString(fmt.Sprintf("%04d %02d %02d %02d %04d %d\n",
+			cycleStart.Year(), cycleStart.Month(), cycleStart.Day(), cycleStart.Hour(),
+			cycleHours, len(payload.Points)*len(pollutants)))
+
+		for pi, p := range payload.Points {
+			for ci := range pollutants {
+				sb.WriteString(fmt.Sprintf("%04d %02d %02d %02d %02d %02d%02d %f %f %0.1f %g %g 0.0\n",
+					start.Year(), start.Month(), start.Day(), start.Hour(), start.Minute(),
+					minutes/60, minutes%60,
+					p.Latitude, p.Longitude, p.HeightMAgl,
+					rates[w][pi][ci], areas[w][pi][ci]))
+			}
+		}
+	}
+
+	return sb.String(), nil
+}
+
+func newMatrix(rows, cols int) [][]float64 {
+	m := make([][]float64, rows)
+	for i := range m {
+		m[i] = make([]float64, cols)
+	}
+	return m
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// EnsembleConfig turns one payload into several member runs. Members are the
+// combination of every met file set, source offset and physics variant, in
+// that order.
+type EnsembleConfig struct {
+	Id             string              `json:"id"`             // parent ensemble id, defaults to the payload jobId
+	MaxMembers     int                 `json:"maxMembers"`     // 0 keeps every combination
+	MetFileSets    [][]MetFile         `json:"metFileSets"`    // alternative metFiles, e.g. several GFS cycles
+	GridFactor     float64             `json:"gridFactor"`     // source offset in met grid cells; 0 disables offsets
+	GridSpacingDeg float64             `json:"gridSpacingDeg"` // met grid spacing the factor applies to (default 0.25)
+	PhysicsSets    []map[string]string `json:"physicsSets"`    // SETUP.CFG overrides, e.g. {"kblt": "2"}
+}
+
+// EnsembleManifest lists the members of an ensemble so their results can be
+// found and aggregated later.
+type EnsembleManifest struct {
+	EnsembleId string           `json:"ensembleId"`
+	Members    []EnsembleMember `json:"members"`
+}
+
+type EnsembleMember struct {
+	Index        int               `json:"index"`
+	JobId        string            `json:"jobId"`
+	MetFiles     []MetFile         `json:"metFiles"`
+	OffsetLatDeg float64           `json:"offsetLatDeg"`
+	OffsetLonDeg float64           `json:"offsetLonDeg"`
+	Physics      map[string]string `json:"physics,omitempty"`
+	Output       OutputMeta        `json:"output"`
+}
+
+// ensembleOffsets are the source displacements in grid cells: the original
+// position first, then its eight neighbours.
+var ensembleOffsets = [][2]float64{
+	{0, 0}, {1, 0}, {-1, 0}, {0, 1}, {0, -1}, {1, 1}, {1, -1}, {-1, 1}, {-1, -1},
+}
+
+// ensembleId returns the parent id of an ensemble payload.
+func ensembleId(payload Payload) string {
+	if payload.Ensemble != nil && payload.Ensemble.Id != "" {
+		return payload.Ensemble.Id
+	}
+	return payload.JobId
+}
+
+// ExpandEnsemble builds the member payloads of an ensemble. Each member gets
+// its own job id and output file name, and refers back to the parent id.
+func ExpandEnsemble(payload Payload) ([]Payload, EnsembleManifest, error) {
+	ens := payload.Ensemble
+	parent := ensembleId(payload)
+	manifest := EnsembleManifest{EnsembleId: parent}
+	if ens == nil {
+		return nil, manifest, fmt.Errorf("payload has no ensemble block")
+	}
+	if parent == "" {
+		return nil, manifest, fmt.Errorf("ensemble needs an id or a jobId")
+	}
+
+	metSets := ens.MetFileSets
+	if len(metSets) == 0 {
+		metSets = [][]MetFile{payload.MetFiles}
+	}
+	offsets := ensembleOffsets[:1]
+	if ens.GridFactor != 0 {
+		offsets = ensembleOffsets
+	}
+	spacing := ens.GridSpacingDeg
+	if spacing <= 0 {
+		spacing = 0.25
+	}
+	physicsSets := ens.PhysicsSets
+	if len(physicsSets) == 0 {
+		physicsSets = []map[string]string{nil}
+	}
+
+	var members []Payload
+	for _, metFiles := range metSets {
+		if len(metFiles) == 0 {
+			return nil, manifest, fmt.Errorf("ensemble met file set is empty")
+		}
+		for _, off := range offsets {
+			for _, physics := range physicsSets {
+				if ens.MaxMembers > 0 && len(members) >= ens.MaxMembers {
+					return members, manifest, nil
+				}
+				i := len(members) + 1
+				dLat := off[0] * ens.GridFactor * spacing
+				dLon := off[1] * ens.GridFactor * spacing
+
+				m := payload
+				m.Ensemble = nil
+				m.ParentEnsembleId = parent
+				m.JobId = fmt.Sprintf("%s_m%03d", parent, i)
+				m.MetFiles = append([]MetFile(nil), metFiles...)
+				m.SimulationMeta.OutputFile.FileName = fmt.Sprintf("%s.%03d", outputFileName(payload.SimulationMeta), i)
+
+				m.Points = make([]Point, len(payload.Points))
+				for j, p := range payload.Points {
+					p.Latitude += dLat
+					p.Longitude += dLon
+					m.Points[j] = p
+				}
+
+				overrides := make(map[string]string)
+				for k, v := range payload.PhysicsConfig.SetupOverrides {
+					overrides[k] = v
+				}
+				for k, v := range physics {
+					overrides[k] = v
+				}
+				m.PhysicsConfig.SetupOverrides = overrides
+
+				members = append(members, m)
+				manifest.Members = append(manifest.Members, EnsembleMember{
+					Index:        i,
+					JobId:        m.JobId,
+					MetFiles:     m.MetFiles,
+					OffsetLatDeg: dLat,
+					OffsetLonDeg: dLon,
+					Physics:      physics,
+					Output:       m.SimulationMeta.OutputFile,
+				})
+			}
+		}
+	}
+	return members, manifest, nil
+}
+
+// prepareMembers prepares the member payloads with dir as the default
+// output directory and records their met files and output in the manifest.
+// With continueFromJobId, every member starts from the particles of that
+// job, with its own PARINIT in its job directory.
+func prepareMembers(cfg Config, members []Payload, manifest *EnsembleManifest, dir string) error {
+	for i := range members {
+		m, err := preparePayload(cfg, members[i], dir, true)
+		if err != nil {
+			return err
+		}
+		memberDir, err := jobWorkDir(cfg, m.JobId)
+		if err != nil {
+			return err
+		}
+		if m, err = continueFromJob(cfg, m, memberDir); err != nil {
+			return fmt.Errorf("member %s: %v", m.JobId, err)
+		}
+		members[i] = m
+		manifest.Members[i].MetFiles = m.MetFiles
+		manifest.Members[i].Output = m.SimulationMeta.OutputFile
+	}
+	return nil
+}
+
+// writeEnsemble writes the model inputs of every member into its own job
+// directory, and the manifest into the parent ensemble directory. Member
+// payloads must already be prepared.
+func writeEnsemble(cfg Config, members []Payload, manifest EnsembleManifest) (string, error) {
+	if err := writeMemberJobs(cfg, members); err != nil {
+		return "", err
+	}
+	return writeManifest(cfg, manifest.EnsembleId, "ensemble.json", manifest)
+}
+
+// writeMemberJobs writes the model inputs and payload.json of each member
+// job into its own working directory.
+func writeMemberJobs(cfg Config, members []Payload) error {
+	for _, m := range members {
+		dir, err := jobWorkDir(cfg, m.JobId)
+		if err != nil {
+			return err
+		}
+		if _, err := writeModelInputs(m, dir); err != nil {
+			return fmt.Errorf("member %s: %v", m.JobId, err)
+		}
+		if err := writeJobPayload(m, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeManifest writes manifest as JSON into the working directory of the
+// parent job and returns its path.
+func writeManifest(cfg Config, parentId, name string, manifest any) (string, error) {
+	dir, err := jobWorkDir(cfg, parentId)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	return path, os.WriteFile(path, data, 0644)
+}
+
+// runMembers runs every member job in turn and keeps going after a failure.
+func runMembers(cfg Config, members []Payload) error {
+	var failed int
+	for _, m := range members {
+		dir, err := jobWorkDir(cfg, m.JobId)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Running %s in %s\n", m.JobId, dir)
+		if err := runModel(cfg, m, dir); err != nil {
+			fmt.Fprintf(os.Stderr, "Member %s failed: %v\n", m.JobId, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d member runs failed", failed, len(members))
+	}
+	return nil
+}
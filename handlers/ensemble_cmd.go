@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+func ensembleCmd(args []string) error {
+	fs := flag.NewFlagSet("ensemble", flag.ContinueOnError)
+	run := fs.Bool("run", false, "run every member after writing its inputs")
+	resolve := configFlags(fs)
+	cfg, payload, err := parseCommand(fs, args, resolve)
+	if err != nil {
+		return err
+	}
+
+	// Members write their output next to each other in the parent directory
+	// unless the payload says otherwise.
+	dir, err := jobWorkDir(cfg, ensembleId(payload))
+	if err != nil {
+		return err
+	}
+	members, manifest, err := ExpandEnsemble(payload)
+	if err != nil {
+		return err
+	}
+	if err := prepareMembers(cfg, members, &manifest, dir); err != nil {
+		return err
+	}
+	manifestPath, err := writeEnsemble(cfg, members, manifest)
+	if err != nil {
+		return err
+	}
+	fmt.Println(manifestPath)
+
+	if !*run {
+		return nil
+	}
+	return runMembers(cfg, members)
+}
+
+func ensembleStatsCmd(args []string) error {
+	fs := flag.NewFlagSet("ensemble-stats", flag.ContinueOnError)
+	percentiles := fs.String("percentiles", "50,90,95", "comma separated percentiles (0-100)")
+	thresholds := fs.String("thresholds", "", "comma separated concentration thresholds for exceedance probabilities")
+	formats := fs.String("format", "", "also render each statistic: kml, png, geojson")
+	resolve := configFlags(fs)
+	cfg, payload, err := parseCommand(fs, args, resolve)
+	if err != nil {
+		return err
+	}
+
+	var opts EnsembleStatsOptions
+	if opts.Percentiles, err = parseFloatList(*percentiles); err != nil {
+		return fmt.Errorf("-percentiles: %v", err)
+	}
+	if opts.Thresholds, err = parseFloatList(*thresholds); err != nil {
+		return fmt.Errorf("-thresholds: %v", err)
+	}
+	var formatList []string
+	if *formats != "" {
+		formatList = strings.Split(*formats, ",")
+	}
+
+	written, err := ensembleStatsJob(cfg, payload, opts, formatList)
+	for _, path := range written {
+		fmt.Println(path)
+	}
+	return err
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// EnsembleStatsOptions selects the statistics computed over ensemble members.
+// Mean and max are always computed.
+type EnsembleStatsOptions struct {
+	Percentiles []float64 // 0-100, e.g. 50, 90, 95
+	Thresholds  []float64 // concentrations for the probability of exceedance
+}
+
+// EnsembleStat is one statistic over all members, on the members' grid.
+type EnsembleStat struct {
+	Name  string // "mean", "max", "p95", "prob_1e-12", ...
+	Cdump *Cdump
+}
+
+// EnsembleStatistics computes per grid cell, level and sampling period the
+// mean, max, requested percentiles and the probability (percent of members)
+// of exceeding each threshold. All members must share grid and periods.
+func EnsembleStatistics(members []*Cdump, opts EnsembleStatsOptions) ([]EnsembleStat, error) {
+	if len(members) == 0 {
+		return nil, fmt.Errorf("no ensemble members")
+	}
+	ref := members[0]
+	for i, m := range members[1:] {
+		if !ref.SameGrid(m) {
+			return nil, fmt.Errorf("member %d does not share the grid of member 1", i+2)
+		}
+		if len(m.Periods) != len(ref.Periods) {
+			return nil, fmt.Errorf("member %d has %d sampling periods, member 1 has %d", i+2, len(m.Periods), len(ref.Periods))
+		}
+		for p := range m.Periods {
+			if !m.Periods[p].Start.Equal(ref.Periods[p].Start) || !m.Periods[p].Stop.Equal(ref.Periods[p].Stop) {
+				return nil, fmt.Errorf("member %d sampling period %d does not match member 1", i+2, p+1)
+			}
+		}
+	}
+	for _, pct := range opts.Percentiles {
+		if pct < 0 || pct > 100 {
+			return nil, fmt.Errorf("percentile %g outside 0-100", pct)
+		}
+	}
+
+	names := []string{"mean", "max"}
+	for _, pct := range opts.Percentiles {
+		names = append(names, "p"+strconv.FormatFloat(pct, 'g', -1, 64))
+	}
+	for _, thr := range opts.Thresholds {
+		names = append(names, "prob_"+strconv.FormatFloat(thr, 'g', -1, 64))
+	}
+
+	stats := make([]EnsembleStat, len(names))
+	for s, name := range names {
+		c := ref.CloneHeader()
+		for _, p := range ref.Periods {
+			c.Periods = append(c.Periods, ref.NewPeriodLike(p))
+		}
+		stats[s] = EnsembleStat{Name: name, Cdump: c}
+	}
+
+	n := len(members)
+	values := make([]float64, n)
+	for p := range ref.Periods {
+		for k := range ref.Pollutants {
+			for l := range ref.Levels {
+				for e := range ref.Periods[p].Conc[k][l] {
+					sum := 0.0
+					for m, member := range members {
+						values[m] = float64(member.Periods[p].Conc[k][l][e])
+						sum += values[m]
+					}
+					sort.Float64s(values)
+
+					out := []float64{sum / float64(n), values[n-1]}
+					for _, pct := range opts.Percentiles {
+						out = append(out, percentile(values, pct))
+					}
+					for _, thr := range opts.Thresholds {
+						// values is sorted, so count from the first value above thr.
+						above := n - sort.Search(n, func(i int) bool { return values[i] > thr })
+						out = append(out, 100*float64(above)/float64(n))
+					}
+					for s := range stats {
+						stats[s].Cdump.Periods[p].Conc[k][l][e] = float32(out[s])
+					}
+				}
+			}
+		}
+	}
+	return stats, nil
+}
+
+// percentile interpolates linearly between the closest ranks of sorted.
+func percentile(sorted []float64, pct float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := pct / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	frac := rank - float64(lo)
+	return sorted[lo] + (sorted[hi]-sorted[lo])*frac
+}
+
+// readEnsembleManifest loads the manifest written by writeEnsemble.
+func readEnsembleManifest(cfg Config, id string) (EnsembleManifest, error) {
+	var manifest EnsembleManifest
+	dir, err := jobWorkDir(cfg, id)
+	if err != nil {
+		return manifest, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "ensemble.json"))
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(data, &manifest)
+	return manifest, err
+}
+
+// ensembleStatsJob reads the member outputs listed in the manifest of an
+// ensemble, writes one cdump per statistic into the ensemble directory and
+// renders them in the requested formats.
+func ensembleStatsJob(cfg Config, payload Payload, opts EnsembleStatsOptions, formats []string) ([]string, error) {
+	id := ensembleId(payload)
+	manifest, err := readEnsembleManifest(cfg, id)
+	if err != nil {
+		return nil, fmt.Errorf("reading ensemble manifest: %v", err)
+	}
+	dir, err := jobWorkDir(cfg, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var members []*Cdump
+	for _, m := range manifest.Members {
+		path := filepath.Join(m.Output.Directory, m.Output.FileName)
+		c, err := ReadCdumpFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("member %s: %v", m.JobId, err)
+		}
+		members = append(members, c)
+	}
+
+	stats, err := EnsembleStatistics(members, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	base := outputFileName(payload.SimulationMeta)
+	var written []string
+	for _, s := range stats {
+		name := base + "." + s.Name
+		path := filepath.Join(dir, name)
+		if err := WriteCdumpFile(path, s.Cdump); err != nil {
+			return written, err
+		}
+		written = append(written, path)
+
+		if len(formats) == 0 {
+			continue
+		}
+		statPayload := payload
+		statPayload.SimulationMeta.ModelType = "CONCENTRATION"
+		statPayload.SimulationMeta.OutputFile = OutputMeta{Directory: dir + string(filepath.Separator), FileName: name}
+		files, err := plotOutputs(cfg, statPayload, dir, formats)
+		written = append(written, files...)
+		if err != nil {
+			return written, fmt.Errorf("rendering %s: %v", name, err)
+		}
+	}
+	return written, nil
+}
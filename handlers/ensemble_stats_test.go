@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEnsembleStatistics(t *testing.T) {
+	start := time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC)
+	// Three members of two cells; the second cell is zero in one member.
+	var members []*Cdump
+	for _, v := range [][2]float32{{1, 0}, {4, 6}, {2, 3}} {
+		c := &Cdump{NumLat: 1, NumLon: 2, DLat: 1, DLon: 1, Lat1: 40, Lon1: -90, Levels: []int{100}, Pollutants: []string{"SOX"}}
+		p := c.NewPeriodLike(CdumpPeriod{Start: start, Stop: start.Add(time.Hour)})
+		p.Conc[0][0][0], p.Conc[0][0][1] = v[0], v[1]
+		c.Periods = []CdumpPeriod{p}
+		members = append(members, c)
+	}
+
+	stats, err := EnsembleStatistics(members, EnsembleStatsOptions{
+		Percentiles: []float64{50, 75},
+		Thresholds:  []float64{2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sorted values are 1 2 4 and 0 3 6; the 75th percentile is three
+	// quarters of the way from the second to the third.
+	want := map[string][2]float64{
+		"mean":   {7.0 / 3, 3},
+		"max":    {4, 6},
+		"p50":    {2, 3},
+		"p75":    {3, 4.5},
+		"prob_2": {100.0 / 3, 200.0 / 3},
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("got %d statistics, want %d", len(stats), len(want))
+	}
+	for _, s := range stats {
+		w, ok := want[s.Name]
+		if !ok {
+			t.Errorf("unexpected statistic %q", s.Name)
+			continue
+		}
+		got := s.Cdump.Periods[0].Conc[0][0]
+		for e := range w {
+			if math.Abs(float64(got[e])-w[e]) > 1e-5 {
+				t.Errorf("%s cell %d = %g, want %g", s.Name, e, got[e], w[e])
+			}
+		}
+	}
+
+	members[2].Periods[0].Stop = start.Add(2 * time.Hour)
+	if _, err := EnsembleStatistics(members, EnsembleStatsOptions{}); err == nil {
+		t.Error("expected an error for members with different periods")
+	}
+	if _, err := EnsembleStatistics(members[:1], EnsembleStatsOptions{Percentiles: []float64{101}}); err == nil {
+		t.Error("expected an error for a percentile above 100")
+	}
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"math"
+	"testing"
+)
+
+func TestExpandEnsemble(t *testing.T) {
+	p := testPayload("CONCENTRATION", "FORWARD")
+	p.PhysicsConfig.SetupOverrides = map[string]string{"kblt": "1", "numpar": "2500"}
+	p.Ensemble = &EnsembleConfig{
+		Id: "ens",
+		MetFileSets: [][]MetFile{
+			{{Directory: "/metfiles/", FileName: "gfs.t00z"}},
+			{{Directory: "/metfiles/", FileName: "gfs.t06z"}},
+		},
+		GridFactor:  2,
+		PhysicsSets: []map[string]string{nil, {"kblt": "2"}},
+	}
+
+	members, manifest, err := ExpandEnsemble(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two met sets, nine source positions and two physics variants.
+	if len(members) != 36 || len(manifest.Members) != 36 || manifest.EnsembleId != "ens" {
+		t.Fatalf("got %d members, manifest %s with %d", len(members), manifest.EnsembleId, len(manifest.Members))
+	}
+
+	// Member 4 is the second position, one cell north, with the second
+	// physics variant: two cells of 0.25 degrees.
+	m, mm := members[3], manifest.Members[3]
+	if m.JobId != "ens_m004" || m.ParentEnsembleId != "ens" || m.Ensemble != nil ||
+		m.SimulationMeta.OutputFile.FileName != "out.004" {
+		t.Errorf("member 4: job %s, parent %s, output %s", m.JobId, m.ParentEnsembleId, m.SimulationMeta.OutputFile.FileName)
+	}
+	if mm.OffsetLatDeg != 0.5 || mm.OffsetLonDeg != 0 ||
+		math.Abs(m.Points[0].Latitude-40.5) > 1e-12 || m.Points[0].Longitude != -90 {
+		t.Errorf("member 4 offset %g,%g, point %+v", mm.OffsetLatDeg, mm.OffsetLonDeg, m.Points[0])
+	}
+	if o := m.PhysicsConfig.SetupOverrides; o["kblt"] != "2" || o["numpar"] != "2500" {
+		t.Errorf("member 4 overrides = %v", o)
+	}
+	if p.Points[0].Latitude != 40 || p.PhysicsConfig.SetupOverrides["kblt"] != "1" {
+		t.Error("expanding changed the parent payload")
+	}
+	// The last member uses the second met set at the south-west neighbour.
+	last := manifest.Members[35]
+	if last.MetFiles[0].FileName != "gfs.t06z" || last.OffsetLatDeg != -0.5 || last.OffsetLonDeg != -0.5 {
+		t.Errorf("last member = %+v", last)
+	}
+
+	p.Ensemble.MaxMembers = 5
+	if members, _, _ = ExpandEnsemble(p); len(members) != 5 {
+		t.Errorf("got %d members, want maxMembers 5", len(members))
+	}
+	// Without a grid factor the source is not displaced.
+	p.Ensemble.MaxMembers, p.Ensemble.GridFactor = 0, 0
+	if members, _, _ = ExpandEnsemble(p); len(members) != 4 {
+		t.Errorf("got %d members without offsets, want 4", len(members))
+	}
+	// Without an output name members get the default one with their number.
+	p.SimulationMeta.OutputFile.FileName = ""
+	if members, _, _ = ExpandEnsemble(p); members[1].SimulationMeta.OutputFile.FileName != "cdump.002" {
+		t.Errorf("member 2 output %q, want cdump.002", members[1].SimulationMeta.OutputFile.FileName)
+	}
+	p.Ensemble = nil
+	if _, _, err := ExpandEnsemble(p); err == nil {
+		t.Error("expected an error without an ensemble block")
+	}
+}
@@ -0,0 +1,323 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Observation is one measured concentration.
+type Observation struct {
+	Station   string
+	Latitude  float64
+	Longitude float64
+	Time      time.Time
+	Value     float64
+}
+
+// observationTimeLayouts are the accepted time formats besides epoch
+// seconds.
+var observationTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+}
+
+func parseObservationTime(s string) (time.Time, error) {
+	if epoch, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(epoch, 0).UTC(), nil
+	}
+	for _, layout := range observationTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q", s)
+}
+
+// ReadObservationsFile reads measurements as CSV with the columns station,
+// lat, lon, time, value. A header line is skipped. Times are RFC 3339,
+// "YYYY-MM-DD HH:MM" in UTC or epoch seconds.
+func ReadObservationsFile(path string) ([]Observation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadObservations(f)
+}
+
+func ReadObservations(r io.Reader) ([]Observation, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var obs []Observation
+	for n, rec := range records {
+		if len(rec) < 5 {
+			return nil, fmt.Errorf("observation line %d: want station, lat, lon, time, value", n+1)
+		}
+		lat, err := strconv.ParseFloat(rec[1], 64)
+		if err != nil {
+			if n == 0 {
+				continue // header
+			}
+			return nil, fmt.Errorf("observation line %d: bad latitude %q", n+1, rec[1])
+		}
+		lon, err := strconv.ParseFloat(rec[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("observation line %d: bad longitude %q", n+1, rec[2])
+		}
+		t, err := parseObservationTime(strings.TrimSpace(rec[3]))
+		if err != nil {
+			return nil, fmt.Errorf("observation line %d: %v", n+1, err)
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(rec[4]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("observation line %d: bad value %q", n+1, rec[4])
+		}
+		obs = append(obs, Observation{Station: rec[0], Latitude: lat, Longitude: lon, Time: t, Value: value})
+	}
+	return obs, nil
+}
+
+// EvaluationPair is a measured and a predicted concentration for the same
+// station and sampling period.
+type EvaluationPair struct {
+	Station   string    `json:"station"`
+	Time      time.Time `json:"time"`
+	Measured  float64   `json:"measured"`
+	Predicted float64   `json:"predicted"`
+}
+
+// EvaluationMetrics are the statistics HYSPLIT's statmain reports.
+// FMS, KSP, FA2 and FA5 are percentages; Rank combines correlation,
+// bias, spatial overlap and distribution into a score from 0 to 4.
+type EvaluationMetrics struct {
+	N             int     `json:"n"`
+	MeanMeasured  float64 `json:"meanMeasured"`
+	MeanPredicted float64 `json:"meanPredicted"`
+	Bias          float64 `json:"bias"`
+	NMSE          float64 `json:"nmse"`
+	R             float64 `json:"r"`
+	FB            float64 `json:"fb"`
+	FMS           float64 `json:"fms"`
+	KSP           float64 `json:"ksp"`
+	FA2           float64 `json:"fa2"`
+	FA5           float64 `json:"fa5"`
+	Rank          float64 `json:"rank"`
+}
+
+type StationEvaluation struct {
+	Station   string  `json:"station"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	EvaluationMetrics
+}
+
+type Evaluation struct {
+	Summary  EvaluationMetrics   `json:"summary"`
+	Stations []StationEvaluation `json:"stations"`
+	Pairs    []EvaluationPair    `json:"pairs"`
+	Unpaired int                 `json:"unpaired"` // observations outside the grid or the sampling periods
+}
+
+// EvaluateOptions selects the field compared with the observations.
+type EvaluateOptions struct {
+	Pollutant string  // pollutant id, default the first
+	Level     int     // level height, default the first
+	Threshold float64 // values above it count as "nonzero" for FMS and FA
+	TimeSeriesOptions
+}
+
+// Evaluate pairs each observation with the concentration of the sampling
+// period containing its time, interpolated at the station, and scores the
+// pairs per station and overall.
+func Evaluate(c *Cdump, obs []Observation, opts EvaluateOptions) (*Evaluation, error) {
+	k, l := 0, 0
+	if opts.Pollutant != "" {
+		if k = c.PollutantIndex(opts.Pollutant); k < 0 {
+			return nil, fmt.Errorf("pollutant %q not in cdump", opts.Pollutant)
+		}
+	}
+	if opts.Level != 0 {
+		if l = c.LevelIndex(opts.Level); l < 0 {
+			return nil, fmt.Errorf("level %d not in cdump", opts.Level)
+		}
+	}
+
+	// One receptor per distinct station location.
+	type site struct {
+		station  string
+		lat, lon float64
+	}
+	var receptors []Receptor
+	seen := make(map[site]int)
+	for _, o := range obs {
+		s := site{o.Station, o.Latitude, o.Longitude}
+		if _, ok := seen[s]; !ok {
+			seen[s] = len(receptors)
+			receptors = append(receptors, Receptor{Id: o.Station, Latitude: o.Latitude, Longitude: o.Longitude})
+		}
+	}
+	series, _, err := ExtractTimeSeries(c, receptors, opts.TimeSeriesOptions)
+	if err != nil {
+		return nil, err
+	}
+	predicted := make(map[site][]SeriesValue)
+	for _, s := range series {
+		if s.Pollutant == c.Pollutants[k] && s.Level == c.Levels[l] {
+			predicted[site{s.Receptor.Id, s.Receptor.Latitude, s.Receptor.Longitude}] = s.Values
+		}
+	}
+
+	ev := &Evaluation{}
+	bySite := make(map[site][]EvaluationPair)
+	var order []site
+	for _, o := range obs {
+		s := site{o.Station, o.Latitude, o.Longitude}
+		values, ok := predicted[s]
+		if !ok {
+			ev.Unpaired++
+			continue
+		}
+		i := sort.Search(len(values), func(i int) bool { return values[i].Stop.After(o.Time) })
+		if i == len(values) || o.Time.Before(values[i].Start) {
+			ev.Unpaired++
+			continue
+		}
+		p := EvaluationPair{Station: o.Station, Time: o.Time, Measured: o.Value, Predicted: values[i].Conc}
+		ev.Pairs = append(ev.Pairs, p)
+		if _, ok := bySite[s]; !ok {
+			order = append(order, s)
+		}
+		bySite[s] = append(bySite[s], p)
+	}
+	if len(ev.Pairs) == 0 {
+		return nil, fmt.Errorf("no observation matches a sampling period inside the grid")
+	}
+
+	ev.Summary = evaluationMetrics(ev.Pairs, opts.Threshold)
+	for _, s := range order {
+		ev.Stations = append(ev.Stations, StationEvaluation{
+			Station:           s.station,
+			Latitude:          s.lat,
+			Longitude:         s.lon,
+			EvaluationMetrics: evaluationMetrics(bySite[s], opts.Threshold),
+		})
+	}
+	return ev, nil
+}
+
+// evaluationMetrics computes the statistics of a set of pairs. Pairs where
+// both values are at or below the threshold are left out of FMS, FA2 and
+// FA5, as they say nothing about the plume.
+func evaluationMetrics(pairs []EvaluationPair, threshold float64) EvaluationMetrics {
+	m := EvaluationMetrics{N: len(pairs)}
+	n := float64(len(pairs))
+	var sumM, sumP, sumSq float64
+	for _, p := range pairs {
+		sumM += p.Measured
+		sumP += p.Predicted
+		sumSq += (p.Predicted - p.Measured) * (p.Predicted - p.Measured)
+	}
+	m.MeanMeasured, m.MeanPredicted = sumM/n, sumP/n
+	m.Bias = m.MeanPredicted - m.MeanMeasured
+	if prod := m.MeanMeasured * m.MeanPredicted; prod > 0 {
+		m.NMSE = sumSq / n / prod
+	}
+	if sum := m.MeanMeasured + m.MeanPredicted; sum > 0 {
+		m.FB = 2 * m.Bias / sum
+	}
+
+	var sxy, sxx, syy float64
+	for _, p := range pairs {
+		dx, dy := p.Measured-m.MeanMeasured, p.Predicted-m.MeanPredicted
+		sxy += dx * dy
+		sxx += dx * dx
+		syy += dy * dy
+	}
+	if sxx > 0 && syy > 0 {
+		m.R = sxy / math.Sqrt(sxx*syy)
+	}
+
+	var both, either, fa2, fa5 int
+	for _, p := range pairs {
+		mo, pr := p.Measured > threshold, p.Predicted > threshold
+		if mo || pr {
+			either++
+		}
+		if mo && pr {
+			both++
+			ratio := p.Predicted / p.Measured
+			if ratio >= 0.5 && ratio <= 2 {
+				fa2++
+			}
+			if ratio >= 0.2 && ratio <= 5 {
+				fa5++
+			}
+		}
+	}
+	if either > 0 {
+		m.FMS = 100 * float64(both) / float64(either)
+		m.FA2 = 100 * float64(fa2) / float64(either)
+		m.FA5 = 100 * float64(fa5) / float64(either)
+	}
+
+	// KSP is the largest difference between the cumulative distributions
+	// of the measured and predicted values.
+	meas := make([]float64, len(pairs))
+	pred := make([]float64, len(pairs))
+	for i, p := range pairs {
+		meas[i], pred[i] = p.Measured, p.Predicted
+	}
+	sort.Float64s(meas)
+	sort.Float64s(pred)
+	for _, v := range append(append([]float64(nil), meas...), pred...) {
+		cm := float64(sort.Search(len(meas), func(i int) bool { return meas[i] > v })) / n
+		cp := float64(sort.Search(len(pred), func(i int) bool { return pred[i] > v })) / n
+		m.KSP = math.Max(m.KSP, 100*math.Abs(cm-cp))
+	}
+
+	m.Rank = m.R*m.R + (1 - math.Abs(m.FB)/2) + m.FMS/100 + (1 - m.KSP/100)
+	return m
+}
+
+// WriteEvaluationCSV writes the per-station table followed by an "ALL" row
+// with the overall summary.
+func WriteEvaluationCSV(w io.Writer, ev *Evaluation) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"station", "latitude", "longitude", "n", "mean_measured", "mean_predicted",
+		"bias", "nmse", "r", "fb", "fms", "ksp", "fa2", "fa5", "rank"})
+	row := func(station, lat, lon string, m EvaluationMetrics) {
+		g := func(v float64) string { return strconv.FormatFloat(v, 'g', 6, 64) }
+		cw.Write([]string{station, lat, lon, strconv.Itoa(m.N), g(m.MeanMeasured), g(m.MeanPredicted),
+			g(m.Bias), g(m.NMSE), g(m.R), g(m.FB), g(m.FMS), g(m.KSP), g(m.FA2), g(m.FA5), g(m.Rank)})
+	}
+	for _, s := range ev.Stations {
+		row(s.Station,
+			strconv.FormatFloat(s.Latitude, 'f', -1, 64),
+			strconv.FormatFloat(s.Longitude, 'f', -1, 64),
+			s.EvaluationMetrics)
+	}
+	row("ALL", "", "", ev.Summary)
+	cw.Flush()
+	return cw.Error()
+}
+
+func WriteEvaluationJSON(w io.Writer, ev *Evaluation) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(ev)
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvaluationMetrics(t *testing.T) {
+	pairs := []EvaluationPair{
+		{Measured: 1, Predicted: 2},
+		{Measured: 2, Predicted: 2},
+		{Measured: 4, Predicted: 1},
+		{Measured: 0, Predicted: 1},
+	}
+	m := evaluationMetrics(pairs, 0)
+	// Means 1.75 and 1.5; squared errors 1, 0, 9, 1. Three pairs are
+	// nonzero on both sides, with ratios 2, 1 and 0.25. The sorted values
+	// 0 1 2 4 and 1 1 2 2 differ most, by a quarter, below 1 and 4.
+	r := -0.5 / math.Sqrt(8.75)
+	fb := 2 * -0.25 / 3.25
+	want := EvaluationMetrics{
+		N: 4, MeanMeasured: 1.75, MeanPredicted: 1.5, Bias: -0.25,
+		NMSE: 11.0 / 4 / (1.75 * 1.5), R: r, FB: fb,
+		FMS: 75, KSP: 25, FA2: 50, FA5: 75,
+		Rank: r*r + (1 - math.Abs(fb)/2) + 0.75 + 0.75,
+	}
+	got := []float64{m.MeanMeasured, m.MeanPredicted, m.Bias, m.NMSE, m.R, m.FB, m.FMS, m.KSP, m.FA2, m.FA5, m.Rank}
+	exp := []float64{want.MeanMeasured, want.MeanPredicted, want.Bias, want.NMSE, want.R, want.FB, want.FMS, want.KSP, want.FA2, want.FA5, want.Rank}
+	names := strings.Fields("meanMeasured meanPredicted bias nmse r fb fms ksp fa2 fa5 rank")
+	if m.N != want.N {
+		t.Errorf("n = %d, want %d", m.N, want.N)
+	}
+	for i := range got {
+		if math.Abs(got[i]-exp[i]) > 1e-12 {
+			t.Errorf("%s = %g, want %g", names[i], got[i], exp[i])
+		}
+	}
+
+	// With a threshold of 1 only the pairs above it on either side count.
+	if m := evaluationMetrics(pairs, 1); m.FMS != 100*1.0/3 || m.FA2 != 100*1.0/3 {
+		t.Errorf("threshold 1: fms %g, fa2 %g, want 33.3", m.FMS, m.FA2)
+	}
+}
+
+func TestEvaluateSites(t *testing.T) {
+	start := time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC)
+	c := &Cdump{
+		NumLat: 2, NumLon: 2, DLat: 1, DLon: 1, Lat1: 40, Lon1: -90,
+		Levels: []int{100}, Pollutants: []string{"SOX"},
+	}
+	p := c.NewPeriodLike(CdumpPeriod{Start: start, Stop: start.Add(6 * time.Hour)})
+	p.Conc[0][0][0], p.Conc[0][0][1] = 1, 4
+	c.Periods = []CdumpPeriod{p}
+
+	// Two sites share the name A; a third observation is after the period.
+	obs := []Observation{
+		{Station: "A", Latitude: 40, Longitude: -90, Time: start.Add(time.Hour), Value: 2},
+		{Station: "A", Latitude: 40, Longitude: -89, Time: start.Add(time.Hour), Value: 4},
+		{Station: "A", Latitude: 40, Longitude: -89, Time: start.Add(2 * time.Hour), Value: 8},
+		{Station: "A", Latitude: 40, Longitude: -90, Time: start.Add(7 * time.Hour), Value: 1},
+	}
+	ev, err := Evaluate(c, obs, EvaluateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Unpaired != 1 || len(ev.Pairs) != 3 || ev.Summary.N != 3 {
+		t.Fatalf("got %d pairs, %d unpaired", len(ev.Pairs), ev.Unpaired)
+	}
+	if len(ev.Stations) != 2 {
+		t.Fatalf("got %d stations, want one per site", len(ev.Stations))
+	}
+	if s := ev.Stations[0]; s.Longitude != -90 || s.N != 1 || s.MeanPredicted != 1 {
+		t.Errorf("first site = %+v", s)
+	}
+	if s := ev.Stations[1]; s.Longitude != -89 || s.N != 2 || s.MeanPredicted != 4 || s.MeanMeasured != 6 {
+		t.Errorf("second site = %+v", s)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package handlers
 
 import (
 	"fmt"
@@ -9,21 +9,31 @@ import (
 
 // Payload is the root structure for the generic JSON input.
 type Payload struct {
-	JobId             string            `json:"jobId"`
-	SimulationMeta    SimulationMeta    `json:"simulationMeta"`
-	MetFiles          []MetFile         `json:"metFiles"`
-	PhysicsConfig     PhysicsConfig     `json:"physicsConfig"`
-	Points            []Point           `json:"points"`
+	JobId                 string                `json:"jobId"`
+	SimulationMeta        SimulationMeta        `json:"simulationMeta"`
+	MetFiles              []MetFile             `json:"metFiles"`
+	Met                   *MetSelection         `json:"met,omitempty"` // pick metFiles from the met catalog
+	PhysicsConfig         PhysicsConfig         `json:"physicsConfig"`
+	Points                []Point               `json:"points"`
 	PollutantMatrixConfig PollutantMatrixConfig `json:"pollutantMatrixConfig"`
-	ConcentrationGrids []ConcentrationGrid `json:"concentrationGrids"`
+	ConcentrationGrids    []ConcentrationGrid   `json:"concentrationGrids"`
+	EmissionScenarios     []EmissionScenario    `json:"emissionScenarios"`
+	Ensemble              *EnsembleConfig       `json:"ensemble,omitempty"`
+	ParentEnsembleId      string                `json:"parentEnsembleId,omitempty"` // set on ensemble members
+	TransferMatrix        *TransferMatrixConfig `json:"transferMatrix,omitempty"`
+	TrajectoryConfig      *TrajectoryConfig     `json:"trajectoryConfig,omitempty"`
+	ContinueFromJobId     string                `json:"continueFromJobId,omitempty"` // start from the particles of an earlier job
+	Units                 map[string]Unit       `json:"units,omitempty"`             // display units and their color zones, by unitId
 }
 
 type SimulationMeta struct {
-	ModelType string `json:"modelType"` // "CONCENTRATION" or "TRAJECTORY"
-	Direction string `json:"direction"` // "FORWARD" or "BACKWARD"
-	StartEpochUTC int64 `json:"startEpochUTC"`
-	EndEpochUTC   int64 `json:"endEpochUTC"`
-	OutputFile    OutputMeta `json:"outputFile"`
+	ModelType     string        `json:"modelType"` // "CONCENTRATION" or "TRAJECTORY"
+	Direction     string        `json:"direction"` // "FORWARD" or "BACKWARD"
+	StartEpochUTC int64         `json:"startEpochUTC"`
+	EndEpochUTC   int64         `json:"endEpochUTC"`
+	OutputFile    OutputMeta    `json:"outputFile"`
+	Matrix        *MatrixConfig `json:"matrix,omitempty"`      // source-receptor matrix run (ICHEM=1)
+	StartRepeat   *StartRepeat  `json:"startRepeat,omitempty"` // staggered trajectory starts
 }
 
 type OutputMeta struct {
@@ -37,21 +47,26 @@ type MetFile struct {
 }
 
 type PhysicsConfig struct {
-	VerticalMotionCode int `json:"verticalMotionCode"`
-	TopOfModelMAgl     float64 `json:"topOfModelMAgl"`
+	ConfigMode         string            `json:"configMode"` // "Particle" or "Puff"
+	MaxParticles       int               `json:"maxParticles"`
+	VerticalMotionCode int               `json:"verticalMotionCode"`
+	TopOfModelMAgl     float64           `json:"topOfModelMAgl"`
+	SetupOverrides     map[string]string `json:"setupOverrides,omitempty"` // extra SETUP.CFG namelist values
 }
 
 type Point struct {
-	PointId  int     `json:"pointId"`
-	Latitude float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
-	HeightMAgl float64 `json:"heightMAgl"`
+	PointId     int       `json:"pointId"`
+	Latitude    float64   `json:"latitude"`
+	Longitude   float64   `json:"longitude"`
+	HeightMAgl  float64   `json:"heightMAgl"`
+	HeightsMAgl []float64 `json:"heightsMAgl,omitempty"` // several trajectory start heights, replaces heightMAgl
 }
 
 type PollutantMatrixConfig struct {
 	SOX struct {
-		PollutantId  string `json:"pollutantId"`
+		PollutantId  string  `json:"pollutantId"`
 		InitialMassG float64 `json:"initialMassG"`
+		UnitId       string  `json:"unitId,omitempty"` // key into Payload.Units
 	} `json:"sox"`
 	IsEmissionRateZero bool `json:"isEmissionRateZero"`
 }
@@ -64,6 +79,30 @@ type ConcentrationGrid struct {
 	SpanLat          int       `json:"spanLat"` // Number of grid points
 	SpanLon          int       `json:"spanLon"`
 	OutputLevelsMAgl []float64 `json:"outputLevelsMAgl"`
+	FileName         string    `json:"fileName,omitempty"` // output file of this grid; grids after the first default to <outputFile>.g<n>
+
+	// Sampling schedule. Zero epochs sample from the run start to the run
+	// end; the default is an hourly average.
+	SamplingStartEpochUTC   int64  `json:"samplingStartEpochUTC,omitempty"`
+	SamplingStopEpochUTC    int64  `json:"samplingStopEpochUTC,omitempty"`
+	AveragingType           string `json:"averagingType,omitempty"` // "average", "snapshot" or "maximum"
+	SamplingIntervalHours   int    `json:"samplingIntervalHours,omitempty"`
+	SamplingIntervalMinutes int    `json:"samplingIntervalMinutes,omitempty"`
+}
+
+// EmissionScenario is one time-varying release written to EMITIMES.
+type EmissionScenario struct {
+	PointId              int           `json:"pointId"`
+	PollutantId          string        `json:"pollutantId"`
+	ReleaseStartEpochUTC int64         `json:"releaseStartEpochUTC"`
+	ReleaseEndEpochUTC   int64         `json:"releaseEndEpochUTC"`
+	Rate                 ScenarioValue `json:"rate"`
+	Area                 ScenarioValue `json:"area"`
+}
+
+type ScenarioValue struct {
+	Value  float64 `json:"value"`
+	UnitId string  `json:"unitId"`
 }
 
 // ------------------- Helper Functions -------------------
@@ -71,12 +110,12 @@ type ConcentrationGrid struct {
 // epochToHysplitTime converts a Unix epoch to the HYSPLIT format "YY MM DD HH MM".
 func epochToHysplitTime(epoch int64) string {
 	t := time.Unix(epoch, 0).UTC()
-	return fmt.Sprintf("%02d %02d %02d %02d %01d",
+	return fmt.Sprintf("%02d %02d %02d %02d %02d",
 		t.Year()%100, // YY
 		t.Month(),    // MM
 		t.Day(),      // DD
 		t.Hour(),     // HH
-		t.Minute(),   // M (single digit for minutes, usually 0)
+		t.Minute(),   // MM
 	)
 }
 
@@ -91,6 +130,82 @@ func calculateDuration(meta SimulationMeta) float64 {
 	return math.Abs(durationHours)
 }
 
+// runHours is the signed run time written to CONTROL. HYSPLIT only takes
+// whole hours, so partial hours are rounded up to cover the whole window;
+// the sampling stop time still ends the output at the exact minute.
+func runHours(meta SimulationMeta) int {
+	hours := int(math.Ceil(math.Abs(calculateDuration(meta))))
+	if meta.Direction == "BACKWARD" {
+		return -hours
+	}
+	return hours
+}
+
+// maxMetGrids is the number of meteorological grids HYSPLIT accepts.
+// Longer lists are written as one grid with consecutive files in time.
+const maxMetGrids = 12
+
+// metFilesLine returns the CONTROL line giving the number of met grids, and
+// the number of files per grid when there are more files than grids.
+func metFilesLine(n int) string {
+	if n > maxMetGrids {
+		return fmt.Sprintf("1 %d", n)
+	}
+	return fmt.Sprintf("%d", n)
+}
+
+// averagingTypes are the sampling interval type codes of CONTROL.
+var averagingTypes = map[string]int{"average": 0, "snapshot": 1, "maximum": 2}
+
+// samplingSchedule returns the sampling start and stop epochs, the averaging
+// type code and the interval of a grid, checking that the window lies inside
+// the run and runs in its direction.
+func samplingSchedule(meta SimulationMeta, grid ConcentrationGrid) (int64, int64, int, int, int, error) {
+	start, stop := grid.SamplingStartEpochUTC, grid.SamplingStopEpochUTC
+	if start == 0 {
+		start = meta.StartEpochUTC
+	}
+	if stop == 0 {
+		stop = meta.EndEpochUTC
+	}
+	first, last := min(meta.StartEpochUTC, meta.EndEpochUTC), max(meta.StartEpochUTC, meta.EndEpochUTC)
+	if start < first || start > last || stop < first || stop > last {
+		return 0, 0, 0, 0, 0, fmt.Errorf("sampling window %s to %s is outside the run",
+			time.Unix(start, 0).UTC().Format(time.RFC3339), time.Unix(stop, 0).UTC().Format(time.RFC3339))
+	}
+	if meta.Direction == "BACKWARD" && stop >= start || meta.Direction != "BACKWARD" && stop <= start {
+		return 0, 0, 0, 0, 0, fmt.Errorf("sampling stop must come after sampling start in the direction of the run")
+	}
+
+	avg := 0
+	if grid.AveragingType != "" {
+		code, ok := averagingTypes[strings.ToLower(grid.AveragingType)]
+		if !ok {
+			return 0, 0, 0, 0, 0, fmt.Errorf("unknown averagingType %q (want average, snapshot or maximum)", grid.AveragingType)
+		}
+		avg = code
+	}
+	hours, minutes := grid.SamplingIntervalHours, grid.SamplingIntervalMinutes
+	if hours < 0 || minutes < 0 || minutes > 59 {
+		return 0, 0, 0, 0, 0, fmt.Errorf("invalid sampling interval %d h %d min", hours, minutes)
+	}
+	if hours == 0 && minutes == 0 {
+		hours = 1
+	}
+	return start, stop, avg, hours, minutes, nil
+}
+
+// gridFileName returns the output file name of the i-th concentration grid.
+func gridFileName(meta SimulationMeta, grid ConcentrationGrid, i int) string {
+	if grid.FileName != "" {
+		return grid.FileName
+	}
+	if i == 0 {
+		return meta.OutputFile.FileName
+	}
+	return fmt.Sprintf("%s.g%d", meta.OutputFile.FileName, i+1)
+}
+
 // ------------------- Main Generator Function -------------------
 
 // func GenerateHysplitControlFile(payload Payload) (string, error) {
@@ -158,7 +273,6 @@ func calculateDuration(meta SimulationMeta) float64 {
 // 			sb.WriteString(fmt.Sprintf("%0.1f %s\t\t\t#POLLUTANT IDENTIFICATION AND INITIAL MASS\n", massG, pollutantID))
 // 		}
 
-
 // 		// 12. EMISSION RATE (per hour)
 // 		// 13. HOURS OF EMISSION
 // 		emissionRate := 0.0
@@ -233,7 +347,6 @@ func calculateDuration(meta SimulationMeta) float64 {
 // 		sb.WriteString("0\t\t\t\t#RADIOACTIVE DECAY HALF-LIFE (days)\n")
 // 		sb.WriteString("0.0\t\t\t\t#POLLUTANT RESUSPENSION (1/m)\n")
 
-
 // 	} else if meta.ModelType == "TRAJECTORY" {
 // 		// --- Trajectory Specific Block (Sim 2, Sim 4) ---
 
@@ -260,6 +373,23 @@ func GenerateHysplitControlFile(payload Payload) (string, error) {
 
 	sb.WriteString(fmt.Sprintf("%s\n", epochToHysplitTime(meta.StartEpochUTC)))
 
+	if meta.Matrix != nil {
+		// Matrix runs take the source grid corners as the two sources.
+		ll, ur, err := matrixCorners(payload)
+		if err != nil {
+			return "", err
+		}
+		points = []Point{ll, ur}
+	}
+	if meta.ModelType == "TRAJECTORY" {
+		points = startLocations(points)
+	} else {
+		for _, p := range points {
+			if len(p.HeightsMAgl) > 0 {
+				return "", fmt.Errorf("heightsMAgl is only supported for trajectory runs")
+			}
+		}
+	}
 	sb.WriteString(fmt.Sprintf("%d\n", len(points)))
 
 	for _, p := range points {
@@ -267,22 +397,26 @@ func GenerateHysplitControlFile(payload Payload) (string, error) {
 			p.Latitude, p.Longitude, p.HeightMAgl))
 	}
 
-	duration := calculateDuration(meta)
-	sb.WriteString(fmt.Sprintf("%0.f\n", duration))
+	sb.WriteString(fmt.Sprintf("%d\n", runHours(meta)))
 
-	sb.WriteString(fmt.Sprintf("%d\n", phys.VerticalMotionCode))
+	verticalMotion, err := verticalMotionCode(payload)
+	if err != nil {
+		return "", err
+	}
+	sb.WriteString(fmt.Sprintf("%d\n", verticalMotion))
 
 	sb.WriteString(fmt.Sprintf("%0.f\n", phys.TopOfModelMAgl))
 
-	sb.WriteString(fmt.Sprintf("%d\n", len(metfiles)))
+	sb.WriteString(fmt.Sprintf("%s\n", metFilesLine(len(metfiles))))
 
 	for _, mf := range metfiles {
 		sb.WriteString(fmt.Sprintf("%s\n", mf.Directory))
 		sb.WriteString(fmt.Sprintf("%s\n", mf.FileName))
 	}
 	if meta.ModelType == "CONCENTRATION" {
-		grid := payload.ConcentrationGrids[0]
-
+		if len(payload.ConcentrationGrids) == 0 {
+			return "", fmt.Errorf("concentration runs need at least one concentration grid")
+		}
 		sb.WriteString(fmt.Sprintf("1\n"))
 
 		pollutantID := strings.ToUpper(payload.PollutantMatrixConfig.SOX.PollutantId)
@@ -294,13 +428,13 @@ func GenerateHysplitControlFile(payload Payload) (string, error) {
 
 		emissionRate := 1.0
 		emissionHours := 1.0
-		releaseTime := "00 00 00 00 0"
+		releaseTime := "00 00 00 00 00"
 
 		if meta.Direction == "FORWARD" {
 			emissionRate = 1.0
 			emissionHours = 1.0
 			releaseTime = epochToHysplitTime(meta.StartEpochUTC)
-		} 
+		}
 		// else if meta.Direction == "BACKWARD" {
 		// 	emissionRate = 0.0
 		// 	emissionHours = 0.0
@@ -312,31 +446,38 @@ func GenerateHysplitControlFile(payload Payload) (string, error) {
 
 		sb.WriteString(fmt.Sprintf("%s\n", releaseTime))
 
-		sb.WriteString(fmt.Sprintf("1\n"))
+		sb.WriteString(fmt.Sprintf("%d\n", len(payload.ConcentrationGrids)))
 
-		sb.WriteString(fmt.Sprintf("%0.1f %0.1f\n", grid.CenterLat, grid.CenterLon))
+		for i, grid := range payload.ConcentrationGrids {
+			start, stop, avg, hours, minutes, err := samplingSchedule(meta, grid)
+			if err != nil {
+				return "", fmt.Errorf("concentration grid %d: %v", i+1, err)
+			}
 
-		sb.WriteString(fmt.Sprintf("%0.3f %0.3f\n", grid.SpacingLat, grid.SpacingLon))
+			sb.WriteString(fmt.Sprintf("%0.1f %0.1f\n", grid.CenterLat, grid.CenterLon))
 
-		sb.WriteString(fmt.Sprintf("%d %d\n", grid.SpanLat, grid.SpanLon))
+			sb.WriteString(fmt.Sprintf("%0.3f %0.3f\n", grid.SpacingLat, grid.SpacingLon))
 
-		sb.WriteString(fmt.Sprintf("%s\n", meta.OutputFile.Directory))
+			sb.WriteString(fmt.Sprintf("%d %d\n", grid.SpanLat, grid.SpanLon))
 
-		sb.WriteString(fmt.Sprintf("%s\n", meta.OutputFile.FileName))
+			sb.WriteString(fmt.Sprintf("%s\n", meta.OutputFile.Directory))
 
-		sb.WriteString(fmt.Sprintf("%d\n", len(grid.OutputLevelsMAgl)))
+			sb.WriteString(fmt.Sprintf("%s\n", gridFileName(meta, grid, i)))
 
-		levelStrings := make([]string, len(grid.OutputLevelsMAgl))
-		for i, level := range grid.OutputLevelsMAgl {
-			levelStrings[i] = fmt.Sprintf("%0.f", level)
-		}
-		sb.WriteString(fmt.Sprintf("%s\n", strings.Join(levelStrings, " ")))
+			sb.WriteString(fmt.Sprintf("%d\n", len(grid.OutputLevelsMAgl)))
+
+			levelStrings := make([]string, len(grid.OutputLevelsMAgl))
+			for i, level := range grid.OutputLevelsMAgl {
+				levelStrings[i] = fmt.Sprintf("%0.f", level)
+			}
+			sb.WriteString(fmt.Sprintf("%s\n", strings.Join(levelStrings, " ")))
 
-		sb.WriteString(fmt.Sprintf("%s\n", epochToHysplitTime(meta.StartEpochUTC)))
+			sb.WriteString(fmt.Sprintf("%s\n", epochToHysplitTime(start)))
 
-		sb.WriteString(fmt.Sprintf("00 00 00 %02d 00\n", int(math.Abs(duration))))
+			sb.WriteString(fmt.Sprintf("%s\n", epochToHysplitTime(stop)))
 
-		sb.WriteString(fmt.Sprintf("0 1 0\n"))
+			sb.WriteString(fmt.Sprintf("%d %d %d\n", avg, hours, minutes))
+		}
 
 		sb.WriteString("1\n")
 		sb.WriteString("0.0 0.0 0.0\n")
@@ -348,9 +489,7 @@ func GenerateHysplitControlFile(payload Payload) (string, error) {
 	} else if meta.ModelType == "TRAJECTORY" {
 		sb.WriteString(fmt.Sprintf("%s\n", meta.OutputFile.Directory))
 		sb.WriteString(fmt.Sprintf("%s\n", meta.OutputFile.FileName))
-		sb.WriteString("0\n")
-		sb.WriteString("100\n")
 	}
 
 	return sb.String(), nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,290 @@
+package handlers
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files with the current output")
+
+// checkGolden compares got with testdata/<name>.golden, or rewrites the file
+// when the test runs with -update.
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading golden file (run go test -update to create it): %v", err)
+	}
+	if got != string(want) {
+		t.Errorf("output does not match %s\n--- got ---\n%s\n--- want ---\n%s", path, got, want)
+	}
+}
+
+// testPayload returns the payload of the test_scripts simulations: a 20 hour
+// run from 2025-12-01 00 UTC at a single point.
+func testPayload(modelType, direction string) Payload {
+	p := Payload{
+		JobId: "golden",
+		SimulationMeta: SimulationMeta{
+			ModelType:     modelType,
+			Direction:     direction,
+			StartEpochUTC: 1764547200,
+			EndEpochUTC:   1764619200,
+			OutputFile:    OutputMeta{Directory: "/output/", FileName: "out"},
+		},
+		MetFiles:      []MetFile{{Directory: "/metfiles/", FileName: "20251201_gfs0p25"}},
+		PhysicsConfig: PhysicsConfig{VerticalMotionCode: 0, TopOfModelMAgl: 10000},
+		Points:        []Point{{PointId: 1, Latitude: 40, Longitude: -90, HeightMAgl: 100}},
+	}
+	if direction == "BACKWARD" {
+		p.SimulationMeta.StartEpochUTC, p.SimulationMeta.EndEpochUTC = 1764619200, 1764547200
+	}
+	if modelType == "CONCENTRATION" {
+		p.PollutantMatrixConfig.SOX.PollutantId = "sox"
+		p.PollutantMatrixConfig.SOX.InitialMassG = 10000
+		p.PollutantMatrixConfig.IsEmissionRateZero = direction == "BACKWARD"
+		p.ConcentrationGrids = []ConcentrationGrid{{
+			CenterLat: 40, CenterLon: -90, SpacingLat: 0.1, SpacingLon: 0.1,
+			SpanLat: 50, SpanLon: 50, OutputLevelsMAgl: []float64{100},
+		}}
+	}
+	return p
+}
+
+func TestGenerateHysplitControlFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload func() Payload
+	}{
+		{"sim1_conc_fwd", func() Payload { return testPayload("CONCENTRATION", "FORWARD") }},
+		{"sim2_traj_fwd", func() Payload { return testPayload("TRAJECTORY", "FORWARD") }},
+		{"sim3_conc_bwd", func() Payload { return testPayload("CONCENTRATION", "BACKWARD") }},
+		{"sim4_traj_bwd", func() Payload { return testPayload("TRAJECTORY", "BACKWARD") }},
+		{"multi_point", func() Payload {
+			p := testPayload("TRAJECTORY", "BACKWARD")
+			p.Points = append(p.Points,
+				Point{PointId: 2, Latitude: 40.5, Longitude: -90.5, HeightMAgl: 500},
+				Point{PointId: 3, Latitude: 39.5, Longitude: -89.5, HeightMAgl: 1500},
+			)
+			return p
+		}},
+		{"multi_height", func() Payload {
+			p := testPayload("TRAJECTORY", "BACKWARD")
+			p.Points[0].HeightsMAgl = []float64{10, 500, 1500}
+			return p
+		}},
+		{"traj_config", func() Payload {
+			p := testPayload("TRAJECTORY", "FORWARD")
+			p.TrajectoryConfig = &TrajectoryConfig{VerticalMotion: VerticalIsentropic}
+			return p
+		}},
+		{"multi_met_file", func() Payload {
+			p := testPayload("CONCENTRATION", "FORWARD")
+			p.MetFiles = append(p.MetFiles, MetFile{Directory: "/metfiles/", FileName: "20251202_gfs0p25"})
+			return p
+		}},
+		{"multi_grid", func() Payload {
+			p := testPayload("CONCENTRATION", "FORWARD")
+			p.ConcentrationGrids = append(p.ConcentrationGrids, ConcentrationGrid{
+				CenterLat: 40, CenterLon: -90, SpacingLat: 0.5, SpacingLon: 0.5,
+				SpanLat: 20, SpanLon: 20, OutputLevelsMAgl: []float64{0, 500, 1000},
+			})
+			return p
+		}},
+		{"matrix", func() Payload {
+			p := testPayload("CONCENTRATION", "FORWARD")
+			p.SimulationMeta.Matrix = &MatrixConfig{
+				LowerLeftLat: 39.5, LowerLeftLon: -90.5,
+				UpperRightLat: 40.5, UpperRightLon: -89.5,
+			}
+			return p
+		}},
+		{"sampling", func() Payload {
+			p := testPayload("CONCENTRATION", "FORWARD")
+			g := &p.ConcentrationGrids[0]
+			g.SamplingStartEpochUTC = 1764547200 + 6*3600
+			g.SamplingStopEpochUTC = 1764547200 + 18*3600
+			g.AveragingType = "snapshot"
+			g.SamplingIntervalHours = 3
+			return p
+		}},
+		{"year_boundary", func() Payload {
+			// 2025-12-31 22:30 to 2026-01-01 04:15 UTC.
+			p := testPayload("CONCENTRATION", "FORWARD")
+			p.SimulationMeta.StartEpochUTC = 1767220200
+			p.SimulationMeta.EndEpochUTC = 1767240900
+			return p
+		}},
+		{"month_boundary", func() Payload {
+			// Backward from 2024-03-01 02:45 to 2024-02-28 20:00 UTC, over the leap day.
+			p := testPayload("CONCENTRATION", "BACKWARD")
+			p.SimulationMeta.StartEpochUTC = 1709261100
+			p.SimulationMeta.EndEpochUTC = 1709150400
+			return p
+		}},
+		{"long_run", func() Payload {
+			// Six weeks from 2025-11-20, with one met file per 3.5 days.
+			p := testPayload("TRAJECTORY", "FORWARD")
+			p.SimulationMeta.StartEpochUTC = 1763596800
+			p.SimulationMeta.EndEpochUTC = 1763596800 + 42*24*3600
+			p.MetFiles = nil
+			for i := 0; i < 13; i++ {
+				p.MetFiles = append(p.MetFiles, MetFile{Directory: "/metfiles/", FileName: fmt.Sprintf("gdas1.wk%02d", i+1)})
+			}
+			return p
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GenerateHysplitControlFile(tt.payload())
+			if err != nil {
+				t.Fatalf("GenerateHysplitControlFile: %v", err)
+			}
+			checkGolden(t, filepath.Join("control", tt.name), got)
+		})
+	}
+}
+
+func TestGenerateHysplitControlFileErrors(t *testing.T) {
+	p := testPayload("CONCENTRATION", "FORWARD")
+	p.ConcentrationGrids = nil
+	if _, err := GenerateHysplitControlFile(p); err == nil {
+		t.Error("expected an error for a concentration run without grids")
+	}
+
+	p = testPayload("TRAJECTORY", "FORWARD")
+	p.PhysicsConfig.VerticalMotionCode = 12
+	if _, err := GenerateHysplitControlFile(p); err == nil {
+		t.Error("expected an error for an unknown vertical motion code")
+	}
+
+	p.TrajectoryConfig = &TrajectoryConfig{VerticalMotion: "upward"}
+	if _, err := GenerateHysplitControlFile(p); err == nil {
+		t.Error("expected an error for an unknown vertical motion method")
+	}
+
+	p = testPayload("CONCENTRATION", "FORWARD")
+	p.ConcentrationGrids[0].SamplingStopEpochUTC = p.SimulationMeta.EndEpochUTC + 3600
+	if _, err := GenerateHysplitControlFile(p); err == nil {
+		t.Error("expected an error for a sampling window past the run end")
+	}
+
+	p = testPayload("CONCENTRATION", "BACKWARD")
+	p.ConcentrationGrids[0].SamplingStartEpochUTC = p.SimulationMeta.EndEpochUTC
+	p.ConcentrationGrids[0].SamplingStopEpochUTC = p.SimulationMeta.StartEpochUTC
+	if _, err := GenerateHysplitControlFile(p); err == nil {
+		t.Error("expected an error for a sampling window against the run direction")
+	}
+
+	p = testPayload("CONCENTRATION", "FORWARD")
+	p.ConcentrationGrids[0].AveragingType = "median"
+	if _, err := GenerateHysplitControlFile(p); err == nil {
+		t.Error("expected an error for an unknown averaging type")
+	}
+
+	p = testPayload("CONCENTRATION", "FORWARD")
+	p.SimulationMeta.Matrix = &MatrixConfig{LowerLeftLat: 30, LowerLeftLon: -100, UpperRightLat: 50, UpperRightLon: -80}
+	if _, err := GenerateHysplitControlFile(p); err == nil {
+		t.Error("expected an error for a matrix source grid outside the concentration grid")
+	}
+}
+
+func TestEpochToHysplitTime(t *testing.T) {
+	tests := []struct {
+		epoch int64
+		want  string
+	}{
+		{1767224700, "25 12 31 23 45"}, // last quarter hour of 2025
+		{1767225600 + 15*60, "26 01 01 00 15"},
+		{946684800, "00 01 01 00 00"},
+		{1709164800 + 5*60, "24 02 29 00 05"}, // leap day
+	}
+	for _, tt := range tests {
+		if got := epochToHysplitTime(tt.epoch); got != tt.want {
+			t.Errorf("epochToHysplitTime(%d) = %q, want %q", tt.epoch, got, tt.want)
+		}
+	}
+}
+
+func TestRunHours(t *testing.T) {
+	start := int64(1767220200) // 2025-12-31 22:30 UTC
+	tests := []struct {
+		direction string
+		seconds   int64
+		want      int
+	}{
+		{"FORWARD", 90 * 60, 2},
+		{"FORWARD", 3 * 3600, 3},
+		{"FORWARD", 1200 * 3600, 1200},
+		{"BACKWARD", -(5*3600 + 45*60), -6},
+		{"BACKWARD", -1008 * 3600, -1008},
+	}
+	for _, tt := range tests {
+		meta := SimulationMeta{Direction: tt.direction, StartEpochUTC: start, EndEpochUTC: start + tt.seconds}
+		if got := runHours(meta); got != tt.want {
+			t.Errorf("runHours(%s, %ds) = %d, want %d", tt.direction, tt.seconds, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateEmitimesFile(t *testing.T) {
+	// A release across the new year that starts and ends off the hour.
+	p := testPayload("CONCENTRATION", "FORWARD")
+	p.SimulationMeta.StartEpochUTC = 1767220200
+	p.SimulationMeta.EndEpochUTC = 1767240900
+	p.EmissionScenarios = []EmissionScenario{{
+		PointId:              1,
+		PollutantId:          "SOX",
+		ReleaseStartEpochUTC: 1767224700, // 2025-12-31 23:45
+		ReleaseEndEpochUTC:   1767229800, // 2026-01-01 01:10
+		Rate:                 ScenarioValue{Value: 2.5},
+	}}
+	got, err := GenerateEmitimesFile(p)
+	if err != nil {
+		t.Fatalf("GenerateEmitimesFile: %v", err)
+	}
+	checkGolden(t, filepath.Join("emitimes", "year_boundary"), got)
+}
+
+func TestGenerateEmitimesOverlap(t *testing.T) {
+	p := testPayload("CONCENTRATION", "FORWARD")
+	p.Points = append(p.Points, Point{PointId: 2, Latitude: 41, Longitude: -91, HeightMAgl: 50})
+	start := p.SimulationMeta.StartEpochUTC
+	scenario := func(point int, from, to int64) EmissionScenario {
+		return EmissionScenario{PointId: point, PollutantId: "SOX", Rate: ScenarioValue{Value: 1},
+			ReleaseStartEpochUTC: start + from, ReleaseEndEpochUTC: start + to}
+	}
+	for _, tt := range []struct {
+		name      string
+		scenarios []EmissionScenario
+		ok        bool
+	}{
+		{"same window", []EmissionScenario{scenario(1, 0, 7200), scenario(2, 0, 7200)}, true},
+		{"consecutive", []EmissionScenario{scenario(1, 0, 7200), scenario(2, 7200, 10800)}, true},
+		{"overlapping", []EmissionScenario{scenario(1, 0, 7200), scenario(2, 3600, 10800)}, false},
+		{"same hour", []EmissionScenario{scenario(1, 0, 1800), scenario(2, 2700, 7200)}, false},
+	} {
+		p.EmissionScenarios = tt.scenarios
+		got, err := GenerateEmitimesFile(p)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: expected an error, got\n%s", tt.name, got)
+		}
+	}
+}
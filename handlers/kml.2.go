@@ -1,4 +1,4 @@
-package main
+package handlers
 
 import (
 	"bytes"
@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"image/color"
 	"image/png"
-	"log"
 	"math"
 	"os"
 	"regexp"
@@ -44,9 +43,10 @@ type StyleMap struct {
 }
 
 type Folder struct {
-	Name       string      `xml:"name"`
-	TimeSpan   TimeSpan    `xml:"TimeSpan"`
-	Placemarks []Placemark `xml:"Placemark"`
+	Name        string      `xml:"name"`
+	Description string      `xml:"description"`
+	TimeSpan    TimeSpan    `xml:"TimeSpan"`
+	Placemarks  []Placemark `xml:"Placemark"`
 }
 
 type TimeSpan struct {
@@ -240,28 +240,3 @@ func ProcessKml(filePath string) ([]KmlResult, error) {
 
 	return results, nil
 }
-
-func main() {
-	logFile, err := os.OpenFile("output.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatalf("Failed to open log file: %v", err)
-	}
-	defer logFile.Close()
-	log.SetOutput(logFile)
-
-	kmlPath := "/workspaces/hysplit-test/programfiles/hysplit/working/HYSPLIT_ps.kml"
-	results, err := ProcessKml(kmlPath)
-	if err != nil {
-		log.Fatalf("Error: %v", err)
-	}
-
-	message := fmt.Sprintf("Successfully processed %d time segments.\n", len(results))
-	log.Print(message)
-	fmt.Print(message)
-
-	for _, res := range results {
-		line := fmt.Sprintf("Time: %d, BBox: %+v, Base64 Length: %d\n", res.T, res.Bbox, res.Base64)
-		log.Print(line)
-		// fmt.Print(line)
-	}
-}
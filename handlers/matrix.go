@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MatrixConfig turns a concentration run into a HYSPLIT source-receptor
+// matrix run (ICHEM=1). Sources are released from every node of a grid
+// between the two corners, with the spacing of the first concentration
+// grid. Zero corners use the bounding box of the payload points.
+type MatrixConfig struct {
+	LowerLeftLat  float64 `json:"lowerLeftLat"`
+	LowerLeftLon  float64 `json:"lowerLeftLon"`
+	UpperRightLat float64 `json:"upperRightLat"`
+	UpperRightLon float64 `json:"upperRightLon"`
+	HeightMAgl    float64 `json:"heightMAgl"` // release height, defaults to the first point's
+}
+
+// matrixCorners returns the lower left and upper right source of a matrix
+// run, as written to CONTROL.
+func matrixCorners(payload Payload) (Point, Point, error) {
+	m := payload.SimulationMeta.Matrix
+	if payload.SimulationMeta.ModelType != "CONCENTRATION" {
+		return Point{}, Point{}, fmt.Errorf("matrix runs need a concentration run")
+	}
+	if len(payload.EmissionScenarios) > 0 {
+		return Point{}, Point{}, fmt.Errorf("matrix runs release from the source grid; emissionScenarios are not supported")
+	}
+	ll := Point{PointId: 1, Latitude: m.LowerLeftLat, Longitude: m.LowerLeftLon, HeightMAgl: m.HeightMAgl}
+	ur := Point{PointId: 2, Latitude: m.UpperRightLat, Longitude: m.UpperRightLon, HeightMAgl: m.HeightMAgl}
+	if ll.Latitude == 0 && ll.Longitude == 0 && ur.Latitude == 0 && ur.Longitude == 0 {
+		if len(payload.Points) == 0 {
+			return Point{}, Point{}, fmt.Errorf("matrix runs need corners or points")
+		}
+		ll.Latitude, ll.Longitude = 90, 180
+		ur.Latitude, ur.Longitude = -90, -180
+		for _, p := range payload.Points {
+			ll.Latitude, ll.Longitude = min(ll.Latitude, p.Latitude), min(ll.Longitude, p.Longitude)
+			ur.Latitude, ur.Longitude = max(ur.Latitude, p.Latitude), max(ur.Longitude, p.Longitude)
+		}
+	}
+	if ll.HeightMAgl == 0 && len(payload.Points) > 0 {
+		ll.HeightMAgl = payload.Points[0].HeightMAgl
+		ur.HeightMAgl = ll.HeightMAgl
+	}
+	if ur.Latitude < ll.Latitude || ur.Longitude < ll.Longitude {
+		return Point{}, Point{}, fmt.Errorf("matrix upper right corner is below or left of the lower left corner")
+	}
+
+	// Every source must land on the concentration grid.
+	if len(payload.ConcentrationGrids) > 0 {
+		g := payload.ConcentrationGrids[0]
+		halfLat := float64(g.SpanLat) * g.SpacingLat / 2
+		halfLon := float64(g.SpanLon) * g.SpacingLon / 2
+		if ll.Latitude < g.CenterLat-halfLat || ur.Latitude > g.CenterLat+halfLat ||
+			ll.Longitude < g.CenterLon-halfLon || ur.Longitude > g.CenterLon+halfLon {
+			return Point{}, Point{}, fmt.Errorf("matrix source grid extends beyond the concentration grid")
+		}
+	}
+	return ll, ur, nil
+}
+
+// MatrixContribution is the concentration at a receptor due to one source
+// of a matrix run.
+type MatrixContribution struct {
+	Receptor        Receptor      `json:"receptor"`
+	SourceLatitude  float64       `json:"sourceLatitude"`
+	SourceLongitude float64       `json:"sourceLongitude"`
+	SourceHeight    float64       `json:"sourceHeight"`
+	Level           int           `json:"level"`
+	Total           float64       `json:"total"` // sum over the sampling periods
+	Values          []SeriesValue `json:"values"`
+}
+
+// MatrixContributions splits the output of a matrix run into per-source
+// concentrations at each receptor. A matrix cdump holds one field per
+// source, in the order of its starting locations, in place of pollutants.
+func MatrixContributions(c *Cdump, receptors []Receptor, opts TimeSeriesOptions) ([]MatrixContribution, []Receptor, error) {
+	if len(c.Starts) < 2 || len(c.Pollutants) != len(c.Starts) {
+		return nil, nil, fmt.Errorf("cdump has %d fields for %d sources; not the output of a matrix run", len(c.Pollutants), len(c.Starts))
+	}
+	method := strings.ToLower(opts.Method)
+	if method == "" {
+		method = "nearest"
+	}
+	if method != "nearest" && method != "bilinear" {
+		return nil, nil, fmt.Errorf("unknown interpolation %q (want nearest or bilinear)", opts.Method)
+	}
+	factor := opts.Factor
+	if factor == 0 {
+		factor = 1
+	}
+
+	var out []MatrixContribution
+	var outside []Receptor
+	for _, rec := range receptors {
+		x, y, ok := c.gridPoint(rec.Latitude, rec.Longitude)
+		if !ok {
+			outside = append(outside, rec)
+			continue
+		}
+		for k, src := range c.Starts {
+			for l, level := range c.Levels {
+				mc := MatrixContribution{
+					Receptor:        rec,
+					SourceLatitude:  src.Latitude,
+					SourceLongitude: src.Longitude,
+					SourceHeight:    src.HeightMAgl,
+					Level:           level,
+				}
+				for _, p := range c.Periods {
+					v := c.sample(p.Conc[k][l], x, y, method == "bilinear") * factor
+					mc.Values = append(mc.Values, SeriesValue{Start: p.Start, Stop: p.Stop, Conc: v})
+					mc.Total += v
+				}
+				out = append(out, mc)
+			}
+		}
+	}
+	return out, outside, nil
+}
+
+// WriteMatrixCSV writes one row per receptor, source, level and period.
+func WriteMatrixCSV(w io.Writer, contributions []MatrixContribution, units string) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"receptor", "receptor_lat", "receptor_lon", "source_lat", "source_lon", "source_height",
+		"level", "start", "stop", "conc", "units"})
+	g := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	for _, mc := range contributions {
+		for _, v := range mc.Values {
+			cw.Write([]string{
+				mc.Receptor.Id, g(mc.Receptor.Latitude), g(mc.Receptor.Longitude),
+				g(mc.SourceLatitude), g(mc.SourceLongitude), g(mc.SourceHeight),
+				strconv.Itoa(mc.Level),
+				v.Start.Format(time.RFC3339), v.Stop.Format(time.RFC3339),
+				strconv.FormatFloat(v.Conc, 'g', 6, 64), units,
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// gridPoint returns the fractional grid indices of a point, and false if it
+// lies more than half a cell outside the grid.
+func (c *Cdump) gridPoint(lat, lon float64) (float64, float64, bool) {
+	x, y := c.gridPosition(lat, lon)
+	ok := x >= -0.5 && y >= -0.5 && x <= float64(c.NumLon)-0.5 && y <= float64(c.NumLat)-0.5
+	return x, y, ok
+}
+
+// sample reads a field at fractional grid indices, from the nearest cell or
+// interpolated bilinearly between the four surrounding cell centers. Both
+// are clamped at the grid edge.
+func (c *Cdump) sample(conc []float32, x, y float64, bilinear bool) float64 {
+	if !bilinear {
+		i := min(max(int(math.Round(x)), 0), c.NumLon-1)
+		j := min(max(int(math.Round(y)), 0), c.NumLat-1)
+		return float64(conc[j*c.NumLon+i])
+	}
+	cx := min(max(x, 0), float64(c.NumLon-1))
+	cy := min(max(y, 0), float64(c.NumLat-1))
+	i0, j0 := int(math.Floor(cx)), int(math.Floor(cy))
+	i1, j1 := min(i0+1, c.NumLon-1), min(j0+1, c.NumLat-1)
+	fx, fy := cx-float64(i0), cy-float64(j0)
+	at := func(i, j int) float64 { return float64(conc[j*c.NumLon+i]) }
+	return (1-fy)*((1-fx)*at(i0, j0)+fx*at(i1, j0)) + fy*((1-fx)*at(i0, j1)+fx*at(i1, j1))
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	_ "modernc.org/sqlite"
+)
+
+// MBTiles reads map tiles from an MBTiles file. The file is an SQLite
+// database whose tiles may be a plain table or a view, such as the view
+// over the map and images tables that mb-util and TileMill write.
+type MBTiles struct {
+	Path   string
+	Format string // image format from the metadata, e.g. "png"
+	db     *sql.DB
+}
+
+// OpenMBTiles opens an MBTiles file read-only. The file stays open for
+// Tile until Close.
+func OpenMBTiles(path string) (*MBTiles, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite would report a missing file as a database it cannot open.
+	if _, err := os.Stat(abs); err != nil {
+		return nil, err
+	}
+	dsn := (&url.URL{Scheme: "file", Path: abs, RawQuery: "mode=ro"}).String()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	m := &MBTiles{Path: path, db: db}
+	if err := m.check(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+func (m *MBTiles) Close() error { return m.db.Close() }
+
+// check reads the tile format from the metadata and makes sure the tiles
+// can be queried.
+func (m *MBTiles) check() error {
+	var format sql.NullString
+	err := m.db.QueryRow(`SELECT value FROM metadata WHERE name = 'format'`).Scan(&format)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("reading metadata: %v", err)
+	}
+	m.Format = format.String
+	if m.Format == "pbf" {
+		return fmt.Errorf("vector tiles are not supported, only PNG and JPEG")
+	}
+	rows, err := m.db.Query(`SELECT zoom_level, tile_column, tile_row, tile_data FROM tiles LIMIT 1`)
+	if err != nil {
+		return fmt.Errorf("reading tiles: %v", err)
+	}
+	return rows.Close()
+}
+
+// Tile returns the image data of an XYZ tile, or nil when the file does not
+// have it. MBTiles rows count from the south, as in TMS.
+func (m *MBTiles) Tile(z, x, y int) ([]byte, error) {
+	var data []byte
+	err := m.db.QueryRow(`SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?`,
+		z, x, 1<<z-1-y).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: tile %d/%d/%d: %v", m.Path, z, x, y, err)
+	}
+	if data == nil {
+		return nil, fmt.Errorf("%s: tile %d/%d/%d has no image data", m.Path, z, x, y)
+	}
+	return data, nil
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func metCatalogCmd(args []string) error {
+	fs := flag.NewFlagSet("metcatalog", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: hysplit-run metcatalog [flags] [json_payload_file]")
+		fmt.Fprintln(fs.Output(), "Lists the ARL files of the met catalog, or the files picked for a payload.")
+		fs.PrintDefaults()
+	}
+	model := fs.String("model", "", "only list files of this model")
+	format := fs.String("format", "text", "text or json")
+	resolve := configFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return fmt.Errorf("expected at most one payload file")
+	}
+	cfg, err := resolve()
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() == 1 {
+		payload, err := loadPayload(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		if payload.Met == nil {
+			return fmt.Errorf("payload has no met block")
+		}
+		payload.MetFiles = nil
+		if payload, err = selectMetFiles(cfg, payload); err != nil {
+			return err
+		}
+		for _, mf := range payload.MetFiles {
+			fmt.Println(filepath.Join(mf.Directory, mf.FileName))
+		}
+		return nil
+	}
+
+	dirs := metCatalogDirs(cfg)
+	if len(dirs) == 0 {
+		return fmt.Errorf("no met catalog directories configured (-met-catalog or -met-dir)")
+	}
+	cat, err := ScanMetCatalog(dirs)
+	if err != nil {
+		return err
+	}
+	if *model != "" {
+		var entries []MetCatalogEntry
+		for _, e := range cat.Entries {
+			if e.Matches(*model) {
+				entries = append(entries, e)
+			}
+		}
+		cat.Entries = entries
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(cat)
+	case "text":
+		for _, e := range cat.Entries {
+			fmt.Printf("%-10s %-4s %g %-3s %s to %s every %dmin  lat %.2f..%.2f lon %.2f..%.2f  %s\n",
+				e.Model, e.Source, e.Resolution, e.ResolutionUnits,
+				e.Start.Format("2006-01-02 15:04"), e.End.Format("2006-01-02 15:04"), e.StepMinutes,
+				e.South, e.North, e.West, e.East, filepath.Join(e.Directory, e.FileName))
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown format %q (want text or json)", *format)
+}
+
+func metProfileCmd(args []string) error {
+	fs := flag.NewFlagSet("metprofile", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: hysplit-run metprofile -lat <lat> -lon <lon> -time <time> [flags] <arl_file>...")
+		fs.PrintDefaults()
+	}
+	lat := fs.Float64("lat", 0, "latitude")
+	lon := fs.Float64("lon", 0, "longitude")
+	at := fs.String("time", "", `valid time, e.g. "2025-12-01 06:00" or RFC3339 (UTC)`)
+	format := fs.String("format", "text", "text or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 || *at == "" {
+		fs.Usage()
+		return fmt.Errorf("need -time and at least one ARL file")
+	}
+	t, err := parseObservationTime(*at)
+	if err != nil {
+		return err
+	}
+	var files []MetFile
+	for _, path := range fs.Args() {
+		dir, name := filepath.Split(path)
+		files = append(files, MetFile{Directory: dir, FileName: name})
+	}
+	a, err := metFileAt(files, t)
+	if err != nil {
+		return err
+	}
+	prof, err := a.Profile(*lat, *lon, t)
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(prof)
+	case "text":
+		return WriteMetProfileText(os.Stdout, prof)
+	}
+	return fmt.Errorf("unknown format %q (want text or json)", *format)
+}
+
+func windCmd(args []string) error {
+	fs := flag.NewFlagSet("wind", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: hysplit-run wind (-time <time> | -frames <frames.json>) [flags] <arl_file>...")
+		fmt.Fprintln(fs.Output(), "With -frames, one wind frame is drawn per concentration frame, at its time and bbox.")
+		fs.PrintDefaults()
+	}
+	at := fs.String("time", "", `valid time, e.g. "2025-12-01 06:00" or RFC3339 (UTC)`)
+	framesPath := fs.String("frames", "", "match the times and bboxes of a <name>_frames.json file")
+	level := fs.Int("level", 1, "ARL level index, 0 for the 10 m wind")
+	style := fs.String("style", "barbs", "barbs or streamlines")
+	spacing := fs.Int("spacing", 48, "pixels between barbs or streamline seeds")
+	bbox := fs.String("bbox", "", "west,south,east,north (default: the met grid)")
+	output := fs.String("o", ".", "output directory")
+	name := fs.String("name", "wind", "base name of the PNG and frames files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 || (*at == "") == (*framesPath == "") {
+		fs.Usage()
+		return fmt.Errorf("need one of -time or -frames and at least one ARL file")
+	}
+	var files []MetFile
+	for _, path := range fs.Args() {
+		dir, base := filepath.Split(path)
+		files = append(files, MetFile{Directory: dir, FileName: base})
+	}
+	opts := WindFieldOptions{Level: *level, Style: *style, Spacing: *spacing}
+	if *bbox != "" {
+		b, err := parseFloatList(*bbox)
+		if err != nil || len(b) != 4 {
+			return fmt.Errorf("bad -bbox %q (want west,south,east,north)", *bbox)
+		}
+		opts.West, opts.South, opts.East, opts.North = b[0], b[1], b[2], b[3]
+	}
+
+	// Each frame is a time and a bbox.
+	var targets []KmlResult
+	if *framesPath != "" {
+		data, err := os.ReadFile(*framesPath)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &targets); err != nil {
+			return fmt.Errorf("parsing %s: %v", *framesPath, err)
+		}
+	} else {
+		t, err := parseObservationTime(*at)
+		if err != nil {
+			return err
+		}
+		targets = []KmlResult{{T: t.Unix()}}
+	}
+
+	var frames []KmlResult
+	for _, target := range targets {
+		t := time.Unix(target.T, 0).UTC()
+		a, err := metFileAt(files, t)
+		if err != nil {
+			return err
+		}
+		o := opts
+		if b := target.Bbox; b != nil {
+			o.West, o.South, o.East, o.North = b["west"], b["south"], b["east"], b["north"]
+		}
+		frame, err := RenderWindField(a, t, o)
+		if err != nil {
+			return err
+		}
+		frames = append(frames, frame)
+	}
+	if err := os.MkdirAll(*output, 0755); err != nil {
+		return err
+	}
+	written, err := writeFrames(frames, *output, *name)
+	for _, path := range written {
+		fmt.Println(path)
+	}
+	return err
+}
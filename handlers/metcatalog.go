@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MetSelection asks for met files from the catalog instead of a metFiles
+// list. Files of the model that cover the run window and the points are
+// picked automatically.
+type MetSelection struct {
+	Model string `json:"model"` // e.g. "GFS0P25", matched against the file name or the ARL source
+}
+
+// MetCatalogEntry indexes one ARL file.
+type MetCatalogEntry struct {
+	Directory       string    `json:"directory"`
+	FileName        string    `json:"fileName"`
+	Model           string    `json:"model"`  // from the file name, e.g. "GFS0P25"
+	Source          string    `json:"source"` // from the index record, e.g. "GFSQ"
+	Resolution      float64   `json:"resolution"`
+	ResolutionUnits string    `json:"resolutionUnits"` // "deg" or "km"
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	StepMinutes     int       `json:"stepMinutes"`
+	South           float64   `json:"south"`
+	North           float64   `json:"north"`
+	West            float64   `json:"west"`
+	East            float64   `json:"east"`
+	Grid            ARLGrid   `json:"grid"`
+}
+
+// MetCatalog is the list of ARL files found under the catalog directories.
+type MetCatalog struct {
+	Entries []MetCatalogEntry `json:"entries"`
+}
+
+// metNameDate matches the date parts of met file names, e.g. "20251201",
+// "dec25", "w1" or "t00z", which do not name the model.
+var metNameDate = regexp.MustCompile(`^(\d+|(jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)\d*|w\d|t\d\dz|f\d+|bin|arl)$`)
+
+// metModelName returns the model part of a met file name, e.g. "GFS0P25"
+// for "20251201_gfs0p25" and "GDAS1" for "gdas1.dec25.w1".
+func metModelName(fileName string) string {
+	for _, part := range strings.FieldsFunc(strings.ToLower(fileName), func(r rune) bool {
+		return r == '_' || r == '.' || r == '-'
+	}) {
+		if !metNameDate.MatchString(part) {
+			return strings.ToUpper(part)
+		}
+	}
+	return ""
+}
+
+// ScanMetCatalog indexes the ARL files under dirs, recursively. Files that
+// are not ARL files are skipped.
+func ScanMetCatalog(dirs []string) (*MetCatalog, error) {
+	cat := &MetCatalog{}
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			a, err := ReadARLFile(path)
+			if err != nil {
+				return nil
+			}
+			cat.Entries = append(cat.Entries, newMetCatalogEntry(a))
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("scanning met directory %s: %v", dir, err)
+		}
+	}
+	sort.SliceStable(cat.Entries, func(i, j int) bool {
+		a, b := cat.Entries[i], cat.Entries[j]
+		if a.Model != b.Model {
+			return a.Model < b.Model
+		}
+		return a.Start.Before(b.Start)
+	})
+	return cat, nil
+}
+
+func newMetCatalogEntry(a *ARLFile) MetCatalogEntry {
+	dir, name := filepath.Split(a.Path)
+	e := MetCatalogEntry{
+		Directory: dir,
+		FileName:  name,
+		Model:     metModelName(name),
+		Source:    strings.TrimSpace(a.Source),
+		Start:     a.Times[0],
+		End:       a.Times[len(a.Times)-1],
+		Grid:      a.Grid,
+	}
+	if e.Model == "" {
+		e.Model = e.Source
+	}
+	if len(a.Times) > 1 {
+		e.StepMinutes = int(a.Times[1].Sub(a.Times[0]).Minutes())
+	}
+	e.Resolution, e.ResolutionUnits = a.Grid.Resolution()
+	e.South, e.North, e.West, e.East = a.Grid.Bounds()
+	return e
+}
+
+// Matches reports whether the entry is of the given model, by file name or
+// ARL source.
+func (e MetCatalogEntry) Matches(model string) bool {
+	return strings.EqualFold(e.Model, model) || strings.EqualFold(e.Source, model)
+}
+
+// runWindow returns the first and last time a payload needs met data for,
+// including repeated start times.
+func runWindow(payload Payload) (int64, int64) {
+	meta := payload.SimulationMeta
+	first, last := min(meta.StartEpochUTC, meta.EndEpochUTC), max(meta.StartEpochUTC, meta.EndEpochUTC)
+	if rep := meta.StartRepeat; rep != nil && rep.Count > 1 {
+		last += int64((rep.Count-1)*rep.IntervalHours) * 3600
+	}
+	return first, last
+}
+
+// Select returns the smallest time ordered set of files of a model that
+// covers the run window of the payload and contains its points. Files
+// may join with a gap of at most one time step.
+func (c *MetCatalog) Select(payload Payload, model string) ([]MetFile, error) {
+	var candidates []MetCatalogEntry
+	for _, e := range c.Entries {
+		if !e.Matches(model) {
+			continue
+		}
+		inside := true
+		for _, p := range payload.Points {
+			inside = inside && e.Grid.Contains(p.Latitude, p.Longitude)
+		}
+		if inside {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no %s met files in the catalog contain the points", model)
+	}
+
+	first, last := runWindow(payload)
+	from, to := time.Unix(first, 0).UTC(), time.Unix(last, 0).UTC()
+	var files []MetFile
+	covered := from
+	for len(files) == 0 || covered.Before(to) {
+		best := -1
+		for i, e := range candidates {
+			start := e.Start
+			if len(files) > 0 {
+				start = start.Add(-time.Duration(e.StepMinutes) * time.Minute)
+			}
+			if start.After(covered) || e.End.Before(covered) || len(files) > 0 && e.End.Equal(covered) {
+				continue
+			}
+			if best < 0 || e.End.After(candidates[best].End) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return nil, fmt.Errorf("%s met files in the catalog do not cover %s", model, covered.Format("2006-01-02 15:04"))
+		}
+		e := candidates[best]
+		files = append(files, MetFile{Directory: e.Directory, FileName: e.FileName})
+		covered = e.End
+	}
+	return files, nil
+}
+
+// metCatalogDirs returns the directories scanned for the met catalog.
+func metCatalogDirs(cfg Config) []string {
+	if len(cfg.MetCatalogDirs) > 0 {
+		return cfg.MetCatalogDirs
+	}
+	if cfg.MetDir != "" {
+		return []string{cfg.MetDir}
+	}
+	return nil
+}
+
+// selectMetFiles fills in the met files of a payload that asks for a
+// model. An explicit metFiles list takes precedence.
+func selectMetFiles(cfg Config, payload Payload) (Payload, error) {
+	if payload.Met == nil || len(payload.MetFiles) > 0 {
+		return payload, nil
+	}
+	if payload.Met.Model == "" {
+		return payload, fmt.Errorf("met: model is required")
+	}
+	dirs := metCatalogDirs(cfg)
+	if len(dirs) == 0 {
+		return payload, fmt.Errorf("met: no met catalog directories configured (-met-catalog or -met-dir)")
+	}
+	cat, err := ScanMetCatalog(dirs)
+	if err != nil {
+		return payload, err
+	}
+	files, err := cat.Select(payload, payload.Met.Model)
+	if err != nil {
+		return payload, err
+	}
+	payload.MetFiles = files
+	return payload, nil
+}
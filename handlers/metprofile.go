@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MetProfile is the meteorology at one place and time, interpolated from
+// an ARL file: the surface variables and one entry per native level.
+type MetProfile struct {
+	Latitude  float64            `json:"latitude"`
+	Longitude float64            `json:"longitude"`
+	Time      time.Time          `json:"time"`
+	Source    string             `json:"source"`
+	Surface   map[string]float64 `json:"surface"`
+	Levels    []MetProfileLevel  `json:"levels"`
+}
+
+// MetProfileLevel holds the variables of one level. U and V are turned to
+// true east and north; Speed and Direction (where the wind comes from, in
+// degrees) follow from them.
+type MetProfileLevel struct {
+	Level      float64            `json:"level"`              // native level: sigma, hPa or m
+	Pressure   float64            `json:"pressure,omitempty"` // hPa
+	HeightMAgl float64            `json:"heightMAgl"`
+	U          float64            `json:"u"`
+	V          float64            `json:"v"`
+	Speed      float64            `json:"speed"`
+	Direction  float64            `json:"direction"`
+	Values     map[string]float64 `json:"values"`
+}
+
+// rdOverG is the dry air gas constant over gravity, in m/K.
+const rdOverG = 287.04 / 9.81
+
+// windDirection returns the direction the wind blows from, in degrees.
+func windDirection(u, v float64) float64 {
+	if u == 0 && v == 0 {
+		return 0
+	}
+	return math.Mod(math.Atan2(-u, -v)*180/math.Pi+360, 360)
+}
+
+// timeWeights returns the periods around t and the weight of the later one.
+func (a *ARLFile) timeWeights(t time.Time) (int, int, float64, error) {
+	n := len(a.Times)
+	if n == 0 {
+		return 0, 0, 0, fmt.Errorf("%s has no time periods", a.Path)
+	}
+	if t.Before(a.Times[0]) || t.After(a.Times[n-1]) {
+		return 0, 0, 0, fmt.Errorf("%s covers %s to %s, not %s", a.Path,
+			a.Times[0].Format("2006-01-02 15:04"), a.Times[n-1].Format("2006-01-02 15:04"), t.Format("2006-01-02 15:04"))
+	}
+	i := sort.Search(n, func(i int) bool { return !a.Times[i].Before(t) })
+	if a.Times[i].Equal(t) {
+		return i, i, 0, nil
+	}
+	span := a.Times[i].Sub(a.Times[i-1]).Seconds()
+	return i - 1, i, t.Sub(a.Times[i-1]).Seconds() / span, nil
+}
+
+// value interpolates a variable of level k in space and time.
+func (a *ARLFile) value(k int, v string, x, y float64, t0, t1 int, w float64) (float64, error) {
+	f0, err := a.ReadField(t0, k, v)
+	if err != nil {
+		return 0, err
+	}
+	val := f0.At(x, y, a.Grid.Global())
+	if w == 0 {
+		return val, nil
+	}
+	f1, err := a.ReadField(t1, k, v)
+	if err != nil {
+		return 0, err
+	}
+	return (1-w)*val + w*f1.At(x, y, a.Grid.Global()), nil
+}
+
+// Profile interpolates every variable of the file to a point and time,
+// bilinearly on the grid and linearly between time periods. Level heights
+// come from HGTS where the file has it, and from the hypsometric equation
+// otherwise.
+func (a *ARLFile) Profile(lat, lon float64, t time.Time) (*MetProfile, error) {
+	if !a.Grid.Contains(lat, lon) {
+		return nil, fmt.Errorf("%s: %.4f, %.4f is outside the grid", a.Path, lat, lon)
+	}
+	t0, t1, w, err := a.timeWeights(t)
+	if err != nil {
+		return nil, err
+	}
+	x, y := a.Grid.XY(lat, lon)
+	rot := a.Grid.Rotation(lat, lon)
+	turn := func(u, v float64) (float64, float64) {
+		return u*math.Cos(rot) + v*math.Sin(rot), v*math.Cos(rot) - u*math.Sin(rot)
+	}
+
+	p := &MetProfile{Latitude: lat, Longitude: lon, Time: t, Source: a.Source, Surface: make(map[string]float64)}
+	for _, v := range a.Levels[0].Variables {
+		if p.Surface[v], err = a.value(0, v, x, y, t0, t1, w); err != nil {
+			return nil, err
+		}
+	}
+	if u, ok := p.Surface["U10M"]; ok {
+		p.Surface["U10M"], p.Surface["V10M"] = turn(u, p.Surface["V10M"])
+	}
+
+	psfc, hasPsfc := p.Surface["PRSS"]
+	if !hasPsfc {
+		psfc = 1013.25
+	}
+	zsfc := p.Surface["SHGT"]
+	for k := 1; k < len(a.Levels); k++ {
+		lvl := MetProfileLevel{Level: a.Levels[k].Height, Values: make(map[string]float64)}
+		for _, v := range a.Levels[k].Variables {
+			if lvl.Values[v], err = a.value(k, v, x, y, t0, t1, w); err != nil {
+				return nil, err
+			}
+		}
+		switch a.Grid.VertFlag {
+		case 1: // sigma
+			lvl.Pressure = lvl.Level * psfc
+		case 2: // pressure
+			lvl.Pressure = lvl.Level
+		case 4: // hybrid: pressure offset plus sigma
+			offset := math.Floor(lvl.Level)
+			lvl.Pressure = offset + (lvl.Level-offset)*psfc
+		case 3: // terrain following, heights in m
+			lvl.HeightMAgl = lvl.Level
+		}
+		if u, ok := lvl.Values["UWND"]; ok {
+			lvl.U, lvl.V = turn(u, lvl.Values["VWND"])
+			lvl.Speed = math.Hypot(lvl.U, lvl.V)
+			lvl.Direction = windDirection(lvl.U, lvl.V)
+		}
+		p.Levels = append(p.Levels, lvl)
+	}
+
+	// Heights above ground, from the surface up.
+	prevP, prevT := psfc, p.Surface["T02M"]
+	prevZ := 0.0
+	for k := range p.Levels {
+		lvl := &p.Levels[k]
+		if hgts, ok := lvl.Values["HGTS"]; ok {
+			lvl.HeightMAgl = hgts - zsfc
+			continue
+		}
+		if lvl.Pressure <= 0 {
+			continue
+		}
+		tv := lvl.Values["TEMP"] * (1 + 0.61*lvl.Values["SPHU"])
+		if prevT == 0 {
+			prevT = tv
+		}
+		lvl.HeightMAgl = prevZ + rdOverG*(prevT+tv)/2*math.Log(prevP/lvl.Pressure)
+		prevP, prevT, prevZ = lvl.Pressure, tv, lvl.HeightMAgl
+	}
+	return p, nil
+}
+
+// At interpolates the wind and temperature of a profile linearly in height.
+// Heights below the lowest level take its values.
+func (p *MetProfile) At(height float64) (u, v, temp float64) {
+	if len(p.Levels) == 0 {
+		return 0, 0, 0
+	}
+	lv := p.Levels
+	if height <= lv[0].HeightMAgl {
+		return lv[0].U, lv[0].V, lv[0].Values["TEMP"]
+	}
+	for k := 1; k < len(lv); k++ {
+		if height <= lv[k].HeightMAgl {
+			w := (height - lv[k-1].HeightMAgl) / (lv[k].HeightMAgl - lv[k-1].HeightMAgl)
+			mix := func(a, b float64) float64 { return (1-w)*a + w*b }
+			return mix(lv[k-1].U, lv[k].U), mix(lv[k-1].V, lv[k].V), mix(lv[k-1].Values["TEMP"], lv[k].Values["TEMP"])
+		}
+	}
+	top := lv[len(lv)-1]
+	return top.U, top.V, top.Values["TEMP"]
+}
+
+// metFileAt returns the first met file of a list that covers t.
+func metFileAt(files []MetFile, t time.Time) (*ARLFile, error) {
+	for _, mf := range files {
+		a, err := ReadARLFile(filepath.Join(mf.Directory, mf.FileName))
+		if err != nil {
+			return nil, err
+		}
+		if !t.Before(a.Times[0]) && !t.After(a.Times[len(a.Times)-1]) {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("no met file covers %s", t.Format("2006-01-02 15:04"))
+}
+
+// SourceConditions is the meteorology at a release point at the start of
+// a run.
+type SourceConditions struct {
+	PointId         int       `json:"pointId"`
+	Latitude        float64   `json:"latitude"`
+	Longitude       float64   `json:"longitude"`
+	HeightMAgl      float64   `json:"heightMAgl"`
+	Time            time.Time `json:"time"`
+	PBLHeight       float64   `json:"pblHeight,omitempty"` // m, from PBLH, HPBL or MXHT
+	Wind10mSpeed    float64   `json:"wind10mSpeed,omitempty"`
+	Wind10mDir      float64   `json:"wind10mDir,omitempty"`
+	WindSpeed       float64   `json:"windSpeed"` // at the release height
+	WindDirection   float64   `json:"windDirection"`
+	Temperature     float64   `json:"temperature,omitempty"` // K, at the release height
+	SurfacePressure float64   `json:"surfacePressure,omitempty"`
+}
+
+// PointConditions reports the wind and boundary layer at each point of a
+// payload at the run start, from its met files.
+func PointConditions(payload Payload) ([]SourceConditions, error) {
+	t := time.Unix(payload.SimulationMeta.StartEpochUTC, 0).UTC()
+	a, err := metFileAt(payload.MetFiles, t)
+	if err != nil {
+		return nil, err
+	}
+	var out []SourceConditions
+	for _, pt := range startLocations(payload.Points) {
+		prof, err := a.Profile(pt.Latitude, pt.Longitude, t)
+		if err != nil {
+			return nil, err
+		}
+		u, v, temp := prof.At(pt.HeightMAgl)
+		sc := SourceConditions{
+			PointId:         pt.PointId,
+			Latitude:        pt.Latitude,
+			Longitude:       pt.Longitude,
+			HeightMAgl:      pt.HeightMAgl,
+			Time:            t,
+			WindSpeed:       math.Hypot(u, v),
+			WindDirection:   windDirection(u, v),
+			Temperature:     temp,
+			SurfacePressure: prof.Surface["PRSS"],
+		}
+		for _, name := range []string{"PBLH", "HPBL", "MXHT"} {
+			if h, ok := prof.Surface[name]; ok {
+				sc.PBLHeight = h
+				break
+			}
+		}
+		if u10, ok := prof.Surface["U10M"]; ok {
+			v10 := prof.Surface["V10M"]
+			sc.Wind10mSpeed, sc.Wind10mDir = math.Hypot(u10, v10), windDirection(u10, v10)
+		}
+		out = append(out, sc)
+	}
+	return out, nil
+}
+
+// writeSourceConditions writes the conditions at the release points into
+// the job directory as source_met.json.
+func writeSourceConditions(payload Payload, dir string) (string, error) {
+	conditions, err := PointConditions(payload)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "source_met.json")
+	data, err := json.MarshalIndent(conditions, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// WriteMetProfileText writes a profile as a table, one line per level.
+func WriteMetProfileText(w io.Writer, p *MetProfile) error {
+	fmt.Fprintf(w, "%s at %.4f, %.4f, %s\n", strings.TrimSpace(p.Source), p.Latitude, p.Longitude, p.Time.Format("2006-01-02 15:04"))
+	var names []string
+	for name := range p.Surface {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s %g\n", name, p.Surface[name])
+	}
+	fmt.Fprintf(w, "%10s %8s %9s %7s %7s %7s %5s %8s\n", "level", "hPa", "m agl", "u", "v", "speed", "dir", "temp")
+	for _, l := range p.Levels {
+		fmt.Fprintf(w, "%10g %8.1f %9.1f %7.2f %7.2f %7.2f %5.0f %8.2f\n",
+			l.Level, l.Pressure, l.HeightMAgl, l.U, l.V, l.Speed, l.Direction, l.Values["TEMP"])
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/fogleman/gg"
+)
+
+// Particle is one particle or puff of a particle dump.
+type Particle struct {
+	Latitude     float64   `json:"latitude"`
+	Longitude    float64   `json:"longitude"`
+	HeightMAgl   float64   `json:"heightMAgl"`
+	SigmaH       float64   `json:"sigmaH"` // horizontal puff size, m
+	SigmaW       float64   `json:"sigmaW"` // vertical turbulence, m/s
+	SigmaV       float64   `json:"sigmaV"` // horizontal turbulence, m/s
+	Mass         []float64 `json:"mass"`   // per pollutant slot
+	AgeMinutes   int       `json:"ageMinutes"`
+	Distribution int       `json:"distribution"` // HDWP: 0 particle, 1-4 puff and particle mixes
+	Pollutant    int       `json:"pollutant"`    // PTYP, index of the pollutant from 1
+	MetGrid      int       `json:"metGrid"`
+	Sort         int       `json:"sort"`
+}
+
+// ParticleDump holds every particle at one time of a PARDUMP file.
+type ParticleDump struct {
+	Time       time.Time  `json:"time"`
+	Pollutants int        `json:"pollutants"` // mass slots per particle
+	Particles  []Particle `json:"particles"`
+}
+
+// ReadPardumpFile reads a PARDUMP (or PARINIT) file.
+func ReadPardumpFile(path string) ([]ParticleDump, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dumps, err := ReadPardump(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return dumps, nil
+}
+
+// ReadPardump decodes particle dumps: per time a record with the particle
+// and pollutant count and the time, then three records per particle with
+// its masses, its position and spread, and its age, type, grid and sort
+// index. Big-endian Fortran records, as written by HYSPLIT.
+func ReadPardump(r io.Reader) ([]ParticleDump, error) {
+	var dumps []ParticleDump
+	for {
+		rec, err := readRecord(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return dumps, err
+		}
+		rr := &recordReader{buf: rec}
+		n, npol := rr.int32(), rr.int32()
+		yy, mm, dd, hh, mi := rr.int32(), rr.int32(), rr.int32(), rr.int32(), rr.int32()
+		if rr.err != nil {
+			return dumps, fmt.Errorf("dump %d: short header", len(dumps)+1)
+		}
+		if n < 0 || npol <= 0 {
+			return dumps, fmt.Errorf("dump %d: %d particles of %d pollutants", len(dumps)+1, n, npol)
+		}
+		d := ParticleDump{Time: cdumpTime(yy, mm, dd, hh, mi), Pollutants: npol, Particles: make([]Particle, n)}
+		for i := range d.Particles {
+			p := &d.Particles[i]
+			var recs [3]*recordReader
+			for k := range recs {
+				rec, err := readRecord(r)
+				if err != nil {
+					if errors.Is(err, io.EOF) {
+						err = io.ErrUnexpectedEOF
+					}
+					return dumps, fmt.Errorf("dump at %s, particle %d: %v", d.Time.Format("2006-01-02 15:04"), i+1, err)
+				}
+				recs[k] = &recordReader{buf: rec}
+			}
+			p.Mass = make([]float64, npol)
+			for m := range p.Mass {
+				p.Mass[m] = float64(recs[0].float32())
+			}
+			p.Latitude = float64(recs[1].float32())
+			p.Longitude = float64(recs[1].float32())
+			p.HeightMAgl = float64(recs[1].float32())
+			p.SigmaH = float64(recs[1].float32())
+			p.SigmaW = float64(recs[1].float32())
+			p.SigmaV = float64(recs[1].float32())
+			p.AgeMinutes = recs[2].int32()
+			p.Distribution = recs[2].int32()
+			p.Pollutant = recs[2].int32()
+			p.MetGrid = recs[2].int32()
+			p.Sort = recs[2].int32()
+			for _, rr := range recs {
+				if rr.err != nil {
+					return dumps, fmt.Errorf("dump at %s, particle %d: short record", d.Time.Format("2006-01-02 15:04"), i+1)
+				}
+			}
+		}
+		dumps = append(dumps, d)
+	}
+	return dumps, nil
+}
+
+// WritePardumpFile writes particle dumps in the PARDUMP format, which is
+// also the format HYSPLIT reads from PARINIT to initialize a run.
+func WritePardumpFile(path string, dumps []ParticleDump) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := WritePardump(w, dumps); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WritePardump encodes particle dumps in the PARDUMP format.
+func WritePardump(w io.Writer, dumps []ParticleDump) error {
+	rw := &recordWriter{}
+	for _, d := range dumps {
+		t := d.Time.UTC()
+		npol := max(d.Pollutants, 1)
+		rw.int32(len(d.Particles))
+		rw.int32(npol)
+		rw.int32(t.Year() % 100)
+		rw.int32(int(t.Month()))
+		rw.int32(t.Day())
+		rw.int32(t.Hour())
+		rw.int32(t.Minute())
+		if err := rw.flush(w); err != nil {
+			return err
+		}
+		for _, p := range d.Particles {
+			for m := 0; m < npol; m++ {
+				v := 0.0
+				if m < len(p.Mass) {
+					v = p.Mass[m]
+				}
+				rw.float32(float32(v))
+			}
+			if err := rw.flush(w); err != nil {
+				return err
+			}
+			for _, v := range []float64{p.Latitude, p.Longitude, p.HeightMAgl, p.SigmaH, p.SigmaW, p.SigmaV} {
+				rw.float32(float32(v))
+			}
+			if err := rw.flush(w); err != nil {
+				return err
+			}
+			for _, v := range []int{p.AgeMinutes, p.Distribution, p.Pollutant, p.MetGrid, p.Sort} {
+				rw.int32(v)
+			}
+			if err := rw.flush(w); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// selectDump returns the dump at t, or the last dump when t is zero.
+func selectDump(dumps []ParticleDump, t time.Time) (ParticleDump, error) {
+	if len(dumps) == 0 {
+		return ParticleDump{}, fmt.Errorf("no particle dumps")
+	}
+	if t.IsZero() {
+		return dumps[len(dumps)-1], nil
+	}
+	for _, d := range dumps {
+		if d.Time.Equal(t) {
+			return d, nil
+		}
+	}
+	return ParticleDump{}, fmt.Errorf("no particle dump at %s", t.Format("2006-01-02 15:04"))
+}
+
+// heightColor shades particles from yellow near the ground through red to
+// purple at the top height.
+func heightColor(h, top float64) color.NRGBA {
+	f := min(max(h/top, 0), 1)
+	if f < 0.5 {
+		g := 1 - f*2
+		return color.NRGBA{240, uint8(40 + 180*g), 30, 220}
+	}
+	g := (f - 0.5) * 2
+	return color.NRGBA{uint8(240 - 120*g), 40, uint8(30 + 170*g), 220}
+}
+
+// RenderParticles draws every dump as a plan view on a Web Mercator canvas
+// matching the frames of ProcessKml, and as a cross-section of height
+// against longitude over the same west-east range. All frames of a file
+// share one bbox and height range so they animate in place. Section
+// frames carry the height range as "bottom" and "top" in their bbox.
+func RenderParticles(dumps []ParticleDump) (plan, section []KmlResult, err error) {
+	minLon, minLat, maxLon, maxLat := 180.0, 90.0, -180.0, -90.0
+	top := 0.0
+	n := 0
+	for _, d := range dumps {
+		for _, p := range d.Particles {
+			minLon, maxLon = min(minLon, p.Longitude), max(maxLon, p.Longitude)
+			minLat, maxLat = min(minLat, p.Latitude), max(maxLat, p.Latitude)
+			top = max(top, p.HeightMAgl)
+			n++
+		}
+	}
+	if n == 0 {
+		return nil, nil, fmt.Errorf("no particles to render")
+	}
+	padLon := max((maxLon-minLon)*0.05, 0.05)
+	padLat := max((maxLat-minLat)*0.05, 0.05)
+	minLon, maxLon = minLon-padLon, maxLon+padLon
+	minLat, maxLat = max(minLat-padLat, -85), min(maxLat+padLat, 85)
+	// Round the section top up to a whole 500 m.
+	top = math.Ceil(max(top, 1)*1.05/500) * 500
+
+	minX, maxX := lonToX(minLon), lonToX(maxLon)
+	minY, maxY := latToY(maxLat), latToY(minLat)
+	const imgSize = 1024
+	const sectionHeight = 512
+	project := func(lon, lat float64) (float64, float64) {
+		return (lonToX(lon) - minX) / (maxX - minX) * imgSize,
+			(latToY(lat) - minY) / (maxY - minY) * imgSize
+	}
+
+	for _, d := range dumps {
+		dc := gg.NewContext(imgSize, imgSize)
+		sc := gg.NewContext(imgSize, sectionHeight)
+		for _, p := range d.Particles {
+			dc.SetColor(heightColor(p.HeightMAgl, top))
+			sc.SetColor(heightColor(p.HeightMAgl, top))
+			x, y := project(p.Longitude, p.Latitude)
+			dc.DrawCircle(x, y, 1.5)
+			dc.Fill()
+			sc.DrawCircle(x, sectionHeight*(1-p.HeightMAgl/top), 1.5)
+			sc.Fill()
+		}
+		frame, err := encodeFrame(dc, d.Time.Unix(), minLon, minLat, maxLon, maxLat)
+		if err != nil {
+			return nil, nil, err
+		}
+		plan = append(plan, frame)
+		frame, err = encodeFrame(sc, d.Time.Unix(), minLon, 0, maxLon, top)
+		if err != nil {
+			return nil, nil, err
+		}
+		frame.Bbox = map[string]float64{"west": minLon, "east": maxLon, "bottom": 0, "top": top}
+		section = append(section, frame)
+	}
+	return plan, section, nil
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+func particlesCmd(args []string) error {
+	fs := flag.NewFlagSet("particles", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: hysplit-run particles [flags] <PARDUMP>")
+		fs.PrintDefaults()
+	}
+	output := fs.String("o", ".", "output directory")
+	name := fs.String("name", "particles", "base name of the PNG and frames files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected one PARDUMP file")
+	}
+	dumps, err := ReadPardumpFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	plan, section, err := RenderParticles(dumps)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*output, 0755); err != nil {
+		return err
+	}
+	written, err := writeFrames(plan, *output, *name)
+	if err == nil {
+		var more []string
+		more, err = writeFrames(section, *output, *name+"_section")
+		written = append(written, more...)
+	}
+	for _, path := range written {
+		fmt.Println(path)
+	}
+	return err
+}
+
+func parinitCmd(args []string) error {
+	fs := flag.NewFlagSet("parinit", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: hysplit-run parinit [flags] <PARDUMP>")
+		fs.PrintDefaults()
+	}
+	at := fs.String("time", "", "dump time to keep (default: the last dump)")
+	output := fs.String("o", "PARINIT", "PARINIT file to write")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected one PARDUMP file")
+	}
+	dumps, err := ReadPardumpFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var t time.Time
+	if *at != "" {
+		if t, err = parseObservationTime(*at); err != nil {
+			return err
+		}
+	}
+	d, err := selectDump(dumps, t)
+	if err != nil {
+		return err
+	}
+	if err := WritePardumpFile(*output, []ParticleDump{d}); err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d particles at %s\n", *output, len(d.Particles), d.Time.Format("2006-01-02 15:04"))
+	return nil
+}
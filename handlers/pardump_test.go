@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDumps returns three hourly dumps of four particles from start.
+func testDumps(start time.Time) []ParticleDump {
+	var dumps []ParticleDump
+	for k := 0; k < 3; k++ {
+		d := ParticleDump{Time: start.Add(time.Duration(k) * time.Hour), Pollutants: 2}
+		for i := 0; i < 4; i++ {
+			d.Particles = append(d.Particles, Particle{
+				Latitude:     40 + float64(i)*0.25,
+				Longitude:    -90 + float64(k)*0.5,
+				HeightMAgl:   100 * float64(i+1),
+				SigmaH:       250,
+				Mass:         []float64{1.5, 0},
+				AgeMinutes:   60 * k,
+				Distribution: 0,
+				Pollutant:    1,
+				MetGrid:      1,
+				Sort:         i + 1,
+			})
+		}
+		dumps = append(dumps, d)
+	}
+	return dumps
+}
+
+func TestPardumpRoundTrip(t *testing.T) {
+	dumps := testDumps(time.Date(2025, 12, 31, 23, 30, 0, 0, time.UTC))
+	var buf bytes.Buffer
+	if err := WritePardump(&buf, dumps); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	got, err := ReadPardump(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, dumps) {
+		t.Errorf("round trip changed the dumps:\ngot  %+v\nwant %+v", got, dumps)
+	}
+
+	if _, err := ReadPardump(bytes.NewReader(data[:len(data)-10])); err == nil {
+		t.Error("expected an error for a truncated file")
+	}
+}
+
+func TestContinueFromJob(t *testing.T) {
+	root := t.TempDir()
+	cfg := Config{WorkRoot: root}
+	start := time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC)
+	dumps := testDumps(start)
+	if err := os.MkdirAll(filepath.Join(root, "day1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WritePardumpFile(filepath.Join(root, "day1", "PARDUMP"), dumps); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := Payload{
+		JobId: "day2",
+		SimulationMeta: SimulationMeta{
+			ModelType:     "CONCENTRATION",
+			Direction:     "FORWARD",
+			StartEpochUTC: start.Add(90 * time.Minute).Unix(),
+			EndEpochUTC:   start.Add(24 * time.Hour).Unix(),
+		},
+		ContinueFromJobId: "day1",
+	}
+	dir := filepath.Join(root, "day2")
+	got, err := continueFromJob(cfg, payload, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := dumps[1].Time.Unix(); got.SimulationMeta.StartEpochUTC != want {
+		t.Errorf("start = %d, want %d, the dump before the requested start", got.SimulationMeta.StartEpochUTC, want)
+	}
+	parinit, err := ReadPardumpFile(filepath.Join(dir, "PARINIT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parinit, dumps[1:2]) {
+		t.Errorf("PARINIT holds %+v, want the dump at %s", parinit, dumps[1].Time)
+	}
+	setup, err := GenerateSetupFile(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(setup, " ninit = 1,\n pinpf = 'PARINIT',\n") {
+		t.Errorf("SETUP.CFG does not read PARINIT:\n%s", setup)
+	}
+
+	payload.SimulationMeta.StartEpochUTC = start.Add(-time.Hour).Unix()
+	if _, err := continueFromJob(cfg, payload, dir); err == nil {
+		t.Error("expected an error for a start before the first dump")
+	}
+	payload.ContinueFromJobId = "missing"
+	if _, err := continueFromJob(cfg, payload, dir); err == nil {
+		t.Error("expected an error for a job without a PARDUMP")
+	}
+}
+
+func TestContinueEnsembleMembers(t *testing.T) {
+	root := t.TempDir()
+	cfg := Config{WorkRoot: root}
+	p := testPayload("CONCENTRATION", "FORWARD")
+	start := time.Unix(p.SimulationMeta.StartEpochUTC, 0).UTC()
+	if err := os.MkdirAll(filepath.Join(root, "day1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WritePardumpFile(filepath.Join(root, "day1", "PARDUMP"), testDumps(start)); err != nil {
+		t.Fatal(err)
+	}
+
+	p.SimulationMeta.StartEpochUTC = start.Add(90 * time.Minute).Unix()
+	p.ContinueFromJobId = "day1"
+	p.Ensemble = &EnsembleConfig{Id: "ens", GridFactor: 1, MaxMembers: 2}
+	members, manifest, err := ExpandEnsemble(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := prepareMembers(cfg, members, &manifest, filepath.Join(root, "ens")); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range members {
+		if want := start.Add(time.Hour).Unix(); m.SimulationMeta.StartEpochUTC != want {
+			t.Errorf("member %s starts at %d, want the dump at %d", m.JobId, m.SimulationMeta.StartEpochUTC, want)
+		}
+		if _, err := os.Stat(filepath.Join(root, m.JobId, "PARINIT")); err != nil {
+			t.Errorf("member %s: %v", m.JobId, err)
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image/color"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fogleman/gg"
+)
+
+// --- GeoJSON types ---
+
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GeoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// trajectoryColors are cycled through when drawing several trajectories.
+var trajectoryColors = []color.RGBA{
+	{220, 20, 60, 255},
+	{30, 144, 255, 255},
+	{34, 139, 34, 255},
+	{255, 140, 0, 255},
+	{148, 0, 211, 255},
+	{0, 128, 128, 255},
+}
+
+// runPlotProgram converts the model output to KML with concplot or trajplot
+// and returns the path of the KML file they produced in dir.
+func runPlotProgram(cfg Config, payload Payload, dir string) (string, error) {
+	name := "concplot"
+	if payload.SimulationMeta.ModelType == "TRAJECTORY" {
+		name = "trajplot"
+	}
+	bin, err := findExecutable(cfg, name)
+	if err != nil {
+		return "", err
+	}
+
+	input := outputPath(payload)
+	if _, err := os.Stat(input); err != nil {
+		return "", fmt.Errorf("model output not found: %v", err)
+	}
+
+	started := time.Now().Add(-time.Second)
+	ps := filepath.Join(dir, payload.SimulationMeta.OutputFile.FileName+".ps")
+	cmd := exec.Command(bin, "-i"+input, "-o"+ps, "-a3")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("%s failed: %v\n%s", name, err, out)
+	}
+
+	// The KML file name is chosen by the plot program, so pick the one it
+	// just wrote.
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.kml"))
+	var newest string
+	var newestTime time.Time
+	for _, m := range matches {
+		info, err := os.Stat(m)
+		if err != nil || info.ModTime().Before(started) {
+			continue
+		}
+		if newest == "" || info.ModTime().After(newestTime) {
+			newest, newestTime = m, info.ModTime()
+		}
+	}
+	if newest == "" {
+		return "", fmt.Errorf("%s did not produce a KML file in %s", name, dir)
+	}
+	return newest, nil
+}
+
+// writeFrames writes each rendered frame as a PNG file plus a JSON index of
+// all frames (the KmlResult list served by the API).
+func writeFrames(frames []KmlResult, dir, base string) ([]string, error) {
+	var written []string
+	for _, f := range frames {
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(f.Base64, "data:image/png;base64,"))
+		if err != nil {
+			return written, err
+		}
+		path := filepath.Join(dir, fmt.Sprintf("%s_%d.png", base, f.T))
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return written, err
+		}
+		written = append(written, path)
+	}
+
+	index, err := json.Marshal(frames)
+	if err != nil {
+		return written, err
+	}
+	path := filepath.Join(dir, base+"_frames.json")
+	if err := os.WriteFile(path, index, 0644); err != nil {
+		return written, err
+	}
+	return append(written, path), nil
+}
+
+// KmlToGeoJSON converts the concentration contours of a concplot KML file to
+// a GeoJSON feature collection, one MultiPolygon per contour and time.
+func KmlToGeoJSON(filePath string) (*GeoJSONFeatureCollection, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var root KmlRoot
+	if err := xml.Unmarshal(content, &root); err != nil {
+		return nil, fmt.Errorf("XML unmarshal error: %v", err)
+	}
+	styles := make(map[string]color.RGBA)
+	for _, s := range root.Document.Styles {
+		styles["#"+s.ID] = parseKmlColor(s.PolyStyle.Color)
+	}
+
+	fc := &GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for _, folder := range root.Document.Folders {
+		if !strings.Contains(folder.Name, "Concentration") {
+			continue
+		}
+		t := extractTimestamp(folder)
+		for _, pm := range folder.Placemarks {
+			var polygons [][][][]float64
+			for _, poly := range pm.MultiGeometry.Polygons {
+				ring := parseCoordinates(poly.OuterBoundary)
+				if len(ring) > 0 {
+					polygons = append(polygons, [][][]float64{ring})
+				}
+			}
+			if len(polygons) == 0 {
+				continue
+			}
+			props := map[string]interface{}{"t": t, "folder": folder.Name, "name": pm.Name}
+			if c, ok := styles[pm.StyleUrl]; ok {
+				props["fill"] = fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+				props["fill-opacity"] = float64(c.A) / 255.0
+			}
+			fc.Features = append(fc.Features, GeoJSONFeature{
+				Type:       "Feature",
+				Geometry:   GeoJSONGeometry{Type: "MultiPolygon", Coordinates: polygons},
+				Properties: props,
+			})
+		}
+	}
+	return fc, nil
+}
+
+// TdumpToGeoJSON converts trajectories to GeoJSON LineStrings with
+// [lon, lat, height] coordinates.
+func TdumpToGeoJSON(td *Tdump) *GeoJSONFeatureCollection {
+	fc := &GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for _, traj := range td.Trajectories {
+		coords := make([][]float64, 0, len(traj.Points))
+		times := make([]int64, 0, len(traj.Points))
+		for _, p := range traj.Points {
+			coords = append(coords, []float64{p.Longitude, p.Latitude, p.Height})
+			times = append(times, p.Time.Unix())
+		}
+		fc.Features = append(fc.Features, GeoJSONFeature{
+			Type:     "Feature",
+			Geometry: GeoJSONGeometry{Type: "LineString", Coordinates: coords},
+			Properties: map[string]interface{}{
+				"trajectory":      traj.Index,
+				"direction":       td.Direction,
+				"startTime":       traj.Start.Time.Unix(),
+				"startHeightMAgl": traj.Start.HeightMAgl,
+				"times":           times,
+			},
+		})
+	}
+	return fc
+}
+
+// RenderTrajectories draws all trajectories onto a transparent Web Mercator
+// canvas, matching the frames produced by ProcessKml.
+func RenderTrajectories(td *Tdump) (KmlResult, error) {
+	minLon, minLat, maxLon, maxLat := 180.0, 90.0, -180.0, -90.0
+	n := 0
+	for _, traj := range td.Trajectories {
+		for _, p := range traj.Points {
+			minLon, maxLon = min(minLon, p.Longitude), max(maxLon, p.Longitude)
+			minLat, maxLat = min(minLat, p.Latitude), max(maxLat, p.Latitude)
+			n++
+		}
+	}
+	if n == 0 {
+		return KmlResult{}, fmt.Errorf("no trajectory points to render")
+	}
+	// Pad the bounds so lines and start markers are not clipped.
+	padLon := max((maxLon-minLon)*0.05, 0.05)
+	padLat := max((maxLat-minLat)*0.05, 0.05)
+	minLon, maxLon = minLon-padLon, maxLon+padLon
+	minLat, maxLat = minLat-padLat, maxLat+padLat
+
+	minX, maxX := lonToX(minLon), lonToX(maxLon)
+	minY, maxY := latToY(maxLat), latToY(minLat)
+	const imgSize = 1024
+	project := func(lon, lat float64) (float64, float64) {
+		return (lonToX(lon) - minX) / (maxX - minX) * imgSize,
+			(latToY(lat) - minY) / (maxY - minY) * imgSize
+	}
+
+	dc := gg.NewContext(imgSize, imgSize)
+	var start int64
+	for i, traj := range td.Trajectories {
+		if len(traj.Points) == 0 {
+			continue
+		}
+		if start == 0 || traj.Start.Time.Unix() < start {
+			start = traj.Start.Time.Unix()
+		}
+		dc.SetColor(trajectoryColors[i%len(trajectoryColors)])
+		dc.SetLineWidth(3)
+		for j, p := range traj.Points {
+			x, y := project(p.Longitude, p.Latitude)
+			if j == 0 {
+				dc.MoveTo(x, y)
+			} else {
+				dc.LineTo(x, y)
+			}
+		}
+		dc.Stroke()
+
+		x, y := project(traj.Points[0].Longitude, traj.Points[0].Latitude)
+		dc.DrawRectangle(x-6, y-6, 12, 12)
+		dc.SetRGB(0, 0, 0)
+		dc.Fill()
+	}
+
+	return encodeFrame(dc, start, minLon, minLat, maxLon, maxLat)
+}
+
+// encodeFrame packs a rendered canvas into a KmlResult.
+func encodeFrame(dc *gg.Context, t int64, west, south, east, north float64) (KmlResult, error) {
+	var sb strings.Builder
+	enc := base64.NewEncoder(base64.StdEncoding, &sb)
+	if err := dc.EncodePNG(enc); err != nil {
+		return KmlResult{}, err
+	}
+	enc.Close()
+	return KmlResult{
+		T: t,
+		Bbox: map[string]float64{
+			"west": west, "south": south, "east": east, "north": north,
+		},
+		Base64: "data:image/png;base64," + sb.String(),
+	}, nil
+}
+
+// plotOutputs converts the model output of a prepared payload to the requested
+// formats ("kml", "png", "geojson", "annotated", "map", "particles") and
+// writes the results into dir.
+func plotOutputs(cfg Config, payload Payload, dir string, formats []string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	base := payload.SimulationMeta.OutputFile.FileName
+	isTraj := payload.SimulationMeta.ModelType == "TRAJECTORY"
+
+	var written []string
+	kmlPath := ""
+	ensureKml := func() (string, error) {
+		if kmlPath == "" {
+			path, err := runPlotProgram(cfg, payload, dir)
+			if err != nil {
+				return "", err
+			}
+			kmlPath = path
+			written = append(written, path)
+		}
+		return kmlPath, nil
+	}
+
+	for _, format := range formats {
+		switch strings.ToLower(strings.TrimSpace(format)) {
+		case "kml":
+			if _, err := ensureKml(); err != nil {
+				return written, err
+			}
+
+		case "png":
+			var frames []KmlResult
+			if isTraj {
+				td, err := ReadTdumpFile(outputPath(payload))
+				if err != nil {
+					return written, err
+				}
+				frame, err := RenderTrajectories(td)
+				if err != nil {
+					return written, err
+				}
+				frames = []KmlResult{frame}
+			} else {
+				path, err := ensureKml()
+				if err != nil {
+					return written, err
+				}
+				if frames, err = ProcessKml(path); err != nil {
+					return written, err
+				}
+			}
+			files, err := writeFrames(frames, dir, base)
+			written = append(written, files...)
+			if err != nil {
+				return written, err
+			}
+
+		case "geojson":
+			var fc *GeoJSONFeatureCollection
+			if isTraj {
+				td, err := ReadTdumpFile(outputPath(payload))
+				if err != nil {
+					return written, err
+				}
+				fc = TdumpToGeoJSON(td)
+			} else {
+				path, err := ensureKml()
+				if err != nil {
+					return written, err
+				}
+				if fc, err = KmlToGeoJSON(path); err != nil {
+					return written, err
+				}
+			}
+			data, err := json.Marshal(fc)
+			if err != nil {
+				return written, err
+			}
+			path := filepath.Join(dir, base+".geojson")
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				return written, err
+			}
+			written = append(written, path)
+
+		case "annotated":
+			if isTraj {
+				return written, fmt.Errorf("annotated frames need a concentration run")
+			}
+			path, err := ensureKml()
+			if err != nil {
+				return written, err
+			}
+			frames, err := RenderAnnotatedKml(path, annotateOptions(payload))
+			if err != nil {
+				return written, err
+			}
+			files, err := writeFrames(frames, dir, base+"_annotated")
+			written = append(written, files...)
+			if err != nil {
+				return written, err
+			}
+
+		case "map":
+			b, err := LoadBasemap(cfg)
+			if err != nil {
+				return written, err
+			}
+			defer b.Close()
+			var frames []KmlResult
+			if isTraj {
+				td, err := ReadTdumpFile(outputPath(payload))
+				if err != nil {
+					return written, err
+				}
+				frame, err := RenderTrajectories(td)
+				if err != nil {
+					return written, err
+				}
+				frames = []KmlResult{frame}
+			} else {
+				path, err := ensureKml()
+				if err != nil {
+					return written, err
+				}
+				if frames, err = RenderAnnotatedKml(path, annotateOptions(payload)); err != nil {
+					return written, err
+				}
+			}
+			if frames, err = b.ComposeFrames(frames); err != nil {
+				return written, err
+			}
+			files, err := writeFrames(frames, dir, base+"_map")
+			written = append(written, files...)
+			if err != nil {
+				return written, err
+			}
+
+		case "particles":
+			dumps, err := ReadPardumpFile(pardumpPath(payload, dir))
+			if err != nil {
+				return written, fmt.Errorf("particles need a PARDUMP (set ndump in setupOverrides): %v", err)
+			}
+			plan, section, err := RenderParticles(dumps)
+			if err != nil {
+				return written, err
+			}
+			files, err := writeFrames(plan, dir, base+"_particles")
+			written = append(written, files...)
+			if err != nil {
+				return written, err
+			}
+			files, err = writeFrames(section, dir, base+"_particles_section")
+			written = append(written, files...)
+			if err != nil {
+				return written, err
+			}
+
+		default:
+			return written, fmt.Errorf("unknown plot format %q (want kml, png, geojson, annotated, map or particles)", format)
+		}
+	}
+	return written, nil
+}
+
+// pardumpPath returns the particle dump a job writes: poutf from the setup
+// overrides, or PARDUMP in the working directory.
+func pardumpPath(payload Payload, dir string) string {
+	name := "PARDUMP"
+	for k, v := range payload.PhysicsConfig.SetupOverrides {
+		if strings.EqualFold(k, "poutf") {
+			name = strings.Trim(strings.TrimSpace(v), `'"`)
+		}
+	}
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Receptor is a monitoring location concentrations are extracted at.
+type Receptor struct {
+	Id        string  `json:"id"`
+	Name      string  `json:"name,omitempty"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// ReadReceptorsFile reads receptor points, one per line, either as
+// "id lat lon name..." like programfiles/test/plants.txt or as CSV
+// "id,lat,lon[,name]". Blank lines and lines starting with # are skipped.
+func ReadReceptorsFile(path string) ([]Receptor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadReceptors(f)
+}
+
+func ReadReceptors(r io.Reader) ([]Receptor, error) {
+	var receptors []Receptor
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		// Names may contain commas, so the whitespace layout wins whenever
+		// its coordinates parse.
+		fields := strings.Fields(text)
+		if len(fields) > 3 {
+			fields = append(fields[:3], strings.Join(fields[3:], " "))
+		}
+		if len(fields) < 3 || !isFloat(fields[1]) || !isFloat(fields[2]) {
+			fields = strings.Split(text, ",")
+			for i := range fields {
+				fields[i] = strings.TrimSpace(fields[i])
+			}
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("receptor line %d: want id, latitude and longitude", line)
+		}
+		lat, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			// A CSV header line.
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("receptor line %d: bad latitude %q", line, fields[1])
+		}
+		lon, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("receptor line %d: bad longitude %q", line, fields[2])
+		}
+		rec := Receptor{Id: fields[0], Latitude: lat, Longitude: lon}
+		if len(fields) > 3 {
+			rec.Name = fields[3]
+		}
+		receptors = append(receptors, rec)
+	}
+	return receptors, sc.Err()
+}
+
+// massUnits are grams per unit.
+var massUnits = map[string]float64{
+	"kg": 1e3,
+	"g":  1,
+	"mg": 1e-3,
+	"ug": 1e-6,
+	"ng": 1e-9,
+	"pg": 1e-12,
+}
+
+// ConcUnitFactor returns the factor converting concentrations between mass
+// per volume units such as "g/m3" and "ug/m3". An empty unit on either side
+// means no conversion.
+func ConcUnitFactor(from, to string) (float64, error) {
+	if from == "" || to == "" {
+		return 1, nil
+	}
+	parse := func(u string) (float64, error) {
+		mass, volume, ok := strings.Cut(strings.ToLower(strings.TrimSpace(u)), "/")
+		g, known := massUnits[strings.ReplaceAll(mass, "µ", "u")]
+		if !ok || !known || (volume != "m3" && volume != "m^3") {
+			return 0, fmt.Errorf("unsupported concentration unit %q (want e.g. ug/m3)", u)
+		}
+		return g, nil
+	}
+	f, err := parse(from)
+	if err != nil {
+		return 0, err
+	}
+	t, err := parse(to)
+	if err != nil {
+		return 0, err
+	}
+	return f / t, nil
+}
+
+// TimeSeriesOptions controls receptor extraction.
+type TimeSeriesOptions struct {
+	Method string  // "nearest" (default) or "bilinear"
+	Factor float64 // unit conversion applied to every value, 0 means 1
+	Units  string  // label of the converted values
+}
+
+type SeriesValue struct {
+	Start time.Time `json:"start"`
+	Stop  time.Time `json:"stop"`
+	Conc  float64   `json:"conc"`
+}
+
+// ReceptorSeries is the concentration at one receptor, pollutant and level
+// for every sampling period.
+type ReceptorSeries struct {
+	Receptor  Receptor      `json:"receptor"`
+	Pollutant string        `json:"pollutant"`
+	Level     int           `json:"level"`
+	Units     string        `json:"units,omitempty"`
+	Values    []SeriesValue `json:"values"`
+}
+
+// gridPosition returns the fractional grid indices of a point, with the
+// longitude wrapped onto the grid.
+func (c *Cdump) gridPosition(lat, lon float64) (float64, float64) {
+	for lon < c.Lon1-c.DLon/2 {
+		lon += 360
+	}
+	for lon >= c.Lon1+360-c.DLon/2 {
+		lon -= 360
+	}
+	return (lon - c.Lon1) / c.DLon, (lat - c.Lat1) / c.DLat
+}
+
+// ExtractTimeSeries interpolates the concentration of every sampling period
+// at each receptor, pollutant and level. Receptors more than half a cell
+// outside the grid are returned separately.
+func ExtractTimeSeries(c *Cdump, receptors []Receptor, opts TimeSeriesOptions) ([]ReceptorSeries, []Receptor, error) {
+	method := strings.ToLower(opts.Method)
+	if method == "" {
+		method = "nearest"
+	}
+	if method != "nearest" && method != "bilinear" {
+		return nil, nil, fmt.Errorf("unknown interpolation %q (want nearest or bilinear)", opts.Method)
+	}
+	factor := opts.Factor
+	if factor == 0 {
+		factor = 1
+	}
+
+	var series []ReceptorSeries
+	var outside []Receptor
+	for _, rec := range receptors {
+		x, y, ok := c.gridPoint(rec.Latitude, rec.Longitude)
+		if !ok {
+			outside = append(outside, rec)
+			continue
+		}
+
+		for k, pol := range c.Pollutants {
+			for l, level := range c.Levels {
+				s := ReceptorSeries{Receptor: rec, Pollutant: pol, Level: level, Units: opts.Units}
+				for _, p := range c.Periods {
+					s.Values = append(s.Values, SeriesValue{
+						Start: p.Start,
+						Stop:  p.Stop,
+						Conc:  c.sample(p.Conc[k][l], x, y, method == "bilinear") * factor,
+					})
+				}
+				series = append(series, s)
+			}
+		}
+	}
+	return series, outside, nil
+}
+
+// WriteTimeSeriesCSV writes one row per receptor, pollutant, level and
+// sampling period.
+func WriteTimeSeriesCSV(w io.Writer, series []ReceptorSeries) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"receptor", "name", "latitude", "longitude", "pollutant", "level", "start", "stop", "conc", "units"})
+	for _, s := range series {
+		for _, v := range s.Values {
+			cw.Write([]string{
+				s.Receptor.Id,
+				s.Receptor.Name,
+				strconv.FormatFloat(s.Receptor.Latitude, 'f', -1, 64),
+				strconv.FormatFloat(s.Receptor.Longitude, 'f', -1, 64),
+				s.Pollutant,
+				strconv.Itoa(s.Level),
+				v.Start.Format(time.RFC3339),
+				v.Stop.Format(time.RFC3339),
+				strconv.FormatFloat(v.Conc, 'g', 6, 64),
+				s.Units,
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func WriteTimeSeriesJSON(w io.Writer, series []ReceptorSeries) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(series)
+}
+
+func isFloat(s string) bool {
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// receptorFlags are the flags shared by the commands that sample a cdump at
+// receptor points.
+type receptorFlags struct {
+	receptors  *string
+	method     *string
+	inputUnits *string
+	units      *string
+}
+
+func addReceptorFlags(fs *flag.FlagSet) *receptorFlags {
+	return &receptorFlags{
+		receptors:  fs.String("receptors", "", "receptor points: \"id lat lon name\" lines or id,lat,lon,name CSV"),
+		method:     fs.String("method", "nearest", "nearest or bilinear"),
+		inputUnits: fs.String("input-units", "g/m3", "concentration units of the cdump"),
+		units:      fs.String("units", "", "convert to these units, e.g. ug/m3"),
+	}
+}
+
+// load parses args and reads the receptors and the single cdump argument.
+func (rf *receptorFlags) load(fs *flag.FlagSet, args []string) ([]Receptor, *Cdump, TimeSeriesOptions, error) {
+	var opts TimeSeriesOptions
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, opts, err
+	}
+	if fs.NArg() != 1 || *rf.receptors == "" {
+		fs.Usage()
+		return nil, nil, opts, fmt.Errorf("need a receptors file and one cdump")
+	}
+
+	receptors, err := ReadReceptorsFile(*rf.receptors)
+	if err != nil {
+		return nil, nil, opts, err
+	}
+	c, err := ReadCdumpFile(fs.Arg(0))
+	if err != nil {
+		return nil, nil, opts, err
+	}
+	opts = TimeSeriesOptions{Method: *rf.method, Units: *rf.inputUnits}
+	if *rf.units != "" {
+		if opts.Factor, err = ConcUnitFactor(*rf.inputUnits, *rf.units); err != nil {
+			return nil, nil, opts, err
+		}
+		opts.Units = *rf.units
+	}
+	return receptors, c, opts, nil
+}
+
+func reportOutside(outside []Receptor) {
+	for _, r := range outside {
+		fmt.Fprintf(os.Stderr, "Receptor %s (%g, %g) is outside the concentration grid\n", r.Id, r.Latitude, r.Longitude)
+	}
+}
+
+// writeOutput calls write with the file at path, or with stdout when path
+// is empty. The file is buffered, and an error flushing or closing it is
+// returned.
+func writeOutput(path string, write func(io.Writer) error) error {
+	if path == "" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := write(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func timeSeriesCmd(args []string) error {
+	fs := flag.NewFlagSet("timeseries", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: hysplit-run timeseries [flags] -receptors <file> <cdump>")
+		fs.PrintDefaults()
+	}
+	rf := addReceptorFlags(fs)
+	format := fs.String("format", "csv", "csv or json")
+	output := fs.String("o", "", "output file (default stdout)")
+	receptors, c, opts, err := rf.load(fs, args)
+	if err != nil {
+		return err
+	}
+	series, outside, err := ExtractTimeSeries(c, receptors, opts)
+	if err != nil {
+		return err
+	}
+	reportOutside(outside)
+
+	var write func(io.Writer, []ReceptorSeries) error
+	switch strings.ToLower(*format) {
+	case "csv":
+		write = WriteTimeSeriesCSV
+	case "json":
+		write = WriteTimeSeriesJSON
+	default:
+		return fmt.Errorf("unknown format %q (want csv or json)", *format)
+	}
+	return writeOutput(*output, func(w io.Writer) error { return write(w, series) })
+}
+
+func matrixCmd(args []string) error {
+	fs := flag.NewFlagSet("matrix", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: hysplit-run matrix [flags] -receptors <file> <cdump>")
+		fs.PrintDefaults()
+	}
+	rf := addReceptorFlags(fs)
+	output := fs.String("o", "", "output CSV file (default stdout)")
+	receptors, c, opts, err := rf.load(fs, args)
+	if err != nil {
+		return err
+	}
+	contributions, outside, err := MatrixContributions(c, receptors, opts)
+	if err != nil {
+		return err
+	}
+	reportOutside(outside)
+
+	return writeOutput(*output, func(w io.Writer) error { return WriteMatrixCSV(w, contributions, opts.Units) })
+}
+
+func evaluateCmd(args []string) error {
+	fs := flag.NewFlagSet("evaluate", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: hysplit-run evaluate [flags] -obs <observations.csv> <cdump>")
+		fs.PrintDefaults()
+	}
+	obsFile := fs.String("obs", "", "observations CSV: station,lat,lon,time,value")
+	pollutant := fs.String("pollutant", "", "pollutant id (default: the first in the cdump)")
+	level := fs.Int("level", 0, "level height in m (default: the first in the cdump)")
+	method := fs.String("method", "nearest", "nearest or bilinear")
+	inputUnits := fs.String("input-units", "g/m3", "concentration units of the cdump")
+	units := fs.String("units", "", "units of the observations, e.g. ug/m3 (default: same as the cdump)")
+	threshold := fs.Float64("threshold", 0, "values above this count as nonzero for FMS and FA2/FA5")
+	format := fs.String("format", "csv", "csv (per-station table and ALL summary) or json (with pairs)")
+	output := fs.String("o", "", "output file (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *obsFile == "" {
+		fs.Usage()
+		return fmt.Errorf("need an observations file and one cdump")
+	}
+
+	obs, err := ReadObservationsFile(*obsFile)
+	if err != nil {
+		return err
+	}
+	c, err := ReadCdumpFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	opts := EvaluateOptions{Pollutant: *pollutant, Level: *level, Threshold: *threshold}
+	opts.Method = *method
+	if opts.Factor, err = ConcUnitFactor(*inputUnits, *units); err != nil {
+		return err
+	}
+	ev, err := Evaluate(c, obs, opts)
+	if err != nil {
+		return err
+	}
+	if ev.Unpaired > 0 {
+		fmt.Fprintf(os.Stderr, "%d observations outside the grid or sampling periods were not paired\n", ev.Unpaired)
+	}
+
+	var write func(io.Writer, *Evaluation) error
+	switch strings.ToLower(*format) {
+	case "csv":
+		write = WriteEvaluationCSV
+	case "json":
+		write = WriteEvaluationJSON
+	default:
+		return fmt.Errorf("unknown format %q (want csv or json)", *format)
+	}
+	return writeOutput(*output, func(w io.Writer) error { return write(w, ev) })
+}
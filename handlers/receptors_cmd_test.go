@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.csv")
+	err := writeOutput(path, func(w io.Writer) error {
+		_, err := io.WriteString(w, "id,conc\n")
+		return err
+	})
+	if data, _ := os.ReadFile(path); err != nil || string(data) != "id,conc\n" {
+		t.Errorf("wrote %q, %v", data, err)
+	}
+
+	failed := errors.New("write failed")
+	if err := writeOutput(path, func(io.Writer) error { return failed }); err != failed {
+		t.Errorf("got %v, want the write error", err)
+	}
+	if err := writeOutput(filepath.Join(path, "out.csv"), func(io.Writer) error { return nil }); err == nil {
+		t.Error("expected an error for a path below a file")
+	}
+}
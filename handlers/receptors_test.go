@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadReceptors(t *testing.T) {
+	plants, err := ReadReceptorsFile("../programfiles/test/plants.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Receptor{Id: "AT", Name: "VIENNA, AUSTRIA", Latitude: 48, Longitude: 16}
+	if len(plants) != 86 || plants[1] != want {
+		t.Errorf("got %d receptors, second %+v", len(plants), plants[1])
+	}
+
+	csv := "id,lat,lon,name\n# stations\nS1, 40.5, -89.5, North site\n\nS2,41,-90\n"
+	got, err := ReadReceptors(strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != (Receptor{Id: "S1", Name: "North site", Latitude: 40.5, Longitude: -89.5}) || got[1].Name != "" {
+		t.Errorf("csv receptors = %+v", got)
+	}
+	if _, err := ReadReceptors(strings.NewReader("S1,40\n")); err == nil {
+		t.Error("expected an error for a line without a longitude")
+	}
+	if _, err := ReadReceptors(strings.NewReader("S1,40,-90\nS2,north,-90\n")); err == nil {
+		t.Error("expected an error for a bad latitude after the first line")
+	}
+}
+
+func TestExtractTimeSeries(t *testing.T) {
+	start := time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC)
+	c := &Cdump{NumLat: 2, NumLon: 2, DLat: 1, DLon: 1, Lat1: 40, Lon1: -90, Levels: []int{100}, Pollutants: []string{"SOX"}}
+	for h := 0; h < 2; h++ {
+		p := c.NewPeriodLike(CdumpPeriod{Start: start.Add(time.Duration(h) * time.Hour), Stop: start.Add(time.Duration(h+1) * time.Hour)})
+		// 1 per cell east and 2 per cell north, doubled in the second hour.
+		for e := range p.Conc[0][0] {
+			p.Conc[0][0][e] = float32((h + 1) * (e%2 + 2*(e/2)))
+		}
+		c.Periods = append(c.Periods, p)
+	}
+	receptors := []Receptor{
+		{Id: "A", Latitude: 40.25, Longitude: -89.75},
+		{Id: "B", Latitude: 41, Longitude: 270}, // the north-west cell, east of 180
+		{Id: "far", Latitude: 45, Longitude: -80},
+	}
+
+	for _, tc := range []struct {
+		method string
+		a, b   float64
+	}{
+		{"nearest", 0, 2},
+		{"bilinear", 0.75, 2}, // a quarter cell east and north of the first center
+	} {
+		series, outside, err := ExtractTimeSeries(c, receptors, TimeSeriesOptions{Method: tc.method, Factor: 1e6, Units: "ug/m3"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(outside) != 1 || outside[0].Id != "far" {
+			t.Errorf("%s: outside = %+v", tc.method, outside)
+		}
+		if len(series) != 2 || series[0].Pollutant != "SOX" || series[0].Level != 100 || series[0].Units != "ug/m3" {
+			t.Fatalf("%s: series = %+v", tc.method, series)
+		}
+		for i, want := range []float64{tc.a, tc.b} {
+			v := series[i].Values
+			if len(v) != 2 || !v[1].Start.Equal(start.Add(time.Hour)) ||
+				math.Abs(v[0].Conc-want*1e6) > 1e-6 || math.Abs(v[1].Conc-2*want*1e6) > 1e-6 {
+				t.Errorf("%s: %s values = %+v, want %g then %g", tc.method, series[i].Receptor.Id, v, want*1e6, 2*want*1e6)
+			}
+		}
+	}
+
+	if _, _, err := ExtractTimeSeries(c, receptors, TimeSeriesOptions{Method: "cubic"}); err == nil {
+		t.Error("expected an error for an unknown method")
+	}
+	if f, err := ConcUnitFactor("g/m3", "ug/m3"); err != nil || f != 1e6 {
+		t.Errorf("g/m3 to ug/m3 = %g, %v", f, err)
+	}
+	if _, err := ConcUnitFactor("g/m3", "ppm"); err == nil {
+		t.Error("expected an error for a mixing ratio unit")
+	}
+}
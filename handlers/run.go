@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bhagirath-bhp/hysplit-test/internal/jobdir"
+)
+
+// jobWorkDir returns the absolute working directory of a job under the
+// configured work root.
+func jobWorkDir(cfg Config, jobId string) (string, error) {
+	if !jobdir.ValidId(jobId) {
+		return "", fmt.Errorf("invalid jobId %q", jobId)
+	}
+	return filepath.Abs(filepath.Join(cfg.WorkRoot, jobId))
+}
+
+// preparePayload picks met files from the catalog for payloads with "met"
+// and fills in directories the payload leaves empty from the config.
+// Output defaults to dir. Relative directories are made absolute when
+// absolute is set, so CONTROL stays valid from inside a working directory.
+// Directories always end with a separator, as HYSPLIT expects. More met
+// files than HYSPLIT takes as grids must be consecutive pieces of one grid;
+// files that are not there yet are only reported.
+func preparePayload(cfg Config, payload Payload, dir string, absolute bool) (Payload, error) {
+	fix := func(d, fallback string) (string, error) {
+		if d == "" {
+			d = fallback
+		}
+		if d == "" {
+			d = "."
+		}
+		if absolute {
+			abs, err := filepath.Abs(d)
+			if err != nil {
+				return "", err
+			}
+			d = abs
+		}
+		if !strings.HasSuffix(d, "/") {
+			d += "/"
+		}
+		return d, nil
+	}
+
+	payload, err := selectMetFiles(cfg, payload)
+	if err != nil {
+		return payload, err
+	}
+	metFiles := make([]MetFile, len(payload.MetFiles))
+	for i, mf := range payload.MetFiles {
+		metFiles[i] = mf
+		if metFiles[i].Directory, err = fix(mf.Directory, cfg.MetDir); err != nil {
+			return payload, err
+		}
+	}
+	payload.MetFiles = metFiles
+	if len(metFiles) > maxMetGrids {
+		err := checkMetFileSeries(metFiles)
+		if errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "Warning: %d met files are run as one grid without checking them: %v\n", len(metFiles), err)
+		} else if err != nil {
+			return payload, fmt.Errorf("%d met files are more than the %d grids HYSPLIT accepts, and cannot be read as one grid: %v",
+				len(metFiles), maxMetGrids, err)
+		}
+	}
+
+	outputDefault := cfg.OutputDir
+	if outputDefault == "" {
+		outputDefault = dir
+	}
+	if payload.SimulationMeta.OutputFile.Directory, err = fix(payload.SimulationMeta.OutputFile.Directory, outputDefault); err != nil {
+		return payload, err
+	}
+	payload.SimulationMeta.OutputFile.FileName = outputFileName(payload.SimulationMeta)
+	return payload, nil
+}
+
+// checkMetFileSeries checks that ARL files share source and grid, and that
+// each one starts one time step after the previous one ends.
+func checkMetFileSeries(files []MetFile) error {
+	var prev *ARLFile
+	for _, mf := range files {
+		a, err := ReadARLFile(filepath.Join(mf.Directory, mf.FileName))
+		if err != nil {
+			return err
+		}
+		if prev != nil {
+			if a.Source != prev.Source || a.Grid != prev.Grid {
+				return fmt.Errorf("%s is not on the grid of %s", a.Path, prev.Path)
+			}
+			last := prev.Times[len(prev.Times)-1]
+			step := time.Duration(0)
+			if len(prev.Times) > 1 {
+				step = prev.Times[1].Sub(prev.Times[0])
+			} else if len(a.Times) > 1 {
+				step = a.Times[1].Sub(a.Times[0])
+			}
+			if gap := a.Times[0].Sub(last); gap <= 0 || step > 0 && gap > step {
+				return fmt.Errorf("%s starts at %s, not one time step after %s ends at %s",
+					a.Path, a.Times[0].Format("2006-01-02 15:04"), prev.Path, last.Format("2006-01-02 15:04"))
+			}
+		}
+		prev = a
+	}
+	return nil
+}
+
+// outputFileName returns the output file name of a run, tdump or cdump
+// when the payload leaves it empty.
+func outputFileName(meta SimulationMeta) string {
+	switch {
+	case meta.OutputFile.FileName != "":
+		return meta.OutputFile.FileName
+	case meta.ModelType == "TRAJECTORY":
+		return "tdump"
+	default:
+		return "cdump"
+	}
+}
+
+// outputPath returns the model output file of a prepared payload.
+func outputPath(payload Payload) string {
+	out := payload.SimulationMeta.OutputFile
+	return filepath.Join(out.Directory, out.FileName)
+}
+
+// writeModelInputs writes CONTROL, SETUP.CFG and, when the run uses emission
+// scenarios, EMITIMES into dir. It returns the paths written.
+func writeModelInputs(payload Payload, dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	control, err := GenerateHysplitControlFile(payload)
+	if err != nil {
+		return nil, fmt.Errorf("generating CONTROL: %v", err)
+	}
+	setup, err := GenerateSetupFile(payload)
+	if err != nil {
+		return nil, fmt.Errorf("generating SETUP.CFG: %v", err)
+	}
+	files := map[string]string{"CONTROL": control, "SETUP.CFG": setup}
+	names := []string{"CONTROL", "SETUP.CFG"}
+
+	meta := payload.SimulationMeta
+	if meta.ModelType == "CONCENTRATION" && meta.Direction == "FORWARD" && len(payload.EmissionScenarios) > 0 {
+		emitimes, err := GenerateEmitimesFile(payload)
+		if err != nil {
+			return nil, fmt.Errorf("generating EMITIMES: %v", err)
+		}
+		files["EMITIMES"] = emitimes
+		names = append(names, "EMITIMES")
+	}
+
+	var written []string
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(files[name]), 0644); err != nil {
+			return written, err
+		}
+		written = append(written, path)
+	}
+	return written, nil
+}
+
+// writeJobPayload records the payload of a job as payload.json in its
+// working directory, for later runs that continue from it.
+func writeJobPayload(payload Payload, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "payload.json"), data, 0644)
+}
+
+// modelExecutable returns the HYSPLIT binary for the payload's model type.
+func modelExecutable(cfg Config, payload Payload) (string, error) {
+	var name string
+	switch payload.SimulationMeta.ModelType {
+	case "CONCENTRATION":
+		name = "hycs_std"
+	case "TRAJECTORY":
+		name = "hyts_std"
+	default:
+		return "", fmt.Errorf("unknown modelType %q", payload.SimulationMeta.ModelType)
+	}
+	return findExecutable(cfg, name)
+}
+
+// findExecutable looks for a HYSPLIT program in the exec directory, falling
+// back to PATH.
+func findExecutable(cfg Config, name string) (string, error) {
+	path := filepath.Join(cfg.ExecDir, name)
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		return filepath.Abs(path)
+	}
+	if found, err := exec.LookPath(name); err == nil {
+		return found, nil
+	}
+	return "", fmt.Errorf("%s not found in %s or PATH", name, cfg.ExecDir)
+}
+
+// linkBoundaryFiles makes ASCDATA.CFG available in the working directory.
+func linkBoundaryFiles(cfg Config, dir string) error {
+	src, err := filepath.Abs(filepath.Join(cfg.BdyDir, "ASCDATA.CFG"))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("ASCDATA.CFG not found in %s: %v", cfg.BdyDir, err)
+	}
+	dst := filepath.Join(dir, "ASCDATA.CFG")
+	if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Symlink(src, dst)
+}
+
+// runModel writes the model inputs into the job's working directory and runs
+// HYSPLIT there. Model output goes to hysplit.log, and the exit code is
+// recorded in EXITCODE whether or not the run succeeds.
+func runModel(cfg Config, payload Payload, dir string) error {
+	bin, err := modelExecutable(cfg, payload)
+	if err != nil {
+		return err
+	}
+
+	// Clear state from a previous run of the same job.
+	for _, name := range []string{jobdir.ExitCodeFile, "MESSAGE", "WARNING"} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	if _, err := writeModelInputs(payload, dir); err != nil {
+		return err
+	}
+	if err := linkBoundaryFiles(cfg, dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(payload.SimulationMeta.OutputFile.Directory, 0755); err != nil {
+		return err
+	}
+
+	logFile, err := os.Create(filepath.Join(dir, "hysplit.log"))
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(bin)
+	cmd.Dir = dir
+	cmd.Stdout = io.MultiWriter(logFile, os.Stderr)
+	cmd.Stderr = io.MultiWriter(logFile, os.Stderr)
+
+	runErr := cmd.Run()
+	code := 0
+	if runErr != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(runErr, &exitErr) {
+			code = -1
+		} else {
+			code = exitErr.ExitCode()
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, jobdir.ExitCodeFile), []byte(fmt.Sprintf("%d\n", code)), 0644); err != nil {
+		return err
+	}
+	if runErr != nil {
+		return fmt.Errorf("%s failed: %v", filepath.Base(bin), runErr)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func generateCmd(args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ContinueOnError)
+	outDir := fs.String("o", "", "directory to write CONTROL, SETUP.CFG and EMITIMES to (default: print CONTROL)")
+	resolve := configFlags(fs)
+	cfg, payload, err := parseCommand(fs, args, resolve)
+	if err != nil {
+		return err
+	}
+
+	if *outDir == "" && payload.SimulationMeta.StartRepeat != nil {
+		return fmt.Errorf("startRepeat writes one CONTROL file per start time; use -o")
+	}
+	if *outDir == "" {
+		payload, err = preparePayload(cfg, payload, "", false)
+		if err != nil {
+			return err
+		}
+		controlContent, err := GenerateHysplitControlFile(payload)
+		if err != nil {
+			return fmt.Errorf("generating CONTROL file: %v", err)
+		}
+		fmt.Print(controlContent)
+		return nil
+	}
+
+	payload, err = preparePayload(cfg, payload, *outDir, false)
+	if err != nil {
+		return err
+	}
+	if payload.SimulationMeta.StartRepeat != nil {
+		return generateStarts(payload, *outDir)
+	}
+	if payload, err = continueFromJob(cfg, payload, *outDir); err != nil {
+		return err
+	}
+	written, err := writeModelInputs(payload, *outDir)
+	for _, path := range written {
+		fmt.Println(path)
+	}
+	return err
+}
+
+// generateStarts writes the inputs of each repeated start time into its
+// own subdirectory of dir, named by the start time.
+func generateStarts(payload Payload, dir string) error {
+	starts, err := ExpandStartTimes(payload)
+	if err != nil {
+		return err
+	}
+	for _, s := range starts {
+		written, err := writeModelInputs(s, filepath.Join(dir, startSuffix(s.SimulationMeta.StartEpochUTC)))
+		for _, path := range written {
+			fmt.Println(path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runCmd(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	resolve := configFlags(fs)
+	cfg, payload, err := parseCommand(fs, args, resolve)
+	if err != nil {
+		return err
+	}
+	_, err = runJob(cfg, payload)
+	return err
+}
+
+func plotCmd(args []string) error {
+	fs := flag.NewFlagSet("plot", flag.ContinueOnError)
+	formats := fs.String("format", "kml,png", "comma separated output formats: kml, png, geojson, annotated, map, particles")
+	resolve := configFlags(fs)
+	cfg, payload, err := parseCommand(fs, args, resolve)
+	if err != nil {
+		return err
+	}
+	return plotJob(cfg, payload, strings.Split(*formats, ","))
+}
+
+func allCmd(args []string) error {
+	fs := flag.NewFlagSet("all", flag.ContinueOnError)
+	formats := fs.String("format", "kml,png", "comma separated output formats: kml, png, geojson, annotated, map, particles")
+	resolve := configFlags(fs)
+	cfg, payload, err := parseCommand(fs, args, resolve)
+	if err != nil {
+		return err
+	}
+	if _, err := runJob(cfg, payload); err != nil {
+		return err
+	}
+	return plotJob(cfg, payload, strings.Split(*formats, ","))
+}
+
+// runJob prepares the job's working directory and runs the model in it.
+func runJob(cfg Config, payload Payload) (string, error) {
+	if payload.SimulationMeta.StartRepeat != nil {
+		return runStaggeredJob(cfg, payload)
+	}
+	dir, err := jobWorkDir(cfg, payload.JobId)
+	if err != nil {
+		return "", err
+	}
+	if payload, err = preparePayload(cfg, payload, dir, true); err != nil {
+		return dir, err
+	}
+	if payload, err = continueFromJob(cfg, payload, dir); err != nil {
+		return dir, err
+	}
+	if err := writeJobPayload(payload, dir); err != nil {
+		return dir, err
+	}
+	fmt.Fprintf(os.Stderr, "Running %s in %s\n", payload.JobId, dir)
+	if err := runModel(cfg, payload, dir); err != nil {
+		return dir, err
+	}
+	fmt.Fprintf(os.Stderr, "Output: %s\n", outputPath(payload))
+	if _, err := writeSourceConditions(payload, dir); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: met conditions at the sources: %v\n", err)
+	}
+	return dir, nil
+}
+
+// plotJob converts the output of a job and lists the files written.
+func plotJob(cfg Config, payload Payload, formats []string) error {
+	dir, err := jobWorkDir(cfg, payload.JobId)
+	if err != nil {
+		return err
+	}
+	if payload, err = preparePayload(cfg, payload, dir, true); err != nil {
+		return err
+	}
+	written, err := plotOutputs(cfg, payload, dir, formats)
+	for _, path := range written {
+		fmt.Println(path)
+	}
+	return err
+}
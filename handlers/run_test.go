@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// splitARLFile writes the periods of the test ARL file into n consecutive
+// files named gdas1.wk01 and on, and returns them as met files.
+func splitARLFile(t *testing.T, dir string, n int) []MetFile {
+	t.Helper()
+	a, err := ReadARLFile(testARLFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(testARLFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	period := a.RecordLength * a.RecordsPerTime
+	var files []MetFile
+	for i := 0; i < n; i++ {
+		from, to := i*len(a.Times)/n, (i+1)*len(a.Times)/n
+		name := fmt.Sprintf("gdas1.wk%02d", i+1)
+		if err := os.WriteFile(filepath.Join(dir, name), data[from*period:to*period], 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, MetFile{Directory: dir + "/", FileName: name})
+	}
+	return files
+}
+
+func TestPreparePayloadMetSeries(t *testing.T) {
+	// 13 met files, more than HYSPLIT takes as separate grids.
+	p := testPayload("TRAJECTORY", "FORWARD")
+	p.MetFiles = splitARLFile(t, t.TempDir(), 13)
+	dir := t.TempDir()
+	if _, err := preparePayload(Config{}, p, dir, true); err != nil {
+		t.Fatalf("preparePayload: %v", err)
+	}
+
+	// A missing piece breaks the series.
+	gap := append(append([]MetFile{}, p.MetFiles[:6]...), p.MetFiles[7:]...)
+	gap = append(gap, p.MetFiles[0])
+	if _, err := preparePayload(Config{}, Payload{SimulationMeta: p.SimulationMeta, MetFiles: gap}, dir, true); err == nil || !strings.Contains(err.Error(), "gdas1.wk08") {
+		t.Errorf("expected an error for the gap before gdas1.wk08, got %v", err)
+	}
+
+	// Files that are not there yet are run as one grid.
+	p.MetFiles = nil
+	for i := 0; i < 13; i++ {
+		p.MetFiles = append(p.MetFiles, MetFile{Directory: "/metfiles/", FileName: fmt.Sprintf("gdas1.wk%02d", i+1)})
+	}
+	prepared, err := preparePayload(Config{}, p, dir, true)
+	if err != nil {
+		t.Fatalf("preparePayload with absent met files: %v", err)
+	}
+	control, err := GenerateHysplitControlFile(prepared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(control, "\n1 13\n") {
+		t.Errorf("CONTROL does not list the 13 files as one grid:\n%s", control)
+	}
+}
@@ -0,0 +1,415 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"fmt"
+	"image/color"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fogleman/gg"
+)
+
+// ContourLevel is one band of a concentration color scale. Values at or
+// above Threshold, up to the next level, are filled with Color.
+type ContourLevel struct {
+	Threshold float64
+	Color     color.NRGBA
+	Units     string
+}
+
+// concplotColors are the fills concplot gives its four default contours,
+// from the highest level down (styles conc2 to conc5 of its KML).
+var concplotColors = []color.NRGBA{
+	{255, 255, 0, 200},
+	{0, 0, 255, 200},
+	{0, 255, 0, 200},
+	{0, 255, 255, 200},
+}
+
+// defaultColorScale returns contours like the concplot default: four levels
+// a decade apart, the highest at the decade of max.
+func defaultColorScale(max float64, units string) []ContourLevel {
+	if max <= 0 {
+		return nil
+	}
+	top := math.Floor(math.Log10(max))
+	scale := make([]ContourLevel, len(concplotColors))
+	for i, c := range concplotColors {
+		scale[len(scale)-1-i] = ContourLevel{Threshold: math.Pow(10, top-float64(i)), Color: c, Units: units}
+	}
+	return scale
+}
+
+// contourColor returns the color of the highest level at or below v.
+func contourColor(scale []ContourLevel, v float64) (color.NRGBA, bool) {
+	for i := len(scale) - 1; i >= 0; i-- {
+		if v >= scale[i].Threshold {
+			return scale[i].Color, true
+		}
+	}
+	return color.NRGBA{}, false
+}
+
+var contourLevelName = regexp.MustCompile(`Contour Level:\s*(\S+)\s*(.*)`)
+
+// readKml parses a KML file written by concplot.
+func readKml(filePath string) (*KmlRoot, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	s := strings.TrimSpace(string(content))
+	if ok, err := validateKmlContent(s); !ok {
+		return nil, err
+	}
+	var root KmlRoot
+	if err := xml.Unmarshal([]byte(s), &root); err != nil {
+		return nil, fmt.Errorf("XML unmarshal error: %v", err)
+	}
+	return &root, nil
+}
+
+// kmlFillColors returns the polygon fill of each style by "#id". KML colors
+// are not premultiplied.
+func kmlFillColors(root *KmlRoot) map[string]color.NRGBA {
+	styles := make(map[string]color.NRGBA)
+	for _, st := range root.Document.Styles {
+		if st.PolyStyle.Color == "" {
+			continue // icon and line styles
+		}
+		c := parseKmlColor(st.PolyStyle.Color)
+		styles["#"+st.ID] = color.NRGBA{c.R, c.G, c.B, c.A}
+	}
+	return styles
+}
+
+// KmlColorScales reads the contour levels and fills of each concentration
+// frame of a concplot KML file, keyed by the frame time ProcessKml gives
+// the frame. Levels are sorted from the lowest up.
+func KmlColorScales(filePath string) (map[int64][]ContourLevel, error) {
+	root, err := readKml(filePath)
+	if err != nil {
+		return nil, err
+	}
+	styles := kmlFillColors(root)
+
+	scales := make(map[int64][]ContourLevel)
+	for _, folder := range root.Document.Folders {
+		if !strings.Contains(folder.Name, "Concentration") {
+			continue
+		}
+		var scale []ContourLevel
+		for _, pm := range folder.Placemarks {
+			m := contourLevelName.FindStringSubmatch(pm.Name)
+			if m == nil {
+				continue
+			}
+			v, err := strconv.ParseFloat(m[1], 64)
+			if err != nil {
+				continue
+			}
+			c, ok := styles[pm.StyleUrl]
+			if !ok {
+				c = color.NRGBA{255, 0, 0, 128}
+			}
+			scale = append(scale, ContourLevel{Threshold: v, Color: c, Units: strings.TrimSpace(m[2])})
+		}
+		if len(scale) == 0 {
+			continue
+		}
+		sort.Slice(scale, func(i, j int) bool { return scale[i].Threshold < scale[j].Threshold })
+		scales[extractTimestamp(folder)] = scale
+	}
+	return scales, nil
+}
+
+// SectionPoint is a vertex of a cross-section path. HeightMAgl is only used
+// for trajectories, whose height is drawn over the section.
+type SectionPoint struct {
+	Latitude   float64
+	Longitude  float64
+	HeightMAgl float64
+}
+
+// ParseSectionPath parses a path written as "lat,lon;lat,lon;...".
+func ParseSectionPath(s string) ([]SectionPoint, error) {
+	var path []SectionPoint
+	for _, vertex := range strings.Split(s, ";") {
+		if strings.TrimSpace(vertex) == "" {
+			continue
+		}
+		v, err := parseFloatList(vertex)
+		if err != nil || len(v) != 2 {
+			return nil, fmt.Errorf("bad path vertex %q (want lat,lon)", vertex)
+		}
+		path = append(path, SectionPoint{Latitude: v[0], Longitude: v[1]})
+	}
+	if len(path) < 2 {
+		return nil, fmt.Errorf("a path needs at least two vertices")
+	}
+	return path, nil
+}
+
+// TrajectoryPath returns the points of a trajectory as a section path.
+func TrajectoryPath(traj Trajectory) []SectionPoint {
+	path := make([]SectionPoint, len(traj.Points))
+	for i, p := range traj.Points {
+		path[i] = SectionPoint{Latitude: p.Latitude, Longitude: p.Longitude, HeightMAgl: p.Height}
+	}
+	return path
+}
+
+// greatCircleKm returns the distance between two points on the sphere of
+// the HYSPLIT projections.
+func greatCircleKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const rad = math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(min(h, 1)))
+}
+
+// CrossSectionOptions controls RenderCrossSection.
+type CrossSectionOptions struct {
+	Pollutant string // pollutant id, default the first in the cdump
+	Method    string // "nearest" (default) or "bilinear"
+	Units     string // legend units when there is no KML scale, default "mass/m3"
+	// Scales are the plan view color scales by frame time, from
+	// KmlColorScales. Frames without one get the concplot default scale.
+	Scales map[int64][]ContourLevel
+	// Trajectory draws the height of the path points over the section.
+	Trajectory bool
+}
+
+// Layout of the cross-section images: the section itself, axes to its left
+// and below, and the legend to its right.
+const (
+	sectionWidth  = 1024
+	sectionHeight = 512
+	sectionLeft   = 64
+	sectionRight  = 872
+	sectionTop    = 28
+	sectionBottom = 472
+)
+
+// RenderCrossSection draws the concentration along a path against height,
+// one frame per sampling period, valid at the end of the period like the
+// plan view frames. Each level of the cdump fills the layer from the level
+// below it up to its own height; the deposition level is left out. Frames
+// carry the path length as "distanceKm" and the height range as "bottom"
+// and "top" in their bbox.
+func RenderCrossSection(c *Cdump, path []SectionPoint, opts CrossSectionOptions) ([]KmlResult, error) {
+	if len(path) < 2 {
+		return nil, fmt.Errorf("a path needs at least two vertices")
+	}
+	k := 0
+	if opts.Pollutant != "" {
+		if k = c.PollutantIndex(opts.Pollutant); k < 0 {
+			return nil, fmt.Errorf("pollutant %q not in cdump (have %v)", opts.Pollutant, c.Pollutants)
+		}
+	}
+	method := strings.ToLower(opts.Method)
+	if method == "" {
+		method = "nearest"
+	}
+	if method != "nearest" && method != "bilinear" {
+		return nil, fmt.Errorf("unknown interpolation %q (want nearest or bilinear)", opts.Method)
+	}
+	units := opts.Units
+	if units == "" {
+		units = "mass/m3"
+	}
+
+	// Layers from the bottom up, as level indices and their bottom heights.
+	var layers, bottoms []int
+	for l, h := range c.Levels {
+		if h > 0 {
+			layers = append(layers, l)
+		}
+	}
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("cdump has no levels above ground")
+	}
+	sort.Slice(layers, func(i, j int) bool { return c.Levels[layers[i]] < c.Levels[layers[j]] })
+	for i := range layers {
+		if i == 0 {
+			bottoms = append(bottoms, 0)
+		} else {
+			bottoms = append(bottoms, c.Levels[layers[i-1]])
+		}
+	}
+
+	// The section reaches the top level, or above the highest point of a
+	// trajectory, rounded up to 100 m.
+	dist := make([]float64, len(path))
+	top := float64(c.Levels[layers[len(layers)-1]])
+	for i := range path {
+		if i > 0 {
+			dist[i] = dist[i-1] + greatCircleKm(path[i-1].Latitude, path[i-1].Longitude, path[i].Latitude, path[i].Longitude)
+		}
+		if opts.Trajectory && path[i].HeightMAgl*1.05 > top {
+			top = math.Ceil(path[i].HeightMAgl*1.05/100) * 100
+		}
+	}
+	total := dist[len(dist)-1]
+	if total <= 0 {
+		return nil, fmt.Errorf("path has zero length")
+	}
+
+	// at returns the point of the path at distance d.
+	at := func(d float64) SectionPoint {
+		i := sort.SearchFloat64s(dist, d)
+		if i == 0 {
+			return path[0]
+		}
+		if i >= len(dist) {
+			return path[len(path)-1]
+		}
+		w := (d - dist[i-1]) / (dist[i] - dist[i-1])
+		a, b := path[i-1], path[i]
+		return SectionPoint{
+			Latitude:   a.Latitude + w*(b.Latitude-a.Latitude),
+			Longitude:  a.Longitude + w*(b.Longitude-a.Longitude),
+			HeightMAgl: a.HeightMAgl + w*(b.HeightMAgl-a.HeightMAgl),
+		}
+	}
+	const columnPx = 2
+	plotW, plotH := float64(sectionRight-sectionLeft), float64(sectionBottom-sectionTop)
+	px := func(d float64) float64 { return sectionLeft + d/total*plotW }
+	py := func(h float64) float64 { return sectionBottom - h/top*plotH }
+
+	var frames []KmlResult
+	for _, p := range c.Periods {
+		valid := p.Stop
+		scale, ok := opts.Scales[valid.Unix()]
+		if !ok {
+			peak := 0.0
+			for _, l := range layers {
+				for _, v := range p.Conc[k][l] {
+					peak = max(peak, float64(v))
+				}
+			}
+			scale = defaultColorScale(peak, units)
+		}
+
+		dc := gg.NewContext(sectionWidth, sectionHeight)
+		dc.SetRGB(1, 1, 1)
+		dc.Clear()
+		for x := float64(sectionLeft); x < sectionRight; x += columnPx {
+			pt := at((x + columnPx/2 - sectionLeft) / plotW * total)
+			gx, gy, inside := c.gridPoint(pt.Latitude, pt.Longitude)
+			if !inside {
+				dc.SetRGB(0.85, 0.85, 0.85)
+				dc.DrawRectangle(x, sectionTop, columnPx, plotH)
+				dc.Fill()
+				continue
+			}
+			for i, l := range layers {
+				col, ok := contourColor(scale, c.sample(p.Conc[k][l], gx, gy, method == "bilinear"))
+				if !ok {
+					continue
+				}
+				y0, y1 := py(float64(c.Levels[l])), py(float64(bottoms[i]))
+				dc.SetColor(col)
+				dc.DrawRectangle(x, y0, columnPx, y1-y0)
+				dc.Fill()
+			}
+		}
+		if opts.Trajectory {
+			dc.SetRGB(0, 0, 0)
+			dc.SetLineWidth(2)
+			for i, pt := range path {
+				if i == 0 {
+					dc.MoveTo(px(dist[i]), py(pt.HeightMAgl))
+				} else {
+					dc.LineTo(px(dist[i]), py(pt.HeightMAgl))
+				}
+			}
+			dc.Stroke()
+		}
+		vertices := dist
+		if opts.Trajectory {
+			vertices = nil // trajectory points are not corners worth marking
+		}
+		dc.SetFontFace(annotationFace(12))
+		drawSectionAxes(dc, total, top, vertices)
+		legendUnits := units
+		if len(scale) > 0 && scale[0].Units != "" {
+			legendUnits = scale[0].Units
+		}
+		drawLegend(dc, sectionRight+12, sectionTop, legendUnits, scaleLegend(scale), false)
+		dc.SetRGB(0, 0, 0)
+		dc.DrawString(fmt.Sprintf("%s  %s", strings.TrimSpace(c.Pollutants[k]), valid.UTC().Format("2006-01-02 15:04 UTC")), sectionLeft, sectionTop-10)
+
+		frame, err := encodeFrame(dc, valid.Unix(), 0, 0, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		frame.Bbox = map[string]float64{"distanceKm": total, "bottom": 0, "top": top}
+		frames = append(frames, frame)
+	}
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("cdump has no sampling periods")
+	}
+	return frames, nil
+}
+
+// niceStep returns a 1, 2 or 5 times a power of ten step that splits span
+// into at most n intervals.
+func niceStep(span float64, n int) float64 {
+	raw := span / float64(n)
+	mag := math.Pow(10, math.Floor(math.Log10(raw)))
+	for _, f := range []float64{1, 2, 5} {
+		if f*mag >= raw {
+			return f * mag
+		}
+	}
+	return 10 * mag
+}
+
+// drawSectionAxes frames the section and labels distance and height. Inner
+// path vertices are marked along the top edge.
+func drawSectionAxes(dc *gg.Context, total, top float64, vertices []float64) {
+	plotW, plotH := float64(sectionRight-sectionLeft), float64(sectionBottom-sectionTop)
+	dc.SetRGB(0, 0, 0)
+	dc.SetLineWidth(1)
+	dc.DrawRectangle(sectionLeft, sectionTop, plotW, plotH)
+	dc.Stroke()
+
+	step := niceStep(total, 8)
+	for d := 0.0; d <= total+step/1000; d += step {
+		x := sectionLeft + d/total*plotW
+		dc.DrawLine(x, sectionBottom, x, sectionBottom+5)
+		dc.Stroke()
+		dc.DrawStringAnchored(strconv.FormatFloat(d, 'f', -1, 64), x, sectionBottom+16, 0.5, 0)
+	}
+	dc.DrawStringAnchored("distance (km)", sectionLeft+plotW/2, sectionBottom+34, 0.5, 0)
+
+	step = niceStep(top, 6)
+	for h := 0.0; h <= top+step/1000; h += step {
+		y := sectionBottom - h/top*plotH
+		dc.DrawLine(sectionLeft-5, y, sectionLeft, y)
+		dc.Stroke()
+		dc.DrawStringAnchored(strconv.FormatFloat(h, 'f', -1, 64), sectionLeft-8, y, 1, 0.35)
+	}
+	dc.Push()
+	dc.RotateAbout(-math.Pi/2, 14, sectionTop+plotH/2)
+	dc.DrawStringAnchored("height (m agl)", 14, sectionTop+plotH/2, 0.5, 0.5)
+	dc.Pop()
+
+	for i, d := range vertices {
+		if i == 0 || i == len(vertices)-1 {
+			continue
+		}
+		x := sectionLeft + d/total*plotW
+		dc.MoveTo(x, sectionTop)
+		dc.LineTo(x-4, sectionTop-6)
+		dc.LineTo(x+4, sectionTop-6)
+		dc.ClosePath()
+		dc.Fill()
+	}
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func sectionCmd(args []string) error {
+	fs := flag.NewFlagSet("section", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: hysplit-run section (-path <lat,lon;lat,lon...> | -tdump <tdump>) [flags] <cdump>")
+		fmt.Fprintln(fs.Output(), "Renders concentration against height along a polyline or a trajectory, one frame per sampling period.")
+		fs.PrintDefaults()
+	}
+	pathFlag := fs.String("path", "", `polyline vertices, e.g. "40,-90;40.5,-88"`)
+	tdumpPath := fs.String("tdump", "", "follow a trajectory of this tdump file instead of -path")
+	trajIndex := fs.Int("traj", 1, "trajectory number in the tdump file, from 1")
+	pollutant := fs.String("pollutant", "", "pollutant id (default: the first in the cdump)")
+	method := fs.String("method", "nearest", "nearest or bilinear")
+	kmlPath := fs.String("kml", "", "concplot KML of the plan view, for its contour levels and colors")
+	output := fs.String("o", ".", "output directory")
+	name := fs.String("name", "section", "base name of the PNG and frames files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || (*pathFlag == "") == (*tdumpPath == "") {
+		fs.Usage()
+		return fmt.Errorf("need one of -path or -tdump and one cdump")
+	}
+
+	opts := CrossSectionOptions{Pollutant: *pollutant, Method: *method}
+	var path []SectionPoint
+	if *tdumpPath != "" {
+		td, err := ReadTdumpFile(*tdumpPath)
+		if err != nil {
+			return err
+		}
+		if *trajIndex < 1 || *trajIndex > len(td.Trajectories) {
+			return fmt.Errorf("%s has %d trajectories, not %d", *tdumpPath, len(td.Trajectories), *trajIndex)
+		}
+		path = TrajectoryPath(td.Trajectories[*trajIndex-1])
+		opts.Trajectory = true
+	} else {
+		var err error
+		if path, err = ParseSectionPath(*pathFlag); err != nil {
+			return err
+		}
+	}
+	if *kmlPath != "" {
+		var err error
+		if opts.Scales, err = KmlColorScales(*kmlPath); err != nil {
+			return err
+		}
+	}
+	c, err := ReadCdumpFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	frames, err := RenderCrossSection(c, path, opts)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*output, 0755); err != nil {
+		return err
+	}
+	written, err := writeFrames(frames, *output, *name)
+	for _, path := range written {
+		fmt.Println(path)
+	}
+	return err
+}
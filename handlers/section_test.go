@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"image/color"
+	"testing"
+	"time"
+)
+
+func TestKmlColorScales(t *testing.T) {
+	scales, err := KmlColorScales("../programfiles/test/HYSPLIT_ps.kml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := time.Date(2025, 12, 1, 12, 0, 0, 0, time.UTC).Unix()
+	scale, ok := scales[valid]
+	if !ok {
+		t.Fatalf("no scale for the 12:00 frame, have %d frames", len(scales))
+	}
+	want := []ContourLevel{
+		{1e-12, color.NRGBA{0, 255, 255, 200}, "mass/m3"},
+		{1e-11, color.NRGBA{0, 255, 0, 200}, "mass/m3"},
+		{1e-10, color.NRGBA{0, 0, 255, 200}, "mass/m3"},
+		{1e-9, color.NRGBA{255, 255, 0, 200}, "mass/m3"},
+	}
+	if len(scale) != len(want) {
+		t.Fatalf("got %d levels, want %d", len(scale), len(want))
+	}
+	for i := range want {
+		if scale[i] != want[i] {
+			t.Errorf("level %d = %+v, want %+v", i, scale[i], want[i])
+		}
+	}
+	// The default scale uses the same colors for the same peak.
+	def := defaultColorScale(2.6e-9, "mass/m3")
+	for i := range want {
+		if def[i] != want[i] {
+			t.Errorf("default level %d = %+v, want %+v", i, def[i], want[i])
+		}
+	}
+}
+
+func TestRenderCrossSection(t *testing.T) {
+	start := time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC)
+	c := &Cdump{
+		NumLat: 3, NumLon: 5, DLat: 0.5, DLon: 0.5, Lat1: 40, Lon1: -91,
+		Levels:     []int{0, 100, 1000},
+		Pollutants: []string{"TEST"},
+	}
+	p := c.NewPeriodLike(CdumpPeriod{Start: start, Stop: start.Add(time.Hour)})
+	for i := 0; i < c.NumLon; i++ {
+		p.Conc[0][1][c.NumLon+i] = 1e-9
+		p.Conc[0][2][c.NumLon+i] = 1e-11
+	}
+	c.Periods = []CdumpPeriod{p}
+
+	path, err := ParseSectionPath("40.5,-91; 40.5,-89")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames, err := RenderCrossSection(c, path, CrossSectionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || frames[0].T != p.Stop.Unix() {
+		t.Fatalf("got %d frames, want one valid at the end of the period", len(frames))
+	}
+	if km := frames[0].Bbox["distanceKm"]; km < 168 || km > 170 {
+		t.Errorf("distanceKm = %g, want about 169", km)
+	}
+	if top := frames[0].Bbox["top"]; top != 1000 {
+		t.Errorf("top = %g, want the top level", top)
+	}
+
+	if _, err := ParseSectionPath("40.5,-91"); err == nil {
+		t.Error("expected an error for a path of one vertex")
+	}
+	if _, err := RenderCrossSection(c, path, CrossSectionOptions{Pollutant: "NONE"}); err == nil {
+		t.Error("expected an error for an unknown pollutant")
+	}
+}
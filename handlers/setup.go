@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// namelistEntry is one "key = value" line of a SETUP.CFG namelist. Values are
+// written as-is, so strings must already be quoted.
+type namelistEntry struct {
+	Key   string
+	Value string
+}
+
+// setNamelist replaces the value of key, or appends it if missing.
+func setNamelist(entries []namelistEntry, key, value string) []namelistEntry {
+	for i := range entries {
+		if strings.EqualFold(entries[i].Key, key) {
+			entries[i].Value = value
+			return entries
+		}
+	}
+	return append(entries, namelistEntry{Key: key, Value: value})
+}
+
+func formatNamelist(entries []namelistEntry) string {
+	var sb strings.Builder
+	sb.WriteString(" &SETUP\n")
+	for _, e := range entries {
+		sb.WriteString(fmt.Sprintf(" %s = %s,\n", e.Key, e.Value))
+	}
+	sb.WriteString(" /\n")
+	return sb.String()
+}
+
+// setupEntries derives the SETUP.CFG namelist from the payload.
+func setupEntries(payload Payload) ([]namelistEntry, error) {
+	meta := payload.SimulationMeta
+	phys := payload.PhysicsConfig
+
+	kmsl := "0"
+	if tc := payload.TrajectoryConfig; tc != nil && tc.HeightsAboveMsl {
+		kmsl = "1"
+	}
+	entries := []namelistEntry{
+		{"tratio", "0.75"},
+		{"mgmin", "10"},
+		{"kmsl", kmsl},
+		{"messg", "'MESSAGE'"},
+	}
+
+	if meta.ModelType == "TRAJECTORY" {
+		traj, err := trajectorySetupEntries(payload.TrajectoryConfig)
+		if err != nil {
+			return nil, err
+		}
+		return append(entries, traj...), nil
+	}
+
+	initd := 0
+	if strings.EqualFold(phys.ConfigMode, "Puff") {
+		initd = 3
+	}
+	maxpar := phys.MaxParticles
+	if maxpar <= 0 {
+		maxpar = 10000
+	}
+	numpar := 2500
+	if numpar > maxpar {
+		numpar = maxpar
+	}
+	entries = append(entries,
+		namelistEntry{"initd", fmt.Sprintf("%d", initd)},
+		namelistEntry{"numpar", fmt.Sprintf("%d", numpar)},
+		namelistEntry{"maxpar", fmt.Sprintf("%d", maxpar)},
+	)
+	if meta.Matrix != nil {
+		entries = append(entries, namelistEntry{"ichem", "1"})
+	}
+	if len(payload.EmissionScenarios) > 0 && meta.Direction == "FORWARD" {
+		entries = append(entries, namelistEntry{"efile", "'EMITIMES'"})
+	}
+	if payload.ContinueFromJobId != "" {
+		entries = append(entries,
+			namelistEntry{"ninit", "1"},
+			namelistEntry{"pinpf", "'" + parinitFile + "'"},
+		)
+	}
+	return entries, nil
+}
+
+// applySetupOverrides applies PhysicsConfig.SetupOverrides on top of the
+// generated entries, in key order so the output is stable.
+func applySetupOverrides(entries []namelistEntry, overrides map[string]string) []namelistEntry {
+	keys := make([]string, 0, len(overrides))
+	for k := range overrides {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		entries = setNamelist(entries, strings.ToLower(k), overrides[k])
+	}
+	return entries
+}
+
+// GenerateSetupFile builds the SETUP.CFG namelist for the payload.
+func GenerateSetupFile(payload Payload) (string, error) {
+	entries, err := setupEntries(payload)
+	if err != nil {
+		return "", err
+	}
+	entries = applySetupOverrides(entries, payload.PhysicsConfig.SetupOverrides)
+	return formatNamelist(entries), nil
+}
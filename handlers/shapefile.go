@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"strings"
+)
+
+// Shape is one polyline or polygon record of a shapefile, in longitude and
+// latitude.
+type Shape struct {
+	Polygon                  bool
+	West, South, East, North float64
+	Parts                    [][][2]float64 // rings or lines of lon, lat points
+}
+
+// Shapefile holds the line and polygon shapes of an ESRI shapefile. Point
+// and null records are skipped.
+type Shapefile struct {
+	Path   string
+	Shapes []Shape
+}
+
+// Intersects reports whether the shape's box overlaps a bbox.
+func (s Shape) Intersects(west, south, east, north float64) bool {
+	return s.West <= east && s.East >= west && s.South <= north && s.North >= south
+}
+
+// ReadShapefile reads the .shp file of a shapefile. Coordinates must be
+// geographic; a .prj next to it that names a projected system is an error.
+func ReadShapefile(path string) (*Shapefile, error) {
+	prj, err := os.ReadFile(strings.TrimSuffix(path, ".shp") + ".prj")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if strings.HasPrefix(strings.TrimSpace(strings.ToUpper(string(prj))), "PROJCS") {
+		return nil, fmt.Errorf("%s: projected coordinates are not supported, reproject to longitude and latitude", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sf := &Shapefile{Path: path}
+	if sf.Shapes, err = parseShapes(data); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return sf, nil
+}
+
+// parseShapes decodes the records of a .shp file. Record headers are
+// big-endian, record contents little-endian. The Z and M values of
+// PolyLineZ/M and PolygonZ/M follow the points and are skipped.
+func parseShapes(data []byte) ([]Shape, error) {
+	if len(data) < 100 || binary.BigEndian.Uint32(data[0:4]) != 9994 {
+		return nil, fmt.Errorf("not a shapefile")
+	}
+	le := binary.LittleEndian
+	f64 := func(b []byte) float64 { return math.Float64frombits(le.Uint64(b)) }
+
+	var shapes []Shape
+	for off := 100; off+8 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[off:])) // record number
+		size := int(binary.BigEndian.Uint32(data[off+4:])) * 2
+		rec := data[off+8:]
+		if size > len(rec) {
+			return shapes, fmt.Errorf("record %d: truncated", n)
+		}
+		rec = rec[:size]
+		off += 8 + size
+		if len(rec) < 4 {
+			continue
+		}
+		switch typ := le.Uint32(rec); typ {
+		case 3, 5, 13, 15, 23, 25: // polyline and polygon, plain, Z and M
+			if len(rec) < 44 {
+				return shapes, fmt.Errorf("record %d: short header", n)
+			}
+			s := Shape{
+				Polygon: typ%10 == 5,
+				West:    f64(rec[4:]), South: f64(rec[12:]), East: f64(rec[20:]), North: f64(rec[28:]),
+			}
+			numParts, numPoints := int(le.Uint32(rec[36:])), int(le.Uint32(rec[40:]))
+			pts := 44 + 4*numParts
+			if numParts < 0 || numPoints < 0 || pts+16*numPoints > len(rec) {
+				return shapes, fmt.Errorf("record %d: %d parts of %d points do not fit", n, numParts, numPoints)
+			}
+			for p := 0; p < numParts; p++ {
+				start := int(le.Uint32(rec[44+4*p:]))
+				end := numPoints
+				if p+1 < numParts {
+					end = int(le.Uint32(rec[44+4*(p+1):]))
+				}
+				if start < 0 || end > numPoints || start > end {
+					return shapes, fmt.Errorf("record %d: bad part %d", n, p)
+				}
+				part := make([][2]float64, end-start)
+				for i := range part {
+					b := rec[pts+16*(start+i):]
+					part[i] = [2]float64{f64(b), f64(b[8:])}
+				}
+				s.Parts = append(s.Parts, part)
+			}
+			shapes = append(shapes, s)
+		}
+	}
+	return shapes, nil
+}
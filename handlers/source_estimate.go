@@ -0,0 +1,565 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FootprintObservation pairs the backward footprint of a receptor with the
+// value measured there.
+type FootprintObservation struct {
+	Footprint string  // backward cdump path
+	Value     float64 // measured concentration
+	Sigma     float64 // measurement error, 0 uses the default
+}
+
+// ReadFootprintObservationsFile reads CSV lines "cdump,value[,sigma]".
+// Relative cdump paths are taken from the file's directory. A header line
+// is skipped.
+func ReadFootprintObservationsFile(path string) ([]FootprintObservation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cr := csv.NewReader(f)
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var obs []FootprintObservation
+	for n, rec := range records {
+		if len(rec) < 2 {
+			return nil, fmt.Errorf("line %d: want cdump and value", n+1)
+		}
+		value, err := strconv.ParseFloat(rec[1], 64)
+		if err != nil {
+			if n == 0 {
+				continue // header
+			}
+			return nil, fmt.Errorf("line %d: bad value %q", n+1, rec[1])
+		}
+		o := FootprintObservation{Footprint: rec[0], Value: value}
+		if !filepath.IsAbs(o.Footprint) {
+			o.Footprint = filepath.Join(filepath.Dir(path), o.Footprint)
+		}
+		if len(rec) > 2 && rec[2] != "" {
+			if o.Sigma, err = strconv.ParseFloat(rec[2], 64); err != nil {
+				return nil, fmt.Errorf("line %d: bad sigma %q", n+1, rec[2])
+			}
+		}
+		obs = append(obs, o)
+	}
+	return obs, nil
+}
+
+// SourceEstimateOptions controls the source search.
+type SourceEstimateOptions struct {
+	// Method is "single-cell" (fit a single point source in every cell on
+	// its own and rank cells by the residual), "bayes" (the same, ranked by
+	// the posterior probability under Gaussian measurement errors and a
+	// flat prior over cells) or "nnls" (fit non-negative rates to all cells
+	// at once, so cells compete for the observations).
+	Method string
+	// RelativeError and MinError give the default measurement error
+	// max(RelativeError*value, MinError) where Sigma is not set.
+	RelativeError float64
+	MinError      float64
+	Level         int // footprint level height, default the first
+	Top           int // number of best cells reported, default 10
+}
+
+// SourceCandidate is a grid cell with its fitted emission rate. For
+// single-cell and bayes it is the best single source in that cell; for nnls
+// it is one of the cells the joint fit emits from.
+type SourceCandidate struct {
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	Rate        float64 `json:"rate"`   // emission rate in the footprints' unit emission
+	RateSD      float64 `json:"rateSd"` // standard error of the rate
+	Cost        float64 `json:"cost"`   // residual sum of squares, weighted by 1/sigma² for bayes
+	Probability float64 `json:"probability"`
+	R           float64 `json:"r"` // correlation of fitted and observed values
+}
+
+type SourceEstimate struct {
+	Method     string            `json:"method"`
+	Receptors  int               `json:"receptors"`
+	Candidates []SourceCandidate `json:"candidates"`
+	// Field holds the location probability of every cell, on the
+	// footprint grid. For nnls it is the share of the total emission.
+	Field *Cdump `json:"-"`
+}
+
+// EstimateSource looks for sources of constant rate on the footprint grid
+// such that each observation is the sum over cells of rate times the
+// footprint of its receptor at that cell. Footprints are summed over their
+// sampling periods. Cells no footprint reaches are not candidates.
+func EstimateSource(footprints []*Cdump, obs []FootprintObservation, opts SourceEstimateOptions) (*SourceEstimate, error) {
+	if len(footprints) == 0 || len(footprints) != len(obs) {
+		return nil, fmt.Errorf("need one footprint per observation")
+	}
+	method := strings.ToLower(opts.Method)
+	if method == "" {
+		method = "single-cell"
+	}
+	if method != "single-cell" && method != "bayes" && method != "nnls" {
+		return nil, fmt.Errorf("unknown method %q (want single-cell, bayes or nnls)", opts.Method)
+	}
+	ref := footprints[0]
+	for i, fp := range footprints[1:] {
+		if !ref.SameGrid(fp) {
+			return nil, fmt.Errorf("footprint %d does not share the grid of footprint 1", i+2)
+		}
+	}
+	l := 0
+	if opts.Level != 0 {
+		if l = ref.LevelIndex(opts.Level); l < 0 {
+			return nil, fmt.Errorf("level %d not in footprints", opts.Level)
+		}
+	}
+	top := opts.Top
+	if top <= 0 {
+		top = 10
+	}
+
+	cells := ref.NumLat * ref.NumLon
+	// srs[r][e] is the sensitivity of receptor r to a unit source in cell e.
+	srs := make([][]float64, len(footprints))
+	for r, fp := range footprints {
+		srs[r] = make([]float64, cells)
+		for _, p := range fp.Periods {
+			for k := range fp.Pollutants {
+				for e, v := range p.Conc[k][l] {
+					srs[r][e] += float64(v)
+				}
+			}
+		}
+	}
+
+	sigma := make([]float64, len(obs))
+	for r, o := range obs {
+		sigma[r] = o.Sigma
+		if sigma[r] <= 0 {
+			sigma[r] = math.Max(opts.RelativeError*o.Value, opts.MinError)
+		}
+		if method == "bayes" && sigma[r] <= 0 {
+			return nil, fmt.Errorf("observation %d has no measurement error; set sigma, a relative or a minimum error", r+1)
+		}
+	}
+
+	var candidates []SourceCandidate
+	var index []int
+	if method == "nnls" {
+		candidates, index = jointCandidates(ref, srs, obs)
+	} else {
+		candidates, index = cellCandidates(ref, srs, obs, sigma, method == "bayes")
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("footprints are zero everywhere")
+	}
+
+	est := &SourceEstimate{Method: method, Receptors: len(obs)}
+	field := ref.CloneHeader()
+	field.Pollutants = []string{"SRCP"}
+	field.Levels = []int{ref.Levels[l]}
+	period := field.NewPeriodLike(ref.Periods[0])
+	if len(ref.Periods) > 1 {
+		period.Stop = ref.Periods[len(ref.Periods)-1].Stop
+		period.StopForecastHour = ref.Periods[len(ref.Periods)-1].StopForecastHour
+	}
+	for i, c := range candidates {
+		period.Conc[0][0][index[i]] = float32(c.Probability)
+	}
+	field.Periods = []CdumpPeriod{period}
+	est.Field = field
+
+	if method == "nnls" {
+		sort.SliceStable(candidates, func(a, b int) bool { return candidates[a].Rate > candidates[b].Rate })
+	} else {
+		sort.SliceStable(candidates, func(a, b int) bool { return candidates[a].Cost < candidates[b].Cost })
+	}
+	est.Candidates = candidates[:min(top, len(candidates))]
+	return est, nil
+}
+
+// cellCandidates fits a single source in every reached cell on its own, by
+// least squares in one unknown clipped at zero, weighted by 1/sigma² for
+// bayes. Bayes gives each cell p ∝ exp(-cost/2); single-cell does the same
+// with the residual variance of the best cell as the error, so
+// probabilities still rank cells on a common scale.
+func cellCandidates(ref *Cdump, srs [][]float64, obs []FootprintObservation, sigma []float64, bayes bool) ([]SourceCandidate, []int) {
+	var candidates []SourceCandidate
+	var index []int
+	for e := range srs[0] {
+		var sff, sfy, reached float64
+		for r := range obs {
+			w := 1.0
+			if bayes {
+				w = 1 / (sigma[r] * sigma[r])
+			}
+			f := srs[r][e]
+			sff += w * f * f
+			sfy += w * f * obs[r].Value
+			reached += f
+		}
+		if reached <= 0 {
+			continue
+		}
+		q := math.Max(sfy/sff, 0)
+		var cost float64
+		fitted := make([]float64, len(obs))
+		for r := range obs {
+			w := 1.0
+			if bayes {
+				w = 1 / (sigma[r] * sigma[r])
+			}
+			fitted[r] = q * srs[r][e]
+			d := obs[r].Value - fitted[r]
+			cost += w * d * d
+		}
+		c := SourceCandidate{
+			Latitude:  ref.Lat(e / ref.NumLon),
+			Longitude: ref.Lon(e % ref.NumLon),
+			Rate:      q,
+			Cost:      cost,
+			R:         correlation(fitted, obs),
+		}
+		if bayes {
+			c.RateSD = 1 / math.Sqrt(sff)
+		} else if n := len(obs); n > 1 {
+			c.RateSD = math.Sqrt(cost / float64(n-1) / sff)
+		}
+		candidates = append(candidates, c)
+		index = append(index, e)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	scale := 2.0
+	minCost := math.Inf(1)
+	for _, c := range candidates {
+		minCost = math.Min(minCost, c.Cost)
+	}
+	if !bayes {
+		scale = 2 * math.Max(minCost/float64(max(len(obs)-1, 1)), math.SmallestNonzeroFloat64)
+	}
+	var total float64
+	for i := range candidates {
+		candidates[i].Probability = math.Exp(-(candidates[i].Cost - minCost) / scale)
+		total += candidates[i].Probability
+	}
+	for i := range candidates {
+		candidates[i].Probability /= total
+	}
+	return candidates, index
+}
+
+// jointCandidates fits non-negative rates to all reached cells at once and
+// returns the cells with a positive rate. Each gets the residual of the
+// whole fit as its cost and its share of the total emission as its
+// probability.
+func jointCandidates(ref *Cdump, srs [][]float64, obs []FootprintObservation) ([]SourceCandidate, []int) {
+	var index []int
+	var cols [][]float64
+	for e := range srs[0] {
+		col := make([]float64, len(obs))
+		var reached float64
+		for r := range obs {
+			col[r] = srs[r][e]
+			reached += col[r]
+		}
+		if reached > 0 {
+			cols = append(cols, col)
+			index = append(index, e)
+		}
+	}
+	if len(cols) == 0 {
+		return nil, nil
+	}
+	y := make([]float64, len(obs))
+	for r, o := range obs {
+		y[r] = o.Value
+	}
+	q, sd := nnls(cols, y)
+
+	fitted := make([]float64, len(obs))
+	var total float64
+	for j, col := range cols {
+		for r := range fitted {
+			fitted[r] += q[j] * col[r]
+		}
+		total += q[j]
+	}
+	var cost float64
+	for r := range obs {
+		d := y[r] - fitted[r]
+		cost += d * d
+	}
+	rc := correlation(fitted, obs)
+
+	var candidates []SourceCandidate
+	var kept []int
+	for j, e := range index {
+		if q[j] <= 0 {
+			continue
+		}
+		candidates = append(candidates, SourceCandidate{
+			Latitude:    ref.Lat(e / ref.NumLon),
+			Longitude:   ref.Lon(e % ref.NumLon),
+			Rate:        q[j],
+			RateSD:      sd[j],
+			Cost:        cost,
+			Probability: q[j] / total,
+			R:           rc,
+		})
+		kept = append(kept, e)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	return candidates, kept
+}
+
+// nnls solves min |A x - b| subject to x >= 0 with the active set method of
+// Lawson and Hanson. A is given by its columns. It also returns the standard
+// error of the positive rates from the unconstrained fit on those columns,
+// which is zero when there are no more observations than positive rates.
+func nnls(cols [][]float64, b []float64) ([]float64, []float64) {
+	n, m := len(cols), len(b)
+	x := make([]float64, n)
+	passive := make([]bool, n)
+
+	var bNorm, aMax float64
+	for _, v := range b {
+		bNorm += v * v
+	}
+	for _, col := range cols {
+		var s float64
+		for _, v := range col {
+			s += v * v
+		}
+		aMax = math.Max(aMax, math.Sqrt(s))
+	}
+	tol := 1e-12 * math.Sqrt(bNorm) * aMax * float64(max(m, n))
+
+	residual := func() []float64 {
+		r := append([]float64(nil), b...)
+		for j, col := range cols {
+			if x[j] != 0 {
+				for i := range r {
+					r[i] -= x[j] * col[i]
+				}
+			}
+		}
+		return r
+	}
+	passiveSet := func() []int {
+		var set []int
+		for j, p := range passive {
+			if p {
+				set = append(set, j)
+			}
+		}
+		return set
+	}
+
+	for iter := 0; iter < 3*n; iter++ {
+		// Add the column that most reduces the residual.
+		r := residual()
+		best, bestW := -1, tol
+		for j, col := range cols {
+			if passive[j] {
+				continue
+			}
+			var w float64
+			for i := range r {
+				w += col[i] * r[i]
+			}
+			if w > bestW {
+				best, bestW = j, w
+			}
+		}
+		if best < 0 {
+			break
+		}
+		passive[best] = true
+
+		for {
+			set := passiveSet()
+			sub := make([][]float64, len(set))
+			for k, j := range set {
+				sub[k] = cols[j]
+			}
+			z, _ := leastSquares(sub, b)
+			// Move towards the unconstrained solution until a rate would
+			// turn negative, and drop that column.
+			alpha, drop := 1.0, -1
+			for k, j := range set {
+				if z[k] <= 0 {
+					if a := x[j] / (x[j] - z[k]); a < alpha {
+						alpha, drop = a, j
+					}
+				}
+			}
+			for k, j := range set {
+				x[j] += alpha * (z[k] - x[j])
+			}
+			if drop < 0 {
+				break
+			}
+			x[drop] = 0
+			for _, j := range set {
+				if x[j] <= 0 {
+					x[j] = 0
+					passive[j] = false
+				}
+			}
+		}
+	}
+
+	sd := make([]float64, n)
+	set := passiveSet()
+	if len(set) > 0 && m > len(set) {
+		sub := make([][]float64, len(set))
+		for k, j := range set {
+			sub[k] = cols[j]
+		}
+		_, variance := leastSquares(sub, b)
+		var rss float64
+		for _, v := range residual() {
+			rss += v * v
+		}
+		s2 := rss / float64(m-len(set))
+		for k, j := range set {
+			sd[j] = math.Sqrt(s2 * variance[k])
+		}
+	}
+	return x, sd
+}
+
+// leastSquares solves min |A x - b| by Householder QR. A is given by its
+// columns, which must be linearly independent. It also returns the diagonal
+// of (AᵀA)⁻¹, the variance factors of x.
+func leastSquares(cols [][]float64, b []float64) ([]float64, []float64) {
+	n, m := len(cols), len(b)
+	a := make([][]float64, n) // columns, reduced to R in place
+	for j := range cols {
+		a[j] = append([]float64(nil), cols[j]...)
+	}
+	y := append([]float64(nil), b...)
+	for k := 0; k < n && k < m; k++ {
+		var norm float64
+		for i := k; i < m; i++ {
+			norm += a[k][i] * a[k][i]
+		}
+		norm = math.Sqrt(norm)
+		if norm == 0 {
+			continue
+		}
+		if a[k][k] > 0 {
+			norm = -norm
+		}
+		// v = a_k - norm e_k, applied as I - 2vvᵀ/vᵀv.
+		v := make([]float64, m)
+		copy(v[k:], a[k][k:])
+		v[k] -= norm
+		var vv float64
+		for i := k; i < m; i++ {
+			vv += v[i] * v[i]
+		}
+		reflect := func(c []float64) {
+			var d float64
+			for i := k; i < m; i++ {
+				d += v[i] * c[i]
+			}
+			d *= 2 / vv
+			for i := k; i < m; i++ {
+				c[i] -= d * v[i]
+			}
+		}
+		for j := k; j < n; j++ {
+			reflect(a[j])
+		}
+		reflect(y)
+	}
+
+	// Back substitution with R, and R⁻¹ for the variance factors.
+	x := make([]float64, n)
+	rinv := make([][]float64, n)
+	for k := n - 1; k >= 0; k-- {
+		rinv[k] = make([]float64, n)
+		if k >= m || a[k][k] == 0 {
+			continue
+		}
+		s := y[k]
+		for j := k + 1; j < n; j++ {
+			s -= a[j][k] * x[j]
+		}
+		x[k] = s / a[k][k]
+		rinv[k][k] = 1 / a[k][k]
+		for j := k + 1; j < n; j++ {
+			var t float64
+			for i := k + 1; i <= j; i++ {
+				t += a[i][k] * rinv[i][j]
+			}
+			rinv[k][j] = -t / a[k][k]
+		}
+	}
+	variance := make([]float64, n)
+	for k := range variance {
+		for j := k; j < n; j++ {
+			variance[k] += rinv[k][j] * rinv[k][j]
+		}
+	}
+	return x, variance
+}
+
+func correlation(fitted []float64, obs []FootprintObservation) float64 {
+	n := float64(len(obs))
+	var mf, mo float64
+	for r := range obs {
+		mf += fitted[r] / n
+		mo += obs[r].Value / n
+	}
+	var sxy, sxx, syy float64
+	for r := range obs {
+		dx, dy := obs[r].Value-mo, fitted[r]-mf
+		sxy += dx * dy
+		sxx += dx * dx
+		syy += dy * dy
+	}
+	if sxx == 0 || syy == 0 {
+		return 0
+	}
+	return sxy / math.Sqrt(sxx*syy)
+}
+
+func WriteSourceEstimateCSV(w io.Writer, est *SourceEstimate) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"rank", "latitude", "longitude", "rate", "rate_sd", "cost", "probability", "r"})
+	g := func(v float64) string { return strconv.FormatFloat(v, 'g', 6, 64) }
+	for i, c := range est.Candidates {
+		cw.Write([]string{strconv.Itoa(i + 1), g(c.Latitude), g(c.Longitude), g(c.Rate), g(c.RateSD), g(c.Cost), g(c.Probability), g(c.R)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func WriteSourceEstimateJSON(w io.Writer, est *SourceEstimate) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(est)
+}
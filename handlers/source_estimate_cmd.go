@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func sourceEstimateCmd(args []string) error {
+	fs := flag.NewFlagSet("source-estimate", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: hysplit-run source-estimate [flags] <observations.csv>")
+		fmt.Fprintln(fs.Output(), "Each line of the observations file is: backward cdump,measured value[,sigma]")
+		fs.PrintDefaults()
+	}
+	method := fs.String("method", "single-cell", "single-cell, bayes or nnls")
+	relErr := fs.Float64("rel-error", 0.3, "default measurement error relative to the value")
+	minErr := fs.Float64("min-error", 0, "smallest default measurement error, for non-detects")
+	level := fs.Int("level", 0, "footprint level height in m (default: the first)")
+	top := fs.Int("top", 10, "number of best cells to report")
+	format := fs.String("format", "csv", "csv or json")
+	field := fs.String("field", "", "also write the location probability as a cdump to this path")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("need one observations file")
+	}
+
+	obs, err := ReadFootprintObservationsFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var footprints []*Cdump
+	for _, o := range obs {
+		c, err := ReadCdumpFile(o.Footprint)
+		if err != nil {
+			return err
+		}
+		footprints = append(footprints, c)
+	}
+	est, err := EstimateSource(footprints, obs, SourceEstimateOptions{
+		Method:        *method,
+		RelativeError: *relErr,
+		MinError:      *minErr,
+		Level:         *level,
+		Top:           *top,
+	})
+	if err != nil {
+		return err
+	}
+	if *field != "" {
+		if err := WriteCdumpFile(*field, est.Field); err != nil {
+			return err
+		}
+	}
+
+	switch strings.ToLower(*format) {
+	case "csv":
+		return WriteSourceEstimateCSV(os.Stdout, est)
+	case "json":
+		return WriteSourceEstimateJSON(os.Stdout, est)
+	default:
+		return fmt.Errorf("unknown format %q (want csv or json)", *format)
+	}
+}
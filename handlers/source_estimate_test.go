@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// syntheticFootprints returns footprints of receptors on a 2x3 grid with
+// random sensitivities, and the observations of the given sources (cell
+// index to rate) without noise.
+func syntheticFootprints(receptors int, sources map[int]float64) ([]*Cdump, []FootprintObservation) {
+	rng := rand.New(rand.NewSource(1))
+	start := time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC)
+	var footprints []*Cdump
+	var obs []FootprintObservation
+	for r := 0; r < receptors; r++ {
+		c := &Cdump{
+			NumLat: 2, NumLon: 3, DLat: 1, DLon: 1, Lat1: 40, Lon1: -90,
+			Levels: []int{100}, Pollutants: []string{"TEST"},
+		}
+		p := c.NewPeriodLike(CdumpPeriod{Start: start, Stop: start.Add(24 * time.Hour)})
+		var y float64
+		for e := range p.Conc[0][0] {
+			p.Conc[0][0][e] = float32(rng.Float64() * 1e-12)
+			y += sources[e] * float64(p.Conc[0][0][e])
+		}
+		c.Periods = []CdumpPeriod{p}
+		footprints = append(footprints, c)
+		obs = append(obs, FootprintObservation{Value: y})
+	}
+	return footprints, obs
+}
+
+func TestEstimateSourceSingleCell(t *testing.T) {
+	footprints, obs := syntheticFootprints(8, map[int]float64{4: 2000})
+	for _, method := range []string{"single-cell", "bayes"} {
+		est, err := EstimateSource(footprints, obs, SourceEstimateOptions{Method: method, RelativeError: 0.1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		best := est.Candidates[0]
+		// Cell 4 is row 1, column 1.
+		if best.Latitude != 41 || best.Longitude != -89 {
+			t.Errorf("%s: best cell at %g,%g, want 41,-89", method, best.Latitude, best.Longitude)
+		}
+		if math.Abs(best.Rate-2000) > 1e-6*2000 || best.Cost > 1e-12 || best.Probability < 0.99 {
+			t.Errorf("%s: best candidate %+v, want rate 2000 with no residual", method, best)
+		}
+	}
+	if _, err := EstimateSource(footprints, obs, SourceEstimateOptions{Method: "ls"}); err == nil {
+		t.Error("expected an error for an unknown method")
+	}
+}
+
+func TestEstimateSourceNNLS(t *testing.T) {
+	// Two sources: no single cell explains the observations, the joint fit
+	// recovers both.
+	sources := map[int]float64{1: 1000, 4: 3000}
+	footprints, obs := syntheticFootprints(8, sources)
+
+	single, err := EstimateSource(footprints, obs, SourceEstimateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if single.Method != "single-cell" || single.Candidates[0].Cost < 1e-20 {
+		t.Errorf("single-cell fit of two sources: %+v", single.Candidates[0])
+	}
+
+	est, err := EstimateSource(footprints, obs, SourceEstimateOptions{Method: "nnls"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(est.Candidates) != 2 {
+		t.Fatalf("got %d emitting cells, want 2: %+v", len(est.Candidates), est.Candidates)
+	}
+	for i, want := range []struct {
+		lat, lon, rate, share float64
+	}{{41, -89, 3000, 0.75}, {40, -89, 1000, 0.25}} {
+		c := est.Candidates[i]
+		if c.Latitude != want.lat || c.Longitude != want.lon ||
+			math.Abs(c.Rate-want.rate) > 1e-6*want.rate || math.Abs(c.Probability-want.share) > 1e-6 {
+			t.Errorf("candidate %d = %+v, want %g at %g,%g", i, c, want.rate, want.lat, want.lon)
+		}
+	}
+	if est.Candidates[0].Cost > 1e-12 || math.Abs(est.Candidates[0].R-1) > 1e-9 {
+		t.Errorf("joint fit cost %g, r %g", est.Candidates[0].Cost, est.Candidates[0].R)
+	}
+}
+
+func TestNNLS(t *testing.T) {
+	// The unconstrained fit of b from these columns is x = (2, -1); the
+	// non-negative one drops the second column.
+	cols := [][]float64{{1, 1, 0}, {1, 2, 1}}
+	x, _ := nnls(cols, []float64{1, 0, -1})
+	// min |(x1, x1, 0) - (1, 0, -1)| gives x1 = 0.5.
+	if math.Abs(x[0]-0.5) > 1e-12 || x[1] != 0 {
+		t.Errorf("nnls = %v, want [0.5 0]", x)
+	}
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// StartRepeat starts the same trajectories again every IntervalHours, Count
+// times in total. Each start becomes its own CONTROL file and job.
+type StartRepeat struct {
+	IntervalHours int `json:"intervalHours"`
+	Count         int `json:"count"`
+}
+
+// startLocations expands points with several start heights into one
+// starting location per height.
+func startLocations(points []Point) []Point {
+	var out []Point
+	for _, p := range points {
+		if len(p.HeightsMAgl) == 0 {
+			out = append(out, p)
+			continue
+		}
+		for _, h := range p.HeightsMAgl {
+			loc := p
+			loc.HeightMAgl = h
+			loc.HeightsMAgl = nil
+			out = append(out, loc)
+		}
+	}
+	return out
+}
+
+// startSuffix names a start time the way HYSPLIT names daily output files,
+// with the minutes added so starts off the hour stay apart, e.g.
+// "2512010630".
+func startSuffix(epoch int64) string {
+	t := time.Unix(epoch, 0).UTC()
+	return fmt.Sprintf("%02d%02d%02d%02d%02d", t.Year()%100, t.Month(), t.Day(), t.Hour(), t.Minute())
+}
+
+// ExpandStartTimes builds one payload per repeated start time. The run
+// length stays the same, job ids and output names get the start time as a
+// suffix, e.g. job "site_2512010600" writes "tdump.2512010600".
+func ExpandStartTimes(payload Payload) ([]Payload, error) {
+	meta := payload.SimulationMeta
+	rep := meta.StartRepeat
+	if rep == nil {
+		return nil, fmt.Errorf("payload has no startRepeat block")
+	}
+	if meta.ModelType != "TRAJECTORY" {
+		return nil, fmt.Errorf("startRepeat is only supported for trajectory runs")
+	}
+	if rep.IntervalHours <= 0 || rep.Count <= 0 {
+		return nil, fmt.Errorf("startRepeat needs a positive intervalHours and count")
+	}
+	if payload.ContinueFromJobId != "" {
+		return nil, fmt.Errorf("startRepeat cannot be combined with continueFromJobId")
+	}
+
+	var starts []Payload
+	for k := 0; k < rep.Count; k++ {
+		shift := int64(k*rep.IntervalHours) * 3600
+		s := payload
+		s.SimulationMeta.StartRepeat = nil
+		s.SimulationMeta.StartEpochUTC += shift
+		s.SimulationMeta.EndEpochUTC += shift
+		suffix := startSuffix(s.SimulationMeta.StartEpochUTC)
+		s.JobId = payload.JobId + "_" + suffix
+		s.SimulationMeta.OutputFile.FileName = outputFileName(meta) + "." + suffix
+		starts = append(starts, s)
+	}
+	return starts, nil
+}
+
+// MergeTdumps combines trajectory files into one dataset, ordered by start
+// time, and numbers the trajectories again. Met grids are listed once.
+func MergeTdumps(tdumps []*Tdump) (*Tdump, error) {
+	if len(tdumps) == 0 {
+		return nil, fmt.Errorf("no trajectory files to merge")
+	}
+	merged := &Tdump{
+		Direction:      tdumps[0].Direction,
+		VerticalMotion: tdumps[0].VerticalMotion,
+		VarNames:       tdumps[0].VarNames,
+	}
+	seen := make(map[string]bool)
+	for _, td := range tdumps {
+		if td.Direction != merged.Direction {
+			return nil, fmt.Errorf("cannot merge %s and %s trajectories", merged.Direction, td.Direction)
+		}
+		if fmt.Sprint(td.VarNames) != fmt.Sprint(merged.VarNames) {
+			return nil, fmt.Errorf("trajectory files have different diagnostic variables")
+		}
+		for i, model := range td.MetModels {
+			var t time.Time
+			if i < len(td.MetTimes) {
+				t = td.MetTimes[i]
+			}
+			if key := model + t.String(); !seen[key] {
+				seen[key] = true
+				merged.MetModels = append(merged.MetModels, model)
+				merged.MetTimes = append(merged.MetTimes, t)
+			}
+		}
+		merged.Trajectories = append(merged.Trajectories, td.Trajectories...)
+	}
+	sort.SliceStable(merged.Trajectories, func(a, b int) bool {
+		return merged.Trajectories[a].Start.Time.Before(merged.Trajectories[b].Start.Time)
+	})
+	for i := range merged.Trajectories {
+		merged.Trajectories[i].Index = i + 1
+	}
+	return merged, nil
+}
+
+// runStaggeredJob runs every start time of a payload with startRepeat in its
+// own job directory, and merges their trajectories into the output file of
+// the parent job. Each start writes its output next to the merged file.
+func runStaggeredJob(cfg Config, payload Payload) (string, error) {
+	dir, err := jobWorkDir(cfg, payload.JobId)
+	if err != nil {
+		return "", err
+	}
+	if payload, err = preparePayload(cfg, payload, dir, true); err != nil {
+		return dir, err
+	}
+	starts, err := ExpandStartTimes(payload)
+	if err != nil {
+		return dir, err
+	}
+	if err := writeMemberJobs(cfg, starts); err != nil {
+		return dir, err
+	}
+	if err := runMembers(cfg, starts); err != nil {
+		return dir, err
+	}
+
+	var tdumps []*Tdump
+	for _, s := range starts {
+		td, err := ReadTdumpFile(outputPath(s))
+		if err != nil {
+			return dir, err
+		}
+		tdumps = append(tdumps, td)
+	}
+	merged, err := MergeTdumps(tdumps)
+	if err != nil {
+		return dir, err
+	}
+	if err := os.MkdirAll(filepath.Dir(outputPath(payload)), 0755); err != nil {
+		return dir, err
+	}
+	if err := WriteTdumpFile(outputPath(payload), merged); err != nil {
+		return dir, err
+	}
+	fmt.Fprintf(os.Stderr, "Output: %s (%d trajectories from %d starts)\n", outputPath(payload), len(merged.Trajectories), len(starts))
+	return dir, nil
+}
@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Types for tdump (trajectory endpoints) files ---
+
+type Tdump struct {
+	MetModels      []string     `json:"metModels"`
+	MetTimes       []time.Time  `json:"metTimes,omitempty"` // start of each met grid
+	Direction      string       `json:"direction"`
+	VerticalMotion string       `json:"verticalMotion,omitempty"`
+	VarNames       []string     `json:"varNames"`
+	Trajectories   []Trajectory `json:"trajectories"`
+}
+
+type Trajectory struct {
+	Index  int               `json:"index"`
+	Start  TrajectoryStart   `json:"start"`
+	Points []TrajectoryPoint `json:"points"`
+}
+
+type TrajectoryStart struct {
+	Time       time.Time `json:"time"`
+	Latitude   float64   `json:"latitude"`
+	Longitude  float64   `json:"longitude"`
+	HeightMAgl float64   `json:"heightMAgl"`
+}
+
+type TrajectoryPoint struct {
+	Time      time.Time `json:"time"`
+	Age       float64   `json:"age"` // hours since start, negative for backward runs
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Height    float64   `json:"height"`
+	Vars      []float64 `json:"vars"` // diagnostic values in Tdump.VarNames order
+}
+
+// Var returns the named diagnostic variable of a point, e.g. "PRESSURE".
+func (t *Tdump) Var(p TrajectoryPoint, name string) (float64, bool) {
+	for i, n := range t.VarNames {
+		if strings.EqualFold(n, name) && i < len(p.Vars) {
+			return p.Vars[i], true
+		}
+	}
+	return 0, false
+}
+
+// ReadTdumpFile parses a trajectory endpoints file written by hyts_std.
+func ReadTdumpFile(path string) (*Tdump, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	td, err := ReadTdump(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return td, nil
+}
+
+// ReadTdump parses trajectory endpoints in the HYSPLIT tdump text format.
+func ReadTdump(r io.Reader) (*Tdump, error) {
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	next := func() ([]string, error) {
+		for scanner.Scan() {
+			lineNo++
+			if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+				return fields, nil
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	truncated := func(err error) error {
+		if err == io.EOF {
+			return fmt.Errorf("truncated tdump header at line %d", lineNo)
+		}
+		return err
+	}
+
+	// 1. Number of met grids and the file format version.
+	fields, err := next()
+	if err != nil {
+		return nil, truncated(err)
+	}
+	numGrids, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("line %d: invalid grid count: %v", lineNo, err)
+	}
+
+	td := &Tdump{}
+	for i := 0; i < numGrids; i++ {
+		if fields, err = next(); err != nil {
+			return nil, truncated(err)
+		}
+		td.MetModels = append(td.MetModels, fields[0])
+		if v, err := parseFloats(fields[1:]); err == nil && len(v) >= 4 {
+			td.MetTimes = append(td.MetTimes, tdumpTime(v[0], v[1], v[2], v[3], 0))
+		}
+	}
+
+	// 2. Number of trajectories, direction and vertical motion method.
+	if fields, err = next(); err != nil {
+		return nil, truncated(err)
+	}
+	numTraj, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("line %d: invalid trajectory count: %v", lineNo, err)
+	}
+	if len(fields) > 1 {
+		td.Direction = fields[1]
+	}
+	if len(fields) > 2 {
+		td.VerticalMotion = fields[2]
+	}
+
+	// 3. One starting location per trajectory.
+	for i := 0; i < numTraj; i++ {
+		if fields, err = next(); err != nil {
+			return nil, truncated(err)
+		}
+		v, err := parseFloats(fields)
+		if err != nil || len(v) < 7 {
+			return nil, fmt.Errorf("line %d: invalid starting location", lineNo)
+		}
+		td.Trajectories = append(td.Trajectories, Trajectory{
+			Index: i + 1,
+			Start: TrajectoryStart{
+				Time:       tdumpTime(v[0], v[1], v[2], v[3], 0),
+				Latitude:   v[4],
+				Longitude:  v[5],
+				HeightMAgl: v[6],
+			},
+		})
+	}
+
+	// 4. Diagnostic variable names.
+	if fields, err = next(); err != nil {
+		return nil, truncated(err)
+	}
+	numVars, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("line %d: invalid variable count: %v", lineNo, err)
+	}
+	td.VarNames = fields[1:]
+	if len(td.VarNames) > numVars {
+		td.VarNames = td.VarNames[:numVars]
+	}
+
+	// 5. Endpoints: traj grid yy mm dd hh mi fhr age lat lon height vars...
+	for {
+		fields, err = next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		v, err := parseFloats(fields)
+		if err != nil || len(v) < 12 {
+			return nil, fmt.Errorf("line %d: invalid trajectory endpoint", lineNo)
+		}
+		idx := int(v[0])
+		if idx < 1 || idx > len(td.Trajectories) {
+			return nil, fmt.Errorf("line %d: trajectory %d out of range", lineNo, idx)
+		}
+		td.Trajectories[idx-1].Points = append(td.Trajectories[idx-1].Points, TrajectoryPoint{
+			Time:      tdumpTime(v[2], v[3], v[4], v[5], v[6]),
+			Age:       v[8],
+			Latitude:  v[9],
+			Longitude: v[10],
+			Height:    v[11],
+			Vars:      v[12:],
+		})
+	}
+
+	// Starting locations only give the hour; the first endpoint has the
+	// minute.
+	for i, traj := range td.Trajectories {
+		for _, p := range traj.Points {
+			if p.Age == 0 && p.Time.Truncate(time.Hour).Equal(traj.Start.Time) {
+				td.Trajectories[i].Start.Time = p.Time
+				break
+			}
+		}
+	}
+	return td, nil
+}
+
+func parseFloats(fields []string) ([]float64, error) {
+	v := make([]float64, len(fields))
+	for i, f := range fields {
+		x, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return nil, err
+		}
+		v[i] = x
+	}
+	return v, nil
+}
+
+// tdumpTime converts the two digit year date fields of HYSPLIT output files.
+func tdumpTime(yy, mm, dd, hh, mi float64) time.Time {
+	year := int(yy)
+	if year < 100 {
+		if year < 40 {
+			year += 2000
+		} else {
+			year += 1900
+		}
+	}
+	return time.Date(year, time.Month(int(mm)), int(dd), int(hh), int(mi), 0, 0, time.UTC)
+}
+
+// WriteTdumpFile writes trajectories in the tdump format read by ReadTdump.
+func WriteTdumpFile(path string, td *Tdump) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := WriteTdump(f, td); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WriteTdump writes trajectories in the HYSPLIT tdump text format, with the
+// endpoints of all trajectories interleaved by age as hyts_std does.
+func WriteTdump(w io.Writer, td *Tdump) error {
+	bw := bufio.NewWriter(w)
+	yy := func(t time.Time) int { return t.Year() % 100 }
+
+	fmt.Fprintf(bw, "%6d%6d\n", len(td.MetModels), 1)
+	for i, model := range td.MetModels {
+		var t time.Time
+		if i < len(td.MetTimes) {
+			t = td.MetTimes[i]
+		}
+		// The last column is the forecast hour of the met data.
+		fmt.Fprintf(bw, "%8s%6d%6d%6d%6d%6d\n", model, yy(t), t.Month(), t.Day(), t.Hour(), 0)
+	}
+	fmt.Fprintf(bw, "%6d %-8s %-8s\n", len(td.Trajectories), td.Direction, td.VerticalMotion)
+	for _, traj := range td.Trajectories {
+		s := traj.Start
+		fmt.Fprintf(bw, "%6d%6d%6d%6d %8.3f %8.3f %8.1f\n",
+			yy(s.Time), s.Time.Month(), s.Time.Day(), s.Time.Hour(), s.Latitude, s.Longitude, s.HeightMAgl)
+	}
+	fmt.Fprintf(bw, "%6d", len(td.VarNames))
+	for _, name := range td.VarNames {
+		fmt.Fprintf(bw, " %8s", name)
+	}
+	bw.WriteString("\n")
+
+	type endpoint struct {
+		traj int
+		p    TrajectoryPoint
+	}
+	var endpoints []endpoint
+	for i, traj := range td.Trajectories {
+		for _, p := range traj.Points {
+			endpoints = append(endpoints, endpoint{i + 1, p})
+		}
+	}
+	sort.SliceStable(endpoints, func(a, b int) bool {
+		return math.Abs(endpoints[a].p.Age) < math.Abs(endpoints[b].p.Age)
+	})
+	for _, e := range endpoints {
+		p := e.p
+		fmt.Fprintf(bw, "%6d%6d%6d%6d%6d%6d%6d%6d%8.1f%9.3f%9.3f%9.1f",
+			e.traj, 1, yy(p.Time), p.Time.Month(), p.Time.Day(), p.Time.Hour(), p.Time.Minute(), 0,
+			p.Age, p.Latitude, p.Longitude, p.Height)
+		for _, v := range p.Vars {
+			fmt.Fprintf(bw, "%9.1f", v)
+		}
+		bw.WriteString("\n")
+	}
+	return bw.Flush()
+}
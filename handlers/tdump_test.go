@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTdumpRoundTrip(t *testing.T) {
+	// Two trajectories starting off the hour, with one diagnostic variable.
+	start := time.Date(2025, 12, 1, 6, 30, 0, 0, time.UTC)
+	td := &Tdump{
+		MetModels:      []string{"GFSQ"},
+		MetTimes:       []time.Time{time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC)},
+		Direction:      "FORWARD",
+		VerticalMotion: "OMEGA",
+		VarNames:       []string{"PRESSURE"},
+	}
+	for i := 0; i < 2; i++ {
+		traj := Trajectory{
+			Index: i + 1,
+			Start: TrajectoryStart{Time: start, Latitude: 40, Longitude: -90 + float64(i), HeightMAgl: 100},
+		}
+		for h := 0; h < 3; h++ {
+			traj.Points = append(traj.Points, TrajectoryPoint{
+				Time:      start.Add(time.Duration(h) * time.Hour),
+				Age:       float64(h),
+				Latitude:  40 + 0.125*float64(h),
+				Longitude: -90 + float64(i) + 0.25*float64(h),
+				Height:    100 + 50*float64(h),
+				Vars:      []float64{1000 - 5*float64(h)},
+			})
+		}
+		td.Trajectories = append(td.Trajectories, traj)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteTdump(&buf, td); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadTdump(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, td) {
+		t.Errorf("round trip changed the trajectories:\ngot  %+v\nwant %+v", got, td)
+	}
+}
+
+func TestExpandStartTimes(t *testing.T) {
+	p := testPayload("TRAJECTORY", "FORWARD")
+	p.SimulationMeta.StartEpochUTC += 30 * 60
+	p.SimulationMeta.EndEpochUTC += 30 * 60
+	p.SimulationMeta.StartRepeat = &StartRepeat{IntervalHours: 6, Count: 3}
+
+	starts, err := ExpandStartTimes(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(starts) != 3 {
+		t.Fatalf("got %d starts, want 3", len(starts))
+	}
+	// The run starts 2025-12-01 00:30; the minutes are part of the name.
+	last := starts[2]
+	if last.JobId != "golden_2512011230" || last.SimulationMeta.OutputFile.FileName != "out.2512011230" {
+		t.Errorf("last start: job %s, output %s", last.JobId, last.SimulationMeta.OutputFile.FileName)
+	}
+	if d := last.SimulationMeta.EndEpochUTC - last.SimulationMeta.StartEpochUTC; d != 20*3600 {
+		t.Errorf("run length %d s, want 20 h", d)
+	}
+
+	p.SimulationMeta.OutputFile.FileName = ""
+	if starts, _ = ExpandStartTimes(p); starts[0].SimulationMeta.OutputFile.FileName != "tdump.2512010030" {
+		t.Errorf("first start without an output name writes %q", starts[0].SimulationMeta.OutputFile.FileName)
+	}
+
+	p.ContinueFromJobId = "day1"
+	if _, err := ExpandStartTimes(p); err == nil {
+		t.Error("expected an error for startRepeat with continueFromJobId")
+	}
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+)
+
+// VerticalMotion is the vertical motion method on the CONTROL file.
+type VerticalMotion string
+
+const (
+	VerticalData       VerticalMotion = "data"       // 0: vertical velocity from the met data
+	VerticalIsobaric   VerticalMotion = "isobaric"   // 1
+	VerticalIsentropic VerticalMotion = "isentropic" // 2
+	VerticalDensity    VerticalMotion = "density"    // 3: constant density
+	VerticalSigma      VerticalMotion = "sigma"      // 4: constant internal sigma
+	VerticalDivergence VerticalMotion = "divergence" // 5: from the velocity divergence
+	VerticalRemapMSL   VerticalMotion = "remapMsl"   // 6: remap MSL to AGL data
+	VerticalAverage    VerticalMotion = "average"    // 7: spatially averaged data velocity
+	VerticalDamped     VerticalMotion = "damped"     // 8: damped by the ratio of vertical to horizontal
+)
+
+var verticalMotionCodes = map[VerticalMotion]int{
+	VerticalData:       0,
+	VerticalIsobaric:   1,
+	VerticalIsentropic: 2,
+	VerticalDensity:    3,
+	VerticalSigma:      4,
+	VerticalDivergence: 5,
+	VerticalRemapMSL:   6,
+	VerticalAverage:    7,
+	VerticalDamped:     8,
+}
+
+// Code returns the CONTROL file code of the method.
+func (v VerticalMotion) Code() (int, error) {
+	for m, code := range verticalMotionCodes {
+		if strings.EqualFold(string(m), string(v)) {
+			return code, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown vertical motion method %q", v)
+}
+
+// trajectoryDiagnostics are the TRAJ.CFG switches for the meteorological
+// variables written along each trajectory, in namelist order.
+var trajectoryDiagnostics = []string{"tpot", "tamb", "rain", "mixd", "relh", "sphu", "mixr", "dswf", "terr", "pres"}
+
+// TrajectoryConfig holds the settings of a trajectory run that are written
+// to CONTROL and the SETUP.CFG namelist (TRAJ.CFG in the HYSPLIT GUI).
+type TrajectoryConfig struct {
+	VerticalMotion        VerticalMotion `json:"verticalMotion"`        // replaces physicsConfig.verticalMotionCode
+	Diagnostics           []string       `json:"diagnostics"`           // e.g. ["pres", "rain", "mixd"]; tm_<name> switches
+	HeightsAboveMsl       bool           `json:"heightsAboveMsl"`       // start heights in m above sea level (kmsl=1)
+	OutputIntervalMinutes int            `json:"outputIntervalMinutes"` // endpoint output interval (tout), default 60
+	SplitIntervalHours    int            `json:"splitIntervalHours"`    // trajectory splitting interval (kspl), 0 keeps the model default
+}
+
+// verticalMotionCode returns the vertical motion line of CONTROL, from the
+// trajectory config when it sets a method.
+func verticalMotionCode(payload Payload) (int, error) {
+	if tc := payload.TrajectoryConfig; tc != nil && tc.VerticalMotion != "" {
+		return tc.VerticalMotion.Code()
+	}
+	code := payload.PhysicsConfig.VerticalMotionCode
+	if code < 0 || code > 8 {
+		return 0, fmt.Errorf("verticalMotionCode %d outside 0-8", code)
+	}
+	return code, nil
+}
+
+// trajectorySetupEntries returns the namelist entries of a trajectory run.
+// Without a trajectory config only pressure is output, hourly.
+func trajectorySetupEntries(tc *TrajectoryConfig) ([]namelistEntry, error) {
+	if tc == nil {
+		return []namelistEntry{{"tout", "60"}, {"tm_pres", "1"}}, nil
+	}
+	tout := tc.OutputIntervalMinutes
+	if tout < 0 {
+		return nil, fmt.Errorf("outputIntervalMinutes must not be negative")
+	}
+	if tout == 0 {
+		tout = 60
+	}
+	entries := []namelistEntry{{"tout", fmt.Sprintf("%d", tout)}}
+
+	selected := make(map[string]bool)
+	for _, d := range tc.Diagnostics {
+		name := strings.TrimPrefix(strings.ToLower(d), "tm_")
+		known := false
+		for _, k := range trajectoryDiagnostics {
+			known = known || k == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown trajectory diagnostic %q (want one of %s)", d, strings.Join(trajectoryDiagnostics, ", "))
+		}
+		selected[name] = true
+	}
+	for _, name := range trajectoryDiagnostics {
+		on := 0
+		if selected[name] {
+			on = 1
+		}
+		entries = append(entries, namelistEntry{"tm_" + name, fmt.Sprintf("%d", on)})
+	}
+
+	if tc.SplitIntervalHours < 0 {
+		return nil, fmt.Errorf("splitIntervalHours must not be negative")
+	}
+	if tc.SplitIntervalHours > 0 {
+		entries = append(entries, namelistEntry{"kspl", fmt.Sprintf("%d", tc.SplitIntervalHours)})
+	}
+	return entries, nil
+}
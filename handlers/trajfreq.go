@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// FreqGrid is the lat/lon grid trajectory frequencies are counted on.
+type FreqGrid struct {
+	Lat1   float64 // lower left cell center
+	Lon1   float64
+	DLat   float64
+	DLon   float64
+	NumLat int
+	NumLon int
+}
+
+// FreqGridFor returns a grid with the given spacing that covers every
+// trajectory point.
+func FreqGridFor(tdumps []*Tdump, spacing float64) (FreqGrid, error) {
+	if spacing <= 0 {
+		return FreqGrid{}, fmt.Errorf("grid spacing must be positive")
+	}
+	minLon, minLat, maxLon, maxLat := 180.0, 90.0, -180.0, -90.0
+	n := 0
+	for _, td := range tdumps {
+		for _, traj := range td.Trajectories {
+			for _, p := range traj.Points {
+				minLon, maxLon = min(minLon, p.Longitude), max(maxLon, p.Longitude)
+				minLat, maxLat = min(minLat, p.Latitude), max(maxLat, p.Latitude)
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return FreqGrid{}, fmt.Errorf("no trajectory points")
+	}
+	lat1 := math.Floor(minLat/spacing) * spacing
+	lon1 := math.Floor(minLon/spacing) * spacing
+	return FreqGrid{
+		Lat1:   lat1,
+		Lon1:   lon1,
+		DLat:   spacing,
+		DLon:   spacing,
+		NumLat: int(math.Round((maxLat-lat1)/spacing)) + 1,
+		NumLon: int(math.Round((maxLon-lon1)/spacing)) + 1,
+	}, nil
+}
+
+// cell returns the grid indices of a position, and false outside the grid.
+func (g FreqGrid) cell(lat, lon float64) (int, int, bool) {
+	i := int(math.Round((lon - g.Lon1) / g.DLon))
+	j := int(math.Round((lat - g.Lat1) / g.DLat))
+	return i, j, i >= 0 && i < g.NumLon && j >= 0 && j < g.NumLat
+}
+
+// TrajFreqOptions controls how trajectory passages are counted.
+type TrajFreqOptions struct {
+	// Weight is "count" (each trajectory counts once per cell it passes
+	// through) or "time" (residence time: hours spent in the cell).
+	Weight string
+	// HeightBands are band boundaries in m agl, e.g. [0, 500, 1500, 10000].
+	// Each band becomes one output level. Empty counts all heights together.
+	HeightBands []float64
+}
+
+// TrajectoryFrequency grids how often trajectories pass through each cell,
+// like HYSPLIT's TrajFreq. Segments between endpoints are subdivided so
+// no cell along the path is skipped. Values are normalized to percent: of
+// all trajectories for "count", of the total trajectory time for "time".
+// The result is a single period cdump with pollutant "TFRQ" and one level
+// per height band (named by the band top), so it renders like a
+// concentration field.
+func TrajectoryFrequency(tdumps []*Tdump, grid FreqGrid, opts TrajFreqOptions) (*Cdump, error) {
+	if grid.NumLat <= 0 || grid.NumLon <= 0 || grid.DLat <= 0 || grid.DLon <= 0 {
+		return nil, fmt.Errorf("invalid frequency grid")
+	}
+	weight := opts.Weight
+	if weight == "" {
+		weight = "count"
+	}
+	if weight != "count" && weight != "time" {
+		return nil, fmt.Errorf("unknown weight %q (want count or time)", weight)
+	}
+	bands := opts.HeightBands
+	for i := 1; i < len(bands); i++ {
+		if bands[i] <= bands[i-1] {
+			return nil, fmt.Errorf("height bands must increase")
+		}
+	}
+	numLevels := 1
+	if len(bands) >= 2 {
+		numLevels = len(bands) - 1
+	}
+	band := func(h float64) int {
+		if len(bands) < 2 {
+			return 0
+		}
+		for b := 0; b < numLevels; b++ {
+			if h >= bands[b] && h < bands[b+1] {
+				return b
+			}
+		}
+		return -1
+	}
+
+	out := &Cdump{
+		MetModel:   "TFRQ",
+		NumLat:     grid.NumLat,
+		NumLon:     grid.NumLon,
+		DLat:       grid.DLat,
+		DLon:       grid.DLon,
+		Lat1:       grid.Lat1,
+		Lon1:       grid.Lon1,
+		Pollutants: []string{"TFRQ"},
+		Packed:     true,
+	}
+	if len(bands) >= 2 {
+		for _, top := range bands[1:] {
+			out.Levels = append(out.Levels, int(top))
+		}
+	} else {
+		out.Levels = []int{0}
+	}
+	field := make([][]float64, numLevels)
+	for l := range field {
+		field[l] = make([]float64, grid.NumLat*grid.NumLon)
+	}
+
+	var first, last time.Time
+	numTraj := 0
+	totalHours := 0.0
+	// Sub-steps per segment keep consecutive samples within half a cell.
+	step := math.Min(grid.DLat, grid.DLon) / 2
+
+	for _, td := range tdumps {
+		if len(td.MetModels) > 0 && out.MetTime.IsZero() {
+			out.MetModel = td.MetModels[0]
+		}
+		for _, traj := range td.Trajectories {
+			if len(traj.Points) == 0 {
+				continue
+			}
+			numTraj++
+			out.Starts = append(out.Starts, CdumpStart{
+				Time:       traj.Start.Time,
+				Latitude:   traj.Start.Latitude,
+				Longitude:  traj.Start.Longitude,
+				HeightMAgl: traj.Start.HeightMAgl,
+			})
+			if out.MetTime.IsZero() || traj.Start.Time.Before(out.MetTime) {
+				out.MetTime = traj.Start.Time
+			}
+
+			visited := make(map[int]bool)
+			mark := func(lat, lon, h, hours float64) {
+				i, j, ok := grid.cell(lat, lon)
+				b := band(h)
+				if !ok || b < 0 {
+					return
+				}
+				e := j*grid.NumLon + i
+				if weight == "time" {
+					field[b][e] += hours
+					return
+				}
+				if key := b*len(field[b]) + e; !visited[key] {
+					visited[key] = true
+					field[b][e]++
+				}
+			}
+
+			for k, p := range traj.Points {
+				if first.IsZero() || p.Time.Before(first) {
+					first = p.Time
+				}
+				if p.Time.After(last) {
+					last = p.Time
+				}
+				if k == 0 {
+					mark(p.Latitude, p.Longitude, p.Height, 0)
+					continue
+				}
+				prev := traj.Points[k-1]
+				hours := math.Abs(p.Age - prev.Age)
+				totalHours += hours
+				dist := math.Max(math.Abs(p.Latitude-prev.Latitude), math.Abs(p.Longitude-prev.Longitude))
+				n := int(math.Ceil(dist/step)) + 1
+				for s := 1; s <= n; s++ {
+					f := float64(s) / float64(n)
+					mark(prev.Latitude+(p.Latitude-prev.Latitude)*f,
+						prev.Longitude+(p.Longitude-prev.Longitude)*f,
+						prev.Height+(p.Height-prev.Height)*f,
+						hours/float64(n))
+				}
+			}
+		}
+	}
+	if numTraj == 0 {
+		return nil, fmt.Errorf("no trajectories to count")
+	}
+
+	norm := 100 / float64(numTraj)
+	if weight == "time" {
+		if totalHours == 0 {
+			return nil, fmt.Errorf("trajectories have no duration")
+		}
+		norm = 100 / totalHours
+	}
+
+	if first.After(last) {
+		first, last = last, first
+	}
+	period := out.NewPeriodLike(CdumpPeriod{Start: first, Stop: last})
+	for l := range field {
+		for e, v := range field[l] {
+			period.Conc[0][l][e] = float32(v * norm)
+		}
+	}
+	out.Periods = []CdumpPeriod{period}
+	return out, nil
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+func trajFreqCmd(args []string) error {
+	fs := flag.NewFlagSet("trajfreq", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: hysplit-run trajfreq [flags] <tdump>...")
+		fs.PrintDefaults()
+	}
+	spacing := fs.Float64("spacing", 1.0, "grid spacing in degrees")
+	weight := fs.String("weight", "count", "count (trajectories per cell) or time (residence time)")
+	bands := fs.String("bands", "", "comma separated height band boundaries in m agl, e.g. 0,500,1500,10000")
+	output := fs.String("o", "tfdump", "output cdump file")
+	formats := fs.String("format", "", "also render the field: kml, png, geojson")
+	resolve := configFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no tdump files given")
+	}
+	cfg, err := resolve()
+	if err != nil {
+		return err
+	}
+
+	var opts TrajFreqOptions
+	opts.Weight = *weight
+	if opts.HeightBands, err = parseFloatList(*bands); err != nil {
+		return fmt.Errorf("-bands: %v", err)
+	}
+
+	var tdumps []*Tdump
+	for _, path := range fs.Args() {
+		td, err := ReadTdumpFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		tdumps = append(tdumps, td)
+	}
+	grid, err := FreqGridFor(tdumps, *spacing)
+	if err != nil {
+		return err
+	}
+	field, err := TrajectoryFrequency(tdumps, grid, opts)
+	if err != nil {
+		return err
+	}
+
+	path, err := filepath.Abs(*output)
+	if err != nil {
+		return err
+	}
+	if err := WriteCdumpFile(path, field); err != nil {
+		return err
+	}
+	fmt.Println(path)
+	if *formats == "" {
+		return nil
+	}
+
+	// The field is rendered like the output of a concentration run.
+	dir, name := filepath.Split(path)
+	var payload Payload
+	payload.SimulationMeta.ModelType = "CONCENTRATION"
+	payload.SimulationMeta.OutputFile = OutputMeta{Directory: dir, FileName: name}
+	written, err := plotOutputs(cfg, payload, filepath.Clean(dir), strings.Split(*formats, ","))
+	for _, p := range written {
+		fmt.Println(p)
+	}
+	return err
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// testFreqTdump returns two forward trajectories of two hours at 40 N: one
+// moving a degree east per hour at 100 m, one staying at 90 W at height h.
+func testFreqTdump(h float64) *Tdump {
+	start := time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC)
+	td := &Tdump{MetModels: []string{"GFSQ"}, Direction: "FORWARD"}
+	for i, move := range []float64{1, 0} {
+		height := 100.0
+		if move == 0 {
+			height = h
+		}
+		traj := Trajectory{Index: i + 1, Start: TrajectoryStart{Time: start, Latitude: 40, Longitude: -90, HeightMAgl: height}}
+		for k := 0; k < 3; k++ {
+			traj.Points = append(traj.Points, TrajectoryPoint{
+				Time: start.Add(time.Duration(k) * time.Hour), Age: float64(k),
+				Latitude: 40, Longitude: -90 + move*float64(k), Height: height,
+			})
+		}
+		td.Trajectories = append(td.Trajectories, traj)
+	}
+	return td
+}
+
+func TestTrajectoryFrequency(t *testing.T) {
+	td := testFreqTdump(100)
+	grid, err := FreqGridFor([]*Tdump{td}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (FreqGrid{Lat1: 40, Lon1: -90, DLat: 1, DLon: 1, NumLat: 1, NumLon: 3}); grid != want {
+		t.Fatalf("grid = %+v, want %+v", grid, want)
+	}
+
+	check := func(name string, got []float32, want []float64) {
+		t.Helper()
+		for e := range want {
+			if math.Abs(float64(got[e])-want[e]) > 1e-4 {
+				t.Errorf("%s = %v, want %v", name, got, want)
+				return
+			}
+		}
+	}
+
+	// Both trajectories pass the first cell, only the moving one the others.
+	c, err := TrajectoryFrequency([]*Tdump{td}, grid, TrajFreqOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Starts) != 2 || len(c.Periods) != 1 || c.Pollutants[0] != "TFRQ" {
+		t.Fatalf("got %d starts, %d periods", len(c.Starts), len(c.Periods))
+	}
+	check("count", c.Periods[0].Conc[0][0], []float64{100, 50, 50})
+
+	// Each hour of the moving trajectory is split in three samples half a
+	// cell apart: a third of it in the cell it leaves, two thirds in the
+	// next. The other trajectory spends both hours in the first cell.
+	c, err = TrajectoryFrequency([]*Tdump{td}, grid, TrajFreqOptions{Weight: "time"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("time", c.Periods[0].Conc[0][0], []float64{100 * (2 + 1.0/3) / 4, 100 * 1.0 / 4, 100 * (2.0 / 3) / 4})
+
+	// With height bands the staying trajectory, at 700 m, is counted in the
+	// upper band only.
+	c, err = TrajectoryFrequency([]*Tdump{testFreqTdump(700)}, grid, TrajFreqOptions{HeightBands: []float64{0, 500, 1000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Levels) != 2 || c.Levels[0] != 500 || c.Levels[1] != 1000 {
+		t.Fatalf("levels = %v, want the band tops", c.Levels)
+	}
+	check("band 0-500", c.Periods[0].Conc[0][0], []float64{50, 50, 50})
+	check("band 500-1000", c.Periods[0].Conc[0][1], []float64{50, 0, 0})
+
+	if _, err := TrajectoryFrequency([]*Tdump{td}, grid, TrajFreqOptions{HeightBands: []float64{0, 500, 500}}); err == nil {
+		t.Error("expected an error for bands that do not increase")
+	}
+	if _, err := TrajectoryFrequency([]*Tdump{td}, grid, TrajFreqOptions{Weight: "mass"}); err == nil {
+		t.Error("expected an error for an unknown weight")
+	}
+}
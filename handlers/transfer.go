@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TransferMatrixConfig splits a forward concentration run into unit-release
+// runs, one per point and release period. Their outputs form a transfer
+// coefficient matrix: the concentration field per unit emission rate of
+// each source and period.
+type TransferMatrixConfig struct {
+	Id           string `json:"id"`           // parent id, defaults to the payload jobId
+	ReleaseHours int    `json:"releaseHours"` // length of each release period (default 6)
+	RateUnit     string `json:"rateUnit"`     // unit of the unit release rate, e.g. "g/h"
+}
+
+// TransferManifest lists the unit runs of a transfer coefficient matrix.
+type TransferManifest struct {
+	MatrixId  string        `json:"matrixId"`
+	Pollutant string        `json:"pollutant"`
+	RateUnit  string        `json:"rateUnit,omitempty"`
+	Runs      []TransferRun `json:"runs"`
+}
+
+// TransferRun is one unit run: rate 1 per hour from PointId between
+// ReleaseStart and ReleaseEnd (epoch seconds).
+type TransferRun struct {
+	JobId        string     `json:"jobId"`
+	PointId      int        `json:"pointId"`
+	ReleaseStart int64      `json:"releaseStart"`
+	ReleaseEnd   int64      `json:"releaseEnd"`
+	Output       OutputMeta `json:"output"`
+}
+
+// transferMatrixId returns the parent id of a transfer matrix payload.
+func transferMatrixId(payload Payload) string {
+	if payload.TransferMatrix != nil && payload.TransferMatrix.Id != "" {
+		return payload.TransferMatrix.Id
+	}
+	return payload.JobId
+}
+
+// ExpandTransferRuns builds one unit-release payload per point and release
+// period. Each run keeps the full simulation window so late arrivals are
+// captured, and releases through EMITIMES at rate 1. A continueFromJobId
+// of the payload does not carry over to the unit runs.
+func ExpandTransferRuns(payload Payload) ([]Payload, TransferManifest, error) {
+	meta := payload.SimulationMeta
+	parent := transferMatrixId(payload)
+	pollutant := strings.ToUpper(payload.PollutantMatrixConfig.SOX.PollutantId)
+	manifest := TransferManifest{MatrixId: parent, Pollutant: pollutant}
+	if payload.TransferMatrix == nil {
+		return nil, manifest, fmt.Errorf("payload has no transferMatrix block")
+	}
+	manifest.RateUnit = payload.TransferMatrix.RateUnit
+	if parent == "" {
+		return nil, manifest, fmt.Errorf("transfer matrix needs an id or a jobId")
+	}
+	if meta.ModelType != "CONCENTRATION" || meta.Direction != "FORWARD" {
+		return nil, manifest, fmt.Errorf("transfer matrices need a forward concentration run")
+	}
+	if meta.EndEpochUTC <= meta.StartEpochUTC {
+		return nil, manifest, fmt.Errorf("simulation ends before it starts")
+	}
+	hours := payload.TransferMatrix.ReleaseHours
+	if hours <= 0 {
+		hours = 6
+	}
+	step := int64(hours) * 3600
+
+	var runs []Payload
+	for _, p := range payload.Points {
+		k := 0
+		for start := meta.StartEpochUTC; start < meta.EndEpochUTC; start += step {
+			k++
+			end := min(start+step, meta.EndEpochUTC)
+
+			r := payload
+			r.TransferMatrix = nil
+			r.Ensemble = nil
+			// Unit runs release from nothing; particles of an earlier job
+			// would not scale with the scenario rates.
+			r.ContinueFromJobId = ""
+			r.JobId = fmt.Sprintf("%s_p%d_r%03d", parent, p.PointId, k)
+			r.Points = []Point{p}
+			r.SimulationMeta.OutputFile.FileName = fmt.Sprintf("%s.p%d.r%03d", outputFileName(meta), p.PointId, k)
+			r.EmissionScenarios = []EmissionScenario{{
+				PointId:              p.PointId,
+				PollutantId:          pollutant,
+				ReleaseStartEpochUTC: start,
+				ReleaseEndEpochUTC:   end,
+				Rate:                 ScenarioValue{Value: 1, UnitId: manifest.RateUnit},
+			}}
+
+			runs = append(runs, r)
+			manifest.Runs = append(manifest.Runs, TransferRun{
+				JobId:        r.JobId,
+				PointId:      p.PointId,
+				ReleaseStart: start,
+				ReleaseEnd:   end,
+				Output:       r.SimulationMeta.OutputFile,
+			})
+		}
+	}
+	return runs, manifest, nil
+}
+
+// timeUnits are seconds per unit.
+var timeUnits = map[string]float64{
+	"s":   1,
+	"min": 60,
+	"h":   3600,
+	"hr":  3600,
+	"d":   86400,
+}
+
+// RateUnitFactor returns the factor converting emission rates between mass
+// per time units such as "kg/h" and "g/s".
+func RateUnitFactor(from, to string) (float64, error) {
+	parse := func(u string) (float64, error) {
+		mass, per, ok := strings.Cut(strings.ToLower(strings.TrimSpace(u)), "/")
+		g, knownMass := massUnits[strings.ReplaceAll(mass, "µ", "u")]
+		s, knownTime := timeUnits[per]
+		if !ok || !knownMass || !knownTime {
+			return 0, fmt.Errorf("unsupported emission rate unit %q (want e.g. g/h)", u)
+		}
+		return g / s, nil
+	}
+	f, err := parse(from)
+	if err != nil {
+		return 0, err
+	}
+	t, err := parse(to)
+	if err != nil {
+		return 0, err
+	}
+	return f / t, nil
+}
+
+// scenarioRateFactor converts a scenario rate to the rate unit of a matrix.
+// Without a matrix unit, the first scenario's unit is the reference. Equal
+// unit ids need no conversion, and a scenario without a unit is taken to be
+// in the matrix unit.
+func scenarioRateFactor(unit string, matrixUnit *string) (float64, error) {
+	if *matrixUnit == "" {
+		*matrixUnit = unit
+	}
+	if unit == "" || unit == *matrixUnit {
+		return 1, nil
+	}
+	f, err := RateUnitFactor(unit, *matrixUnit)
+	if err != nil {
+		return 0, fmt.Errorf("scenario rate in %q cannot be converted to the matrix rate unit %q: %v", unit, *matrixUnit, err)
+	}
+	return f, nil
+}
+
+// ApplyTransferMatrix evaluates emission scenarios as a linear combination
+// of the unit run fields. Each run is weighted by the scenario rate of its
+// point, converted to the matrix rate unit and averaged over the run's
+// release period. Scenarios outside the matrix periods or for other
+// pollutants are ignored, and reported.
+func ApplyTransferMatrix(manifest TransferManifest, units []*Cdump, scenarios []EmissionScenario) (*Cdump, []string, error) {
+	if len(units) == 0 || len(units) != len(manifest.Runs) {
+		return nil, nil, fmt.Errorf("need one unit field per matrix run")
+	}
+	ref := units[0]
+	for i, u := range units[1:] {
+		if !ref.SameGrid(u) || len(u.Periods) != len(ref.Periods) {
+			return nil, nil, fmt.Errorf("unit run %s does not share the grid and periods of %s", manifest.Runs[i+1].JobId, manifest.Runs[0].JobId)
+		}
+	}
+
+	var warnings []string
+	weights := make([]float64, len(manifest.Runs))
+	rateUnit := manifest.RateUnit
+	for _, sc := range scenarios {
+		if !strings.EqualFold(sc.PollutantId, manifest.Pollutant) {
+			warnings = append(warnings, fmt.Sprintf("scenario for pollutant %q is not in the matrix (%s)", sc.PollutantId, manifest.Pollutant))
+			continue
+		}
+		factor, err := scenarioRateFactor(sc.Rate.UnitId, &rateUnit)
+		if err != nil {
+			return nil, nil, fmt.Errorf("point %d: %v", sc.PointId, err)
+		}
+		covered := int64(0)
+		for i, run := range manifest.Runs {
+			if run.PointId != sc.PointId {
+				continue
+			}
+			overlap := min(sc.ReleaseEndEpochUTC, run.ReleaseEnd) - max(sc.ReleaseStartEpochUTC, run.ReleaseStart)
+			if overlap <= 0 {
+				continue
+			}
+			weights[i] += factor * sc.Rate.Value * float64(overlap) / float64(run.ReleaseEnd-run.ReleaseStart)
+			covered += overlap
+		}
+		if covered < sc.ReleaseEndEpochUTC-sc.ReleaseStartEpochUTC {
+			warnings = append(warnings, fmt.Sprintf("scenario for point %d from %s to %s is only partly covered by the matrix",
+				sc.PointId,
+				time.Unix(sc.ReleaseStartEpochUTC, 0).UTC().Format(time.RFC3339),
+				time.Unix(sc.ReleaseEndEpochUTC, 0).UTC().Format(time.RFC3339)))
+		}
+	}
+
+	out := ref.CloneHeader()
+	for _, p := range ref.Periods {
+		out.Periods = append(out.Periods, ref.NewPeriodLike(p))
+	}
+	for i, u := range units {
+		if weights[i] == 0 {
+			continue
+		}
+		for p := range u.Periods {
+			for k := range u.Pollutants {
+				for l := range u.Levels {
+					dst := out.Periods[p].Conc[k][l]
+					for e, v := range u.Periods[p].Conc[k][l] {
+						dst[e] += float32(weights[i] * float64(v))
+					}
+				}
+			}
+		}
+	}
+	return out, warnings, nil
+}
+
+// readTransferManifest loads the manifest written for a transfer matrix.
+func readTransferManifest(cfg Config, id string) (TransferManifest, error) {
+	var manifest TransferManifest
+	dir, err := jobWorkDir(cfg, id)
+	if err != nil {
+		return manifest, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "transfer.json"))
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(data, &manifest)
+	return manifest, err
+}
+
+// transferApplyJob combines the unit runs of a matrix for the payload's
+// emission scenarios, writes the result into the matrix directory under
+// the payload's output name and renders it like a normal run.
+func transferApplyJob(cfg Config, payload Payload, formats []string) ([]string, error) {
+	id := transferMatrixId(payload)
+	manifest, err := readTransferManifest(cfg, id)
+	if err != nil {
+		return nil, fmt.Errorf("reading transfer matrix manifest: %v", err)
+	}
+	if len(payload.EmissionScenarios) == 0 {
+		return nil, fmt.Errorf("payload has no emissionScenarios to evaluate")
+	}
+	dir, err := jobWorkDir(cfg, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var units []*Cdump
+	for _, run := range manifest.Runs {
+		c, err := ReadCdumpFile(filepath.Join(run.Output.Directory, run.Output.FileName))
+		if err != nil {
+			return nil, fmt.Errorf("unit run %s: %v", run.JobId, err)
+		}
+		units = append(units, c)
+	}
+	combined, warnings, err := ApplyTransferMatrix(manifest, units, payload.EmissionScenarios)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", w)
+	}
+
+	name := outputFileName(payload.SimulationMeta)
+	path := filepath.Join(dir, name)
+	if err := WriteCdumpFile(path, combined); err != nil {
+		return nil, err
+	}
+	written := []string{path}
+	if len(formats) == 0 {
+		return written, nil
+	}
+	out := payload
+	out.SimulationMeta.ModelType = "CONCENTRATION"
+	out.SimulationMeta.OutputFile = OutputMeta{Directory: dir + string(filepath.Separator), FileName: name}
+	files, err := plotOutputs(cfg, out, dir, formats)
+	return append(written, files...), err
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+func transferCmd(args []string) error {
+	fs := flag.NewFlagSet("transfer", flag.ContinueOnError)
+	run := fs.Bool("run", false, "run every unit release after writing its inputs")
+	resolve := configFlags(fs)
+	cfg, payload, err := parseCommand(fs, args, resolve)
+	if err != nil {
+		return err
+	}
+
+	dir, err := jobWorkDir(cfg, transferMatrixId(payload))
+	if err != nil {
+		return err
+	}
+	runs, manifest, err := ExpandTransferRuns(payload)
+	if err != nil {
+		return err
+	}
+	for i := range runs {
+		if runs[i], err = preparePayload(cfg, runs[i], dir, true); err != nil {
+			return err
+		}
+		manifest.Runs[i].Output = runs[i].SimulationMeta.OutputFile
+	}
+	if err := writeMemberJobs(cfg, runs); err != nil {
+		return err
+	}
+	manifestPath, err := writeManifest(cfg, manifest.MatrixId, "transfer.json", manifest)
+	if err != nil {
+		return err
+	}
+	fmt.Println(manifestPath)
+
+	if !*run {
+		return nil
+	}
+	return runMembers(cfg, runs)
+}
+
+func transferApplyCmd(args []string) error {
+	fs := flag.NewFlagSet("transfer-apply", flag.ContinueOnError)
+	formats := fs.String("format", "", "also render the result: kml, png, geojson")
+	resolve := configFlags(fs)
+	cfg, payload, err := parseCommand(fs, args, resolve)
+	if err != nil {
+		return err
+	}
+	var formatList []string
+	if *formats != "" {
+		formatList = strings.Split(*formats, ",")
+	}
+	written, err := transferApplyJob(cfg, payload, formatList)
+	for _, path := range written {
+		fmt.Println(path)
+	}
+	return err
+}
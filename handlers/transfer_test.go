@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestExpandTransferRuns(t *testing.T) {
+	p := testPayload("CONCENTRATION", "FORWARD")
+	p.Points = append(p.Points, Point{PointId: 2, Latitude: 41, Longitude: -91, HeightMAgl: 50})
+	p.TransferMatrix = &TransferMatrixConfig{ReleaseHours: 6, RateUnit: "g/h"}
+
+	runs, manifest, err := ExpandTransferRuns(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 20 hours in 6 hour periods: three full periods and one of 2 hours,
+	// for each of the two points.
+	if len(runs) != 8 || len(manifest.Runs) != 8 {
+		t.Fatalf("got %d runs and %d manifest entries, want 8", len(runs), len(manifest.Runs))
+	}
+	if manifest.MatrixId != "golden" || manifest.Pollutant != "SOX" || manifest.RateUnit != "g/h" {
+		t.Errorf("manifest = %+v", manifest)
+	}
+	start := p.SimulationMeta.StartEpochUTC
+	last := manifest.Runs[3]
+	if last.PointId != 1 || last.ReleaseStart != start+18*3600 || last.ReleaseEnd != p.SimulationMeta.EndEpochUTC {
+		t.Errorf("last run of point 1 = %+v", last)
+	}
+	r := runs[5]
+	if r.JobId != "golden_p2_r002" || len(r.Points) != 1 || r.Points[0].PointId != 2 || r.TransferMatrix != nil {
+		t.Errorf("run 5: job %s, points %+v", r.JobId, r.Points)
+	}
+	if r.SimulationMeta.EndEpochUTC != p.SimulationMeta.EndEpochUTC {
+		t.Error("unit runs should keep the full simulation window")
+	}
+	sc := r.EmissionScenarios
+	if len(sc) != 1 || sc[0].Rate != (ScenarioValue{Value: 1, UnitId: "g/h"}) ||
+		sc[0].ReleaseStartEpochUTC != start+6*3600 || sc[0].ReleaseEndEpochUTC != start+12*3600 {
+		t.Errorf("run 5 scenarios = %+v", sc)
+	}
+
+	p.ContinueFromJobId = "day1"
+	if runs, _, _ = ExpandTransferRuns(p); runs[0].ContinueFromJobId != "" {
+		t.Error("unit runs should not continue from an earlier job")
+	}
+
+	p.SimulationMeta.ModelType = "TRAJECTORY"
+	if _, _, err := ExpandTransferRuns(p); err == nil {
+		t.Error("expected an error for a trajectory run")
+	}
+}
+
+func TestApplyTransferMatrix(t *testing.T) {
+	const start = int64(1764547200)
+	manifest := TransferManifest{
+		MatrixId: "m", Pollutant: "SOX", RateUnit: "g/h",
+		Runs: []TransferRun{
+			{JobId: "m_p1_r001", PointId: 1, ReleaseStart: start, ReleaseEnd: start + 6*3600},
+			{JobId: "m_p1_r002", PointId: 1, ReleaseStart: start + 6*3600, ReleaseEnd: start + 12*3600},
+		},
+	}
+	// Unit runs on a single cell: 1 and 10 per unit rate.
+	var units []*Cdump
+	for _, v := range []float32{1, 10} {
+		c := &Cdump{NumLat: 1, NumLon: 1, DLat: 1, DLon: 1, Lat1: 40, Lon1: -90, Levels: []int{100}, Pollutants: []string{"SOX"}}
+		p := c.NewPeriodLike(CdumpPeriod{Start: time.Unix(start, 0), Stop: time.Unix(start+12*3600, 0)})
+		p.Conc[0][0][0] = v
+		c.Periods = []CdumpPeriod{p}
+		units = append(units, c)
+	}
+
+	scenarios := []EmissionScenario{
+		// 2 kg/h for half of the first period: weight 2000 * 0.5.
+		{PointId: 1, PollutantId: "sox", ReleaseStartEpochUTC: start, ReleaseEndEpochUTC: start + 3*3600,
+			Rate: ScenarioValue{Value: 2, UnitId: "kg/h"}},
+		// 500 g/h over the second period: weight 500.
+		{PointId: 1, PollutantId: "sox", ReleaseStartEpochUTC: start + 6*3600, ReleaseEndEpochUTC: start + 12*3600,
+			Rate: ScenarioValue{Value: 500, UnitId: "g/h"}},
+		{PointId: 1, PollutantId: "nox", ReleaseStartEpochUTC: start, ReleaseEndEpochUTC: start + 3600,
+			Rate: ScenarioValue{Value: 1, UnitId: "g/h"}},
+	}
+	out, warnings, err := ApplyTransferMatrix(manifest, units, scenarios)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out.Periods[0].Conc[0][0][0]; math.Abs(float64(got)-6000) > 1e-3 {
+		t.Errorf("combined value = %g, want 1000*1 + 500*10", got)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("warnings = %q, want one for the other pollutant", warnings)
+	}
+
+	// A scenario past the matrix periods is reported.
+	late := scenarios[1]
+	late.ReleaseEndEpochUTC = start + 18*3600
+	if _, warnings, _ := ApplyTransferMatrix(manifest, units, []EmissionScenario{late}); len(warnings) != 1 {
+		t.Errorf("warnings = %q, want one for partial coverage", warnings)
+	}
+
+	bad := scenarios[0]
+	bad.Rate.UnitId = "u1"
+	if _, _, err := ApplyTransferMatrix(manifest, units, []EmissionScenario{bad}); err == nil {
+		t.Error("expected an error for a rate unit that cannot be converted")
+	}
+	// Without a matrix unit, the first scenario sets it and the others are
+	// converted to it.
+	manifest.RateUnit = ""
+	out, _, err = ApplyTransferMatrix(manifest, units, scenarios[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out.Periods[0].Conc[0][0][0]; math.Abs(float64(got)-6) > 1e-6 {
+		t.Errorf("combined value in kg/h = %g, want 1*1 + 0.5*10", got)
+	}
+}
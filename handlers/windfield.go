@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"time"
+
+	"github.com/fogleman/gg"
+)
+
+// WindFieldOptions controls RenderWindField.
+type WindFieldOptions struct {
+	Level   int    // ARL level index, 0 for the 10 m wind
+	Style   string // "barbs" (default) or "streamlines"
+	Spacing int    // pixels between barbs or streamline seeds, default 48
+	// Bbox is west, south, east, north. All zero uses the met grid.
+	West, South, East, North float64
+}
+
+// knotsPerMs converts m/s to knots for wind barbs.
+const knotsPerMs = 1.943844
+
+// windAt holds the true east and north wind of one level and time,
+// interpolated between the periods around it.
+type windAt struct {
+	a      *ARLFile
+	u0, v0 *ARLField
+	u1, v1 *ARLField
+	w      float64
+}
+
+// readWind reads the wind of level k around time t.
+func (a *ARLFile) readWind(k int, t time.Time) (*windAt, error) {
+	uName, vName := "UWND", "VWND"
+	if k == 0 {
+		uName, vName = "U10M", "V10M"
+	}
+	t0, t1, w, err := a.timeWeights(t)
+	if err != nil {
+		return nil, err
+	}
+	wa := &windAt{a: a, w: w}
+	if wa.u0, err = a.ReadField(t0, k, uName); err != nil {
+		return nil, err
+	}
+	if wa.v0, err = a.ReadField(t0, k, vName); err != nil {
+		return nil, err
+	}
+	wa.u1, wa.v1 = wa.u0, wa.v0
+	if w > 0 {
+		if wa.u1, err = a.ReadField(t1, k, uName); err != nil {
+			return nil, err
+		}
+		if wa.v1, err = a.ReadField(t1, k, vName); err != nil {
+			return nil, err
+		}
+	}
+	return wa, nil
+}
+
+// at returns the true east and north wind at a point, and false outside
+// the met grid.
+func (wa *windAt) at(lat, lon float64) (float64, float64, bool) {
+	g := wa.a.Grid
+	if !g.Contains(lat, lon) {
+		return 0, 0, false
+	}
+	x, y := g.XY(lat, lon)
+	wrap := g.Global()
+	ug := (1-wa.w)*wa.u0.At(x, y, wrap) + wa.w*wa.u1.At(x, y, wrap)
+	vg := (1-wa.w)*wa.v0.At(x, y, wrap) + wa.w*wa.v1.At(x, y, wrap)
+	rot := g.Rotation(lat, lon)
+	return ug*math.Cos(rot) + vg*math.Sin(rot), vg*math.Cos(rot) - ug*math.Sin(rot), true
+}
+
+// RenderWindField draws wind barbs or streamlines of one level and time
+// onto a transparent Web Mercator canvas, like the frames of ProcessKml.
+func RenderWindField(a *ARLFile, t time.Time, opts WindFieldOptions) (KmlResult, error) {
+	if opts.Level < 0 || opts.Level >= len(a.Levels) {
+		return KmlResult{}, fmt.Errorf("level %d not in %s (0-%d)", opts.Level, a.Path, len(a.Levels)-1)
+	}
+	wind, err := a.readWind(opts.Level, t)
+	if err != nil {
+		return KmlResult{}, err
+	}
+	west, south, east, north := opts.West, opts.South, opts.East, opts.North
+	if west == 0 && south == 0 && east == 0 && north == 0 {
+		south, north, west, east = a.Grid.Bounds()
+	}
+	// Web Mercator does not reach the poles.
+	south, north = max(south, -85), min(north, 85)
+	if east <= west || north <= south {
+		return KmlResult{}, fmt.Errorf("empty bbox %g,%g,%g,%g", west, south, east, north)
+	}
+	spacing := opts.Spacing
+	if spacing <= 0 {
+		spacing = 48
+	}
+
+	minX, maxX := lonToX(west), lonToX(east)
+	minY, maxY := latToY(north), latToY(south)
+	const imgSize = 1024
+	// unproject returns the latitude and longitude of a pixel.
+	unproject := func(px, py float64) (float64, float64) {
+		x := minX + px/imgSize*(maxX-minX)
+		y := minY + py/imgSize*(maxY-minY)
+		lon := x*360.0/256.0 - 180
+		lat := (2*math.Atan(math.Exp(math.Pi-y*math.Pi/128)) - math.Pi/2) * 180 / math.Pi
+		return lat, lon
+	}
+
+	dc := gg.NewContext(imgSize, imgSize)
+	switch opts.Style {
+	case "", "barbs":
+		dc.SetRGB(0, 0, 0)
+		dc.SetLineWidth(1.5)
+		for py := float64(spacing) / 2; py < imgSize; py += float64(spacing) {
+			for px := float64(spacing) / 2; px < imgSize; px += float64(spacing) {
+				lat, lon := unproject(px, py)
+				u, v, ok := wind.at(lat, lon)
+				if ok {
+					drawWindBarb(dc, px, py, u, v, float64(spacing)*0.6, lat < 0)
+				}
+			}
+		}
+	case "streamlines":
+		drawStreamlines(dc, imgSize, float64(spacing), func(px, py float64) (float64, float64, bool) {
+			lat, lon := unproject(px, py)
+			u, v, ok := wind.at(lat, lon)
+			return u, -v, ok // screen y points south
+		})
+	default:
+		return KmlResult{}, fmt.Errorf("unknown wind style %q (want barbs or streamlines)", opts.Style)
+	}
+	return encodeFrame(dc, t.Unix(), west, south, east, north)
+}
+
+// drawWindBarb draws a wind barb at (x, y): a staff of length size towards
+// where the wind comes from, with a pennant per 50 knots, a full barb per
+// 10 and a half barb per 5. Barbs are on the clockwise side of the staff
+// in the northern hemisphere. Calm winds are a circle.
+func drawWindBarb(dc *gg.Context, x, y, u, v, size float64, south bool) {
+	knots := math.Hypot(u, v) * knotsPerMs
+	if knots < 2.5 {
+		dc.DrawCircle(x, y, size/8)
+		dc.Stroke()
+		return
+	}
+	// Unit vector from the station to the staff end, in screen coordinates.
+	dx, dy := -u/math.Hypot(u, v), v/math.Hypot(u, v)
+	// Barbs leave the staff at right angles, swept back a little.
+	side := 1.0
+	if south {
+		side = -1
+	}
+	px, py := -dy*side, dx*side
+	barb := size * 0.4
+	ex, ey := x+dx*size, y+dy*size
+	dc.MoveTo(x, y)
+	dc.LineTo(ex, ey)
+	dc.Stroke()
+
+	step := size / 7
+	pos := 0.0
+	rest := int(math.Round(knots/5)) * 5
+	for ; rest >= 50; rest -= 50 {
+		bx, by := ex-dx*pos, ey-dy*pos
+		dc.MoveTo(bx, by)
+		dc.LineTo(bx+px*barb, by+py*barb)
+		dc.LineTo(bx-dx*step*1.5, by-dy*step*1.5)
+		dc.ClosePath()
+		dc.Fill()
+		pos += step * 2
+	}
+	for ; rest >= 10; rest -= 10 {
+		bx, by := ex-dx*pos, ey-dy*pos
+		dc.MoveTo(bx, by)
+		dc.LineTo(bx+px*barb+dx*step, by+py*barb+dy*step)
+		dc.Stroke()
+		pos += step
+	}
+	if rest >= 5 {
+		if pos == 0 {
+			pos = step // a lone half barb sits off the end of the staff
+		}
+		bx, by := ex-dx*pos, ey-dy*pos
+		dc.MoveTo(bx, by)
+		dc.LineTo(bx+(px*barb+dx*step)/2, by+(py*barb+dy*step)/2)
+		dc.Stroke()
+	}
+}
+
+// streamlineColor shades streamlines from blue for light winds to red for
+// winds of 25 m/s and more.
+func streamlineColor(speed float64) color.NRGBA {
+	f := min(speed/25, 1)
+	return color.NRGBA{uint8(40 + 200*f), uint8(60 * (1 - f)), uint8(200 * (1 - f)), 230}
+}
+
+// drawStreamlines traces streamlines through the screen velocity field
+// from seeds spacing pixels apart. A line stops at the edge of the field,
+// in calm air, where it comes within half a spacing of another line or
+// where it closes on itself around a vortex. Each line gets an arrow head
+// in its middle.
+func drawStreamlines(dc *gg.Context, size int, spacing float64, field func(x, y float64) (float64, float64, bool)) {
+	cell := spacing / 2
+	cells := int(math.Ceil(float64(size) / cell))
+	taken := make([]bool, cells*cells)
+	cellOf := func(x, y float64) int {
+		i, j := int(x/cell), int(y/cell)
+		if i < 0 || j < 0 || i >= cells || j >= cells {
+			return -1
+		}
+		return j*cells + i
+	}
+
+	const stepPx = 2.0
+	const maxSteps = 600
+	dc.SetLineWidth(1.5)
+	for sy := spacing / 2; sy < float64(size); sy += spacing {
+		for sx := spacing / 2; sx < float64(size); sx += spacing {
+			if c := cellOf(sx, sy); c < 0 || taken[c] {
+				continue
+			}
+			// Trace downwind and upwind from the seed, then join the two.
+			var back, fwd [][2]float64
+			var speed float64
+			var samples int
+			for _, dir := range []float64{-1, 1} {
+				x, y := sx, sy
+				var line [][2]float64
+				own := map[int]int{cellOf(sx, sy): 0} // cell to the last step in it
+				for s := 0; s < maxSteps; s++ {
+					u, v, ok := field(x, y)
+					sp := math.Hypot(u, v)
+					if !ok || sp < 0.1 {
+						break
+					}
+					speed += sp
+					samples++
+					// Midpoint step for smoother curves.
+					mx, my := x+dir*u/sp*stepPx/2, y+dir*v/sp*stepPx/2
+					u2, v2, ok := field(mx, my)
+					sp2 := math.Hypot(u2, v2)
+					if !ok || sp2 < 0.1 {
+						break
+					}
+					x, y = x+dir*u2/sp2*stepPx, y+dir*v2/sp2*stepPx
+					c := cellOf(x, y)
+					last, mine := own[c]
+					if c < 0 || taken[c] && !mine || mine && s-last > int(2*cell/stepPx) {
+						break
+					}
+					own[c] = s
+					line = append(line, [2]float64{x, y})
+				}
+				if dir < 0 {
+					back = line
+				} else {
+					fwd = line
+				}
+			}
+			line := make([][2]float64, 0, len(back)+len(fwd)+1)
+			for i := len(back) - 1; i >= 0; i-- {
+				line = append(line, back[i])
+			}
+			line = append(line, [2]float64{sx, sy})
+			line = append(line, fwd...)
+			if len(line) < 8 {
+				continue
+			}
+			for _, p := range line {
+				if c := cellOf(p[0], p[1]); c >= 0 {
+					taken[c] = true
+				}
+			}
+
+			dc.SetColor(streamlineColor(speed / float64(samples)))
+			dc.MoveTo(line[0][0], line[0][1])
+			for _, p := range line[1:] {
+				dc.LineTo(p[0], p[1])
+			}
+			dc.Stroke()
+
+			mid := len(line) / 2
+			ax, ay := line[mid][0], line[mid][1]
+			dx, dy := ax-line[mid-1][0], ay-line[mid-1][1]
+			n := math.Hypot(dx, dy)
+			if n == 0 {
+				continue
+			}
+			dx, dy = dx/n, dy/n
+			const head = 7.0
+			dc.MoveTo(ax+dx*head/2, ay+dy*head/2)
+			dc.LineTo(ax-dx*head/2-dy*head/2, ay-dy*head/2+dx*head/2)
+			dc.LineTo(ax-dx*head/2+dy*head/2, ay-dy*head/2-dx*head/2)
+			dc.ClosePath()
+			dc.Fill()
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/fogleman/gg"
+)
+
+// drawnPixels counts the pixels of img inside r that are not transparent.
+func drawnPixels(img image.Image, r image.Rectangle) int {
+	n := 0
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a > 0 {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// decodeFrame decodes the PNG of a rendered frame.
+func decodeFrame(t *testing.T, f KmlResult) image.Image {
+	t.Helper()
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(f.Base64, "data:image/png;base64,"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestDrawWindBarb(t *testing.T) {
+	barb := func(knots float64, south bool) image.Image {
+		dc := gg.NewContext(100, 100)
+		dc.SetRGB(0, 0, 0)
+		// A westerly wind: the staff points west from the station.
+		drawWindBarb(dc, 50, 50, knots/knotsPerMs, 0, 40, south)
+		return dc.Image()
+	}
+	west := image.Rect(5, 47, 45, 54)
+	east := image.Rect(55, 40, 100, 60)
+	above := image.Rect(0, 0, 100, 46)
+	below := image.Rect(0, 55, 100, 100)
+
+	north := barb(10, false)
+	if drawnPixels(north, west) == 0 || drawnPixels(north, east) != 0 {
+		t.Error("the staff should point west, where the wind comes from")
+	}
+	if drawnPixels(north, above) == 0 || drawnPixels(north, below) != 0 {
+		t.Error("a northern hemisphere barb should be on the north side of a westerly staff")
+	}
+	south := barb(10, true)
+	if drawnPixels(south, above) != 0 || drawnPixels(south, below) == 0 {
+		t.Error("a southern hemisphere barb should be on the south side")
+	}
+
+	// 65 knots adds a filled pennant of about 70 pixels and a half barb.
+	all := image.Rect(0, 0, 100, 100)
+	if strong, light := drawnPixels(barb(65, false), all), drawnPixels(north, all); strong-light < 60 {
+		t.Errorf("65 knots draws %d pixels, 10 knots %d", strong, light)
+	}
+	calm := barb(1, false)
+	if drawnPixels(calm, image.Rect(54, 49, 56, 51)) == 0 || drawnPixels(calm, image.Rect(48, 48, 52, 52)) != 0 ||
+		drawnPixels(calm, image.Rect(5, 47, 40, 54)) != 0 {
+		t.Error("a calm wind should be an empty circle without a staff")
+	}
+}
+
+func TestRenderWindField(t *testing.T) {
+	a, err := ReadARLFile(testARLFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lowest sigma level, halfway between the first two periods. The
+	// file has no 10 m wind.
+	at := a.Times[0].Add(a.Times[1].Sub(a.Times[0]) / 2)
+	for _, style := range []string{"barbs", "streamlines"} {
+		frame, err := RenderWindField(a, at, WindFieldOptions{Level: 1, Style: style, Spacing: 64})
+		if err != nil {
+			t.Fatalf("%s: %v", style, err)
+		}
+		south, north, west, east := a.Grid.Bounds()
+		b := frame.Bbox
+		if frame.T != at.Unix() || b["west"] != west || b["east"] != east || b["south"] != max(south, -85) || b["north"] != min(north, 85) {
+			t.Errorf("%s: frame %d with bbox %v", style, frame.T, b)
+		}
+		img := decodeFrame(t, frame)
+		if n := drawnPixels(img, img.Bounds()); n == 0 {
+			t.Errorf("%s: nothing drawn", style)
+		}
+	}
+
+	if _, err := RenderWindField(a, at, WindFieldOptions{}); err == nil {
+		t.Error("expected an error for the missing 10 m wind")
+	}
+	if _, err := RenderWindField(a, at, WindFieldOptions{Level: 1, Style: "arrows"}); err == nil {
+		t.Error("expected an error for an unknown style")
+	}
+	if _, err := RenderWindField(a, at, WindFieldOptions{Level: len(a.Levels)}); err == nil {
+		t.Error("expected an error for a level above the file")
+	}
+	if _, err := RenderWindField(a, at, WindFieldOptions{Level: 1, West: 10, South: 50, East: 0, North: 60}); err == nil {
+		t.Error("expected an error for an empty bbox")
+	}
+}
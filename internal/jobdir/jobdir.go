@@ -0,0 +1,18 @@
+// Package jobdir holds the conventions for job working directories that
+// the runner (hysplit-run) and the API server share.
+package jobdir
+
+import "regexp"
+
+// ExitCodeFile is written into a job directory by the runner once the model
+// process has exited. It holds the process exit code as a plain integer,
+// and tells finished jobs from running ones.
+const ExitCodeFile = "EXITCODE"
+
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ValidId reports whether a job id is safe to use as a directory name under
+// the jobs root.
+func ValidId(id string) bool {
+	return idPattern.MatchString(id) && id != "." && id != ".."
+}
@@ -1,21 +1,13 @@
 #!/bin/bash
 set -e
 
-# Paths
-WORKSPACE_ROOT="/workspaces/hysplit-test"
-HANDLERS_DIR="$WORKSPACE_ROOT/handlers"
-WORKING_DIR="$WORKSPACE_ROOT/programfiles/hysplit/working"
-EXEC_DIR="$WORKSPACE_ROOT/programfiles/hysplit/exec"
-OUTPUT_DIR="$WORKSPACE_ROOT/programfiles/output/"
-MET_DIR="$WORKSPACE_ROOT/programfiles/metfiles/"
-
-mkdir -p "$OUTPUT_DIR"
-
-# Link ASCDATA.CFG if not present
-if [ ! -f "$WORKING_DIR/ASCDATA.CFG" ]; then
-    echo "Linking ASCDATA.CFG..."
-    ln -sf ../bdyfiles/ASCDATA.CFG "$WORKING_DIR/ASCDATA.CFG"
-fi
+# Paths (override with the HYSPLIT_* environment variables, see hysplit-run -h)
+WORKSPACE_ROOT="${WORKSPACE_ROOT:-$(cd "$(dirname "$0")/../.." && pwd)}"
+OUTPUT_DIR="${HYSPLIT_OUTPUT_DIR:-$WORKSPACE_ROOT/programfiles/output/}"
+MET_DIR="${HYSPLIT_MET_DIR:-$WORKSPACE_ROOT/programfiles/metfiles/}"
+export HYSPLIT_EXEC_DIR="${HYSPLIT_EXEC_DIR:-$WORKSPACE_ROOT/programfiles/hysplit/exec}"
+export HYSPLIT_BDY_DIR="${HYSPLIT_BDY_DIR:-$WORKSPACE_ROOT/programfiles/hysplit/bdyfiles}"
+export HYSPLIT_JOBS_DIR="${HYSPLIT_JOBS_DIR:-$WORKSPACE_ROOT/programfiles/hysplit/jobs}"
 
 # JSON Payload
 cat <<EOF > sim1.json
@@ -70,31 +62,7 @@ cat <<EOF > sim1.json
 }
 EOF
 
-# Generate CONTROL file
-echo "Generating CONTROL file..."
-go run "$HANDLERS_DIR/main.go" "$HANDLERS_DIR/hysplit.go" sim1.json > "$WORKING_DIR/CONTROL"
-
-# Run HYSPLIT
-echo "Running HYSPLIT (hycs_std)..."
-cd "$WORKING_DIR"
-if [ -f "$EXEC_DIR/hycs_std" ]; then
-    "$EXEC_DIR/hycs_std"
-else
-    echo "Error: hycs_std not found at $EXEC_DIR/hycs_std"
-    exit 1
-fi
-
-# Generate KML
-echo "Generating KML..."
-if [ -f "$OUTPUT_DIR/sim1_cdump" ]; then
-    "$EXEC_DIR/concplot" -a3 -i"$OUTPUT_DIR/sim1_cdump" -o"$OUTPUT_DIR/sim1_plot_ps.kml"
-    # Note: concplot generates PostScript by default. -a3 might be KML option depending on version, 
-    # but usually -a3 is for KML output option in some versions or specific flags.
-    # Standard concplot -a option: 0:none, 1:auto, 2:fixed, 3:Google Earth KML
-    echo "KML generation attempted."
-else
-    echo "Error: Output file sim1_cdump not found."
-    exit 1
-fi
+# Generate, run and plot in the job's working directory
+go -C "$WORKSPACE_ROOT" run ./cmd/hysplit-run all "$PWD/sim1.json"
 
 echo "Sim 1 Complete."